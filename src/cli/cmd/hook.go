@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"orbit.sh/engine"
+)
+
+func init() {
+	rootCmd.AddCommand(hookCmd)
+}
+
+var hookCmd = &cobra.Command{
+	Use:    "hook [name]",
+	Short:  "Run a git hook for the repositories that the engine hosts",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := engine.RunGitHook(args[0], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "orbit: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -9,6 +9,18 @@ const instance = axios.create({
   redirect: true // Custom redirect handler option
 });
 
+/**
+ * Attach the session token to every request so that the API can authenticate
+ * the user. While the node is being set up there is no user yet, so the setup
+ * token that bootstrapping or joining returned is used instead.
+ */
+instance.interceptors.request.use(config => {
+  const token =
+    localStorage.getItem("token") || localStorage.getItem("setupToken");
+  if (token) config.headers.Authorization = `Bearer ${token}`;
+  return config;
+});
+
 /**
  * Custom redirect handler. If certain requests fail with authentication errors,
  * we want to be able to clear out the local user store and then redirect to the
@@ -19,7 +31,7 @@ instance.interceptors.response.use(
     if (!res.config.redirect) return res;
 
     // The request was unauthorized, perform the redirect.
-    if (res.status === 401 || res.status === 403) {
+    if (res.status === 401) {
       store.commit("clearUser");
       router.push("/login");
       return Promise.reject("User is not authorized");
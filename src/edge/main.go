@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 
@@ -71,7 +72,7 @@ func main() {
 		// Create the standard app.
 		app := nginx.App{
 			Domain:      r.Domain,
-			ProxyTo:     r.AppID,
+			ProxyTo:     proxyTarget(r.AppID),
 			WWWRedirect: r.WWWRedirect,
 		}
 
@@ -97,6 +98,18 @@ func main() {
 	}
 }
 
+// proxyTarget returns the service that the requests for an app are sent to.
+// Each process type of an app runs as its own service, and only the web process
+// is sent requests. An app that hasn't been deployed since then still runs as a
+// single service named after the app, and nginx won't start if it is sent to a
+// service that doesn't exist, so that one is used if there isn't a web service.
+func proxyTarget(appID string) string {
+	if _, err := net.LookupHost(appID + "-web"); err == nil {
+		return appID + "-web"
+	}
+	return appID
+}
+
 func ensureCertificate(certID string, certs []Certificate) bool {
 	// If there is no certificate ID, we know for sure that there isn't a
 	// certificate.
@@ -1,9 +1,16 @@
 package engine
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,15 +26,57 @@ type APIServer struct {
 	Port   int
 	Socket string
 
+	// SessionLifetime is the longest that a session can last, and
+	// SessionIdleTimeout is how long a session lasts without being used.
+	SessionLifetime    time.Duration
+	SessionIdleTimeout time.Duration
+
 	router  *gin.Engine
 	started sync.WaitGroup
+
+	// hookToken authenticates the git hooks that the git server runs, and
+	// pushes keeps track of who made each push that is being received, by the
+	// nonce its hooks are given, so that the builds they start can be
+	// attributed to them.
+	hookToken string
+	pushMu    sync.Mutex
+	pushes    map[string]Actor
+
+	// oidcStarts counts the logins with an identity provider that each IP
+	// address has started recently, so that they can be rate limited.
+	oidcMu     sync.Mutex
+	oidcStarts map[string]oidcStart
+
+	// unknownAttempts are the failed attempts to log in to accounts that don't
+	// exist. These are only kept by this node rather than in the store, but
+	// they still make those accounts behave like the ones that do exist.
+	attemptMu       sync.Mutex
+	unknownAttempts LoginAttempts
+
+	// setup is the session that the set up wizard uses, if the node has been
+	// bootstrapped or joined to a cluster.
+	setupMu sync.Mutex
+	setup   *setupSession
 }
 
 // NewAPIServer returns a new API server instance.
 func NewAPIServer(e *Engine) *APIServer {
+	// The hook token only has to last as long as the process, as the hooks get
+	// it from the environment of the git server.
+	b := make([]byte, 32)
+	rand.Read(b)
+
 	s := &APIServer{
 		engine: e,
 		router: gin.New(),
+
+		SessionLifetime:    30 * 24 * time.Hour,
+		SessionIdleTimeout: 7 * 24 * time.Hour,
+
+		hookToken: hex.EncodeToString(b),
+		pushes:    map[string]Actor{},
+
+		oidcStarts: map[string]oidcStart{},
 	}
 
 	// We need to set the waitgroup at start so that if the user requests the
@@ -71,7 +120,7 @@ func (s *APIServer) Start() error {
 
 		log.Printf("[INFO] api: Listening on socket %s", s.Socket)
 		s.started.Done()
-		errCh <- s.router.RunUnix(s.Socket)
+		errCh <- s.runUnix(s.Socket)
 	}()
 
 	// Listen for standard TCP requests.
@@ -96,3 +145,23 @@ func (s *APIServer) Start() error {
 
 	return <-errCh
 }
+
+// runUnix will listen for requests on the UNIX socket. This is the same as the
+// gin RunUnix method, except that each request is marked as having come from
+// the socket so that the authentication middleware can tell them apart.
+func (s *APIServer) runUnix(file string) error {
+	os.Remove(file)
+	listener, err := net.Listen("unix", file)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	os.Chmod(file, 0777)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), socketKey{}, true)
+		s.router.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+	return http.Serve(listener, handler)
+}
@@ -0,0 +1,543 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionCookie is the name of the cookie that holds the session token. The
+// token can be provided either this way or through the Authorization header.
+const sessionCookie = "orbit_session"
+
+// Keys used to attach the authenticated details to the gin request context.
+const (
+	contextUser    = "user"
+	contextSession = "session"
+	contextToken   = "token"
+	contextTrusted = "trusted" // Let through without a user during set up or from the edge router
+)
+
+// setupSessionLifetime is how long the set up wizard has to finish once the node
+// has been bootstrapped or joined to a cluster.
+const setupSessionLifetime = 24 * time.Hour
+
+// touchInterval is how often the last used time of a session or an API token
+// gets updated in the store. Updating it on every request would mean a raft
+// apply for every single API call.
+const touchInterval = time.Minute
+
+// socketKey is the request context key that marks a request as having arrived
+// over the UNIX socket rather than over TCP.
+type socketKey struct{}
+
+// routes is a list of method and path combinations in the form "GET /state".
+// Path segments beginning with a ":" match any single segment, and segments
+// beginning with a "*" match the remainder of the path.
+type routes []string
+
+var (
+	// publicRoutes can always be accessed without a session. The git routes are
+	// included as the git server performs its own authentication, as are the git
+	// hooks which authenticate with the hook token, and the webhooks which are
+	// verified with the secret of the deployment.
+	publicRoutes = routes{
+		"GET /",
+		"GET /state",
+		"POST /user/login",
+		"POST /user/login/totp",
+		"POST /user/reset",
+		"GET /user/:id/profile",
+		"GET /oidc/providers",
+		"GET /oidc/login/:provider",
+		"GET /oidc/callback",
+		"ANY /repo/*path",
+		"POST /repo-hook/post-receive",
+		"POST /hooks/github/:deployment",
+		"POST /hooks/gitlab/:deployment",
+	}
+
+	// setupRoutes can be accessed without a session while the engine is still
+	// being set up, to bootstrap or join a cluster. Everything after that is done
+	// with the setup session that the node hands out when it does either.
+	setupRoutes = routes{
+		"POST /cluster/bootstrap",
+		"POST /cluster/join",
+	}
+
+	// setupSessionRoutes can be accessed with the setup session until the engine
+	// is running. These are the routes the set up wizard uses to set up the
+	// domain of the console, create the first user and configure the node, none
+	// of which can wait for a user to log in, as a node that joins a cluster
+	// never has one and the domain is set up before the first user exists.
+	setupSessionRoutes = routes{
+		"POST /router",
+		"PUT /router/:id",
+		"POST /certificate",
+		"POST /certificates/renew",
+		"POST /service/restart/edge",
+		"POST /user",
+		"PUT /node/current",
+		"GET /routers",
+		"GET /node/current",
+	}
+
+	// setupCompleteRoutes can still be accessed with the setup session once the
+	// engine is running, so that the wizard can send the user to the console.
+	setupCompleteRoutes = routes{
+		"GET /routers",
+		"GET /node/current",
+	}
+
+	// socketRoutes are the read-only routes that the edge router uses over the
+	// UNIX socket. These are trusted without a session, but only when the request
+	// has not been proxied on behalf of somebody else by the console.
+	socketRoutes = routes{
+		"GET /routers",
+		"GET /certificates",
+	}
+)
+
+// Match returns whether or not the method and path match any of the routes.
+func (r routes) Match(method, path string) bool {
+	for _, route := range r {
+		parts := strings.SplitN(route, " ", 2)
+		if parts[0] != "ANY" && parts[0] != method {
+			continue
+		}
+		if matchPath(parts[1], path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath will check a request path against a route pattern.
+func matchPath(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, p := range patternParts {
+		if strings.HasPrefix(p, "*") {
+			return true
+		}
+		if i >= len(pathParts) {
+			return false
+		}
+		if strings.HasPrefix(p, ":") {
+			continue
+		}
+		if p != pathParts[i] {
+			return false
+		}
+	}
+
+	return len(patternParts) == len(pathParts)
+}
+
+// isSocketRequest returns whether or not the request arrived over the UNIX
+// socket.
+func isSocketRequest(r *http.Request) bool {
+	socket, _ := r.Context().Value(socketKey{}).(bool)
+	return socket
+}
+
+// clientIP returns the IP address of the client that made the request. Requests
+// over the socket come from the console proxy, which passes the original
+// address along in the headers. Those headers are ignored for TCP requests, as
+// anybody could set them.
+func clientIP(c *gin.Context) string {
+	return requestIP(c.Request)
+}
+
+// requestIP is the same as clientIP, but for requests that aren't handled
+// directly by gin (such as those to the git server).
+func requestIP(r *http.Request) string {
+	if isSocketRequest(r) {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestToken retrieves the session or API token from the request. The
+// Authorization header takes precedence over the session cookie.
+func requestToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+
+	if cookie, err := c.Cookie(sessionCookie); err == nil {
+		return cookie
+	}
+
+	return ""
+}
+
+// authenticate is the middleware that guards every route on the API server.
+// If a valid session or API token is provided, the user and the session or
+// token are attached to the context. Otherwise, the request is rejected unless
+// the route has been explicitly whitelisted.
+func (s *APIServer) authenticate() gin.HandlerFunc {
+	engine := s.engine
+	store := engine.Store
+
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		path := c.Request.URL.Path
+
+		// Attach the user to the context if they have provided a valid session.
+		if token := requestToken(c); token != "" {
+			store.mu.RLock()
+			user, session := store.state.Users.FindBySession(token)
+			store.mu.RUnlock()
+
+			if user != nil && !session.Expired(time.Now()) {
+				s.touchSession(*session)
+				c.Set(contextUser, user)
+				c.Set(contextSession, session)
+				c.Next()
+				return
+			}
+
+			store.mu.RLock()
+			user, apiToken := store.state.Users.FindByAPIToken(token)
+			store.mu.RUnlock()
+
+			if user != nil {
+				s.touchAPIToken(user.ID, *apiToken)
+				c.Set(contextUser, user)
+				c.Set(contextToken, apiToken)
+				c.Next()
+				return
+			}
+		}
+
+		// Work out whether the route can be used without a session. The routes
+		// that are only open during set up or to the edge router are trusted to
+		// do what they need to without a user, whereas the public routes have to
+		// check who they are for themselves.
+		allowed := publicRoutes.Match(method, path)
+		trusted := false
+
+		if engine.Status < StatusRunning && setupRoutes.Match(method, path) {
+			trusted = true
+		}
+		if s.setupSessionAllows(c) {
+			trusted = true
+		}
+
+		// The edge router talks to us directly over the socket. The console also
+		// proxies requests over the socket, but it always sets the forwarding
+		// header, so those requests don't receive the same trust.
+		if isSocketRequest(c.Request) &&
+			c.GetHeader("X-Forwarded-For") == "" &&
+			socketRoutes.Match(method, path) {
+			trusted = true
+		}
+
+		if !allowed && !trusted {
+			c.String(http.StatusUnauthorized, "You must be logged in to do that.")
+			c.Abort()
+			return
+		}
+
+		c.Set(contextTrusted, trusted)
+		c.Next()
+	}
+}
+
+// setupSession lets the set up wizard carry on without a user once the node has
+// been bootstrapped or joined to a cluster. It is kept in the config file of
+// the node, so only the hash of its token is kept.
+type setupSession struct {
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// newSetupSession replaces the setup session of the node with a new one, and
+// returns its token.
+func (s *APIServer) newSetupSession() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	s.setupMu.Lock()
+	s.setup = &setupSession{
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(setupSessionLifetime),
+	}
+	s.setupMu.Unlock()
+	return token
+}
+
+// setupSessionAllows returns whether or not the request was made with the setup
+// session, to a route that it can be used for.
+func (s *APIServer) setupSessionAllows(c *gin.Context) bool {
+	token := requestToken(c)
+	if token == "" {
+		return false
+	}
+
+	s.setupMu.Lock()
+	setup := s.setup
+	s.setupMu.Unlock()
+	if setup == nil || time.Now().After(setup.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(setup.Hash)) != 1 {
+		return false
+	}
+
+	method, path := c.Request.Method, c.Request.URL.Path
+	if s.engine.Status < StatusRunning {
+		return setupSessionRoutes.Match(method, path)
+	}
+	return setupCompleteRoutes.Match(method, path)
+}
+
+// setSessionCookie sets the cookie that holds the session token. It is only
+// ever sent back over HTTPS, and can't be read by scripts.
+func setSessionCookie(c *gin.Context, token string) {
+	c.SetCookie(sessionCookie, token, 0, "/", "", true, true)
+}
+
+// currentUser returns the user that is authenticated for this request, or nil
+// if the request was let through without a session.
+func currentUser(c *gin.Context) *User {
+	if v, ok := c.Get(contextUser); ok {
+		return v.(*User)
+	}
+	return nil
+}
+
+// currentToken returns the API token that the request was authenticated with,
+// or nil if it wasn't made with an API token.
+func currentToken(c *gin.Context) *APIToken {
+	if v, ok := c.Get(contextToken); ok {
+		return v.(*APIToken)
+	}
+	return nil
+}
+
+// touchSession will update the last seen time of the session in the store,
+// which also pushes back the time at which it expires. This happens in the
+// background so that it doesn't hold up the request.
+func (s *APIServer) touchSession(session Session) {
+	if time.Since(session.LastSeen) < touchInterval {
+		return
+	}
+
+	session.Touch(time.Now(), s.SessionLifetime, s.SessionIdleTimeout)
+	cmd := command{
+		Op:      opTouchSession,
+		Session: session,
+	}
+
+	go func() {
+		if err := cmd.Apply(s.engine.Store); err != nil {
+			log.Printf("[ERR] store: Could not update session last seen time: %s", err)
+		}
+	}()
+}
+
+// touchAPIToken will update the last used time of the API token in the store.
+// This happens in the background so that it doesn't hold up the request.
+func (s *APIServer) touchAPIToken(userID string, token APIToken) {
+	if time.Since(token.LastUsed) < touchInterval {
+		return
+	}
+
+	token.LastUsed = time.Now()
+	cmd := command{
+		Op:       opTouchAPIToken,
+		User:     User{ID: userID},
+		APIToken: token,
+	}
+
+	go func() {
+		if err := cmd.Apply(s.engine.Store); err != nil {
+			log.Printf("[ERR] store: Could not update API token last used time: %s", err)
+		}
+	}()
+}
+
+// requestActor returns who is making the request, for the audit log.
+func requestActor(c *gin.Context) Actor {
+	actor := Actor{IP: clientIP(c)}
+	if user := currentUser(c); user != nil {
+		actor.UserID = user.ID
+		actor.Username = user.Username
+	}
+	if token := currentToken(c); token != nil {
+		actor.TokenID = token.ID
+	}
+	return actor
+}
+
+// apply will apply the command to the store on behalf of whoever is making the
+// request, so that it is attributed to them in the audit log.
+func (s *APIServer) apply(c *gin.Context, cmd *command) error {
+	cmd.Actor = requestActor(c)
+	return cmd.Apply(s.engine.Store)
+}
+
+// loginRetryAfter returns how long the client has to wait before they can try
+// to log in again with the attempt keys (one for the account and one for the
+// IP address). Checking this before the password means a locked account can't
+// be used to guess passwords, and also saves running bcrypt.
+func (s *APIServer) loginRetryAfter(keys ...string) time.Duration {
+	store := s.engine.Store
+	now := time.Now()
+
+	store.mu.RLock()
+	wait := store.state.LoginAttempts.RetryAfter(now, keys...)
+	store.mu.RUnlock()
+
+	s.attemptMu.Lock()
+	if d := s.unknownAttempts.RetryAfter(now, keys...); d > wait {
+		wait = d
+	}
+	s.attemptMu.Unlock()
+
+	return wait
+}
+
+// loginFailed records a failed attempt to log in against the attempt keys.
+// Attempts against accounts that don't exist are only recorded by this node.
+func (s *APIServer) loginFailed(keys ...string) {
+	store := s.engine.Store
+	now := time.Now()
+
+	stored := []string{}
+	store.mu.RLock()
+	for _, key := range keys {
+		if store.state.attemptKeyStored(key) {
+			stored = append(stored, key)
+			continue
+		}
+
+		s.attemptMu.Lock()
+		s.unknownAttempts.Fail(key, now)
+		s.attemptMu.Unlock()
+	}
+	store.mu.RUnlock()
+
+	if len(stored) == 0 {
+		return
+	}
+
+	cmd := command{
+		Op:          opLoginFailure,
+		AttemptKeys: stored,
+		Time:        now,
+	}
+	if err := cmd.Apply(store); err != nil {
+		log.Printf("[ERR] store: Could not record failed login attempt: %s", err)
+	}
+}
+
+// loginSucceeded forgets the failed attempts to log in against the attempt
+// keys. Nothing is applied if there aren't any, so that a successful login
+// doesn't cost anything extra.
+func (s *APIServer) loginSucceeded(keys ...string) {
+	store := s.engine.Store
+
+	store.mu.RLock()
+	found := []string{}
+	for _, key := range keys {
+		if store.state.LoginAttempts.Find(key) != nil {
+			found = append(found, key)
+		}
+	}
+	store.mu.RUnlock()
+
+	if len(found) == 0 {
+		return
+	}
+
+	cmd := command{
+		Op:          opLoginSuccess,
+		AttemptKeys: found,
+	}
+	if err := cmd.Apply(store); err != nil {
+		log.Printf("[ERR] store: Could not clear failed login attempts: %s", err)
+	}
+}
+
+// tooManyAttempts responds to a client that has to wait before trying to log
+// in again.
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	c.String(http.StatusTooManyRequests, "Too many failed attempts. Please try again later.")
+}
+
+// allowed returns whether or not the request has been granted at least the
+// given role in the namespace. An empty namespace ID refers to the cluster
+// itself (the orbit-system namespace).
+//
+// Requests without a user are only allowed if the authentication middleware
+// trusted them (such as during set up or from the edge router).
+func (s *APIServer) allowed(c *gin.Context, namespaceID string, role Role) bool {
+	user := currentUser(c)
+	if user == nil {
+		return c.GetBool(contextTrusted)
+	}
+
+	store := s.engine.Store
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.state.Allowed(user.ID, currentToken(c), namespaceID, role)
+}
+
+// authorizeUser is the same as authorize for the admin role in the cluster,
+// except that the request also has to have a role in the cluster that is at
+// least as high as the highest role of the user being managed. This stops an
+// admin from taking over the account of an owner.
+func (s *APIServer) authorizeUser(c *gin.Context, userID string) bool {
+	if !s.authorize(c, "", RoleAdmin) {
+		return false
+	}
+
+	store := s.engine.Store
+	store.mu.RLock()
+	role := store.state.HighestRole(userID)
+	store.mu.RUnlock()
+	if role == "" || s.allowed(c, "", role) {
+		return true
+	}
+
+	c.String(http.StatusForbidden, "You can't manage a user with a higher role than yours.")
+	c.Abort()
+	return false
+}
+
+// authorize is the same as allowed, except that if the request is not allowed
+// it is aborted with a forbidden response. Handlers should return if this
+// returns false.
+func (s *APIServer) authorize(c *gin.Context, namespaceID string, role Role) bool {
+	if s.allowed(c, namespaceID, role) {
+		return true
+	}
+
+	c.String(http.StatusForbidden, "You don't have permission to do that.")
+	c.Abort()
+	return false
+}
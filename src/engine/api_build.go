@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"orbit.sh/engine/docker"
+)
+
+func (s *APIServer) handleListBuilds() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
+		c.JSON(http.StatusOK, store.state.Builds.ForDeployment(deployment.ID))
+	}
+}
+
+func (s *APIServer) handleBuildGet() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		build := store.state.Builds.Find(c.Param("id"))
+		if build == nil {
+			c.String(http.StatusNotFound, "No build with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, build.NamespaceID, RoleViewer) {
+			return
+		}
+
+		c.JSON(http.StatusOK, build)
+	}
+}
+
+func (s *APIServer) handleBuildCancel() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		build := store.state.Builds.Find(c.Param("id"))
+		if build == nil {
+			c.String(http.StatusNotFound, "No build with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, build.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		if build.State.Finished() {
+			c.String(http.StatusConflict, "The build has already %s.", build.State)
+			return
+		}
+
+		// A queued build is never started, and the node running a running build
+		// stops it once it sees that it has been cancelled.
+		cmd := command{
+			Op:    opCancelBuild,
+			Build: Build{ID: build.ID},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply build cancellation: %s", err)
+			c.String(http.StatusConflict, "Could not cancel the build, it may have already finished.")
+			return
+		}
+
+		build.State = BuildCancelled
+		build.FinishedAt = cmd.Time
+		c.JSON(http.StatusOK, build)
+	}
+}
+
+// withBuildLogs fills in the build logs of the deployment from the log store,
+// for the clients that still read them from the deployment. Only the keys are
+// filled in unless the lines are wanted, as reading every log is slow.
+func (s *APIServer) withBuildLogs(d Deployment, lines bool) Deployment {
+	store := s.engine.Store
+
+	logs := map[string][]string{}
+	for key, l := range d.BuildLogs {
+		logs[key] = l // Logs that haven't been moved out of the store yet
+	}
+
+	keys, err := store.BuildLogKeys(d.ID)
+	if err != nil {
+		log.Printf("[WARN] deployment: Could not list the build logs of %s: %s", d.ID, err)
+	}
+	for key := range keys {
+		logs[key] = []string{}
+		if !lines {
+			continue
+		}
+		if logs[key], err = store.BuildLogLines(d.ID, key); err != nil {
+			log.Printf("[WARN] deployment: Could not read build log %s of %s: %s", key, d.ID, err)
+		}
+	}
+
+	d.BuildLogs = logs
+	return d
+}
+
+func (s *APIServer) handleDeploymentLogRetention() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body LogRetention
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The retention policy is invalid.")
+			return
+		}
+		if body.Builds < 0 || body.MaxAge < 0 {
+			c.String(http.StatusBadRequest, "The number of builds and days to keep logs for can't be negative.")
+			return
+		}
+
+		// The logs outside of the new policy are removed the next time that the
+		// leader prunes them.
+		cmd := command{
+			Op: opSetLogRetention,
+			Deployment: Deployment{
+				ID:           deployment.ID,
+				LogRetention: body,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment log retention: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the log retention of the deployment.")
+			return
+		}
+
+		c.JSON(http.StatusOK, body)
+	}
+}
+
+func (s *APIServer) handleDeploymentBuilder() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Builder      string `json:"builder"`
+		BuilderImage string `json:"builder_image"`
+	}
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The builder is invalid.")
+			return
+		}
+		if err := validateBuilder(body.Builder, body.BuilderImage); err != nil {
+			c.String(http.StatusBadRequest, "The builder is invalid: %s.", err)
+			return
+		}
+
+		// The CNB lifecycle is given the docker daemon of the builder node, so
+		// only admins can choose the image that a build runs in.
+		if body.BuilderImage != "" && !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		// The builder is used from the next build, and the running image keeps
+		// being started in the way that it was built for.
+		cmd := command{
+			Op: opSetDeploymentBuilder,
+			Deployment: Deployment{
+				ID:           deployment.ID,
+				Builder:      body.Builder,
+				BuilderImage: body.BuilderImage,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment builder: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the builder of the deployment.")
+			return
+		}
+
+		c.JSON(http.StatusOK, body)
+	}
+}
+
+// validateBuilder checks that a deployment can be built with the kind of
+// builder and image given. A deployment without a builder picks one for each
+// build, so it can't have an image.
+func validateBuilder(kind, image string) error {
+	if kind == "" {
+		if image != "" {
+			return fmt.Errorf("an image can only be used with a builder")
+		}
+		return nil
+	}
+	_, err := docker.NewBuilder(kind, image)
+	return err
+}
+
+func (s *APIServer) handleDeploymentBuildConfig() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Dockerfile string            `json:"dockerfile"`
+		Target     string            `json:"target"`
+		Args       map[string]string `json:"args"`
+		Secrets    []struct {
+			Secret string `json:"secret"` // Name or ID
+			Arg    string `json:"arg"`
+		} `json:"secrets"`
+	}
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The build config is invalid.")
+			return
+		}
+
+		config := BuildConfig{
+			Dockerfile: body.Dockerfile,
+			Target:     body.Target,
+			Args:       body.Args,
+		}
+
+		// Only the ID of a secret is kept, so that its value is read when each
+		// build starts.
+		for _, b := range body.Secrets {
+			secret := store.state.Secrets.Find(deployment.NamespaceID, b.Secret)
+			if secret == nil || secret.NamespaceID != deployment.NamespaceID {
+				c.String(http.StatusNotFound, "No secret %s exists in the namespace of the deployment.", b.Secret)
+				return
+			}
+			if b.Arg == "" {
+				c.String(http.StatusBadRequest, "Secret %s needs the name of the build arg to pass it as.", secret.Name)
+				return
+			}
+			config.Secrets = append(config.Secrets, SecretRef{SecretID: secret.ID, Env: b.Arg})
+		}
+
+		if err := config.Validate(); err != nil {
+			c.String(http.StatusBadRequest, "Could not set the build config: %s.", err)
+			return
+		}
+
+		// The config is used from the next build of the deployment.
+		cmd := command{
+			Op: opSetBuildConfig,
+			Deployment: Deployment{
+				ID:          deployment.ID,
+				BuildConfig: config,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment build config: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the build config of the deployment.")
+			return
+		}
+
+		c.JSON(http.StatusOK, config)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/hashicorp/raft"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 	"orbit.sh/engine/proto"
 )
 
@@ -67,6 +68,10 @@ func (s *APIServer) handleGetTokens() gin.HandlerFunc {
 	store := s.engine.Store
 
 	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"manager": store.state.ManagerJoinToken,
 			"worker":  store.state.WorkerJoinToken,
@@ -75,9 +80,11 @@ func (s *APIServer) handleGetTokens() gin.HandlerFunc {
 }
 
 func (s *APIServer) handleRefreshTokens() gin.HandlerFunc {
-	store := s.engine.Store
-
 	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		// Perform the token rotation.
 		newManagerToken := docker.RotateSwarmToken(true)
 		newWorkerToken := docker.RotateSwarmToken(false)
@@ -88,7 +95,7 @@ func (s *APIServer) handleRefreshTokens() gin.HandlerFunc {
 			ManagerJoinToken: newManagerToken,
 			WorkerJoinToken:  newWorkerToken,
 		}
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			c.String(http.StatusInternalServerError, "Could not refresh the join tokens.")
 			return
 		}
@@ -121,6 +128,10 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 
 		res := "Could not boostrap the cluster." // General error response.
 
+		if !s.authorize(c, "", RoleOwner) {
+			return
+		}
+
 		// Ensure that the store can be bootstrapped.
 		if engine.Status >= StatusReady {
 			c.String(http.StatusConflict, "This node already belongs to a cluster, and cannot be bootstrapped again.")
@@ -183,6 +194,13 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 			return
 		}
 
+		// Create the keyring that sensitive fields in the store are sealed with.
+		if err := store.InitKeyring(); err != nil {
+			log.Printf("[ERR] store: Could not create keyring: %s", err)
+			c.String(http.StatusInternalServerError, res)
+			return
+		}
+
 		// Attempt to bootstrap the store.
 		if err := store.Bootstrap(); err != nil {
 			c.String(http.StatusInternalServerError, res)
@@ -207,13 +225,26 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 			return
 		}
 
+		// Create the cluster CA and issue ourselves a certificate from it, which
+		// is required for any RPC or raft communication with the nodes that join.
+		if err := store.InitClusterCA(); err != nil {
+			log.Printf("[ERR] store: Could not create cluster CA: %s", err)
+			c.String(http.StatusInternalServerError, "Could not create the cluster certificate authority.")
+			return
+		}
+		if err := engine.RPCServer.IssueCertificate(*store.state.ClusterCA); err != nil {
+			log.Printf("[ERR] rpc: Could not issue node certificate: %s", err)
+			c.String(http.StatusInternalServerError, "Could not issue a certificate for this node.")
+			return
+		}
+
 		// Prepare command to add this node's details to the store.
 		cmd := command{
 			Op:   opNewNode,
 			Node: *store.GenerateNodeDetails(),
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not add this node to the list of nodes in the store, despite being joined to it successfully.")
 			return
@@ -229,7 +260,7 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 			},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not add the 'orbit-system' namespace.")
 			return
@@ -254,7 +285,7 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 			WorkerJoinToken:  docker.SwarmToken(false),
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: Could not set join tokens in store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not set the join tokens on the store.")
 			return
@@ -328,10 +359,19 @@ func (s *APIServer) handleClusterBootstrap() gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, engine.marshalConfig())
+		token := s.newSetupSession()
+		engine.writeConfig()
+		c.JSON(http.StatusOK, setupResponse{config: engine.marshalConfig(), SetupToken: token})
 	}
 }
 
+// setupResponse is the response to bootstrapping or joining a cluster, which
+// has the config of the node and the token of the setup session.
+type setupResponse struct {
+	config
+	SetupToken string `json:"setup_token"`
+}
+
 func (s *APIServer) handleGetRepositories() gin.HandlerFunc {
 	store := s.engine.Store
 
@@ -339,12 +379,17 @@ func (s *APIServer) handleGetRepositories() gin.HandlerFunc {
 		var repos []gin.H
 
 		for _, repo := range store.state.Repositories {
+			if !s.allowed(c, repo.NamespaceID, RoleViewer) {
+				continue
+			}
+
 			files := store.RepoFiles(repo.ID)
 
 			repos = append(repos, gin.H{
 				"id":           repo.ID,
 				"name":         repo.Name,
 				"namespace_id": repo.NamespaceID,
+				"upstream":     hideUpstream(repo.Upstream),
 				"files":        files,
 			})
 		}
@@ -364,6 +409,10 @@ func (s *APIServer) handleNamespaceAdd() gin.HandlerFunc {
 		var body body
 		c.Bind(&body)
 
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		id := store.state.Namespaces.GenerateID()
 		cmd := command{
 			Op: opNewNamespace,
@@ -373,12 +422,29 @@ func (s *APIServer) handleNamespaceAdd() gin.HandlerFunc {
 			},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: Could not apply the namespace to the store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not apply the namespace to the store.")
 			return
 		}
 
+		// The user that created the namespace becomes its owner.
+		if user := currentUser(c); user != nil {
+			cmd := command{
+				Op: opGrantRole,
+				RoleBinding: RoleBinding{
+					UserID:      user.ID,
+					NamespaceID: id,
+					Role:        RoleOwner,
+				},
+			}
+			if err := s.apply(c, &cmd); err != nil {
+				log.Printf("[ERR] store: Could not grant the namespace owner role: %s", err)
+				c.String(http.StatusInternalServerError, "Could not make you the owner of the namespace.")
+				return
+			}
+		}
+
 		c.JSON(http.StatusCreated, cmd.Namespace)
 	}
 }
@@ -409,6 +475,10 @@ func (s *APIServer) handleRepositoryAdd() gin.HandlerFunc {
 			namespaceID = namespace.ID
 		}
 
+		if !s.authorize(c, namespaceID, RoleDeveloper) {
+			return
+		}
+
 		// Create the command for the repository.
 		id := store.state.Repositories.GenerateID()
 		cmd := command{
@@ -421,7 +491,7 @@ func (s *APIServer) handleRepositoryAdd() gin.HandlerFunc {
 		}
 
 		// Now apply it to the store.
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			c.String(http.StatusInternalServerError, "Could not apply the new repository the store.")
 			return
 		}
@@ -438,7 +508,14 @@ func (s *APIServer) handleListNamespaces() gin.HandlerFunc {
 	store := s.engine.Store
 
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, store.state.Namespaces)
+		namespaces := Namespaces{}
+		for _, n := range store.state.Namespaces {
+			if s.allowed(c, n.ID, RoleViewer) {
+				namespaces = append(namespaces, n)
+			}
+		}
+
+		c.JSON(http.StatusOK, namespaces)
 	}
 }
 
@@ -470,6 +547,10 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, "", RoleOwner) {
+			return
+		}
+
 		// Bind the default settings from the body.
 		body := body{
 			RPCPort:     6501,
@@ -489,8 +570,17 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 			return
 		}
 
+		// Generate the key for this node, and a request for the target node to
+		// sign it with the cluster CA.
+		keyPEM, csrPEM, err := GenerateNodeKey()
+		if err != nil {
+			log.Printf("[ERR] api: %v", err)
+			c.String(http.StatusInternalServerError, "Could not generate a key for this node.")
+			return
+		}
+
 		// Create the client for connecting to the target node.
-		conn, err := grpc.Dial(targetAddr.String(), grpc.WithInsecure())
+		conn, err := DialJoin(targetAddr.String())
 		if err != nil {
 			c.String(http.StatusBadRequest, "Could not establish a connection to %s.", targetAddr)
 			return
@@ -499,17 +589,48 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 		client := proto.NewRPCClient(conn)
 
 		// Actually make the join request.
+		var p peer.Peer
 		joinRes, err := client.Join(context.Background(), &proto.JoinRequest{
 			JoinToken: body.JoinToken,
-		})
+			Csr:       csrPEM,
+		}, grpc.Peer(&p))
 		if err != nil {
 			log.Printf("[ERR] api: %v", err)
 			c.String(http.StatusBadRequest, "Could not perform cluster join operation.")
 			return
 		}
-		if joinRes.Status == proto.Status_UNAUTHORIZED {
+		switch joinRes.Status {
+		case proto.Status_UNAUTHORIZED:
 			c.String(http.StatusUnauthorized, "That join token is not authorized.")
 			return
+		case proto.Status_ERROR:
+			c.String(http.StatusInternalServerError, "The target node could not issue a certificate for this node.")
+			return
+		}
+
+		// Ensure that the node we're talking to actually belongs to the cluster
+		// that it issued our certificate from, and then start using it.
+		if err := verifyJoinPeer(&p, joinRes.CaCertificate); err != nil {
+			log.Printf("[ERR] api: Could not verify the target node: %v", err)
+			c.String(http.StatusBadGateway, "The certificate of the target node could not be verified.")
+			return
+		}
+		if err := engine.RPCServer.SetCertificate(joinRes.Certificate, keyPEM, joinRes.CaCertificate); err != nil {
+			log.Printf("[ERR] api: %v", err)
+			c.String(http.StatusInternalServerError, "Could not save the certificate for this node.")
+			return
+		}
+
+		// Keep the keyring, which is needed to open the sealed fields in the store.
+		if err := store.keyring.Merge(joinRes.Keyring); err != nil {
+			log.Printf("[ERR] api: %v", err)
+			c.String(http.StatusInternalServerError, "Could not read the keyring of the cluster.")
+			return
+		}
+		if err := store.keyring.Save(store.keyringPath()); err != nil {
+			log.Printf("[ERR] api: %v", err)
+			c.String(http.StatusInternalServerError, "Could not save the keyring of the cluster.")
+			return
 		}
 
 		// Set up the local properties for ourselves.
@@ -534,8 +655,15 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 			return
 		}
 
-		// Let the primary server know that we're ready to be joined to it.
-		cRes, err := client.ConfirmJoin(context.Background(), &proto.ConfirmJoinRequest{
+		// Let the primary server know that we're ready to be joined to it. This is
+		// now done over mutual TLS with the certificate we were issued.
+		confirmConn, err := engine.RPCServer.Dial(targetAddr.String())
+		if err != nil {
+			c.String(http.StatusBadRequest, "Could not establish a connection to %s.", targetAddr)
+			return
+		}
+		defer confirmConn.Close()
+		cRes, err := proto.NewRPCClient(confirmConn).ConfirmJoin(context.Background(), &proto.ConfirmJoinRequest{
 			RaftAddr:  fmt.Sprintf("%s:%d", joinRes.AdvertiseAddr, store.RaftPort),
 			Id:        store.ID,
 			JoinToken: body.JoinToken,
@@ -569,7 +697,7 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 			Op:   opNewNode,
 			Node: *store.GenerateNodeDetails(),
 		}
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: Could not apply node: %s", err)
 			c.String(http.StatusInternalServerError, "Could not add this node to the store state list.")
 			return
@@ -587,12 +715,56 @@ func (s *APIServer) handleClusterJoin() gin.HandlerFunc {
 		}
 
 		engine.Status = StatusReady
+		token := s.newSetupSession()
 		engine.writeConfig()
 
-		c.String(http.StatusOK, "Successfully joined node %s in the cluster.", targetAddr)
+		c.JSON(http.StatusOK, setupResponse{config: engine.marshalConfig(), SetupToken: token})
+	}
+}
+
+func (s *APIServer) handleListKeyring() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type key struct {
+		ID        string    `json:"id"`
+		CreatedAt time.Time `json:"created_at"`
+		Primary   bool      `json:"primary"`
+	}
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleOwner) {
+			return
+		}
+
+		// Only describe the keys, the key material never leaves the nodes.
+		keys, primary := store.keyring.Keys()
+		res := []key{}
+		for _, k := range keys {
+			res = append(res, key{ID: k.ID, CreatedAt: k.CreatedAt, Primary: k.ID == primary})
+		}
+
+		c.JSON(http.StatusOK, res)
 	}
 }
 
+func (s *APIServer) handleRotateKeyring() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleOwner) {
+			return
+		}
+
+		key, err := store.RotateKeyring(requestActor(c))
+		if err != nil {
+			log.Printf("[ERR] store: Could not rotate keyring: %s", err)
+			c.String(http.StatusInternalServerError, "Could not rotate the keyring.")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"id": key.ID, "created_at": key.CreatedAt})
+	}
+}
 func (s *APIServer) handleRepositoryGet() gin.HandlerFunc {
 	store := s.engine.Store
 
@@ -611,12 +783,17 @@ func (s *APIServer) handleRepositoryGet() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, repo.NamespaceID, RoleViewer) {
+			return
+		}
+
 		files := store.RepoFiles(repo.ID)
 
 		c.JSON(http.StatusOK, gin.H{
 			"id":           repo.ID,
 			"name":         repo.Name,
 			"namespace_id": repo.NamespaceID,
+			"upstream":     hideUpstream(repo.Upstream),
 			"files":        files,
 		})
 	}
@@ -638,11 +815,29 @@ func (s *APIServer) handleUserSignup() gin.HandlerFunc {
 		var body body
 		c.ShouldBind(&body)
 
+		// The very first user is created during set up, and becomes the owner of
+		// the cluster. Every user after that has to be created by an admin of the
+		// cluster, rather than by a request that is only trusted for set up. The
+		// store has the final say on which user is first.
+		store.mu.RLock()
+		first := len(store.state.Users) == 0
+		store.mu.RUnlock()
+		if !first && currentUser(c) == nil {
+			c.String(http.StatusForbidden, "You don't have permission to do that.")
+			return
+		}
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		// Read and input the profile file.
 		var profile []byte
 		if body.Profile != nil {
-			file, _ := body.Profile.Open()
-			data, _ := ioutil.ReadAll(file)
+			data, err := readProfile(body.Profile)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Could not read the profile image.")
+				return
+			}
 			profile = data
 		}
 
@@ -672,8 +867,21 @@ func (s *APIServer) handleUserSignup() gin.HandlerFunc {
 			Op:   opNewUser,
 			User: *newUser,
 		}
+		if first {
+			cmd.Op = opNewOwner
+		}
+
+		if err := s.apply(c, &cmd); err != nil {
+			// Another user could have been created since we checked, in which
+			// case this one can't be the owner.
+			store.mu.RLock()
+			taken := first && len(store.state.Users) > 0
+			store.mu.RUnlock()
+			if err == ErrNotFirstUser || taken {
+				c.String(http.StatusConflict, "The cluster already has an owner.")
+				return
+			}
 
-		if err := cmd.Apply(store); err != nil {
 			log.Printf("[ERR] store: Could not perform apply: %s", err)
 			c.String(http.StatusInternalServerError, "Could not create the new user. Ensure that all of the manager nodes are connected correctly.")
 			return
@@ -694,6 +902,11 @@ func (s *APIServer) handleListUsers() gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
+		// Only admins of the cluster can see everyone who has an account.
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		store.mu.RLock()
 		defer store.mu.RUnlock()
 
@@ -720,26 +933,26 @@ func (s *APIServer) handleUserProfile() gin.HandlerFunc {
 		id := c.Param("id")
 
 		// Search for the user with that ID, username, or email address.
-		var user *User
+		var profile []byte
+		store.mu.RLock()
 		for _, u := range store.state.Users {
 			if u.ID == id || u.Email == id || u.Username == id {
-				user = &u
+				profile = u.Profile
 			}
 		}
-		if user == nil {
-			c.String(http.StatusNotFound, "A user with the identifier '%s' could not be found.", id)
-			return
-		}
+		store.mu.RUnlock()
 
-		// If there is no profile data, ensure we return a 404.
-		if len(user.Profile) == 0 {
-			c.String(http.StatusNoContent, "The user was found but they have no profile image.")
+		// The login page shows the profile image before anyone has logged in, so
+		// a user that doesn't exist gets the same response as one without a
+		// profile image, so that the route can't be used to find out who has an
+		// account.
+		if len(profile) == 0 {
+			c.String(http.StatusNoContent, "There is no profile image.")
 			return
 		}
 
 		// Send the profile image data. This will also take in the MIME type of the
 		// byte slice and automatically decode it to the correct one.
-		profile := user.Profile
 		ct := http.DetectContentType(profile)
 		c.Data(http.StatusOK, ct, profile)
 	}
@@ -782,6 +995,10 @@ func (s *APIServer) handleListNodes() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, "", RoleViewer) {
+			return
+		}
+
 		nodes := []node{}
 		raftServers := make(map[raft.ServerID]raft.Server)
 
@@ -834,17 +1051,31 @@ func (s *APIServer) handleUserRemove() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id") // The ID of the user to remove
 
-		if i, _ := store.state.Users.FindByID(id); i == -1 {
+		if !s.authorizeUser(c, id) {
+			return
+		}
+
+		store.mu.RLock()
+		i, _ := store.state.Users.FindByID(id)
+		lastOwner := store.state.LastOwner(id)
+		store.mu.RUnlock()
+		if i == -1 {
 			c.String(http.StatusNotFound, "A user with that ID does not exist.")
 			return
 		}
 
+		// Don't let the only owner of the cluster be removed.
+		if lastOwner {
+			c.String(http.StatusConflict, "The cluster must always have at least one owner.")
+			return
+		}
+
 		cmd := command{
 			Op:   opRemoveUser,
 			User: User{ID: id},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not remove that user.")
 			return
@@ -856,6 +1087,10 @@ func (s *APIServer) handleUserRemove() gin.HandlerFunc {
 
 func (s *APIServer) handleSnapshot() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		op := c.Param("op")
 		switch op {
 		case "take":
@@ -899,10 +1134,19 @@ func (s *APIServer) handleListRouters() gin.HandlerFunc {
 	store := s.engine.Store
 
 	return func(c *gin.Context) {
+		// The routers are copied first, as checking access takes the lock too.
 		store.mu.RLock()
-		defer store.mu.RUnlock()
+		all := append(Routers{}, store.state.Routers...)
+		store.mu.RUnlock()
 
-		c.JSON(http.StatusOK, store.state.Routers)
+		routers := Routers{}
+		for _, r := range all {
+			if s.allowed(c, r.NamespaceID, RoleViewer) {
+				routers = append(routers, r)
+			}
+		}
+
+		c.JSON(http.StatusOK, routers)
 	}
 }
 
@@ -932,6 +1176,10 @@ func (s *APIServer) handleRouterAdd() gin.HandlerFunc {
 			namespaceID = namespace.ID
 		}
 
+		if !s.authorize(c, namespaceID, RoleAdmin) {
+			return
+		}
+
 		// Create a new router without a certificate.
 		cmd := command{
 			Op: opNewRouter,
@@ -946,7 +1194,7 @@ func (s *APIServer) handleRouterAdd() gin.HandlerFunc {
 		}
 
 		// Actually create the router.
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not create that router.")
 			return
@@ -979,6 +1227,26 @@ func (s *APIServer) handleRouterUpdate() gin.HandlerFunc {
 			namespaceID = namespace.ID
 		}
 
+		// The user must be able to manage the router where it currently is, as
+		// well as in the namespace that it's being moved to.
+		var router *Router
+		for _, r := range store.state.Routers {
+			if r.ID == id {
+				router = &r
+				break
+			}
+		}
+		if router == nil {
+			c.String(http.StatusNotFound, "Router with the ID of %s could not be found.", id)
+			return
+		}
+		if !s.authorize(c, router.NamespaceID, RoleAdmin) {
+			return
+		}
+		if namespaceID != "" && !s.authorize(c, namespaceID, RoleAdmin) {
+			return
+		}
+
 		// Create the update command.
 		cmd := command{
 			Op: opUpdateRouter,
@@ -991,7 +1259,7 @@ func (s *APIServer) handleRouterUpdate() gin.HandlerFunc {
 		}
 
 		// Attempt to apply the update command.
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not update the router.")
 			return
@@ -1006,10 +1274,20 @@ func (s *APIServer) handleListCertificates() gin.HandlerFunc {
 	store := s.engine.Store
 
 	return func(c *gin.Context) {
+		// Certificates contain their private keys, so only those that can manage
+		// them can see them.
 		store.mu.RLock()
-		defer store.mu.RUnlock()
+		all := append(Certificates{}, store.state.Certificates...)
+		store.mu.RUnlock()
+
+		certificates := Certificates{}
+		for _, cert := range all {
+			if s.allowed(c, cert.NamespaceID, RoleAdmin) {
+				certificates = append(certificates, cert)
+			}
+		}
 
-		c.JSON(http.StatusOK, store.state.Certificates)
+		c.JSON(http.StatusOK, certificates)
 	}
 }
 
@@ -1055,6 +1333,10 @@ func (s *APIServer) handleCertificateAdd() gin.HandlerFunc {
 			namespaceID = namespace.ID
 		}
 
+		if !s.authorize(c, namespaceID, RoleAdmin) {
+			return
+		}
+
 		// Construct the command.
 		cmd := command{
 			Op: opNewCertificate,
@@ -1076,7 +1358,7 @@ func (s *APIServer) handleCertificateAdd() gin.HandlerFunc {
 		}
 
 		// Apply the certificate to the store.
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR]: store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not add the certificate to the store.")
 			return
@@ -1089,6 +1371,10 @@ func (s *APIServer) handleCertificateAdd() gin.HandlerFunc {
 
 func (s *APIServer) handleRenewCertificates() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		if err := s.engine.Store.RenewCertificates(); err != nil {
 			log.Printf("[ERR] api: Could not renew certificates: %s", err)
 			c.String(http.StatusInternalServerError, "Could not renew certificates")
@@ -1098,13 +1384,42 @@ func (s *APIServer) handleRenewCertificates() gin.HandlerFunc {
 }
 
 func (s *APIServer) handleRestartService() gin.HandlerFunc {
+	store := s.engine.Store
+
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		if err := docker.ForceUpdateService(id); err != nil {
-			log.Printf("[ERR] api: Could not force update service: %s", err)
-			c.String(http.StatusInternalServerError, "Could not force update the %s service.", id)
+
+		// Deployment services can be restarted by the developers of the namespace
+		// that they're in. Every other service belongs to the cluster.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		var namespaceID string
+		role := RoleAdmin
+		if deployment != nil {
+			namespaceID = deployment.NamespaceID
+			role = RoleDeveloper
+		}
+		if !s.authorize(c, namespaceID, role) {
 			return
 		}
+
+		// Restarting a deployment restarts the service of every process type.
+		services := []string{id}
+		if deployment != nil {
+			services = deploymentServices(*deployment)
+		}
+		for _, service := range services {
+			if err := docker.ForceUpdateService(service); err != nil {
+				log.Printf("[ERR] api: Could not force update service: %s", err)
+				c.String(http.StatusInternalServerError, "Could not force update the %s service.", service)
+				return
+			}
+		}
 		c.String(http.StatusOK, "Force updated the %s service.", id)
 	}
 }
@@ -1121,6 +1436,10 @@ func (s *APIServer) handleGetNode() gin.HandlerFunc {
 			id = store.ID
 		}
 
+		if !s.authorize(c, "", RoleViewer) {
+			return
+		}
+
 		// Retrieve the node with this ID.
 		var node *Node
 		for _, n := range store.state.Nodes {
@@ -1157,9 +1476,9 @@ func (s *APIServer) handleUserGet() gin.HandlerFunc {
 				break search
 			}
 
-			// Search their session tokens.
+			// Search their session tokens, ignoring any that have expired.
 			for _, s := range u.Sessions {
-				if s.Token == id {
+				if s.Token == id && !s.Expired(time.Now()) {
 					user = &u
 					break search
 				}
@@ -1176,6 +1495,7 @@ func (s *APIServer) handleUserGet() gin.HandlerFunc {
 			"username": user.Username,
 			"email":    user.Email,
 			"name":     user.Name,
+			"totp":     user.TOTP.Enabled,
 		})
 	}
 }
@@ -1196,6 +1516,17 @@ func (s *APIServer) handleUserLogin() gin.HandlerFunc {
 			return
 		}
 
+		// Make sure that the account or the IP address haven't had too many failed
+		// attempts recently.
+		store.mu.RLock()
+		accountKey := accountAttemptKey(&store.state.Users, body.Identifier)
+		store.mu.RUnlock()
+		ipKey := ipAttemptKey(clientIP(c))
+		if wait := s.loginRetryAfter(accountKey, ipKey); wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+
 		// Search for the credentials that match this user.
 		var user *User
 		for _, u := range store.state.Users {
@@ -1204,14 +1535,41 @@ func (s *APIServer) handleUserLogin() gin.HandlerFunc {
 				break
 			}
 		}
+
+		// Check if the user credentials match. The response is the same whether
+		// or not the user exists, so that it doesn't reveal who has an account.
+		var valid bool
 		if user == nil {
-			c.String(http.StatusNotFound, "That user doesn't exist.")
+			valid = ValidateDummyPassword(body.Password)
+		} else {
+			valid = user.ValidatePassword(body.Password)
+		}
+		if !valid {
+			s.loginFailed(accountKey, ipKey)
+			c.String(http.StatusUnauthorized, "The username or password you provided is incorrect.")
 			return
 		}
 
-		// Check if the user credentials match.
-		if !user.ValidatePassword(body.Password) {
-			c.String(http.StatusUnauthorized, "The password you provided is incorrect.")
+		// If the user has a second factor, then they need to complete a challenge
+		// with it before they get a session. The failed attempts against their
+		// account are only forgotten once they have, as they also limit the
+		// guesses at the code.
+		if user.TOTP.Enabled {
+			cmd := command{
+				Op:             opNewLoginChallenge,
+				User:           User{ID: user.ID},
+				LoginChallenge: user.GenerateLoginChallenge(),
+			}
+			if err := s.apply(c, &cmd); err != nil {
+				log.Printf("[ERR] store: Could not apply new login challenge to user: %s", err)
+				c.String(http.StatusInternalServerError, "Can't update store.")
+				return
+			}
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"challenge":  cmd.LoginChallenge.ID,
+				"expires_at": cmd.LoginChallenge.ExpiresAt,
+			})
 			return
 		}
 
@@ -1219,31 +1577,135 @@ func (s *APIServer) handleUserLogin() gin.HandlerFunc {
 		cmd := command{
 			Op:      opNewSession,
 			User:    User{ID: user.ID},
-			Session: user.GenerateSession(),
+			Session: s.newSession(c, user),
 		}
 
 		// Apply the session to the store.
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Fatalf("[ERR] store: Could not apply new session to user: %s", err)
 			c.String(http.StatusInternalServerError, "Can't update store.")
 			return
 		}
+		s.loginSucceeded(accountKey)
 
-		// Wait for the application to take place.
-	search:
-		for {
-			for _, u := range store.state.Users {
-				for _, s := range u.Sessions {
-					if s.Token == cmd.Session.Token {
-						break search
-					}
-				}
+		s.respondWithSession(c, cmd.Session.Token)
+	}
+}
+
+func (s *APIServer) handleUserLoginTOTP() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Challenge    string `form:"challenge" json:"challenge"`
+		Code         string `form:"code" json:"code"`
+		RecoveryCode string `form:"recovery_code" json:"recovery_code"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		if err := c.ShouldBind(&body); err != nil || body.Challenge == "" {
+			c.String(http.StatusBadRequest, "You must supply a login challenge and a code.")
+			return
+		}
+
+		store.mu.RLock()
+		user, challenge := store.state.Users.FindByLoginChallenge(body.Challenge)
+		store.mu.RUnlock()
+		if user == nil {
+			c.String(http.StatusUnauthorized, "That login has expired. Please log in again.")
+			return
+		}
+
+		// Codes are short, so guessing them is limited in the same way as
+		// passwords.
+		accountKey, ipKey := "user:"+user.ID, ipAttemptKey(clientIP(c))
+		if wait := s.loginRetryAfter(accountKey, ipKey); wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+
+		cmd := command{
+			Op:             opCompleteLoginChallenge,
+			User:           User{ID: user.ID},
+			LoginChallenge: *challenge,
+			Session:        s.newSession(c, user),
+		}
+
+		// Check the code from their authenticator, or the recovery code if they've
+		// lost access to it.
+		if body.RecoveryCode != "" {
+			cmd.RecoveryCode = user.TOTP.FindRecoveryCode(body.RecoveryCode)
+			if cmd.RecoveryCode == "" {
+				s.loginFailed(accountKey, ipKey)
+				c.String(http.StatusUnauthorized, "The recovery code you provided is incorrect.")
+				return
 			}
-			time.Sleep(time.Millisecond * 200)
+		} else {
+			step, ok := user.TOTP.Validate(body.Code, time.Now())
+			if !ok {
+				s.loginFailed(accountKey, ipKey)
+				c.String(http.StatusUnauthorized, "The code you provided is incorrect.")
+				return
+			}
+			cmd.TOTP.LastStep = step
+		}
+
+		// Completing the challenge consumes it, along with the code that was used,
+		// so it can't be used again.
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply login challenge completion: %s", err)
+			c.String(http.StatusInternalServerError, "Can't update store.")
+			return
+		}
+		s.loginSucceeded(accountKey)
+
+		s.respondWithSession(c, cmd.Session.Token)
+	}
+}
+
+// newSession generates a new session for the user that is logging in with this
+// request.
+func (s *APIServer) newSession(c *gin.Context, user *User) Session {
+	session := user.GenerateSession()
+	session.UserAgent = c.Request.UserAgent()
+	session.IP = clientIP(c)
+	session.Touch(time.Now(), s.SessionLifetime, s.SessionIdleTimeout)
+	return session
+}
+
+// respondWithSession waits for the session to be applied to the store and then
+// returns its token to the user. It's also set as a cookie so that requests
+// that can't set headers (such as images) are authenticated.
+func (s *APIServer) respondWithSession(c *gin.Context, token string) {
+	if !s.awaitSession(token) {
+		c.String(http.StatusUnauthorized, "Could not log you in. Please try again.")
+		return
+	}
+
+	setSessionCookie(c, token)
+	c.String(http.StatusOK, token)
+}
+
+// awaitSession waits for the session to be applied to the store. The store
+// might reject the session (such as when the code was used by another login at
+// the same time), so this doesn't wait forever. It returns whether or not the
+// session exists.
+func (s *APIServer) awaitSession(token string) bool {
+	store := s.engine.Store
+
+	deadline := time.Now().Add(store.RaftTimeout)
+	for {
+		store.mu.RLock()
+		user, _ := store.state.Users.FindBySession(token)
+		store.mu.RUnlock()
+		if user != nil {
+			return true
 		}
 
-		// Return the session token to the user.
-		c.String(http.StatusOK, cmd.Session.Token)
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 200)
 	}
 }
 
@@ -1256,17 +1718,27 @@ func (s *APIServer) handleSessionRevoke() gin.HandlerFunc {
 
 		// Find the user for this request.
 		var user *User
+		store.mu.RLock()
 		for _, u := range store.state.Users {
 			if u.Username == id || u.Email == id || u.ID == id {
 				user = &u
 				break
 			}
 		}
+		store.mu.RUnlock()
 		if user == nil {
 			c.String(http.StatusNotFound, "That user doesn't exist.")
 			return
 		}
 
+		// Users can revoke their own sessions, but only admins can revoke the
+		// sessions of somebody else.
+		if current := currentUser(c); current == nil || current.ID != user.ID {
+			if !s.authorize(c, "", RoleAdmin) {
+				return
+			}
+		}
+
 		// Revoke all sessions.
 		if token == "all" {
 			cmd := command{
@@ -1274,19 +1746,34 @@ func (s *APIServer) handleSessionRevoke() gin.HandlerFunc {
 				User: User{ID: user.ID},
 			}
 
-			if err := cmd.Apply(store); err != nil {
+			if err := s.apply(c, &cmd); err != nil {
 				log.Printf("[ERR] store: Could not revoke all sessions: %s", err)
 				c.String(http.StatusInternalServerError, "Could not revoke all sessions.")
 				return
 			}
 		} else {
-			// Revoke that individual session.
+			// The session can be identified by either its ID or its token, and
+			// it has to be one of the sessions of the user.
+			var found *Session
+			for i, session := range user.Sessions {
+				if (session.ID != "" && session.ID == token) || session.Token == token {
+					found = &user.Sessions[i]
+					break
+				}
+			}
+			if found == nil {
+				c.String(http.StatusNotFound, "That session doesn't exist.")
+				return
+			}
+			token = found.Token
+
+			// Revoke that individual session.
 			cmd := command{
 				Op:      opRevokeSession,
 				Session: Session{Token: token},
 			}
 
-			if err := cmd.Apply(store); err != nil {
+			if err := s.apply(c, &cmd); err != nil {
 				log.Printf("[ERR] store: Could not revoke session: %s", err)
 				c.String(http.StatusInternalServerError, "Could not revoke that session.")
 				return
@@ -1316,6 +1803,10 @@ func (s *APIServer) handleNodeUpdate() gin.HandlerFunc {
 			id = store.ID
 		}
 
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
 		// Retrieve the body values (the actual update values).
 		var body body
 		if err := c.ShouldBind(&body); err != nil {
@@ -1335,7 +1826,7 @@ func (s *APIServer) handleNodeUpdate() gin.HandlerFunc {
 			},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] api: Could not update store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not update the store.")
 			return
@@ -1408,6 +1899,10 @@ func (s *APIServer) handleVolumeAdd() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, namespace.ID, RoleAdmin) {
+			return
+		}
+
 		// Construct the volume.
 		volume := Volume{
 			Name:        body.Name,
@@ -1447,13 +1942,17 @@ func (s *APIServer) handleVolumeRemove() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, volume.NamespaceID, RoleAdmin) {
+			return
+		}
+
 		// Otherwise, create and apply the remove operation.
 		cmd := command{
 			Op:     opRemoveVolume,
 			Volume: Volume{ID: volume.ID},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: Could not apply the volume remove operation: %s", err)
 			c.String(http.StatusInternalServerError, "Could not apply store remove operation.")
 			return
@@ -1472,14 +1971,28 @@ func (s *APIServer) handleListVolumes() gin.HandlerFunc {
 	store := s.engine.Store
 
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, store.state.Volumes)
+		volumes := Volumes{}
+		for _, v := range store.state.Volumes {
+			if s.allowed(c, v.NamespaceID, RoleViewer) {
+				volumes = append(volumes, v)
+			}
+		}
+
+		c.JSON(http.StatusOK, volumes)
 	}
 }
 
 func (s *APIServer) handleListDeployments() gin.HandlerFunc {
 	store := s.engine.Store
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, store.state.Deployments)
+		deployments := Deployments{}
+		for _, d := range store.state.Deployments {
+			if s.allowed(c, d.NamespaceID, RoleViewer) {
+				deployments = append(deployments, s.withBuildLogs(hideDeployment(d), false))
+			}
+		}
+
+		c.JSON(http.StatusOK, deployments)
 	}
 }
 
@@ -1502,8 +2015,12 @@ func (s *APIServer) handleDeploymentGet() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
 		// Send the deployment back to the client.
-		c.JSON(http.StatusOK, deployment)
+		c.JSON(http.StatusOK, s.withBuildLogs(hideDeployment(*deployment), true))
 	}
 }
 
@@ -1517,6 +2034,10 @@ func (s *APIServer) handleDeploymentAdd() gin.HandlerFunc {
 		Path         string `form:"path" json:"path"`
 		Branch       string `form:"branch" json:"branch"`
 		Namespace    string `form:"namespace" json:"namespace"`
+		Builder      string `form:"builder" json:"builder"`
+		BuilderImage string `form:"builder_image" json:"builder_image"`
+		Dockerfile   string `form:"dockerfile" json:"dockerfile"`
+		Target       string `form:"target" json:"target"`
 	}
 
 	return func(c *gin.Context) {
@@ -1536,21 +2057,60 @@ func (s *APIServer) handleDeploymentAdd() gin.HandlerFunc {
 			namespaceID = namespace.ID
 		}
 
+		if !s.authorize(c, namespaceID, RoleDeveloper) {
+			return
+		}
+
+		// The repository has to be one that the user can see as well.
+		var repo *Repository
+		for _, r := range store.state.Repositories {
+			if r.ID == body.RepositoryID {
+				repo = &r
+				break
+			}
+		}
+		if repo == nil {
+			c.String(http.StatusNotFound, "A repo with the ID of %s does not exist", body.RepositoryID)
+			return
+		}
+		if !s.authorize(c, repo.NamespaceID, RoleViewer) {
+			return
+		}
+
+		if err := validateBuilder(body.Builder, body.BuilderImage); err != nil {
+			c.String(http.StatusBadRequest, "The builder is invalid: %s.", err)
+			return
+		}
+		if body.BuilderImage != "" && !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		// Build args are set once the deployment exists, as secrets can only be
+		// given to it after that.
+		config := BuildConfig{Dockerfile: body.Dockerfile, Target: body.Target}
+		if err := config.Validate(); err != nil {
+			c.String(http.StatusBadRequest, "The build config is invalid: %s.", err)
+			return
+		}
+
 		// Construct the create command and apply it.
 		id := store.state.Deployments.GenerateID()
 		cmd := command{
 			Op: opNewDeployment,
 			Deployment: Deployment{
-				ID:          id,
-				Name:        body.Name,
-				Repository:  body.RepositoryID,
-				Path:        body.Path,
-				NamespaceID: namespaceID,
-				Branch:      body.Branch,
+				ID:           id,
+				Name:         body.Name,
+				Repository:   body.RepositoryID,
+				Path:         body.Path,
+				NamespaceID:  namespaceID,
+				Branch:       body.Branch,
+				Builder:      body.Builder,
+				BuilderImage: body.BuilderImage,
+				BuildConfig:  config,
 			},
 		}
 
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: Could not apply the deployment to the store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not apply the deployment to the store.")
 			return
@@ -1581,53 +2141,290 @@ func (s *APIServer) handleBuildDeployment() gin.HandlerFunc {
 			return
 		}
 
-		// Now run the build process.
-		key, err := engine.BuildDeployment(*deployment)
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		// Queue the build, which is deployed as a new release once it has been
+		// built on one of the builder nodes.
+		build, err := engine.QueueBuild(*deployment, requestActor(c))
 		if err != nil {
-			log.Printf("[ERR] deployment: %s", err)
-			c.String(http.StatusInternalServerError, "Could not build deployment.")
+			log.Printf("[ERR] store: Could not apply new build: %s", err)
+			c.String(http.StatusInternalServerError, "Could not queue the build of the deployment.")
+			return
+		}
+
+		c.JSON(http.StatusCreated, build)
+	}
+}
+
+func (s *APIServer) handleDeploymentEnv() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
+		env := deployment.Env
+		if env == nil {
+			env = map[string]string{}
+		}
+		c.JSON(http.StatusOK, env)
+	}
+}
+
+func (s *APIServer) handleDeploymentEnvSet() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		// A PUT replaces all of the environment variables, whereas a PATCH only
+		// changes the ones provided and removes the ones set to null.
+		env := map[string]string{}
+		if c.Request.Method == http.MethodPatch {
+			for k, v := range deployment.Env {
+				env[k] = v
+			}
+		}
+
+		var body map[string]*string
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The environment variables must be a JSON object of names to values.")
 			return
 		}
+		for k, v := range body {
+			if !envNameFormat.MatchString(k) {
+				c.String(http.StatusBadRequest, "%s is not a valid environment variable name.", k)
+				return
+			}
+			if v == nil {
+				delete(env, k)
+				continue
+			}
+			env[k] = *v
+		}
 
-		// Create a shorthand function log to the build log entries for this
-		// deployment.
-		buildLog := func(format string, values ...interface{}) {
-			str := fmt.Sprintf(format, values...)
-			store.AppendBuildLog(deployment.ID, key, str)
+		cmd := command{
+			Op: opSetDeploymentEnv,
+			Deployment: Deployment{
+				ID:  deployment.ID,
+				Env: env,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment environment: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the environment variables of the deployment.")
+			return
 		}
 
-		// Push the image to the docker image registry.
-		buildLog("Pushing image %s to the local docker registry", deployment.ID)
-		if err := docker.Push(deployment.ID); err != nil {
+		// Roll the running service over to the new configuration.
+		deployment.Env = env
+		if err := s.engine.Redeploy(*deployment); err != nil {
 			log.Printf("[ERR] deployment: %s", err)
-			c.String(http.StatusInternalServerError, "Could not push to docker image registry.")
+			c.String(http.StatusInternalServerError, "The environment variables were saved, but the service could not be updated.")
+			return
+		}
+
+		c.JSON(http.StatusOK, env)
+	}
+}
+
+// formationLimit is the most replicas that a process type of a deployment can
+// be scaled to.
+const formationLimit = 100
+
+func (s *APIServer) handleDeploymentFormation() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body map[string]int
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The formation must be a JSON object of process types to numbers of replicas.")
 			return
 		}
-		buildLog("Image %s pushed successfully", deployment.ID)
 
-		// Ensure that the service gets removed correctly.
-		if existed := docker.RemoveService(deployment.ID); existed {
-			buildLog("Removed existing service %s", deployment.ID)
+		// Only the process types given are scaled, and the rest are left as they
+		// are. A deployment that hasn't been built yet can be scaled before its
+		// process types are known.
+		formation := map[string]int{}
+		for k, v := range deployment.Formation {
+			formation[k] = v
+		}
+		for process, replicas := range body {
+			if !docker.ProcessNameFormat.MatchString(process) {
+				c.String(http.StatusBadRequest, "%s is not a valid process type name.", process)
+				return
+			}
+			if _, ok := deployment.ProcessTypes()[process]; !ok && deployment.Image != "" {
+				c.String(http.StatusBadRequest, "The deployment has no %s process type.", process)
+				return
+			}
+			if replicas < 0 || replicas > formationLimit {
+				c.String(http.StatusBadRequest, "The %s process can be scaled from 0 to %d replicas.", process, formationLimit)
+				return
+			}
+			formation[process] = replicas
 		}
 
-		// Create the service.
-		buildLog("Creating the docker service definition for %s", deployment.ID)
-		service := docker.Service{
-			Name:    deployment.ID,
-			Tag:     deployment.ID,
-			Command: "/start",
-			Args:    []string{"web"},
+		cmd := command{
+			Op: opSetFormation,
+			Deployment: Deployment{
+				ID:        deployment.ID,
+				Formation: formation,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment formation: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the formation of the deployment.")
+			return
 		}
-		if err := docker.CreateService(service); err != nil {
+
+		// Scale the services of the process types, which creates the services of
+		// the ones scaled up from nothing and removes the ones scaled down to it.
+		deployment.Formation = formation
+		if err := s.engine.Redeploy(*deployment); err != nil {
 			log.Printf("[ERR] deployment: %s", err)
-			c.String(http.StatusInternalServerError, "Could not create docker service.")
+			c.String(http.StatusInternalServerError, "The formation was saved, but the services could not be updated.")
+			return
+		}
+
+		replicas := map[string]int{}
+		for _, process := range deployment.ProcessNames() {
+			replicas[process] = deployment.Replicas(process)
+		}
+		c.JSON(http.StatusOK, replicas)
+	}
+}
+
+func (s *APIServer) handleListReleases() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
+		c.JSON(http.StatusOK, store.state.Releases.ForDeployment(deployment.ID))
+	}
+}
+
+func (s *APIServer) handleDeploymentRollback() gin.HandlerFunc {
+	engine := s.engine
+	store := engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		target := store.state.Releases.Find(deployment.ID, c.Param("release"))
+		if target == nil {
+			c.String(http.StatusNotFound, "No release with that ID or version exists for the deployment.")
+			return
+		}
+
+		// The secrets of the release have to still exist to deploy it.
+		for _, ref := range target.Secrets {
+			secret := store.state.Secrets.Find(deployment.NamespaceID, ref.SecretID)
+			if secret == nil || secret.NamespaceID != deployment.NamespaceID {
+				c.String(http.StatusConflict, "A secret that release v%d uses no longer exists.", target.Version)
+				return
+			}
+		}
+
+		// The rollback is queued like a build, so that it waits for the builds of
+		// the deployment that are already running or queued.
+		build, err := engine.QueueRollback(*deployment, target.ID, requestActor(c))
+		if err != nil {
+			log.Printf("[ERR] store: Could not apply new build: %s", err)
+			c.String(http.StatusInternalServerError, "Could not queue the rollback of the deployment.")
 			return
 		}
-		buildLog("Docker service %s created", deployment.ID)
 
-		// The deployment process has finished.
-		buildLog("-----> Deployment succeeded!")
-		c.String(http.StatusCreated, deployment.ID)
+		c.JSON(http.StatusCreated, build)
 	}
 }
 
@@ -1650,12 +2447,16 @@ func (s *APIServer) handleRouterRemove() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, router.NamespaceID, RoleAdmin) {
+			return
+		}
+
 		// Perform the delete apply operation.
 		cmd := command{
 			Op:     opRemoveRouter,
 			Router: Router{ID: id},
 		}
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not apply router removal to the store.")
 			return
@@ -1684,12 +2485,16 @@ func (s *APIServer) handleCertificateRemove() gin.HandlerFunc {
 			return
 		}
 
+		if !s.authorize(c, certificate.NamespaceID, RoleAdmin) {
+			return
+		}
+
 		// Perform the delete apply operation.
 		cmd := command{
 			Op:          opRemoveCertificate,
 			Certificate: Certificate{ID: id},
 		}
-		if err := cmd.Apply(store); err != nil {
+		if err := s.apply(c, &cmd); err != nil {
 			log.Printf("[ERR] store: %s", err)
 			c.String(http.StatusInternalServerError, "Could not apply certificate removal to the store.")
 			return
@@ -1701,7 +2506,9 @@ func (s *APIServer) handleCertificateRemove() gin.HandlerFunc {
 
 func (s *APIServer) handleNodeRemove() gin.HandlerFunc {
 	return func(c *gin.Context) {
-
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
 	}
 }
 
@@ -1716,3 +2523,842 @@ func (s *APIServer) handleDeploymentRemove() gin.HandlerFunc {
 
 	}
 }
+
+func (s *APIServer) handleListRoles() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		namespace := store.state.Namespaces.Find(c.Param("id"))
+		if namespace == nil {
+			c.String(http.StatusNotFound, "No namespace with the name or ID %s could be found.", c.Param("id"))
+			return
+		}
+
+		if !s.authorize(c, namespace.ID, RoleViewer) {
+			return
+		}
+
+		bindings := RoleBindings{}
+		for _, b := range store.state.RoleBindings {
+			if b.NamespaceID == namespace.ID {
+				bindings = append(bindings, b)
+			}
+		}
+
+		c.JSON(http.StatusOK, bindings)
+	}
+}
+
+func (s *APIServer) handleRoleGrant() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Role Role `form:"role" json:"role"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		c.ShouldBind(&body)
+
+		// Find the namespace and the user that the role is for.
+		namespace := store.state.Namespaces.Find(c.Param("id"))
+		if namespace == nil {
+			c.String(http.StatusNotFound, "No namespace with the name or ID %s could be found.", c.Param("id"))
+			return
+		}
+		user := store.state.Users.Find(c.Param("user"))
+		if user == nil {
+			c.String(http.StatusNotFound, "A user with the identifier '%s' could not be found.", c.Param("user"))
+			return
+		}
+
+		if !s.authorize(c, namespace.ID, RoleOwner) {
+			return
+		}
+
+		if body.Role.level() == 0 {
+			c.String(http.StatusBadRequest, "The role must be one of OWNER, ADMIN, DEVELOPER or VIEWER.")
+			return
+		}
+
+		// Don't let the only owner of the cluster be downgraded.
+		if namespace.Name == "orbit-system" && body.Role != RoleOwner && store.state.LastOwner(user.ID) {
+			c.String(http.StatusConflict, "The cluster must always have at least one owner.")
+			return
+		}
+
+		cmd := command{
+			Op: opGrantRole,
+			RoleBinding: RoleBinding{
+				UserID:      user.ID,
+				NamespaceID: namespace.ID,
+				Role:        body.Role,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not grant role: %s", err)
+			c.String(http.StatusInternalServerError, "Could not grant that role.")
+			return
+		}
+
+		c.JSON(http.StatusOK, cmd.RoleBinding)
+	}
+}
+
+func (s *APIServer) handleRoleRevoke() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		// Find the namespace and the user that the role is for.
+		namespace := store.state.Namespaces.Find(c.Param("id"))
+		if namespace == nil {
+			c.String(http.StatusNotFound, "No namespace with the name or ID %s could be found.", c.Param("id"))
+			return
+		}
+		user := store.state.Users.Find(c.Param("user"))
+		if user == nil {
+			c.String(http.StatusNotFound, "A user with the identifier '%s' could not be found.", c.Param("user"))
+			return
+		}
+
+		if !s.authorize(c, namespace.ID, RoleOwner) {
+			return
+		}
+
+		// Make sure that the cluster always has an owner, otherwise nobody would
+		// be able to manage it anymore.
+		if namespace.Name == "orbit-system" && store.state.LastOwner(user.ID) {
+			c.String(http.StatusConflict, "The cluster must always have at least one owner.")
+			return
+		}
+
+		cmd := command{
+			Op: opRevokeRole,
+			RoleBinding: RoleBinding{
+				UserID:      user.ID,
+				NamespaceID: namespace.ID,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not revoke role: %s", err)
+			c.String(http.StatusInternalServerError, "Could not revoke that role.")
+			return
+		}
+
+		c.String(http.StatusOK, "The role has been revoked.")
+	}
+}
+
+func (s *APIServer) handleListAPITokens() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		user := store.state.Users.Find(c.Param("id"))
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		// Users can see their own tokens, but only admins can see the tokens of
+		// somebody else.
+		if current := currentUser(c); current == nil || current.ID != user.ID {
+			if !s.authorize(c, "", RoleAdmin) {
+				return
+			}
+		}
+
+		// Never send the token hashes back.
+		tokens := []APIToken{}
+		for _, t := range user.Tokens {
+			t.Hash = ""
+			tokens = append(tokens, t)
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+func (s *APIServer) handleAPITokenCreate() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Name        string      `form:"name" json:"name"`
+		Namespace   string      `form:"namespace" json:"namespace"`
+		Permissions Permissions `form:"permissions" json:"permissions"`
+		ExpiresIn   string      `form:"expires_in" json:"expires_in"` // Go duration, such as "720h"
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		c.ShouldBind(&body)
+
+		// Tokens are always created for the user making the request, and only when
+		// they have logged in properly (an API token can't create more tokens).
+		user := currentUser(c)
+		if user == nil || currentToken(c) != nil {
+			c.String(http.StatusForbidden, "You can only create API tokens for yourself after logging in.")
+			return
+		}
+
+		if body.Name == "" {
+			c.String(http.StatusBadRequest, "You must supply a name for the token.")
+			return
+		}
+		if !body.Permissions.Valid() {
+			c.String(http.StatusBadRequest, "The permissions must be one or more of read, write or admin.")
+			return
+		}
+
+		// Scope the token to a namespace if one was provided.
+		var namespaceID string
+		if body.Namespace != "" {
+			namespace := store.state.Namespaces.Find(body.Namespace)
+			if namespace == nil {
+				c.String(http.StatusNotFound, "No namespace with the name or ID %s could be found.", body.Namespace)
+				return
+			}
+			if !s.authorize(c, namespace.ID, RoleViewer) {
+				return
+			}
+			namespaceID = namespace.ID
+		}
+
+		// Work out when the token expires (if it does at all).
+		var expiresAt time.Time
+		if body.ExpiresIn != "" {
+			d, err := time.ParseDuration(body.ExpiresIn)
+			if err != nil || d <= 0 {
+				c.String(http.StatusBadRequest, "The expiry must be a positive duration, such as 720h.")
+				return
+			}
+			expiresAt = time.Now().Add(d)
+		}
+
+		token, secret := user.GenerateAPIToken(body.Name, namespaceID, body.Permissions, expiresAt)
+		cmd := command{
+			Op:       opNewAPIToken,
+			User:     User{ID: user.ID},
+			APIToken: token,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply new API token: %s", err)
+			c.String(http.StatusInternalServerError, "Could not create the API token.")
+			return
+		}
+
+		// This is the only time that the token itself is ever available.
+		token.Hash = ""
+		c.JSON(http.StatusCreated, gin.H{
+			"token":   secret,
+			"details": token,
+		})
+	}
+}
+
+func (s *APIServer) handleAPITokenRevoke() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		user := store.state.Users.Find(c.Param("id"))
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		// Users can revoke their own tokens, but only admins can revoke the tokens
+		// of somebody else.
+		if current := currentUser(c); current == nil || current.ID != user.ID {
+			if !s.authorize(c, "", RoleAdmin) {
+				return
+			}
+		}
+
+		id := c.Param("token")
+		var found bool
+		for _, t := range user.Tokens {
+			if t.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.String(http.StatusNotFound, "That API token doesn't exist.")
+			return
+		}
+
+		cmd := command{
+			Op:       opRevokeAPIToken,
+			User:     User{ID: user.ID},
+			APIToken: APIToken{ID: id},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not revoke API token: %s", err)
+			c.String(http.StatusInternalServerError, "Could not revoke that API token.")
+			return
+		}
+
+		c.String(http.StatusOK, "The API token has been revoked.")
+	}
+}
+
+func (s *APIServer) handleListSessions() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type session struct {
+		ID        string    `json:"id"`
+		CreatedAt time.Time `json:"created_at"`
+		LastSeen  time.Time `json:"last_seen"`
+		ExpiresAt time.Time `json:"expires_at"`
+		UserAgent string    `json:"user_agent"`
+		IP        string    `json:"ip"`
+		Current   bool      `json:"current"` // Whether this request used the session
+	}
+
+	return func(c *gin.Context) {
+		user := store.state.Users.Find(c.Param("id"))
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		// Users can see their own sessions, but only admins can see the sessions
+		// of somebody else.
+		if current := currentUser(c); current == nil || current.ID != user.ID {
+			if !s.authorize(c, "", RoleAdmin) {
+				return
+			}
+		}
+
+		var currentToken string
+		if v, ok := c.Get(contextSession); ok {
+			currentToken = v.(*Session).Token
+		}
+
+		// Only show the sessions that are still active, and never include the
+		// tokens themselves.
+		now := time.Now()
+		sessions := []session{}
+		for _, s := range user.Sessions {
+			if s.Expired(now) {
+				continue
+			}
+			sessions = append(sessions, session{
+				ID:        s.ID,
+				CreatedAt: s.CreatedAt,
+				LastSeen:  s.LastSeen,
+				ExpiresAt: s.ExpiresAt,
+				UserAgent: s.UserAgent,
+				IP:        s.IP,
+				Current:   s.Token == currentToken,
+			})
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	}
+}
+
+func (s *APIServer) handleTOTPEnrol() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// A second factor can only be set up by the user themselves, and only when
+		// they have logged in properly.
+		user := currentUser(c)
+		if user == nil || currentToken(c) != nil {
+			c.String(http.StatusForbidden, "You can only set up two-factor authentication for yourself after logging in.")
+			return
+		}
+		if user.TOTP.Enabled {
+			c.String(http.StatusConflict, "Two-factor authentication is already enabled.")
+			return
+		}
+
+		// Generate a new secret. This replaces any enrolment that wasn't finished,
+		// and isn't enforced until a code from it has been verified.
+		totp, codes := GenerateTOTP()
+		cmd := command{
+			Op:   opSetTOTP,
+			User: User{ID: user.ID},
+			TOTP: totp,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply TOTP enrolment: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set up two-factor authentication.")
+			return
+		}
+
+		// The recovery codes are only ever shown here, as only their hashes are
+		// kept in the store.
+		c.JSON(http.StatusCreated, gin.H{
+			"uri":            totp.URI(user.Username),
+			"secret":         totp.Secret,
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func (s *APIServer) handleTOTPVerify() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Code string `form:"code" json:"code"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		if err := c.ShouldBind(&body); err != nil || body.Code == "" {
+			c.String(http.StatusBadRequest, "You must supply a code from your authenticator.")
+			return
+		}
+
+		current := currentUser(c)
+		if current == nil || currentToken(c) != nil {
+			c.String(http.StatusForbidden, "You can only set up two-factor authentication for yourself after logging in.")
+			return
+		}
+
+		store.mu.RLock()
+		_, user := store.state.Users.FindByID(current.ID)
+		store.mu.RUnlock()
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		if user.TOTP.Enabled {
+			c.String(http.StatusConflict, "Two-factor authentication is already enabled.")
+			return
+		}
+		if user.TOTP.Secret == "" {
+			c.String(http.StatusBadRequest, "You must start setting up two-factor authentication first.")
+			return
+		}
+
+		step, ok := user.TOTP.Validate(body.Code, time.Now())
+		if !ok {
+			c.String(http.StatusUnauthorized, "The code you provided is incorrect.")
+			return
+		}
+
+		// The code is correct, so the second factor is now required to log in.
+		totp := user.TOTP
+		totp.Enabled = true
+		totp.LastStep = step
+
+		cmd := command{
+			Op:   opSetTOTP,
+			User: User{ID: user.ID},
+			TOTP: totp,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply TOTP verification: %s", err)
+			c.String(http.StatusInternalServerError, "Could not enable two-factor authentication.")
+			return
+		}
+
+		c.String(http.StatusOK, "Two-factor authentication has been enabled.")
+	}
+}
+
+func (s *APIServer) handleTOTPDisable() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Code         string `form:"code" json:"code"`
+		RecoveryCode string `form:"recovery_code" json:"recovery_code"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		c.ShouldBind(&body)
+
+		user := store.state.Users.Find(c.Param("id"))
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		// Users can turn off their own second factor by proving that they still
+		// have it. Admins can turn it off for somebody else, such as when they have
+		// lost both their authenticator and their recovery codes.
+		if current := currentUser(c); current != nil && current.ID == user.ID && currentToken(c) == nil {
+			if user.TOTP.Enabled {
+				_, ok := user.TOTP.Validate(body.Code, time.Now())
+				if !ok && (body.RecoveryCode == "" || user.TOTP.FindRecoveryCode(body.RecoveryCode) == "") {
+					c.String(http.StatusUnauthorized, "The code you provided is incorrect.")
+					return
+				}
+			}
+		} else if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		cmd := command{
+			Op:   opSetTOTP,
+			User: User{ID: user.ID},
+			TOTP: TOTP{},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply TOTP removal: %s", err)
+			c.String(http.StatusInternalServerError, "Could not disable two-factor authentication.")
+			return
+		}
+
+		c.String(http.StatusOK, "Two-factor authentication has been disabled.")
+	}
+}
+
+// readProfile reads the profile image that was uploaded with a request.
+func readProfile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func (s *APIServer) handleUserUpdate() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Name     string `form:"name" json:"name"`
+		Username string `form:"username" json:"username"`
+		Email    string `form:"email" json:"email"`
+
+		Profile       *multipart.FileHeader `form:"profile" json:"profile"`
+		RemoveProfile bool                  `form:"remove_profile" json:"remove_profile"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		c.ShouldBind(&body)
+
+		store.mu.RLock()
+		user := store.state.Users.Find(c.Param("id"))
+		store.mu.RUnlock()
+		if user == nil {
+			c.String(http.StatusNotFound, "That user doesn't exist.")
+			return
+		}
+
+		// Users can edit their own profile after logging in, but only admins can
+		// edit the profile of somebody else.
+		if current := currentUser(c); current == nil || current.ID != user.ID || currentToken(c) != nil {
+			if !s.authorizeUser(c, user.ID) {
+				return
+			}
+		}
+
+		// Only the fields that were provided are sent, so that an update made at
+		// the same time isn't undone by this one.
+		update := User{
+			ID:       user.ID,
+			Name:     body.Name,
+			Username: body.Username,
+			Email:    body.Email,
+		}
+		if body.Profile != nil {
+			data, err := readProfile(body.Profile)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Could not read the profile image.")
+				return
+			}
+			update.Profile = data
+		}
+
+		if update.Name != "" {
+			user.Name = update.Name
+		}
+		if update.Username != "" {
+			user.Username = update.Username
+		}
+		if update.Email != "" {
+			user.Email = update.Email
+		}
+
+		// Make sure that the new details don't clash with another user.
+		store.mu.RLock()
+		err := store.state.Users.CheckUnique(user.ID, user.Username, user.Email)
+		store.mu.RUnlock()
+		if err != nil {
+			switch err {
+			case ErrEmailTaken:
+				c.String(http.StatusConflict, "Sorry, that email address is already taken.")
+			case ErrUsernameTaken:
+				c.String(http.StatusConflict, "Sorry, that username is already taken.")
+			default:
+				c.AbortWithStatus(http.StatusBadRequest)
+			}
+			return
+		}
+
+		cmd := command{
+			Op:   opUpdateUser,
+			User: update,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply user update: %s", err)
+			c.String(http.StatusInternalServerError, "Could not update the user.")
+			return
+		}
+
+		// A new profile replaces the old one, so it only has to be removed if one
+		// wasn't provided.
+		if body.RemoveProfile && body.Profile == nil {
+			cmd := command{
+				Op:   opRemoveProfile,
+				User: User{ID: user.ID},
+			}
+			if err := s.apply(c, &cmd); err != nil {
+				log.Printf("[ERR] store: Could not apply profile removal: %s", err)
+				c.String(http.StatusInternalServerError, "Could not remove the profile image of the user.")
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+			"email":    user.Email,
+			"name":     user.Name,
+		})
+	}
+}
+
+func (s *APIServer) handlePasswordChange() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		CurrentPassword string `form:"current_password" json:"current_password"`
+		Password        string `form:"password" json:"password"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		if err := c.ShouldBind(&body); err != nil || body.Password == "" {
+			c.String(http.StatusBadRequest, "You must supply your current password and a new password.")
+			return
+		}
+
+		// Passwords can only be changed by the user themselves after logging in.
+		// Admins have to issue a password reset instead.
+		current := currentUser(c)
+		v, ok := c.Get(contextSession)
+		if current == nil || !ok {
+			c.String(http.StatusForbidden, "You can only change your own password after logging in.")
+			return
+		}
+		user := store.state.Users.Find(c.Param("id"))
+		if user == nil || user.ID != current.ID {
+			c.String(http.StatusForbidden, "You can only change your own password after logging in.")
+			return
+		}
+
+		if !user.ValidatePassword(body.CurrentPassword) {
+			c.String(http.StatusUnauthorized, "The password you provided is incorrect.")
+			return
+		}
+
+		if err := user.SetPassword(body.Password); err != nil {
+			log.Printf("[ERR] store: Could not set password: %s", err)
+			c.String(http.StatusInternalServerError, "Could not change your password.")
+			return
+		}
+
+		cmd := command{
+			Op:   opSetPassword,
+			User: User{ID: user.ID, Password: user.Password},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply password change: %s", err)
+			c.String(http.StatusInternalServerError, "Could not change your password.")
+			return
+		}
+
+		// Log out everywhere else, in case the old password was compromised.
+		cmd = command{
+			Op:      opRevokeOtherSessions,
+			User:    User{ID: user.ID},
+			Session: Session{Token: v.(*Session).Token},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not revoke other sessions: %s", err)
+			c.String(http.StatusInternalServerError, "Your password was changed, but your other sessions could not be logged out.")
+			return
+		}
+
+		c.String(http.StatusOK, "Your password has been changed.")
+	}
+}
+
+func (s *APIServer) handlePasswordResetCreate() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		store.mu.RLock()
+		user := store.state.Users.Find(c.Param("id"))
+		store.mu.RUnlock()
+		if user == nil {
+			if s.authorize(c, "", RoleAdmin) {
+				c.String(http.StatusNotFound, "That user doesn't exist.")
+			}
+			return
+		}
+
+		if !s.authorizeUser(c, user.ID) {
+			return
+		}
+
+		// Issuing a new reset replaces any that was issued before.
+		reset, token := user.GeneratePasswordReset()
+
+		cmd := command{
+			Op:   opSetPasswordReset,
+			User: User{ID: user.ID, Reset: reset},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply password reset: %s", err)
+			c.String(http.StatusInternalServerError, "Could not create a password reset.")
+			return
+		}
+
+		// The token is only ever shown here, so the admin has to pass it on to
+		// the user.
+		c.JSON(http.StatusCreated, gin.H{
+			"token":      token,
+			"expires_at": reset.ExpiresAt,
+		})
+	}
+}
+
+func (s *APIServer) handlePasswordReset() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Token    string `form:"token" json:"token"`
+		Password string `form:"password" json:"password"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		if err := c.ShouldBind(&body); err != nil || body.Token == "" || body.Password == "" {
+			c.String(http.StatusBadRequest, "You must supply a reset token and a new password.")
+			return
+		}
+
+		store.mu.RLock()
+		user := store.state.Users.FindByPasswordReset(body.Token)
+		store.mu.RUnlock()
+		if user == nil {
+			c.String(http.StatusUnauthorized, "That reset token is invalid or has expired.")
+			return
+		}
+
+		// Setting the password also clears the reset, so it can't be used again.
+		if err := user.SetPassword(body.Password); err != nil {
+			log.Printf("[ERR] store: Could not set password: %s", err)
+			c.String(http.StatusInternalServerError, "Could not reset your password.")
+			return
+		}
+
+		cmd := command{
+			Op:   opSetPassword,
+			User: User{ID: user.ID, Password: user.Password},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply password reset: %s", err)
+			c.String(http.StatusInternalServerError, "Could not reset your password.")
+			return
+		}
+
+		// Log out every existing session, as whoever has them might not be the
+		// owner of the account.
+		cmd = command{
+			Op:   opRevokeAllSessions,
+			User: User{ID: user.ID},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not revoke all sessions: %s", err)
+		}
+
+		c.String(http.StatusOK, "Your password has been reset. You can now log in.")
+	}
+}
+
+func (s *APIServer) handleListAudit() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type query struct {
+		User    string `form:"user"`
+		Op      string `form:"op"`
+		Target  string `form:"target"`
+		Outcome string `form:"outcome"` // Either "ok" or "error"
+		Since   string `form:"since"`   // RFC 3339 timestamp
+		Until   string `form:"until"`   // RFC 3339 timestamp
+		Limit   int    `form:"limit"`   // Only the most recent entries
+		Format  string `form:"format"`  // Set to "jsonl" to export as JSON lines
+	}
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		var q query
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.String(http.StatusBadRequest, "The audit log filters are invalid.")
+			return
+		}
+
+		filter := AuditFilter{
+			User:    q.User,
+			Op:      q.Op,
+			Target:  q.Target,
+			Outcome: q.Outcome,
+		}
+		for _, t := range []struct {
+			value string
+			dest  *time.Time
+		}{{q.Since, &filter.Since}, {q.Until, &filter.Until}} {
+			if t.value == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, t.value)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Times must be in RFC 3339 format, such as 2006-01-02T15:04:05Z.")
+				return
+			}
+			*t.dest = parsed
+		}
+
+		entries, err := store.ReadAudit(filter)
+		if err != nil {
+			log.Printf("[ERR] api: Could not read audit log: %s", err)
+			c.String(http.StatusInternalServerError, "Could not read the audit log.")
+			return
+		}
+
+		if q.Limit > 0 && len(entries) > q.Limit {
+			entries = entries[len(entries)-q.Limit:]
+		}
+
+		// Export the entries as JSON lines, which is easier to feed into other
+		// tools than one big array.
+		if q.Format == "jsonl" {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+			c.Status(http.StatusOK)
+
+			enc := json.NewEncoder(c.Writer)
+			for _, e := range entries {
+				if err := enc.Encode(e); err != nil {
+					log.Printf("[ERR] api: Could not export audit log: %s", err)
+					return
+				}
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, entries)
+	}
+}
@@ -1,10 +1,23 @@
 package engine
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,6 +25,25 @@ import (
 	"github.com/sosedoff/gitkit"
 )
 
+// The environment variables that tell the git hooks how to reach the engine.
+// They are set on the engine process, so that the git processes run by the git
+// server (and the hooks that they run) inherit them.
+const (
+	gitHookURLEnv   = "ORBIT_HOOK_URL"
+	gitHookTokenEnv = "ORBIT_HOOK_TOKEN"
+)
+
+// gitPushNonceEnv is the environment variable that identifies a push to the
+// hooks that it runs. It is only set on the git process that receives the push.
+const gitPushNonceEnv = "ORBIT_PUSH_NONCE"
+
+// gitHookTokenHeader is the header that the git hooks authenticate with.
+const gitHookTokenHeader = "X-Orbit-Hook-Token"
+
+// gitZeroRev is the revision of a ref that doesn't exist, such as the old
+// revision of a branch that has just been created.
+const gitZeroRev = "0000000000000000000000000000000000000000"
+
 func gitInitBare(path string) error {
 	// Create and run the command.
 	cmd := exec.Command("git", "init", "--bare", path)
@@ -23,6 +55,33 @@ func gitInitBare(path string) error {
 	return nil
 }
 
+// installGitHooks writes the hooks that Orbit uses into a repository. The hooks
+// run the orbit binary itself, which passes them on to the engine.
+func installGitHooks(path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	quoted := "'" + strings.Replace(exe, "'", `'\''`, -1) + "'"
+	script := fmt.Sprintf("#!/bin/sh\nexec %s hook post-receive\n", quoted)
+
+	hook := filepath.Join(path, "hooks", "post-receive")
+	if existing, err := ioutil.ReadFile(hook); err == nil && string(existing) == script {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(hook), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(hook, []byte(script), 0755)
+}
+
+// isGitPush returns whether or not the git request is part of a push, as
+// opposed to a fetch or a clone.
+func isGitPush(req *gitkit.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/git-receive-pack") ||
+		req.URL.Query().Get("service") == "git-receive-pack"
+}
+
 // handleGit will return a handler for HTTP git requests on the HTTP server.
 func (s *APIServer) handleGit() gin.HandlerFunc {
 	store := s.engine.Store
@@ -43,94 +102,421 @@ func (s *APIServer) handleGit() gin.HandlerFunc {
 		if service == nil {
 			service = gitkit.New(gitkit.Config{Auth: true})
 
+			// Let the hooks know how to reach the engine.
+			hookURL := fmt.Sprintf("http://127.0.0.1:%d", s.Port)
+			if s.Port == -1 {
+				hookURL = "unix:" + s.Socket
+			}
+			os.Setenv(gitHookURLEnv, hookURL)
+			os.Setenv(gitHookTokenEnv, s.hookToken)
+
 			// The following function is responsible for performing all of the checks
 			// on the URL and ensuring that it ends up in the place that it's expected
 			// to.
 			service.AuthFunc = func(creds gitkit.Credential, req *gitkit.Request) (bool, error) {
-				// Find the user attached.
-				user := store.state.Users.Find(creds.Username)
-				if user == nil {
-					// That user does not exist.
-					return false, nil
-				}
-				if !user.ValidatePassword(creds.Password) {
-					// The user's password is incorrect.
-					return false, nil
-				}
-
-				// Remove the repo prefix from the URL so that it's not a factor.
-				urlPath := strings.TrimPrefix(req.RepoPath, "repo/")
-
-				// Attempt to split the path into two items. If there's two items, it
-				// means that the repo is referenced by its name and namespace, and if
-				// there's only one item, it means that it's referenced by its name in
-				// the "default" namespace or its unique identifier in any namespace.
-				tokens := strings.Split(urlPath, "/")
-
-				var namespace *Namespace
-				var identifier string
-				switch len(tokens) {
-				case 1:
-					identifier = tokens[0]
-				case 2:
-					namespace = store.state.Namespaces.Find(tokens[0])
-					identifier = tokens[1]
-				default:
-					log.Printf("[ERR] git: Wrong number of URL components")
-					return false, nil
-				}
-
-				// Search through the repositories to find matching ones.
-				var repo *Repository
-				for _, r := range store.state.Repositories {
-					// Check the ID first.
-					if r.ID == identifier {
-						repo = &r
-						break
-					}
-
-					// If there was no namespace provided, just return the first match for
-					// the given repository name. This handles the case of the "default"
-					// repository. If no match is provided, continue on with the loop
-					// anyway, as the following checks require there to be a namespace.
-					if namespace == nil {
-						if r.Name == identifier {
-							repo = &r
-							break
-						}
-						continue
-					}
-
-					// And finally, if the namespace and name match, then we can return
-					// the repo for that result.
-					if r.NamespaceID == namespace.ID && r.Name == identifier {
-						repo = &r
-						break
-					}
-				}
-
-				// If there was no repository found by this point, it means that with
-				// the details provided, there wasn't a single one found.
-				if repo == nil {
-					log.Printf("[ERR] git: That repository does not exist: identifier: '%s', namespace: %+v", identifier, namespace)
-					return false, nil
-				}
-
-				// Derive the location that the repo should be.
-				path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
-				req.RepoPath = path
-
-				// Ensure that the repo is initialised.
-				if err := gitInitBare(path); err != nil {
-					log.Printf("[ERR] git: There was an error initialising the repository: %s", err)
-					return false, nil
-				}
-
-				return true, nil
+				_, ok := s.authorizeGit(volume, creds, req)
+				return ok, nil
 			}
 		}
 
+		// The pack of a push is received here rather than by the git server, so
+		// that the post-receive hook can tell which push it is for.
+		if c.Request.Method == http.MethodPost && strings.HasSuffix(c.Request.URL.Path, "/git-receive-pack") {
+			s.receivePack(c, volume)
+			return
+		}
+
 		// Now continue executing the service as though it was gin middleware.
 		service.ServeHTTP(c.Writer, c.Request)
 	}
 }
+
+// authorizeGit checks the credentials of a git request, and points it at the
+// repository that it is for on the orbit system volume. It returns who made the
+// request if they are allowed to.
+func (s *APIServer) authorizeGit(volume *Volume, creds gitkit.Credential, req *gitkit.Request) (*Actor, bool) {
+	store := s.engine.Store
+
+	// Git clients can guess passwords just as well as the API, so the
+	// same limits on failed attempts apply.
+	store.mu.RLock()
+	accountKey := accountAttemptKey(&store.state.Users, creds.Username)
+	store.mu.RUnlock()
+	ipKey := ipAttemptKey(requestIP(req.Request))
+	if wait := s.loginRetryAfter(accountKey, ipKey); wait > 0 {
+		log.Printf("[ERR] git: Too many failed attempts for %s from %s", creds.Username, ipKey)
+		return nil, false
+	}
+
+	// Find the user attached.
+	user := store.state.Users.Find(creds.Username)
+	if user == nil {
+		// That user does not exist.
+		ValidateDummyPassword(creds.Password)
+		s.loginFailed(accountKey, ipKey)
+		return nil, false
+	}
+
+	// The password can either be the user's actual password, or one of
+	// their API tokens (which is what automated systems should use). Git can't
+	// ask for a second factor, so users that have one have to use a token.
+	var token *APIToken
+	if user.TOTP.Enabled || !user.ValidatePassword(creds.Password) {
+		token = user.FindAPIToken(creds.Password)
+		if token == nil {
+			// The user's password is incorrect.
+			s.loginFailed(accountKey, ipKey)
+			return nil, false
+		}
+		s.touchAPIToken(user.ID, *token)
+	}
+	s.loginSucceeded(accountKey)
+
+	// Remove the repo prefix from the URL so that it's not a factor.
+	urlPath := strings.TrimPrefix(req.RepoPath, "repo/")
+
+	// Attempt to split the path into two items. If there's two items, it
+	// means that the repo is referenced by its name and namespace, and if
+	// there's only one item, it means that it's referenced by its name in
+	// the "default" namespace or its unique identifier in any namespace.
+	tokens := strings.Split(urlPath, "/")
+
+	var namespace *Namespace
+	var identifier string
+	switch len(tokens) {
+	case 1:
+		identifier = tokens[0]
+	case 2:
+		namespace = store.state.Namespaces.Find(tokens[0])
+		identifier = tokens[1]
+	default:
+		log.Printf("[ERR] git: Wrong number of URL components")
+		return nil, false
+	}
+
+	// Search through the repositories to find matching ones.
+	var repo *Repository
+	for _, r := range store.state.Repositories {
+		// Check the ID first.
+		if r.ID == identifier {
+			repo = &r
+			break
+		}
+
+		// If there was no namespace provided, just return the first match for
+		// the given repository name. This handles the case of the "default"
+		// repository. If no match is provided, continue on with the loop
+		// anyway, as the following checks require there to be a namespace.
+		if namespace == nil {
+			if r.Name == identifier {
+				repo = &r
+				break
+			}
+			continue
+		}
+
+		// And finally, if the namespace and name match, then we can return
+		// the repo for that result.
+		if r.NamespaceID == namespace.ID && r.Name == identifier {
+			repo = &r
+			break
+		}
+	}
+
+	// If there was no repository found by this point, it means that with
+	// the details provided, there wasn't a single one found.
+	if repo == nil {
+		log.Printf("[ERR] git: That repository does not exist: identifier: '%s', namespace: %+v", identifier, namespace)
+		return nil, false
+	}
+
+	// Pushing code requires the developer role in the namespace of the
+	// repository, whereas fetching only requires the viewer role.
+	role := RoleViewer
+	if isGitPush(req) {
+		role = RoleDeveloper
+	}
+
+	// Mirrors only take code from their upstream, as a push would be
+	// replaced by the next fetch anyway.
+	if isGitPush(req) && repo.Upstream != nil {
+		log.Printf("[ERR] git: Repository %s is a mirror and can't be pushed to", repo.ID)
+		return nil, false
+	}
+
+	store.mu.RLock()
+	granted := store.state.Allowed(user.ID, token, repo.NamespaceID, role)
+	store.mu.RUnlock()
+	if !granted {
+		log.Printf("[ERR] git: User %s does not have the %s role for repository %s", user.Username, role, repo.ID)
+		return nil, false
+	}
+
+	// Derive the location that the repo should be.
+	path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
+	req.RepoPath = path
+
+	// Ensure that the repo is initialised.
+	if err := gitInitBare(path); err != nil {
+		log.Printf("[ERR] git: There was an error initialising the repository: %s", err)
+		return nil, false
+	}
+
+	// Pushes run the post-receive hook, which builds the deployments of the
+	// branches that were pushed to on behalf of the user.
+	if isGitPush(req) {
+		if err := installGitHooks(path); err != nil {
+			log.Printf("[ERR] git: Could not install the hooks in the repository: %s", err)
+			return nil, false
+		}
+	}
+
+	actor := Actor{UserID: user.ID, Username: user.Username, IP: requestIP(req.Request)}
+	if token != nil {
+		actor.TokenID = token.ID
+	}
+	return &actor, true
+}
+
+// receivePack receives the pack of a push, as the git server would. The git
+// process is given a nonce in its environment, which the post-receive hook
+// passes back to the engine so that the builds it starts are attributed to
+// whoever made this push.
+func (s *APIServer) receivePack(c *gin.Context, volume *Volume) {
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm=""`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	// The path of the repository is worked out in the same way as the git server
+	// does, so that it is authorized in the same way.
+	urlPath := strings.TrimSuffix(c.Request.URL.Path, "/git-receive-pack")
+	req := &gitkit.Request{
+		Request:  c.Request,
+		RepoPath: strings.TrimPrefix(path.Clean("/"+urlPath), "/"),
+	}
+	req.RepoName = req.RepoPath
+	actor, ok := s.authorizeGit(volume, gitkit.Credential{Username: user, Password: password}, req)
+	if !ok {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	s.pushMu.Lock()
+	s.pushes[nonce] = *actor
+	s.pushMu.Unlock()
+	defer func() {
+		s.pushMu.Lock()
+		delete(s.pushes, nonce)
+		s.pushMu.Unlock()
+	}()
+
+	body := io.Reader(c.Request.Body)
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		r, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.String(http.StatusBadRequest, "The pack could not be decompressed.")
+			return
+		}
+		body = r
+	}
+
+	c.Header("Content-Type", "application/x-git-receive-pack-result")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	cmd := exec.CommandContext(c.Request.Context(), "git", "receive-pack", "--stateless-rpc", req.RepoPath)
+	cmd.Env = append(os.Environ(), gitPushNonceEnv+"="+nonce)
+	cmd.Stdin = body
+	cmd.Stdout = flushWriter{c.Writer}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("[ERR] git: Could not receive the pack for %s: %s", req.RepoPath, err)
+	}
+}
+
+// gitRefUpdate is a ref that has been changed by a push.
+type gitRefUpdate struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+	Ref string `json:"ref"`
+}
+
+// flushWriter flushes every write to the client straight away, so that the
+// output of a build is streamed as it happens.
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
+
+// handlePostReceive is called by the post-receive hook once a push has been
+// accepted. It queues a build of every deployment that uses one of the pushed
+// branches, and streams their output back to the hook. Git sends the output of
+// the hook to the client, so it shows up as part of the push. The builds carry
+// on if the client goes away.
+func (s *APIServer) handlePostReceive() gin.HandlerFunc {
+	engine := s.engine
+	store := engine.Store
+
+	type body struct {
+		Repository string         `json:"repository"` // The path of the repository
+		Push       string         `json:"push"`       // The nonce of the push
+		Refs       []gitRefUpdate `json:"refs"`
+	}
+
+	return func(c *gin.Context) {
+		token := c.GetHeader(gitHookTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.hookToken)) != 1 {
+			c.String(http.StatusUnauthorized, "The hook token is invalid.")
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The hook details are invalid.")
+			return
+		}
+
+		// The repository has to be one that the git server manages.
+		volume := store.OrbitSystemVolume()
+		if volume == nil {
+			c.String(http.StatusServiceUnavailable, "Orbit is not yet ready to handle requests.")
+			return
+		}
+		repoID := filepath.Base(body.Repository)
+		path := filepath.Join(volume.Paths().Data, "repositories", repoID)
+		if filepath.Clean(body.Repository) != path {
+			c.String(http.StatusNotFound, "That repository does not exist.")
+			return
+		}
+
+		// A push that didn't come through the git server, such as one to the
+		// repository on disk, isn't attributed to anyone.
+		s.pushMu.Lock()
+		actor := s.pushes[body.Push]
+		s.pushMu.Unlock()
+
+		// Find the deployments that use the branches that were pushed to.
+		deployments := store.state.Deployments.ForPush(repoID, gitDefaultBranch(path), body.Refs)
+
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := flushWriter{c.Writer}
+
+		builds := map[string]*Build{}
+		for _, d := range deployments {
+			build, err := engine.QueueBuild(d, actor)
+			if err != nil {
+				log.Printf("[ERR] git: Could not queue build of deployment %s: %s", d.ID, err)
+				fmt.Fprintf(w, "-----> Could not queue the build of %s: %s\n", d.Name, err)
+				continue
+			}
+			builds[d.ID] = build
+		}
+
+		for _, d := range deployments {
+			build, ok := builds[d.ID]
+			if !ok {
+				continue
+			}
+
+			fmt.Fprintf(w, "-----> Building %s (build %s)\n", d.Name, build.ID)
+			build, err := engine.FollowBuild(c.Request.Context(), build.ID, w)
+			if err != nil {
+				return // The client has gone away
+			}
+			switch build.State {
+			case BuildFailed:
+				fmt.Fprintf(w, "-----> Deployment of %s failed: %s\n", d.Name, build.Error)
+			case BuildCancelled:
+				fmt.Fprintf(w, "-----> Build of %s was cancelled\n", d.Name)
+			}
+		}
+	}
+}
+
+// RunGitHook runs a git hook on behalf of the engine. The git server runs the
+// hooks that it installs with the orbit binary, which calls this to pass the
+// details of the hook to the engine and write the response back to git.
+func RunGitHook(name string, stdin io.Reader, stdout io.Writer) error {
+	if name != "post-receive" {
+		return fmt.Errorf("unknown git hook %s", name)
+	}
+
+	// Hooks run outside of the engine (such as by pushing to the repository on
+	// disk) have nothing to do.
+	addr := os.Getenv(gitHookURLEnv)
+	if addr == "" {
+		return nil
+	}
+
+	// Git runs the hooks in the repository directory, and passes the refs that
+	// were updated as lines of "<old> <new> <ref>".
+	repository, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	refs := []gitRefUpdate{}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 {
+			refs = append(refs, gitRefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"repository": repository,
+		"push":       os.Getenv(gitPushNonceEnv),
+		"refs":       refs,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The engine is either reached over TCP or over the UNIX socket.
+	client := &http.Client{}
+	if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		addr = "http://orbit"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, addr+"/repo-hook/post-receive", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gitHookTokenHeader, os.Getenv(gitHookTokenEnv))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(stdout, res.Body); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("engine responded with %s", res.Status)
+	}
+	return nil
+}
@@ -12,8 +12,10 @@ import (
 func (s *APIServer) handlers() {
 	r := s.router
 
-	// Register middleware.
+	// Register middleware. Every route requires authentication unless it has
+	// been explicitly whitelisted in the authentication middleware.
 	r.Use(s.simpleLogger())
+	r.Use(s.authenticate())
 
 	//
 	// Handle all of the routes.
@@ -33,7 +35,9 @@ func (s *APIServer) handlers() {
 	r.GET("/volumes", s.handleListVolumes())
 	r.GET("/repositories", s.handleGetRepositories())
 	r.GET("/deployments", s.handleListDeployments())
+	r.GET("/secrets", s.handleListSecrets())
 	r.GET("/tokens", s.handleGetTokens())
+	r.GET("/audit", s.handleListAudit())
 
 	r.POST("/tokens/refresh", s.handleRefreshTokens())
 	r.POST("/snapshot/:op", s.handleSnapshot())
@@ -42,26 +46,59 @@ func (s *APIServer) handlers() {
 
 	// Handle git repositories at the /code URL.
 	r.Any("/repo/*path", s.handleGit())
+	r.POST("/repo-hook/post-receive", s.handlePostReceive())
+	r.POST("/hooks/github/:deployment", s.handleGitHubWebhook())
+	r.POST("/hooks/gitlab/:deployment", s.handleGitLabWebhook())
 
 	{
 		r := r.Group("/cluster")
 		r.POST("/bootstrap", s.handleClusterBootstrap())
 		r.POST("/join", s.handleClusterJoin())
+		r.GET("/keyring", s.handleListKeyring())
+		r.POST("/keyring/rotate", s.handleRotateKeyring())
 	}
 
 	{
 		r := r.Group("/namespace")
 		r.POST("", s.handleNamespaceAdd())
+		r.GET("/:id/roles", s.handleListRoles())
+		r.PUT("/:id/roles/:user", s.handleRoleGrant())
+		r.DELETE("/:id/roles/:user", s.handleRoleRevoke())
 	}
 
 	{
 		r := r.Group("/user")
 		r.POST("", s.handleUserSignup())
 		r.POST("/login", s.handleUserLogin())
+		r.POST("/login/totp", s.handleUserLoginTOTP())
+		r.POST("/reset", s.handlePasswordReset())
+		r.POST("/totp", s.handleTOTPEnrol())
+		r.POST("/totp/verify", s.handleTOTPVerify())
 		r.GET("/:id/profile", s.handleUserProfile())
 		r.GET("/:id", s.handleUserGet())
+		r.PUT("/:id", s.handleUserUpdate())
 		r.DELETE("/:id", s.handleUserRemove())
+		r.PUT("/:id/password", s.handlePasswordChange())
+		r.PUT("/:id/reset", s.handlePasswordResetCreate())
+		r.GET("/:id/sessions", s.handleListSessions())
 		r.DELETE("/:id/session/:token", s.handleSessionRevoke())
+		r.DELETE("/:id/totp", s.handleTOTPDisable())
+		// Tokens are created at /user/tokens rather than /user/:id/tokens, as a
+		// POST to a path starting with :id conflicts with /user/login. A token is
+		// always created for the user making the request.
+		r.POST("/tokens", s.handleAPITokenCreate())
+		r.GET("/:id/tokens", s.handleListAPITokens())
+		r.DELETE("/:id/tokens/:token", s.handleAPITokenRevoke())
+	}
+
+	{
+		r := r.Group("/oidc")
+		r.GET("/providers", s.handleListOIDCProviders())
+		r.POST("/providers", s.handleOIDCProviderAdd())
+		r.PUT("/providers/:id", s.handleOIDCProviderUpdate())
+		r.DELETE("/providers/:id", s.handleOIDCProviderRemove())
+		r.GET("/login/:provider", s.handleOIDCLogin())
+		r.GET("/callback", s.handleOIDCCallback())
 	}
 
 	{
@@ -94,14 +131,45 @@ func (s *APIServer) handlers() {
 		r := r.Group("/repository")
 		r.POST("", s.handleRepositoryAdd())
 		r.GET("/:id", s.handleRepositoryGet())
+		r.PUT("/:id/upstream", s.handleRepositoryUpstreamSet())
+		r.DELETE("/:id/upstream", s.handleRepositoryUpstreamRemove())
+		r.POST("/:id/fetch", s.handleRepositoryFetch())
 		r.DELETE("/:id", s.handleRepositoryRemove())
 	}
 
+	{
+		r := r.Group("/secret")
+		r.POST("", s.handleSecretAdd())
+		r.GET("/:id", s.handleSecretGet())
+		r.PUT("/:id", s.handleSecretUpdate())
+		r.DELETE("/:id", s.handleSecretRemove())
+	}
+
+	{
+		r := r.Group("/build")
+		r.GET("/:id", s.handleBuildGet())
+		r.POST("/:id/cancel", s.handleBuildCancel())
+	}
+
 	{
 		r := r.Group("/deployment")
 		r.GET("/:id", s.handleDeploymentGet())
 		r.POST("", s.handleDeploymentAdd())
 		r.POST("/:id/build", s.handleBuildDeployment())
+		r.PUT("/:id/secrets", s.handleDeploymentSecrets())
+		r.POST("/:id/webhook", s.handleDeploymentWebhook())
+		r.GET("/:id/env", s.handleDeploymentEnv())
+		r.PUT("/:id/env", s.handleDeploymentEnvSet())
+		r.PATCH("/:id/env", s.handleDeploymentEnvSet())
+		r.PUT("/:id/formation", s.handleDeploymentFormation())
+		r.GET("/:id/releases", s.handleListReleases())
+		r.GET("/:id/builds", s.handleListBuilds())
+		r.GET("/:id/builds/:key/logs", s.handleBuildLogs())
+		r.GET("/:id/logs", s.handleDeploymentLogs())
+		r.PUT("/:id/log-retention", s.handleDeploymentLogRetention())
+		r.PUT("/:id/builder", s.handleDeploymentBuilder())
+		r.PUT("/:id/build-config", s.handleDeploymentBuildConfig())
+		r.POST("/:id/rollback/:release", s.handleDeploymentRollback())
 		r.DELETE("/:id", s.handleDeploymentRemove())
 	}
 }
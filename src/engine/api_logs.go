@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"orbit.sh/engine/docker"
+)
+
+// Logs are streamed to clients that follow them as server-sent events, which
+// browsers can read with an EventSource. Each line is sent as a "log" event,
+// and a stream that ends on its own sends an "end" event before closing, so
+// that the client knows not to reconnect.
+
+// queryFlag returns whether or not a flag was turned on in the query string.
+func queryFlag(c *gin.Context, name string) bool {
+	switch c.Query(name) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// sseLogWriter sends each line written to it as a log event. Lines are skipped
+// until the number to skip has been reached, which is how the log is tailed.
+type sseLogWriter struct {
+	c    *gin.Context
+	skip int
+}
+
+func (w *sseLogWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if w.skip > 0 {
+			w.skip--
+			continue
+		}
+		w.c.SSEvent("log", line)
+	}
+	w.c.Writer.Flush()
+	return len(p), nil
+}
+
+func (s *APIServer) handleBuildLogs() gin.HandlerFunc {
+	engine := s.engine
+	store := engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
+		tail := -1
+		if t := c.Query("tail"); t != "" && t != "all" {
+			n, err := strconv.Atoi(t)
+			if err != nil || n < 0 {
+				c.String(http.StatusBadRequest, "The tail must be a number of lines or all.")
+				return
+			}
+			tail = n
+		}
+
+		// The key is either the ID of a build, or the key of a log, which the logs
+		// from before builds were kept in the store only have.
+		key := c.Param("key")
+		var build *Build
+		for _, b := range store.state.Builds.ForDeployment(deployment.ID) {
+			if b.ID == key || (b.LogKey != "" && b.LogKey == key) {
+				build = &b
+				break
+			}
+		}
+		if build != nil {
+			key = build.LogKey
+		}
+
+		var lines []string
+		if stored, ok := deployment.BuildLogs[key]; ok && build == nil {
+			lines = stored // A log that hasn't been moved out of the store yet
+		} else if key != "" {
+			keys, err := store.BuildLogKeys(deployment.ID)
+			if err != nil {
+				log.Printf("[ERR] deployment: Could not list the build logs of %s: %s", deployment.ID, err)
+				c.String(http.StatusInternalServerError, "Could not read the build logs of the deployment.")
+				return
+			}
+			if _, ok := keys[key]; !ok && build == nil {
+				c.String(http.StatusNotFound, "No build log with that key exists.")
+				return
+			}
+			if lines, err = store.BuildLogLines(deployment.ID, key); err != nil {
+				log.Printf("[ERR] deployment: Could not read build log %s of %s: %s", key, deployment.ID, err)
+				c.String(http.StatusInternalServerError, "Could not read the build log.")
+				return
+			}
+		}
+
+		skip := 0
+		if tail >= 0 && len(lines) > tail {
+			skip = len(lines) - tail
+		}
+
+		// Only a build that is still running has anything to follow.
+		if !queryFlag(c, "follow") || build == nil {
+			c.Header("Content-Type", "text/plain; charset=utf-8")
+			c.Status(http.StatusOK)
+			for _, line := range lines[skip:] {
+				fmt.Fprintln(c.Writer, line)
+			}
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		// The lines written since they were counted are after the ones skipped,
+		// so they are still sent.
+		w := &sseLogWriter{c: c, skip: skip}
+		finished, err := engine.FollowBuild(c.Request.Context(), build.ID, w)
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				log.Printf("[ERR] deployment: Could not follow build %s: %s", build.ID, err)
+				c.SSEvent("error", "Could not read the build log.")
+			}
+			return // Otherwise the client has gone away
+		}
+		c.SSEvent("end", finished)
+	}
+}
+
+func (s *APIServer) handleDeploymentLogs() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleViewer) {
+			return
+		}
+
+		follow := queryFlag(c, "follow")
+		timestamps := queryFlag(c, "timestamps")
+
+		// Docker accepts timestamps, unix times and durations to read the logs
+		// since, so only those are passed on.
+		since := c.Query("since")
+		if since != "" {
+			_, timeErr := time.Parse(time.RFC3339Nano, since)
+			_, durationErr := time.ParseDuration(since)
+			_, unixErr := strconv.ParseFloat(since, 64)
+			if timeErr != nil && durationErr != nil && unixErr != nil {
+				c.String(http.StatusBadRequest, "The since time must be a timestamp or a duration such as 10m.")
+				return
+			}
+		}
+
+		tail := c.Query("tail")
+		if tail != "" && tail != "all" {
+			if n, err := strconv.Atoi(tail); err != nil || n < 0 {
+				c.String(http.StatusBadRequest, "The tail must be a number of lines or all.")
+				return
+			}
+		}
+
+		replica := 0
+		if r := c.Query("replica"); r != "" {
+			n, err := strconv.Atoi(r)
+			if err != nil || n < 1 {
+				c.String(http.StatusBadRequest, "The replica must be a number from 1.")
+				return
+			}
+			replica = n
+		}
+
+		// Each process type has its own service, and the web process is the one
+		// that is read from unless another is asked for.
+		process := c.DefaultQuery("process", docker.ProcessWeb)
+		if _, ok := deployment.ProcessTypes()[process]; !ok {
+			c.String(http.StatusNotFound, "The deployment has no %s process type.", process)
+			return
+		}
+		service := deployment.ServiceName(process)
+		if !docker.ServiceExists(service) {
+			c.String(http.StatusNotFound, "The %s process of the deployment is not running.", process)
+			return
+		}
+
+		// The time of each line is always read, so that events have it even if
+		// the client doesn't want it in the text.
+		lines, errs := docker.ServiceLogs(c.Request.Context(), service, docker.LogOptions{
+			Follow:     follow,
+			Since:      since,
+			Tail:       tail,
+			Timestamps: true,
+		})
+
+		started := false
+		start := func() {
+			if started {
+				return
+			}
+			started = true
+			if follow {
+				c.Header("Content-Type", "text/event-stream")
+				c.Header("Cache-Control", "no-cache")
+			} else {
+				c.Header("Content-Type", "text/plain; charset=utf-8")
+			}
+			c.Status(http.StatusOK)
+		}
+		if follow {
+			start()
+			c.Writer.Flush()
+		}
+
+		for line := range lines {
+			if replica != 0 && line.Replica != replica {
+				continue
+			}
+			start()
+			if follow {
+				c.SSEvent("log", line)
+			} else if timestamps {
+				fmt.Fprintf(c.Writer, "%s %s | %s\n", line.Time.Format(time.RFC3339Nano), line.Source(), line.Message)
+			} else {
+				fmt.Fprintf(c.Writer, "%s | %s\n", line.Source(), line.Message)
+			}
+			c.Writer.Flush()
+		}
+
+		if err := <-errs; err != nil {
+			log.Printf("[ERR] deployment: Could not read the logs of %s: %s", deployment.ID, err)
+			if !started {
+				c.String(http.StatusBadGateway, "Could not read the logs of the deployment.")
+				return
+			}
+			if follow {
+				c.SSEvent("error", "Could not read the logs of the deployment.")
+			}
+			return
+		}
+		if c.Request.Context().Err() != nil {
+			return // The client has gone away
+		}
+
+		start()
+		if follow {
+			c.SSEvent("end", "")
+		}
+	}
+}
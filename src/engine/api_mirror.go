@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hideUpstream removes the credentials of the upstream so that it can be sent
+// back to the client. Like secrets, they can be written but never read.
+func hideUpstream(u *Upstream) *Upstream {
+	if u == nil {
+		return nil
+	}
+	hidden := *u
+	hidden.Token = ""
+	hidden.DeployKey = ""
+	return &hidden
+}
+
+// findRepository finds the repository with the ID given in the URL and checks
+// that the user has the role in its namespace. It responds with an error and
+// returns nil if either fails.
+func (s *APIServer) findRepository(c *gin.Context, role Role) *Repository {
+	store := s.engine.Store
+	id := c.Param("id")
+
+	var repo *Repository
+	for _, r := range store.state.Repositories {
+		if r.ID == id {
+			repo = &r
+			break
+		}
+	}
+	if repo == nil {
+		c.String(http.StatusNotFound, "A repo with the ID of %s does not exist", id)
+		return nil
+	}
+
+	if !s.authorize(c, repo.NamespaceID, role) {
+		return nil
+	}
+	return repo
+}
+
+func (s *APIServer) handleRepositoryUpstreamSet() gin.HandlerFunc {
+	type body struct {
+		URL       string `json:"url"`
+		Username  string `json:"username"`
+		Token     string `json:"token"`
+		DeployKey string `json:"deploy_key"`
+		Interval  int    `json:"interval"`
+	}
+
+	return func(c *gin.Context) {
+		repo := s.findRepository(c, RoleDeveloper)
+		if repo == nil {
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The upstream details are invalid.")
+			return
+		}
+
+		upstream := Upstream{
+			URL:       body.URL,
+			Username:  body.Username,
+			Token:     body.Token,
+			DeployKey: body.DeployKey,
+			Interval:  body.Interval,
+		}
+		if err := upstream.Validate(); err != nil {
+			c.String(http.StatusBadRequest, "The upstream can't be used: %s.", err)
+			return
+		}
+
+		// A local upstream could be any repository on the node, including the
+		// ones in other namespaces, so only admins can mirror one.
+		if upstream.Local() && !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		cmd := command{
+			Op: opSetRepositoryUpstream,
+			Repository: Repository{
+				ID:       repo.ID,
+				Upstream: &upstream,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply repository upstream: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the upstream of the repository.")
+			return
+		}
+
+		// Fetch the upstream straight away, rather than waiting for the watcher.
+		repo.Upstream = &upstream
+		go func(actor Actor) {
+			if _, _, err := s.engine.SyncMirror(*repo, actor); err != nil {
+				log.Printf("[ERR] mirror: Could not sync repository %s: %s", repo.ID, err)
+			}
+		}(requestActor(c))
+
+		c.JSON(http.StatusOK, hideUpstream(&upstream))
+	}
+}
+
+func (s *APIServer) handleRepositoryUpstreamRemove() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo := s.findRepository(c, RoleDeveloper)
+		if repo == nil {
+			return
+		}
+
+		// The branches that have been fetched are kept, so that the repository can
+		// carry on being pushed to directly.
+		cmd := command{
+			Op:         opSetRepositoryUpstream,
+			Repository: Repository{ID: repo.ID},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply repository upstream removal: %s", err)
+			c.String(http.StatusInternalServerError, "Could not remove the upstream of the repository.")
+			return
+		}
+
+		c.String(http.StatusOK, repo.ID)
+	}
+}
+
+func (s *APIServer) handleRepositoryFetch() gin.HandlerFunc {
+	type res struct {
+		Refs        []gitRefUpdate `json:"refs"`        // The branches that moved
+		Deployments []string       `json:"deployments"` // The deployments that are being built
+	}
+
+	return func(c *gin.Context) {
+		repo := s.findRepository(c, RoleDeveloper)
+		if repo == nil {
+			return
+		}
+		if repo.Upstream == nil {
+			c.String(http.StatusBadRequest, "The repository does not have an upstream to fetch from.")
+			return
+		}
+
+		refs, deployments, err := s.engine.SyncMirror(*repo, requestActor(c))
+		if err != nil {
+			log.Printf("[ERR] mirror: Could not sync repository %s: %s", repo.ID, err)
+			c.String(http.StatusBadGateway, "Could not fetch the upstream of the repository.")
+			return
+		}
+
+		res := res{Refs: refs, Deployments: []string{}}
+		for _, d := range deployments {
+			res.Deployments = append(res.Deployments, d.ID)
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,555 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcLoginPath is where the user is sent once they have logged in with an
+// identity provider. The session token is passed in the fragment so that it is
+// never sent to a server, and the console picks it up from there.
+const oidcLoginPath = "/login"
+
+const (
+	// oidcStartLimit is the number of logins with an identity provider that a
+	// single IP address can start in each oidcStartWindow.
+	oidcStartLimit  = 10
+	oidcStartWindow = time.Minute
+
+	// oidcPendingLimit is the most logins with an identity provider that can be
+	// in progress across the cluster, as each one is kept in the store until it
+	// is completed or expires.
+	oidcPendingLimit = 1000
+)
+
+// oidcStart is the number of logins an IP address has started since the start
+// of its current window.
+type oidcStart struct {
+	count int
+	since time.Time
+}
+
+// allowOIDCStart records that the IP address is starting a login with an
+// identity provider, and returns whether or not it is within the limit.
+func (s *APIServer) allowOIDCStart(ip string, now time.Time) bool {
+	s.oidcMu.Lock()
+	defer s.oidcMu.Unlock()
+
+	// Forget the windows that have passed so that the map doesn't grow forever.
+	for key, start := range s.oidcStarts {
+		if now.Sub(start.since) >= oidcStartWindow {
+			delete(s.oidcStarts, key)
+		}
+	}
+
+	start, ok := s.oidcStarts[ip]
+	if !ok {
+		start = oidcStart{since: now}
+	}
+	if start.count >= oidcStartLimit {
+		return false
+	}
+	start.count++
+	s.oidcStarts[ip] = start
+	return true
+}
+
+// usernameInvalidChars matches the characters that can't be used in usernames
+// created from identity provider accounts.
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// oidcProviderBody is the body used to create and update identity providers.
+type oidcProviderBody struct {
+	Name          string   `form:"name" json:"name"`
+	Issuer        string   `form:"issuer" json:"issuer"`
+	ClientID      string   `form:"client_id" json:"client_id"`
+	ClientSecret  string   `form:"client_secret" json:"client_secret"`
+	RedirectURL   string   `form:"redirect_url" json:"redirect_url"`
+	Scopes        []string `form:"scopes" json:"scopes"`
+	GroupsClaim   string   `form:"groups_claim" json:"groups_claim"`
+	GroupMappings []struct {
+		Group     string `json:"group"`
+		Namespace string `json:"namespace"` // Name or ID
+		Role      Role   `json:"role"`
+	} `json:"group_mappings"`
+}
+
+// provider validates the body and applies it to the provider. It returns a
+// message describing the problem if the body is invalid.
+func (b oidcProviderBody) provider(state *StoreState, p *OIDCProvider) (int, string) {
+	if b.Name == "" || b.Issuer == "" || b.ClientID == "" || b.RedirectURL == "" {
+		return http.StatusBadRequest, "You must supply a name, issuer, client ID and redirect URL."
+	}
+	if existing := state.OIDCProviders.Find(b.Name); existing != nil && existing.ID != p.ID {
+		return http.StatusConflict, "An identity provider with that name already exists."
+	}
+	if _, err := url.Parse(b.RedirectURL); err != nil {
+		return http.StatusBadRequest, "The redirect URL is invalid."
+	}
+
+	mappings := []OIDCGroupMapping{}
+	for _, m := range b.GroupMappings {
+		namespace := state.Namespaces.Find(m.Namespace)
+		if namespace == nil {
+			return http.StatusNotFound, fmt.Sprintf("No namespace with the name or ID %s could be found.", m.Namespace)
+		}
+		if m.Group == "" || m.Role.level() == 0 {
+			return http.StatusBadRequest, "Each group mapping needs a group and a role of VIEWER, DEVELOPER, ADMIN or OWNER."
+		}
+		mappings = append(mappings, OIDCGroupMapping{
+			Group:       m.Group,
+			NamespaceID: namespace.ID,
+			Role:        m.Role,
+		})
+	}
+
+	// Make sure that the issuer can actually be used before saving it.
+	if _, err := discoverOIDC(b.Issuer); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Could not use that issuer: %s.", err)
+	}
+
+	p.Name = b.Name
+	p.Issuer = strings.TrimSuffix(b.Issuer, "/")
+	p.ClientID = b.ClientID
+	if b.ClientSecret != "" {
+		p.ClientSecret = b.ClientSecret
+	}
+	p.RedirectURL = b.RedirectURL
+	p.Scopes = b.Scopes
+	p.GroupsClaim = b.GroupsClaim
+	p.GroupMappings = mappings
+
+	return http.StatusOK, ""
+}
+
+func (s *APIServer) handleListOIDCProviders() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type provider struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	return func(c *gin.Context) {
+		// Anybody can see which providers they can log in with, but only admins
+		// can see how they have been configured.
+		if currentUser(c) == nil || !s.allowed(c, "", RoleAdmin) {
+			providers := []provider{}
+			for _, p := range store.state.OIDCProviders {
+				providers = append(providers, provider{ID: p.ID, Name: p.Name})
+			}
+			c.JSON(http.StatusOK, providers)
+			return
+		}
+
+		// The client secret is never shown.
+		providers := []OIDCProvider{}
+		for _, p := range store.state.OIDCProviders {
+			p.ClientSecret = ""
+			providers = append(providers, p)
+		}
+		c.JSON(http.StatusOK, providers)
+	}
+}
+
+func (s *APIServer) handleOIDCProviderAdd() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		var body oidcProviderBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The identity provider details are invalid.")
+			return
+		}
+
+		p := OIDCProvider{ID: store.state.OIDCProviders.GenerateID()}
+		if status, msg := body.provider(store.state, &p); msg != "" {
+			c.String(status, msg)
+			return
+		}
+
+		cmd := command{
+			Op:           opNewOIDCProvider,
+			OIDCProvider: p,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply new identity provider: %s", err)
+			c.String(http.StatusInternalServerError, "Could not add the identity provider.")
+			return
+		}
+
+		p.ClientSecret = ""
+		c.JSON(http.StatusCreated, p)
+	}
+}
+
+func (s *APIServer) handleOIDCProviderUpdate() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		p := store.state.OIDCProviders.Find(c.Param("id"))
+		if p == nil {
+			c.String(http.StatusNotFound, "That identity provider doesn't exist.")
+			return
+		}
+
+		var body oidcProviderBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The identity provider details are invalid.")
+			return
+		}
+
+		// The client secret is left alone if a new one isn't provided, as it's
+		// never shown to be sent back.
+		if status, msg := body.provider(store.state, p); msg != "" {
+			c.String(status, msg)
+			return
+		}
+
+		cmd := command{
+			Op:           opUpdateOIDCProvider,
+			OIDCProvider: *p,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply identity provider update: %s", err)
+			c.String(http.StatusInternalServerError, "Could not update the identity provider.")
+			return
+		}
+
+		p.ClientSecret = ""
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+func (s *APIServer) handleOIDCProviderRemove() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		if !s.authorize(c, "", RoleAdmin) {
+			return
+		}
+
+		p := store.state.OIDCProviders.Find(c.Param("id"))
+		if p == nil {
+			c.String(http.StatusNotFound, "That identity provider doesn't exist.")
+			return
+		}
+
+		cmd := command{
+			Op:           opRemoveOIDCProvider,
+			OIDCProvider: OIDCProvider{ID: p.ID},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply identity provider removal: %s", err)
+			c.String(http.StatusInternalServerError, "Could not remove the identity provider.")
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+func (s *APIServer) handleOIDCLogin() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		// Every login is applied to the store, so anonymous clients can't be
+		// allowed to start them as fast as they like.
+		if !s.allowOIDCStart(clientIP(c), time.Now()) {
+			c.Header("Retry-After", strconv.Itoa(int(oidcStartWindow.Seconds())))
+			c.String(http.StatusTooManyRequests, "Too many logins have been started. Please try again later.")
+			return
+		}
+
+		store.mu.RLock()
+		p := store.state.OIDCProviders.Find(c.Param("provider"))
+		pending := len(store.state.OIDCLogins)
+		store.mu.RUnlock()
+		if p == nil {
+			c.String(http.StatusNotFound, "That identity provider doesn't exist.")
+			return
+		}
+		if pending >= oidcPendingLimit {
+			c.String(http.StatusServiceUnavailable, "Too many logins are in progress. Please try again later.")
+			return
+		}
+
+		d, err := discoverOIDC(p.Issuer)
+		if err != nil {
+			log.Printf("[ERR] oidc: Could not discover %s: %s", p.Issuer, err)
+			c.String(http.StatusBadGateway, "Could not reach the identity provider.")
+			return
+		}
+
+		// Keep track of the login so that the callback can be checked against it.
+		// This is in the store as the callback might not arrive at this node.
+		cmd := command{
+			Op:        opNewOIDCLogin,
+			OIDCLogin: GenerateOIDCLogin(p.ID),
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply new identity provider login: %s", err)
+			c.String(http.StatusInternalServerError, "Can't update store.")
+			return
+		}
+
+		c.Redirect(http.StatusFound, d.AuthURL(*p, cmd.OIDCLogin))
+	}
+}
+
+func (s *APIServer) handleOIDCCallback() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		state := c.Query("state")
+		if state == "" {
+			c.String(http.StatusBadRequest, "The login is missing its state.")
+			return
+		}
+
+		store.mu.RLock()
+		login := store.state.OIDCLogins.Find(state)
+		store.mu.RUnlock()
+		if login == nil {
+			c.String(http.StatusBadRequest, "That login has expired. Please log in again.")
+			return
+		}
+
+		// Each login can only be completed once, whether or not it succeeds.
+		cmd := command{
+			Op:        opRemoveOIDCLogin,
+			OIDCLogin: OIDCLogin{State: login.State},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply identity provider login removal: %s", err)
+			c.String(http.StatusInternalServerError, "Can't update store.")
+			return
+		}
+
+		if e := c.Query("error"); e != "" {
+			c.String(http.StatusUnauthorized, "The identity provider did not log you in: %s", e)
+			return
+		}
+
+		p := store.state.OIDCProviders.Find(login.ProviderID)
+		if p == nil {
+			c.String(http.StatusNotFound, "That identity provider doesn't exist.")
+			return
+		}
+
+		// Trade the code for an ID token and check that it's genuine.
+		d, err := discoverOIDC(p.Issuer)
+		if err != nil {
+			log.Printf("[ERR] oidc: Could not discover %s: %s", p.Issuer, err)
+			c.String(http.StatusBadGateway, "Could not reach the identity provider.")
+			return
+		}
+		idToken, err := d.Exchange(*p, c.Query("code"), login.Verifier)
+		if err != nil {
+			log.Printf("[ERR] oidc: Could not exchange code with %s: %s", p.Issuer, err)
+			c.String(http.StatusBadGateway, "Could not log in with the identity provider.")
+			return
+		}
+		claims, err := d.Verify(*p, idToken, login.Nonce)
+		if err != nil {
+			log.Printf("[ERR] oidc: Rejected ID token from %s: %s", p.Issuer, err)
+			c.String(http.StatusUnauthorized, "The identity provider sent an invalid login.")
+			return
+		}
+
+		user, status, msg := s.oidcUser(c, *p, claims)
+		if user == nil {
+			c.String(status, msg)
+			return
+		}
+
+		s.syncOIDCRoles(c, *p, user.ID, claims.Groups(p.GroupsClaim))
+
+		// Log them in.
+		cmd = command{
+			Op:      opNewSession,
+			User:    User{ID: user.ID},
+			Session: s.newSession(c, user),
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply new session to user: %s", err)
+			c.String(http.StatusInternalServerError, "Can't update store.")
+			return
+		}
+		if !s.awaitSession(cmd.Session.Token) {
+			c.String(http.StatusUnauthorized, "Could not log you in. Please try again.")
+			return
+		}
+
+		setSessionCookie(c, cmd.Session.Token)
+		c.Redirect(http.StatusFound, oidcLoginPath+"#token="+cmd.Session.Token)
+	}
+}
+
+// oidcUser finds the user linked to the identity provider account. If there
+// isn't one, then a user with the same verified email address is linked, or a
+// new user is created just in time. On failure, it returns the status and the
+// message to respond with.
+func (s *APIServer) oidcUser(c *gin.Context, p OIDCProvider, claims *oidcClaims) (*User, int, string) {
+	store := s.engine.Store
+	identity := Identity{ProviderID: p.ID, Subject: claims.Subject}
+
+	store.mu.RLock()
+	user := store.state.Users.FindByIdentity(identity.ProviderID, identity.Subject)
+	store.mu.RUnlock()
+	if user != nil {
+		return user, 0, ""
+	}
+
+	if claims.Email == "" {
+		return nil, http.StatusBadRequest, "The identity provider didn't share your email address."
+	}
+
+	// Link the account to an existing user with the same email address, but only
+	// if the provider has verified that it belongs to them.
+	store.mu.RLock()
+	user = store.state.Users.Find(claims.Email)
+	store.mu.RUnlock()
+	if user != nil && !claims.Verified() {
+		return nil, http.StatusConflict, "An account with that email address already exists."
+	}
+
+	if user == nil {
+		// Create the user. They can only log in through the provider, so their
+		// password is random.
+		b := make([]byte, 32)
+		rand.Read(b)
+
+		store.mu.RLock()
+		newUser, err := store.state.Users.Generate(UserConfig{
+			Name:     oidcName(claims),
+			Username: s.oidcUsername(claims),
+			Password: hex.EncodeToString(b),
+			Email:    claims.Email,
+		})
+		store.mu.RUnlock()
+		if err != nil {
+			log.Printf("[ERR] oidc: Could not generate user: %s", err)
+			return nil, http.StatusConflict, "Could not create an account for you."
+		}
+
+		cmd := command{
+			Op:   opNewUser,
+			User: *newUser,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not perform apply: %s", err)
+			return nil, http.StatusInternalServerError, "Could not create an account for you."
+		}
+		user = newUser
+	}
+
+	cmd := command{
+		Op:       opLinkIdentity,
+		User:     User{ID: user.ID},
+		Identity: identity,
+	}
+	if err := s.apply(c, &cmd); err != nil {
+		log.Printf("[ERR] store: Could not apply identity link: %s", err)
+		return nil, http.StatusInternalServerError, "Could not link your account."
+	}
+
+	return user, 0, ""
+}
+
+// oidcName returns the name to give a user created from the claims.
+func oidcName(claims *oidcClaims) string {
+	if claims.Name != "" {
+		return claims.Name
+	}
+	if claims.PreferredUsername != "" {
+		return claims.PreferredUsername
+	}
+	return strings.Split(claims.Email, "@")[0]
+}
+
+// oidcUsername returns an available username for a user created from the
+// claims. A number is added to the end if the username has been taken.
+func (s *APIServer) oidcUsername(claims *oidcClaims) string {
+	store := s.engine.Store
+
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	base = usernameInvalidChars.ReplaceAllString(strings.ToLower(base), "")
+	if base == "" {
+		base = "user"
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	username := base
+	for i := 2; store.state.Users.Find(username) != nil; i++ {
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	return username
+}
+
+// syncOIDCRoles grants the user the roles that their groups are mapped to, and
+// revokes the roles in the mapped namespaces that their groups no longer give
+// them. Roles in namespaces that the provider doesn't map are left alone.
+func (s *APIServer) syncOIDCRoles(c *gin.Context, p OIDCProvider, userID string, groups []string) {
+	store := s.engine.Store
+
+	// The users of a cluster from before roles existed are only made owners if
+	// nobody has been granted a role yet, so a mapping can't be applied first.
+	store.mu.RLock()
+	migrated := store.state.RolesMigrated
+	store.mu.RUnlock()
+	if !migrated {
+		log.Printf("[WARN] oidc: Not applying group mappings as the roles of existing users have not been migrated yet")
+		return
+	}
+
+	for namespaceID, role := range p.Roles(groups) {
+		store.mu.RLock()
+		current := store.state.RoleBindings.Find(userID, namespaceID)
+		store.mu.RUnlock()
+		if current == role {
+			continue
+		}
+
+		// Never take the cluster away from its only owner.
+		store.mu.RLock()
+		lastOwner := namespaceID == store.state.systemNamespaceID() && store.state.LastOwner(userID)
+		store.mu.RUnlock()
+		if lastOwner {
+			continue
+		}
+
+		binding := RoleBinding{UserID: userID, NamespaceID: namespaceID, Role: role}
+		cmd := command{Op: opGrantRole, RoleBinding: binding}
+		if role == "" {
+			cmd.Op = opRevokeRole
+		}
+
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply role from identity provider: %s", err)
+		}
+	}
+}
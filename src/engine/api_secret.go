@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secretValueLimit is the largest value that a secret can have, which is the
+// limit that docker has for its own secrets.
+const secretValueLimit = 500 * 1024
+
+// hideSecret removes the value of the secret so that it can be sent back to
+// the client. Secret values can be written through the API, but never read.
+func hideSecret(s Secret) Secret {
+	s.Value = ""
+	return s
+}
+
+// warn adds a warning to a response for a request that was carried out, but
+// that had a side effect that wasn't. It is sent as a Warning header, so that
+// the body is the same as when everything worked.
+func warn(c *gin.Context, message string) {
+	c.Writer.Header().Add("Warning", fmt.Sprintf("199 orbit %q", message))
+}
+
+func (s *APIServer) handleListSecrets() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		secrets := Secrets{}
+		for _, secret := range store.state.Secrets {
+			if s.allowed(c, secret.NamespaceID, RoleViewer) {
+				secrets = append(secrets, hideSecret(secret))
+			}
+		}
+
+		c.JSON(http.StatusOK, secrets)
+	}
+}
+
+func (s *APIServer) handleSecretGet() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		secret := store.state.Secrets.Find("", c.Param("id"))
+		if secret == nil {
+			c.String(http.StatusNotFound, "No secret with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, secret.NamespaceID, RoleViewer) {
+			return
+		}
+
+		c.JSON(http.StatusOK, hideSecret(*secret))
+	}
+}
+
+func (s *APIServer) handleSecretAdd() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Name      string `form:"name" json:"name"`
+		Value     string `form:"value" json:"value"`
+		Namespace string `form:"namespace" json:"namespace"`
+	}
+
+	return func(c *gin.Context) {
+		var body body
+		c.ShouldBind(&body)
+
+		// Search for the namespace.
+		var namespaceID string
+		namespace := store.state.Namespaces.Find(body.Namespace)
+		if namespace != nil {
+			namespaceID = namespace.ID
+		}
+
+		if !s.authorize(c, namespaceID, RoleDeveloper) {
+			return
+		}
+
+		if !secretNameFormat.MatchString(body.Name) {
+			c.String(http.StatusBadRequest, "You must supply a name made up of letters, numbers, dots, dashes and underscores.")
+			return
+		}
+		if len(body.Value) > secretValueLimit {
+			c.String(http.StatusBadRequest, "The value of a secret can't be larger than %d bytes.", secretValueLimit)
+			return
+		}
+		if existing := store.state.Secrets.Find(namespaceID, body.Name); existing != nil && existing.NamespaceID == namespaceID {
+			c.String(http.StatusConflict, "A secret with that name already exists in the namespace.")
+			return
+		}
+
+		now := time.Now()
+		secret := Secret{
+			ID:          store.state.Secrets.GenerateID(),
+			Name:        body.Name,
+			Value:       body.Value,
+			Version:     1,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			NamespaceID: namespaceID,
+		}
+
+		cmd := command{
+			Op:     opNewSecret,
+			Secret: secret,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply new secret: %s", err)
+			c.String(http.StatusInternalServerError, "Could not add the secret.")
+			return
+		}
+
+		c.JSON(http.StatusCreated, hideSecret(secret))
+	}
+}
+
+func (s *APIServer) handleSecretUpdate() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Name  *string `json:"name"`
+		Value *string `json:"value"`
+	}
+
+	return func(c *gin.Context) {
+		secret := store.state.Secrets.Find("", c.Param("id"))
+		if secret == nil {
+			c.String(http.StatusNotFound, "No secret with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, secret.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The secret details are invalid.")
+			return
+		}
+
+		if body.Name != nil && *body.Name != secret.Name {
+			if !secretNameFormat.MatchString(*body.Name) {
+				c.String(http.StatusBadRequest, "The name can only be made up of letters, numbers, dots, dashes and underscores.")
+				return
+			}
+			if existing := store.state.Secrets.Find(secret.NamespaceID, *body.Name); existing != nil && existing.NamespaceID == secret.NamespaceID {
+				c.String(http.StatusConflict, "A secret with that name already exists in the namespace.")
+				return
+			}
+			secret.Name = *body.Name
+		}
+
+		// Every new value is a new version, so that the services using the secret
+		// as a file get a new docker secret.
+		if body.Value != nil {
+			if len(*body.Value) > secretValueLimit {
+				c.String(http.StatusBadRequest, "The value of a secret can't be larger than %d bytes.", secretValueLimit)
+				return
+			}
+			secret.Value = *body.Value
+			secret.Version++
+		}
+		secret.UpdatedAt = time.Now()
+
+		cmd := command{
+			Op:     opUpdateSecret,
+			Secret: *secret,
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply secret update: %s", err)
+			c.String(http.StatusInternalServerError, "Could not update the secret.")
+			return
+		}
+
+		// Roll the services that use the secret over to the new value. The secret
+		// has been updated by now, so a service that can't be is only a warning.
+		if body.Value != nil {
+			store.mu.RLock()
+			used := store.state.Deployments.UsedBy(secret.ID)
+			store.mu.RUnlock()
+			for _, d := range used {
+				if err := s.engine.Redeploy(d); err != nil {
+					log.Printf("[ERR] deployment: %s", err)
+					warn(c, fmt.Sprintf("The secret was updated, but the service of deployment %s could not be.", d.Name))
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, hideSecret(*secret))
+	}
+}
+
+func (s *APIServer) handleSecretRemove() gin.HandlerFunc {
+	store := s.engine.Store
+
+	return func(c *gin.Context) {
+		secret := store.state.Secrets.Find("", c.Param("id"))
+		if secret == nil {
+			c.String(http.StatusNotFound, "No secret with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, secret.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		// Removing a secret that a deployment relies on would break its next
+		// build, so it has to be detached first.
+		if used := store.state.Deployments.UsedBy(secret.ID); len(used) > 0 {
+			c.String(http.StatusConflict, "The secret is still attached to the deployment %s.", used[0].Name)
+			return
+		}
+
+		cmd := command{
+			Op:     opRemoveSecret,
+			Secret: Secret{ID: secret.ID},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply secret removal: %s", err)
+			c.String(http.StatusInternalServerError, "Could not remove the secret.")
+			return
+		}
+
+		removeSecretVersions(secret.ID, "")
+		c.String(http.StatusOK, secret.ID)
+	}
+}
+
+func (s *APIServer) handleDeploymentSecrets() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type body struct {
+		Secrets []struct {
+			Secret string `json:"secret"` // Name or ID
+			Env    string `json:"env"`
+			Path   string `json:"path"`
+		} `json:"secrets"`
+	}
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		var body body
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "The secrets are invalid.")
+			return
+		}
+
+		// Every secret has to be in the namespace of the deployment, and no two
+		// secrets can be attached with the same name or path.
+		refs := []SecretRef{}
+		used := map[string]bool{}
+		for _, b := range body.Secrets {
+			secret := store.state.Secrets.Find(deployment.NamespaceID, b.Secret)
+			if secret == nil || secret.NamespaceID != deployment.NamespaceID {
+				c.String(http.StatusNotFound, "No secret %s exists in the namespace of the deployment.", b.Secret)
+				return
+			}
+
+			ref := SecretRef{SecretID: secret.ID, Env: b.Env, Path: b.Path}
+			if err := ref.Validate(); err != nil {
+				c.String(http.StatusBadRequest, "Could not attach secret %s: %s.", secret.Name, err)
+				return
+			}
+			if (ref.Env != "" && used["env:"+ref.Env]) || (ref.Path != "" && used["path:"+ref.Path]) {
+				c.String(http.StatusBadRequest, "Secret %s is attached with a name or path that is already used.", secret.Name)
+				return
+			}
+			used["env:"+ref.Env] = true
+			used["path:"+ref.Path] = true
+
+			refs = append(refs, ref)
+		}
+
+		cmd := command{
+			Op: opSetDeploymentSecrets,
+			Deployment: Deployment{
+				ID:      deployment.ID,
+				Secrets: refs,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment secrets: %s", err)
+			c.String(http.StatusInternalServerError, "Could not attach the secrets to the deployment.")
+			return
+		}
+
+		// Roll the running service over to the new secrets. They have been
+		// attached by now, so a service that can't be updated is only a warning.
+		deployment.Secrets = refs
+		if err := s.engine.Redeploy(*deployment); err != nil {
+			log.Printf("[ERR] deployment: %s", err)
+			warn(c, "The secrets were attached, but the service could not be updated.")
+		}
+
+		c.JSON(http.StatusOK, refs)
+	}
+}
@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookBodyLimit is the largest webhook body that is accepted. Push events
+// list the commits that were pushed, so they can be fairly large.
+const webhookBodyLimit = 5 * 1024 * 1024
+
+// webhookPush is a push event from a git host, with just the details needed to
+// build it.
+type webhookPush struct {
+	Ref           string // The ref that was pushed to, such as "refs/heads/main"
+	After         string // The commit that the ref now points to
+	CloneURL      string // Where the commit can be fetched from
+	DefaultBranch string // The default branch of the repository on the host
+}
+
+// Branch returns the branch that was pushed to, or an empty string if it wasn't
+// a branch (such as a tag) or the branch was deleted.
+func (p webhookPush) Branch() string {
+	if !strings.HasPrefix(p.Ref, "refs/heads/") || p.After == "" || p.After == gitZeroRev {
+		return ""
+	}
+	return strings.TrimPrefix(p.Ref, "refs/heads/")
+}
+
+// hideDeployment removes the webhook secret of the deployment so that it can be
+// sent back to the client. It is only shown when it is generated.
+func hideDeployment(d Deployment) Deployment {
+	d.WebhookSecret = ""
+	return d
+}
+
+// webhookDeployment finds the deployment that a webhook is for, and reads the
+// body of the request. It responds with an error and returns nil if it can't.
+func (s *APIServer) webhookDeployment(c *gin.Context) (*Deployment, []byte) {
+	store := s.engine.Store
+	id := c.Param("deployment")
+
+	var deployment *Deployment
+	for _, d := range store.state.Deployments {
+		if d.ID == id {
+			deployment = &d
+			break
+		}
+	}
+
+	// A deployment without a secret doesn't accept webhooks, so it looks the
+	// same as one that doesn't exist.
+	if deployment == nil || deployment.WebhookSecret == "" {
+		c.String(http.StatusNotFound, "No deployment with that ID accepts webhooks.")
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, webhookBodyLimit))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Could not read the webhook body.")
+		return nil, nil
+	}
+
+	return deployment, body
+}
+
+func (s *APIServer) handleGitHubWebhook() gin.HandlerFunc {
+	type payload struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Repository struct {
+			CloneURL      string `json:"clone_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"repository"`
+	}
+
+	return func(c *gin.Context) {
+		deployment, body := s.webhookDeployment(c)
+		if deployment == nil {
+			return
+		}
+
+		// GitHub signs the body with the secret.
+		mac := hmac.New(sha256.New, []byte(deployment.WebhookSecret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		signature := c.GetHeader("X-Hub-Signature-256")
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			log.Printf("[ERR] webhook: Invalid GitHub signature for deployment %s", deployment.ID)
+			c.String(http.StatusUnauthorized, "The webhook signature is invalid.")
+			return
+		}
+
+		switch event := c.GetHeader("X-GitHub-Event"); event {
+		case "ping":
+			c.String(http.StatusOK, "Pong.")
+			return
+		case "push":
+		default:
+			c.String(http.StatusOK, "Ignoring the %s event.", event)
+			return
+		}
+
+		var p payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			c.String(http.StatusBadRequest, "The push event is invalid.")
+			return
+		}
+
+		s.handleWebhookPush(c, *deployment, webhookPush{
+			Ref:           p.Ref,
+			After:         p.After,
+			CloneURL:      p.Repository.CloneURL,
+			DefaultBranch: p.Repository.DefaultBranch,
+		})
+	}
+}
+
+func (s *APIServer) handleGitLabWebhook() gin.HandlerFunc {
+	type payload struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Project struct {
+			GitHTTPURL    string `json:"git_http_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"project"`
+	}
+
+	return func(c *gin.Context) {
+		deployment, body := s.webhookDeployment(c)
+		if deployment == nil {
+			return
+		}
+
+		// GitLab sends the secret as it is.
+		token := c.GetHeader("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(deployment.WebhookSecret)) != 1 {
+			log.Printf("[ERR] webhook: Invalid GitLab token for deployment %s", deployment.ID)
+			c.String(http.StatusUnauthorized, "The webhook token is invalid.")
+			return
+		}
+
+		if event := c.GetHeader("X-Gitlab-Event"); event != "Push Hook" {
+			c.String(http.StatusOK, "Ignoring the %s event.", event)
+			return
+		}
+
+		var p payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			c.String(http.StatusBadRequest, "The push event is invalid.")
+			return
+		}
+
+		s.handleWebhookPush(c, *deployment, webhookPush{
+			Ref:           p.Ref,
+			After:         p.After,
+			CloneURL:      p.Project.GitHTTPURL,
+			DefaultBranch: p.Project.DefaultBranch,
+		})
+	}
+}
+
+// handleWebhookPush fetches the commit that was pushed into the repository of
+// the deployment, and queues a build if it was pushed to the branch that the
+// deployment uses. Git hosts only wait a few seconds for a response, so the
+// build isn't waited for.
+func (s *APIServer) handleWebhookPush(c *gin.Context, d Deployment, p webhookPush) {
+	engine := s.engine
+	store := engine.Store
+
+	branch := p.Branch()
+	if branch == "" {
+		c.String(http.StatusOK, "Ignoring the push, as it isn't to a branch.")
+		return
+	}
+	deploymentBranch := d.Branch
+	if deploymentBranch == "" {
+		deploymentBranch = p.DefaultBranch
+	}
+	if branch != deploymentBranch {
+		c.String(http.StatusOK, "Ignoring the push to %s, as the deployment uses %s.", branch, deploymentBranch)
+		return
+	}
+
+	// Bring the commit into the repository that builds are made from.
+	var repo *Repository
+	for _, r := range store.state.Repositories {
+		if r.ID == d.Repository {
+			repo = &r
+			break
+		}
+	}
+	if repo == nil {
+		c.String(http.StatusNotFound, "The repository of the deployment does not exist.")
+		return
+	}
+
+	// A mirror is fetched from its own upstream with its credentials, which
+	// queues a build of every deployment that uses a branch that moved.
+	if repo.Upstream != nil {
+		if _, _, err := engine.SyncMirror(*repo, requestActor(c)); err != nil {
+			log.Printf("[ERR] webhook: Could not sync mirror %s: %s", repo.ID, err)
+			c.String(http.StatusBadGateway, "Could not fetch the upstream of the repository.")
+			return
+		}
+		c.String(http.StatusAccepted, "Building %s.", p.After)
+		return
+	}
+
+	if err := store.FetchRepository(*repo, p.CloneURL, branch); err != nil {
+		log.Printf("[ERR] webhook: Could not fetch %s into repository %s: %s", branch, repo.ID, err)
+		c.String(http.StatusBadGateway, "Could not fetch the pushed commit.")
+		return
+	}
+
+	build, err := engine.QueueBuild(d, requestActor(c))
+	if err != nil {
+		log.Printf("[ERR] webhook: Could not queue build of deployment %s: %s", d.ID, err)
+		c.String(http.StatusInternalServerError, "Could not queue the build of the deployment.")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, build)
+}
+
+func (s *APIServer) handleDeploymentWebhook() gin.HandlerFunc {
+	store := s.engine.Store
+
+	type res struct {
+		Secret    string `json:"secret"`
+		GitHubURL string `json:"github_url"`
+		GitLabURL string `json:"gitlab_url"`
+	}
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		// Find the ID of the deployment provided.
+		var deployment *Deployment
+		for _, d := range store.state.Deployments {
+			if d.ID == id {
+				deployment = &d
+				break
+			}
+		}
+		if deployment == nil {
+			c.String(http.StatusNotFound, "No deployment with that ID exists.")
+			return
+		}
+
+		if !s.authorize(c, deployment.NamespaceID, RoleDeveloper) {
+			return
+		}
+
+		// A new secret replaces the old one, which stops working straight away.
+		b := make([]byte, 32)
+		rand.Read(b)
+		secret := hex.EncodeToString(b)
+
+		cmd := command{
+			Op: opSetDeploymentWebhook,
+			Deployment: Deployment{
+				ID:            deployment.ID,
+				WebhookSecret: secret,
+			},
+		}
+		if err := s.apply(c, &cmd); err != nil {
+			log.Printf("[ERR] store: Could not apply deployment webhook: %s", err)
+			c.String(http.StatusInternalServerError, "Could not set the webhook secret of the deployment.")
+			return
+		}
+
+		c.JSON(http.StatusCreated, res{
+			Secret:    secret,
+			GitHubURL: fmt.Sprintf("/hooks/github/%s", deployment.ID),
+			GitLabURL: fmt.Sprintf("/hooks/gitlab/%s", deployment.ID),
+		})
+	}
+}
+
+// FetchRepository fetches a branch from a remote repository into one of the
+// repositories that Orbit hosts, replacing the branch if it exists already.
+func (s *Store) FetchRepository(repo Repository, remote, branch string) error {
+	// Only fetch over HTTP, as git supports transports that run commands.
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("%s is not an HTTP git URL", remote)
+	}
+
+	volume := s.OrbitSystemVolume()
+	if volume == nil {
+		return fmt.Errorf("could not find the orbit system volume")
+	}
+	path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
+	if err := gitInitBare(path); err != nil {
+		return err
+	}
+
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", branch, branch)
+	cmd := exec.Command("git", "-C", path, "fetch", "--no-tags", remote, refspec)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch failed: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -21,6 +21,10 @@ type config struct {
 	RaftPort      int    `json:"raft_port"`
 	SerfPort      int    `json:"serf_port"`
 	WANSerfPort   int    `json:"wan_serf_port"`
+
+	// The session that the set up wizard uses, so that it can carry on if the
+	// node restarts before it has finished.
+	SetupSession *setupSession `json:"setup_session,omitempty"`
 }
 
 // configPath will return the path of the config file that the engine will use.
@@ -59,6 +63,10 @@ func (e Engine) marshalConfig() config {
 		parsedAddr = fmt.Sprintf("%s", e.Store.AdvertiseAddr)
 	}
 
+	e.APIServer.setupMu.Lock()
+	setup := e.APIServer.setup
+	e.APIServer.setupMu.Unlock()
+
 	return config{
 		Status:        e.Status,
 		AdvertiseAddr: parsedAddr,
@@ -67,6 +75,7 @@ func (e Engine) marshalConfig() config {
 		WANSerfPort:   e.Store.WANSerfPort,
 		RaftPort:      e.Store.RaftPort,
 		RPCPort:       e.RPCServer.Port,
+		SetupSession:  setup,
 	}
 }
 
@@ -79,6 +88,7 @@ func (e *Engine) unmarshalConfig(c config) {
 	e.Store.SerfPort = c.SerfPort
 	e.Store.WANSerfPort = c.WANSerfPort
 	e.RPCServer.Port = c.RPCPort
+	e.APIServer.setup = c.SetupSession
 }
 
 // readConfig will read in the configuration file and parse it.
@@ -0,0 +1,515 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The kinds of builder that an image can be built with.
+const (
+	// BuilderDockerfile builds the Dockerfile in the source code.
+	BuilderDockerfile = "dockerfile"
+	// BuilderHerokuish builds the source code with the Heroku buildpacks that
+	// herokuish runs.
+	BuilderHerokuish = "herokuish"
+	// BuilderCNB builds the source code with Cloud Native Buildpacks, running
+	// the lifecycle of a CNB builder image in the same way that pack does.
+	BuilderCNB = "cnb"
+)
+
+const (
+	// DefaultHerokuishImage is the image that herokuish builds are run in.
+	DefaultHerokuishImage = "gliderlabs/herokuish"
+
+	// herokuishBuildScript exports the build args in the environment directory
+	// to the buildpacks, which also read them from the directory, and builds.
+	herokuishBuildScript = `set -e
+for file in /tmp/env/*; do
+	if [ -f "$file" ]; then
+		export "$(basename "$file")=$(cat "$file")"
+	fi
+done
+exec /build`
+
+	// DefaultCNBImage is the CNB builder image that buildpack builds are run in.
+	DefaultCNBImage = "heroku/builder:22"
+
+	// DefaultCNBLifecycleImage is the image that the phases of the lifecycle
+	// that have access to the docker daemon are run from, rather than the copy
+	// of the lifecycle in the builder image.
+	DefaultCNBLifecycleImage = "buildpacksio/lifecycle:0.17.0"
+
+	// cnbPlatformAPI is the version of the platform API that the CNB lifecycle
+	// is run with.
+	cnbPlatformAPI = "0.10"
+
+	// cnbPrepareScript copies the source code into the workspace and writes the
+	// build args into the platform directory, where the buildpacks read them.
+	// The stack of the builder image is copied there as well, for the phases
+	// that are run from the lifecycle image to find the run image in.
+	cnbPrepareScript = `set -e
+cp -R /source/. /workspace
+mkdir -p /platform/env
+for name in $ORBIT_BUILD_ARGS; do
+	printf '%s' "$(printenv "$name")" > "/platform/env/$name"
+done
+cp /cnb/stack.toml /platform/stack.toml
+chown -R "$CNB_USER_ID:$CNB_GROUP_ID" /workspace /platform /layers`
+)
+
+// BuildOptions describes what a builder builds.
+type BuildOptions struct {
+	Path      string // The directory with the source code
+	Tag       string // The tag that the image is built as
+	Cache     string // The directory that is kept between builds, if the builder uses one
+	CacheFrom string // An earlier image that layers can be reused from, if the builder uses one
+
+	// The Dockerfile to build, relative to the source code, and the stage of it
+	// to build. Only the Dockerfile builder uses these.
+	Dockerfile string
+	Target     string
+
+	// The build args, which buildpacks are given as environment variables. The
+	// values are never put on the command line, so that they can't be seen in
+	// the process list.
+	Args map[string]string
+}
+
+// dockerfile returns the path of the Dockerfile that is built.
+func (o BuildOptions) dockerfile() string {
+	if o.Dockerfile == "" {
+		return filepath.Join(o.Path, "Dockerfile")
+	}
+	return filepath.Join(o.Path, o.Dockerfile)
+}
+
+// argEnv returns the build args as environment variables for docker to read.
+func (o BuildOptions) argEnv() []string {
+	env := []string{}
+	for k, v := range o.Args {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
+
+// argNames returns the names of the build args, in order.
+func (o BuildOptions) argNames() []string {
+	names := []string{}
+	for k := range o.Args {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builder builds the source code in a directory into an image. As each kind of
+// builder lays the image out differently, the builder also decides how the
+// processes of the image are started.
+type Builder interface {
+	// Build builds the image, and outputs a channel containing the streaming
+	// output of the build. The build is stopped if the context is cancelled.
+	Build(ctx context.Context, opts BuildOptions) (<-chan string, <-chan error)
+
+	// Start returns the entry point and the command that a process type of the
+	// image is run with, given the command of the process type in the Procfile.
+	// Empty values leave the ones set by the image.
+	Start(process, command string) (entrypoint string, args []string)
+}
+
+// NewBuilder returns the builder of the kind given. The image is the one that
+// the build is run in, and the default for the kind is used if it is empty.
+func NewBuilder(kind, image string) (Builder, error) {
+	if err := ValidateBuilderImage(image); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case BuilderDockerfile:
+		return DockerfileBuilder{}, nil
+	case BuilderHerokuish:
+		if image == "" {
+			image = DefaultHerokuishImage
+		}
+		return HerokuishBuilder{Image: image}, nil
+	case BuilderCNB:
+		if image == "" {
+			image = DefaultCNBImage
+		}
+		return CNBBuilder{Image: image}, nil
+	}
+	return nil, fmt.Errorf("%s is not a dockerfile, herokuish or cnb builder", kind)
+}
+
+// ValidateBuilderImage checks that an image can be passed to docker to build
+// with.
+func ValidateBuilderImage(image string) error {
+	if strings.HasPrefix(image, "-") || strings.ContainsAny(image, " \t\n") {
+		return fmt.Errorf("%s is not a valid image", image)
+	}
+	return nil
+}
+
+// DetectBuilder returns the kind of builder that suits the source code in a
+// directory. Source code with a Dockerfile is built from it, and anything else
+// is built by herokuish. The Dockerfile is looked for at the path given, or in
+// the root of the source code if it is empty.
+func DetectBuilder(path, dockerfile string) string {
+	if _, err := os.Stat(BuildOptions{Path: path, Dockerfile: dockerfile}.dockerfile()); err == nil {
+		return BuilderDockerfile
+	}
+	return BuilderHerokuish
+}
+
+// DockerfileBuilder builds the Dockerfile in the source code, which decides how
+// the image is started.
+type DockerfileBuilder struct{}
+
+// Build runs docker build on the source code. The image to reuse layers from is
+// pulled first, as it may have been built on another node, and the build
+// carries on without it if it can't be.
+func (DockerfileBuilder) Build(ctx context.Context, opts BuildOptions) (<-chan string, <-chan error) {
+	steps := []buildStep{}
+	build := []string{"docker", "build", "-t", opts.Tag, "-f", opts.dockerfile()}
+	if opts.Target != "" {
+		build = append(build, "--target", opts.Target)
+	}
+	for _, name := range opts.argNames() {
+		build = append(build, "--build-arg", name) // The value is read from the environment
+	}
+	if opts.CacheFrom != "" {
+		steps = append(steps, buildStep{
+			args:     []string{"docker", "pull", opts.CacheFrom},
+			optional: true,
+		})
+		build = append(build, "--cache-from", opts.CacheFrom)
+	}
+	build = append(build, opts.Path)
+	steps = append(steps, buildStep{args: build, env: opts.argEnv()})
+
+	return streamCommands(ctx, nil, steps...)
+}
+
+// Start runs the command of the process type in a shell, as the image doesn't
+// know about the Procfile. A process type without a command, such as the web
+// process of an app without a Procfile, is run with the entry point and command
+// of the Dockerfile.
+func (DockerfileBuilder) Start(process, command string) (string, []string) {
+	if command == "" {
+		return "", nil
+	}
+	return "/bin/sh", []string{"-c", command}
+}
+
+// HerokuishBuilder builds the source code with the Heroku buildpacks. The
+// source is mounted into a herokuish container which builds it, and the
+// container is then committed as the image. The buildpacks keep their cache in
+// the cache directory.
+type HerokuishBuilder struct {
+	Image string
+}
+
+// Build runs the buildpacks in a herokuish container and commits the result.
+// The build args are written to files in a directory that is mounted as the
+// environment directory of herokuish, rather than given to the container as
+// environment variables, as the commit would keep those in the image.
+func (h HerokuishBuilder) Build(ctx context.Context, opts BuildOptions) (<-chan string, <-chan error) {
+	name := fmt.Sprintf("orbit-build-%d", time.Now().UnixNano())
+	var envDir string
+
+	run := buildStep{
+		args: []string{"docker", "run", "--name", name, "-v", opts.Path + ":/tmp/app"},
+	}
+	if opts.Cache != "" {
+		run.args = append(run.args, "-v", opts.Cache+":/tmp/cache")
+	}
+	run.setup = func(step *buildStep) error {
+		dir, err := writeArgFiles(opts)
+		if err != nil {
+			return fmt.Errorf("could not write the build args: %s", err)
+		}
+		envDir = dir
+		step.args = append(step.args, "-v", dir+":/tmp/env", h.Image, "/bin/bash", "-c", herokuishBuildScript)
+		return nil
+	}
+
+	commit := []string{"docker", "commit", "--change", `CMD ["/start", "web"]`, name, opts.Tag}
+
+	// The container is removed whether or not the build worked, which also
+	// stops it if the build was cancelled.
+	cleanup := func() {
+		exec.Command("docker", "rm", "-f", name).Run()
+		if envDir != "" {
+			os.RemoveAll(envDir)
+		}
+	}
+	return streamCommands(ctx, cleanup, run, buildStep{args: commit})
+}
+
+// writeArgFiles writes each of the build args to a file named after it in a
+// new temporary directory, and returns the directory.
+func writeArgFiles(opts BuildOptions) (string, error) {
+	dir, err := ioutil.TempDir("", "orbit-build-args-")
+	if err != nil {
+		return "", err
+	}
+	for k, v := range opts.Args {
+		if err := ioutil.WriteFile(filepath.Join(dir, k), []byte(v), 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Start runs the process type through herokuish, which reads its command from
+// the Procfile in the image.
+func (HerokuishBuilder) Start(process, command string) (string, []string) {
+	return "", []string{"/start", process}
+}
+
+// CNBBuilder builds the source code with Cloud Native Buildpacks. The phases of
+// the CNB lifecycle are run one at a time, as pack does for builders that it
+// doesn't trust. The buildpacks are run in the builder image as its own user,
+// without access to the docker daemon. Only the phases that talk to the daemon
+// have the docker socket, and they are run from the lifecycle image, so none
+// of the code in the builder image is run with it. The layers that the
+// buildpacks cache are kept in the cache directory.
+type CNBBuilder struct {
+	Image string
+}
+
+// Build copies the source code into a workspace volume that the user of the
+// builder image owns, and writes the build args as platform environment
+// variables, as pack does. It then runs the analyzer, detector, restorer,
+// builder and exporter of the lifecycle, which share the workspace, platform
+// and layers volumes.
+func (c CNBBuilder) Build(ctx context.Context, opts BuildOptions) (<-chan string, <-chan error) {
+	name := fmt.Sprintf("orbit-build-%d", time.Now().UnixNano())
+	workspace := name + "-workspace"
+	platform := name + "-platform"
+	layers := name + "-layers"
+
+	prepare := []string{"docker", "run", "--rm", "--name", name + "-prepare", "--user", "root",
+		"-v", opts.Path + ":/source:ro",
+		"-v", workspace + ":/workspace",
+		"-v", platform + ":/platform",
+		"-v", layers + ":/layers",
+		"-e", "ORBIT_BUILD_ARGS=" + strings.Join(opts.argNames(), " "),
+	}
+	for _, name := range opts.argNames() {
+		prepare = append(prepare, "-e", name)
+	}
+	prepare = append(prepare, "--entrypoint", "/bin/sh", c.Image, "-c", cnbPrepareScript)
+
+	volumes := []string{
+		"-v", workspace + ":/workspace",
+		"-v", platform + ":/platform",
+		"-v", layers + ":/layers",
+	}
+	cache := []string{}
+	if opts.Cache != "" {
+		volumes = append(volumes, "-v", opts.Cache+":/cache")
+		cache = append(cache, "-cache-dir=/cache")
+	}
+
+	// lifecycle returns the step that runs a phase of the lifecycle. Trusted
+	// phases are run from the lifecycle image as root with the docker socket,
+	// and are given the user of the builder image so that the layers they write
+	// can be read by the other phases, which run as that user.
+	lifecycle := func(phase string, trusted bool, args ...string) buildStep {
+		run := []string{"docker", "run", "--rm", "--name", name + "-" + phase,
+			"-e", "CNB_PLATFORM_API=" + cnbPlatformAPI,
+		}
+		run = append(run, volumes...)
+		image := c.Image
+		step := buildStep{}
+		if trusted {
+			image = DefaultCNBLifecycleImage
+			run = append(run, "--user", "root",
+				"-v", "/var/run/docker.sock:/var/run/docker.sock",
+				"-e", "CNB_USER_ID", "-e", "CNB_GROUP_ID",
+			)
+			step.setup = c.userEnv
+		}
+		run = append(run, "--entrypoint", "/cnb/lifecycle/"+phase, image)
+		step.args = append(run, args...)
+		return step
+	}
+
+	restorer := append([]string{"-layers=/layers"}, cache...)
+	exporter := append([]string{"-daemon", "-app=/workspace", "-layers=/layers", "-stack=/platform/stack.toml"}, cache...)
+	exporter = append(exporter, opts.Tag)
+
+	steps := []buildStep{
+		{args: prepare, env: opts.argEnv()},
+		lifecycle("analyzer", true, "-daemon", "-layers=/layers", "-stack=/platform/stack.toml", opts.Tag),
+		lifecycle("detector", false, "-app=/workspace", "-layers=/layers", "-platform=/platform"),
+		lifecycle("restorer", false, restorer...),
+		lifecycle("builder", false, "-app=/workspace", "-layers=/layers", "-platform=/platform"),
+		lifecycle("exporter", true, exporter...),
+	}
+
+	// Stopping the docker client doesn't stop the container, so the containers
+	// and their volumes are removed once the build has finished or been
+	// cancelled.
+	cleanup := func() {
+		for _, phase := range []string{"prepare", "analyzer", "detector", "restorer", "builder", "exporter"} {
+			exec.Command("docker", "rm", "-f", name+"-"+phase).Run()
+		}
+		exec.Command("docker", "volume", "rm", "-f", workspace, platform, layers).Run()
+	}
+	return streamCommands(ctx, cleanup, steps...)
+}
+
+// userEnv adds the user and group of the builder image to the environment of a
+// step. The builder image has been pulled by the steps before it by then.
+func (c CNBBuilder) userEnv(step *buildStep) error {
+	env, err := imageEnv(c.Image)
+	if err != nil {
+		return fmt.Errorf("could not inspect the builder image: %s", err)
+	}
+	for _, name := range []string{"CNB_USER_ID", "CNB_GROUP_ID"} {
+		if env[name] == "" {
+			return fmt.Errorf("the builder image does not set %s", name)
+		}
+		step.env = append(step.env, name+"="+env[name])
+	}
+	return nil
+}
+
+// Start runs the process type through the launcher of the lifecycle, which sets
+// up the environment that the buildpacks provide. The buildpacks make a process
+// type of each one in the Procfile.
+func (CNBBuilder) Start(process, command string) (string, []string) {
+	return "/cnb/process/" + process, nil
+}
+
+// buildStep is a command that is run as part of a build.
+type buildStep struct {
+	args     []string
+	env      []string // Added to the environment of the command
+	optional bool     // Whether the build carries on if the command fails
+
+	// Called just before the command is run, for a step that depends on what
+	// the steps before it did.
+	setup func(step *buildStep) error
+}
+
+// BuildStats counts the steps of a build that were reused from the cache, from
+// the output of the build.
+type BuildStats struct {
+	Steps  int
+	Cached int
+}
+
+// Read counts a line of the output of a build. A Dockerfile build has a step
+// for each instruction, which says if it used the cache, and the export of a
+// CNB build has a step for each layer, which is either reused or added.
+func (s *BuildStats) Read(line string) {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "Step "):
+		s.Steps++
+	case line == "---> Using cache":
+		s.Cached++
+	case strings.Contains(line, "Adding layer "):
+		s.Steps++
+	case strings.Contains(line, "Reusing layer "):
+		s.Steps++
+		s.Cached++
+	}
+}
+
+// HitRatio returns the share of the steps that were reused from the cache, from
+// 0 to 1.
+func (s BuildStats) HitRatio() float64 {
+	if s.Steps == 0 {
+		return 0
+	}
+	return float64(s.Cached) / float64(s.Steps)
+}
+
+// streamCommands runs the commands one after another, and outputs a channel
+// containing the lines that they write to stdout and stderr. It stops at the
+// first command that fails, unless it is optional, and runs the clean up
+// function (if there is one) once they have finished.
+func streamCommands(ctx context.Context, cleanup func(), steps ...buildStep) (<-chan string, <-chan error) {
+	outputCh := make(chan string)
+	errorCh := make(chan error, 1)
+
+	go func() {
+		defer close(outputCh)
+		defer close(errorCh)
+		if cleanup != nil {
+			defer cleanup()
+		}
+
+		for _, step := range steps {
+			if step.setup != nil {
+				if err := step.setup(&step); err != nil {
+					errorCh <- err
+					return
+				}
+			}
+			err := streamCommand(ctx, outputCh, step)
+			if err != nil && (!step.optional || ctx.Err() != nil) {
+				errorCh <- err
+				return
+			}
+		}
+	}()
+
+	return outputCh, errorCh
+}
+
+// streamCommand runs the command of a step and sends the lines that it writes
+// to the output channel.
+func streamCommand(ctx context.Context, outputCh chan<- string, step buildStep) error {
+	args := step.args
+	r, w := io.Pipe()
+	defer r.Close()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), step.env...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start the command: %s", err)
+	}
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+		w.Close()
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		select {
+		case outputCh <- scanner.Text():
+		case <-ctx.Done():
+			r.Close()
+			<-waitCh
+			return ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		r.Close()
+		<-waitCh
+		return fmt.Errorf("could not read the output of %s: %s", args[1], err)
+	}
+
+	if err := <-waitCh; err != nil {
+		return fmt.Errorf("%s %s failed: %s", args[0], args[1], err)
+	}
+	return nil
+}
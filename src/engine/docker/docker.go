@@ -4,18 +4,21 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 )
 
@@ -152,68 +155,159 @@ func (m ServiceMount) String() string {
 	return fmt.Sprintf("type=%s,source=%s,target=%s", m.Type, m.Source, m.Target)
 }
 
-// EnsureDockerfile creates a herokuish dockerfile if one isn't present in the
-// provided directory.
-func EnsureDockerfile(path string) error {
-	dockerfilePath := filepath.Join(path, "Dockerfile")
-	if _, err := os.Stat(dockerfilePath); !os.IsNotExist(err) {
-		// The file exists, so we don't need to do anything.
-		return nil
+// LogOptions decides which of the logs of a service are read.
+type LogOptions struct {
+	Follow     bool   // Keep reading the logs as they are written
+	Since      string // A timestamp or a duration such as "10m", all logs if empty
+	Tail       string // The number of lines from the end of the logs, or "all"
+	Timestamps bool   // Read the time that each line was written
+}
+
+// args returns the arguments of the service logs command.
+func (o LogOptions) args(name string) []string {
+	args := []string{"service", "logs", "--no-trunc"}
+	if o.Follow {
+		args = append(args, "--follow")
+	}
+	if o.Since != "" {
+		args = append(args, "--since="+o.Since)
 	}
+	if o.Tail != "" {
+		args = append(args, "--tail="+o.Tail)
+	}
+	if o.Timestamps {
+		args = append(args, "--timestamps")
+	}
+	return append(args, name)
+}
 
-	// The file doesn't exist, so write the standard herokuish dockerfile.
-	dockerfile := `FROM gliderlabs/herokuish
-WORKDIR /tmp/build
-COPY . .
-RUN /build
-`
-	ioutil.WriteFile(dockerfilePath, []byte(dockerfile), 0644)
+// LogLine is a line written by one of the tasks of a service.
+type LogLine struct {
+	Service string    `json:"service"`
+	Replica int       `json:"replica,omitempty"` // The slot of the task, 0 for global services
+	Task    string    `json:"task"`
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
 
-	return nil
+// Source returns the name of the task that wrote the line, in the same form as
+// docker does.
+func (l LogLine) Source() string {
+	if l.Replica == 0 {
+		return fmt.Sprintf("%s.%s@%s", l.Service, l.Task, l.Node)
+	}
+	return fmt.Sprintf("%s.%d.%s@%s", l.Service, l.Replica, l.Task, l.Node)
 }
 
-// Build will perform the build process and output a channel containing the
-// streaming build process that is taking place.
-func Build(path, tag string) (<-chan string, <-chan error) {
-	// Construct the output channel.
-	outputCh := make(chan string)
-	errorCh := make(chan error)
+// parseLogLine parses a line of the service logs command, which is prefixed by
+// the task that wrote it, as in "name.1.task@node | message". The timestamp
+// comes before the task if it was asked for.
+func parseLogLine(text string, timestamps bool) (LogLine, bool) {
+	var line LogLine
+	if timestamps {
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return line, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return line, false
+		}
+		line.Time = t
+		text = fields[1]
+	}
+
+	fields := strings.SplitN(text, "|", 2)
+	if len(fields) != 2 {
+		return line, false
+	}
+	line.Message = strings.TrimPrefix(fields[1], " ")
+
+	// The task is named after the service, then the slot of the task (or the
+	// node for global services), then the task ID.
+	source := strings.TrimSpace(fields[0])
+	at := strings.LastIndex(source, "@")
+	if at == -1 {
+		return line, false
+	}
+	line.Node = source[at+1:]
+	parts := strings.Split(source[:at], ".")
+	if len(parts) < 3 {
+		return line, false
+	}
+	line.Task = parts[len(parts)-1]
+	line.Service = strings.Join(parts[:len(parts)-2], ".")
+	line.Replica, _ = strconv.Atoi(parts[len(parts)-2])
+	return line, true
+}
+
+// ServiceLogs reads the logs of every task of a service, and outputs a channel
+// containing the lines as they are read. The lines of each task are in order,
+// but the tasks are interleaved as docker reads them. Reading stops once the
+// context is cancelled, or once the logs have been read if they aren't being
+// followed.
+func ServiceLogs(ctx context.Context, name string, opts LogOptions) (<-chan LogLine, <-chan error) {
+	outputCh := make(chan LogLine)
+	errorCh := make(chan error, 1)
 
 	go func() {
-		// Ensure that on completion (or return) that the channel is closed.
 		defer close(outputCh)
 		defer close(errorCh)
 
-		// Construct the build command.
-		cmd := exec.Command("docker", "build", "-t", tag, path)
-		rc, err := cmd.StdoutPipe()
-		if err != nil {
-			errorCh <- fmt.Errorf("could not pipe stdout from the docker build command: %s", err)
+		// Docker writes the lines that the tasks wrote to stderr to its own
+		// stderr, so both are read.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		r, w := io.Pipe()
+		defer r.Close()
+		cmd := exec.CommandContext(ctx, "docker", opts.args(name)...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		if err := cmd.Start(); err != nil {
+			errorCh <- fmt.Errorf("could not start the command: %s", err)
 			return
 		}
-
-		// Handle the output from this command by the individual lines.
-		scanner := bufio.NewScanner(rc)
+		waitCh := make(chan error, 1)
 		go func() {
-			for scanner.Scan() {
-				outputCh <- scanner.Text()
-			}
+			waitCh <- cmd.Wait()
+			w.Close()
 		}()
 
-		// Now we actually need to start the command.
-		if err := cmd.Start(); err != nil {
-			errorCh <- fmt.Errorf("could not start the command: %s", err)
-			return
+		// Anything that docker writes itself isn't prefixed by a task, and is
+		// kept to explain why the command failed.
+		var last string
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line, ok := parseLogLine(scanner.Text(), opts.Timestamps)
+			if !ok {
+				last = scanner.Text()
+				continue
+			}
+			select {
+			case outputCh <- line:
+			case <-ctx.Done():
+				return
+			}
 		}
 
-		// Wait for the command to complete.
-		if err := cmd.Wait(); err != nil {
-			errorCh <- fmt.Errorf("could not wait for command: %s", err)
+		if err := scanner.Err(); err != nil {
+			cancel()
+			r.Close()
+			<-waitCh
+			errorCh <- fmt.Errorf("could not read the logs of service %s: %s", name, err)
 			return
 		}
+
+		if err := <-waitCh; err != nil && ctx.Err() == nil {
+			if last != "" {
+				err = fmt.Errorf("%s", last)
+			}
+			errorCh <- fmt.Errorf("could not read the logs of service %s: %s", name, err)
+		}
 	}()
 
-	// Provide the output channel to the caller.
 	return outputCh, errorCh
 }
 
@@ -227,6 +321,16 @@ func (p Publish) String() string {
 	return fmt.Sprintf("%d:%d", p.Host, p.Container)
 }
 
+// ServiceSecret is a docker secret that a docker service has mounted as a file.
+type ServiceSecret struct {
+	Name   string
+	Target string // The absolute path of the file in the container
+}
+
+func (s ServiceSecret) String() string {
+	return fmt.Sprintf("source=%s,target=%s,mode=0400", s.Name, s.Target)
+}
+
 // Service is a logical docker service. This is not a complete service
 // description, but includes enough of the configuration for Orbit to function
 // properly.
@@ -240,8 +344,122 @@ type Service struct {
 	Mounts               []ServiceMount
 	Networks             []string
 	EnvVars              map[string]string
-	Command              string   // The entry point for the image
-	Args                 []string // The args for the entry point
+	Secrets              []ServiceSecret
+	Update               UpdateConfig
+	Entrypoint           string   // Overrides the entry point of the image, if set
+	Command              string   // The command that the entry point runs
+	Args                 []string // The args for the command
+}
+
+// commandArgs returns the command and args of the service as the single value
+// that the service update command takes, quoted so that docker splits it back
+// up in the same way.
+func (s Service) commandArgs() string {
+	if s.Command == "" {
+		return ""
+	}
+	quoted := []string{}
+	for _, arg := range append([]string{s.Command}, s.Args...) {
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'"'"'`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+// UpdateConfig decides how the tasks of a service are replaced when it is
+// updated. Fields left empty use the docker defaults.
+type UpdateConfig struct {
+	Order         string        // Either "start-first" or "stop-first"
+	Parallelism   int           // The number of tasks replaced at once, 0 for all
+	FailureAction string        // Either "pause", "continue" or "rollback"
+	Delay         time.Duration // The time between replacing each batch of tasks
+	Monitor       time.Duration // How long a new task is watched for failure
+}
+
+// DefaultUpdateConfig replaces one task at a time, starting its replacement
+// before stopping it so that there is no downtime. If the replacement fails,
+// the service is rolled back to how it was before the update.
+var DefaultUpdateConfig = UpdateConfig{
+	Order:         "start-first",
+	Parallelism:   1,
+	FailureAction: "rollback",
+	Monitor:       10 * time.Second,
+}
+
+// args returns the arguments that apply the update config to a service when it
+// is created or updated.
+func (u UpdateConfig) args() []string {
+	var args []string
+	if u.Order != "" {
+		args = append(args, "--update-order", u.Order)
+	}
+	if u.Parallelism > 0 {
+		args = append(args, "--update-parallelism", strconv.Itoa(u.Parallelism))
+	}
+	if u.FailureAction != "" {
+		args = append(args, "--update-failure-action", u.FailureAction)
+	}
+	if u.Delay > 0 {
+		args = append(args, "--update-delay", u.Delay.String())
+	}
+	if u.Monitor > 0 {
+		args = append(args, "--update-monitor", u.Monitor.String())
+	}
+	return args
+}
+
+// clientEnv are the environment variables that the docker client reads itself.
+// A service variable with one of these names can't be given to the client, as
+// it would change how the client runs.
+var clientEnv = map[string]bool{
+	"DOCKER_API_VERSION": true,
+	"DOCKER_CERT_PATH":   true,
+	"DOCKER_CONFIG":      true,
+	"DOCKER_CONTEXT":     true,
+	"DOCKER_HOST":        true,
+	"DOCKER_TLS_VERIFY":  true,
+	"HOME":               true,
+	"PATH":               true,
+}
+
+// IsClientEnv returns whether or not the docker client reads the environment
+// variable itself.
+func IsClientEnv(name string) bool {
+	return clientEnv[name]
+}
+
+// serviceEnv returns the arguments that set the environment variables of a
+// service with the flag, and the environment to run the docker client with.
+// Only the names are passed as arguments, and the client takes the values from
+// its own environment, so that they never show up in the process list. An env
+// file isn't used, as it can't hold a value with a newline and the service
+// update command doesn't take one.
+func serviceEnv(flag string, vars map[string]string) ([]string, []string) {
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{}
+	env := []string{}
+	for _, name := range names {
+		if clientEnv[name] {
+			args = append(args, flag, fmt.Sprintf("%s=%s", name, vars[name]))
+			continue
+		}
+		args = append(args, flag, name)
+		env = append(env, fmt.Sprintf("%s=%s", name, vars[name]))
+	}
+
+	// The variables of our own environment are left out if the service has one
+	// with the same name, so that the client can't pick up ours instead.
+	for _, e := range os.Environ() {
+		name := strings.SplitN(e, "=", 2)[0]
+		if _, ok := vars[name]; !ok || clientEnv[name] {
+			env = append(env, e)
+		}
+	}
+	return args, env
 }
 
 // ServiceMode is a way in which to deploy a service.
@@ -289,6 +507,9 @@ func createService(s Service) error {
 		args = append(args, "--mode", "global")
 	}
 
+	// Add the update config.
+	args = append(args, s.Update.args()...)
+
 	// Add the mount declarations.
 	for _, m := range s.Mounts {
 		args = append(args, "--mount", m.String())
@@ -313,8 +534,17 @@ func createService(s Service) error {
 	if _, ok := s.EnvVars["PORT"]; !ok {
 		s.EnvVars["PORT"] = "5000"
 	}
-	for k, v := range s.EnvVars {
-		args = append(args, "--env", fmt.Sprintf("%s=%s", k, v))
+	envArgs, env := serviceEnv("--env", s.EnvVars)
+	args = append(args, envArgs...)
+
+	// Add the secrets, which are mounted as files.
+	for _, secret := range s.Secrets {
+		args = append(args, "--secret", secret.String())
+	}
+
+	// Override the entry point of the image.
+	if s.Entrypoint != "" {
+		args = append(args, "--entrypoint", s.Entrypoint)
 	}
 
 	// And finally, add the image tag. This can change depending upon whether the
@@ -333,6 +563,7 @@ func createService(s Service) error {
 	}
 
 	cmd := exec.Command("docker", args...)
+	cmd.Env = env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -359,6 +590,31 @@ func Push(tags ...string) error {
 	return nil
 }
 
+// ImageDigest returns the digest of an image that has been pushed to the local
+// registry. Unlike the tag, the digest always refers to the same image.
+func ImageDigest(tag string) (string, error) {
+	name := fmt.Sprintf("127.0.0.1:6510/%s", tag)
+	cmd := exec.Command("docker", "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", name)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	// The digests are listed as the repository (the name without the tag)
+	// followed by the digest, one for every registry it has been pushed to.
+	repository := name
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repository = name[:i]
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, repository+"@") {
+			return strings.TrimPrefix(line, repository+"@"), nil
+		}
+	}
+	return "", fmt.Errorf("image %s has no digest from the registry", tag)
+}
+
 // Services will return a list of the names of the currently running docker
 // services.
 func Services() []string {
@@ -403,6 +659,175 @@ func RemoveService(service string) bool {
 	return true
 }
 
+// serviceUpdateTimeout is how long an update of a service has to converge
+// before it is treated as having failed.
+const serviceUpdateTimeout = 10 * time.Minute
+
+// UpdateService will perform a rolling update of an existing service so that
+// it matches the service configuration. Only the image, command, replicas,
+// environment variables, secrets and update config are changed. The tasks are
+// replaced as the update config describes, and this waits until the update has
+// converged. An update that was paused or rolled back is an error, as the
+// service is not running the configuration.
+func UpdateService(s Service) error {
+	current, err := serviceContainerSpec(s.Name)
+	if err != nil {
+		log.Printf("[ERR] docker: Could not inspect service %s: %s", s.Name, err)
+		return err
+	}
+
+	args := []string{"service", "update", "--detach=false", "--quiet"}
+	args = append(args, s.Update.args()...)
+
+	if s.Mode == Replicated && s.Replicas > 0 {
+		args = append(args, "--replicas", strconv.Itoa(s.Replicas))
+	}
+
+	// Set the image, which is resolved again by the swarm so that a new image
+	// pushed with the same tag is picked up.
+	if s.DisableLocalRegistry {
+		args = append(args, "--image", s.Tag)
+	} else {
+		args = append(args, "--image", fmt.Sprintf("127.0.0.1:6510/%s", s.Tag))
+	}
+
+	// The entry point and command are always set, as an image built in another
+	// way may need to be started differently. Empty values go back to the ones
+	// of the image.
+	args = append(args, "--entrypoint", s.Entrypoint, "--args", s.commandArgs())
+
+	// Work out the environment variables in the same way as when the service is
+	// created. Every variable is added again, and the ones no longer used are
+	// removed.
+	if s.EnvVars == nil {
+		s.EnvVars = make(map[string]string)
+	}
+	if _, ok := s.EnvVars["PORT"]; !ok {
+		s.EnvVars["PORT"] = "5000"
+	}
+	for _, env := range current.Env {
+		key := strings.SplitN(env, "=", 2)[0]
+		if _, ok := s.EnvVars[key]; !ok {
+			args = append(args, "--env-rm", key)
+		}
+	}
+	envArgs, env := serviceEnv("--env-add", s.EnvVars)
+	args = append(args, envArgs...)
+
+	// Secrets are immutable, so a changed secret has a new name. Remove the ones
+	// that aren't wanted any more and add the ones that are missing.
+	wanted := map[string]bool{}
+	for _, secret := range s.Secrets {
+		wanted[secret.String()] = true
+	}
+	existing := map[string]bool{}
+	for _, secret := range current.Secrets {
+		ref := ServiceSecret{Name: secret.SecretName}
+		if secret.File != nil {
+			ref.Target = secret.File.Name
+		}
+		existing[ref.String()] = true
+		if !wanted[ref.String()] {
+			args = append(args, "--secret-rm", secret.SecretName)
+		}
+	}
+	for _, secret := range s.Secrets {
+		if !existing[secret.String()] {
+			args = append(args, "--secret-add", secret.String())
+		}
+	}
+
+	args = append(args, s.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), serviceUpdateTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.Printf("[INFO] docker: Updating service %s", s.Name)
+	if err := cmd.Run(); err != nil {
+		log.Printf("[ERR] docker: Could not run docker service update on service %s: %s", s.Name, err)
+		return err
+	}
+
+	// Older clients return as soon as the update has started, so the state of
+	// the update is checked as well.
+	if err := waitForUpdate(ctx, s.Name); err != nil {
+		log.Printf("[ERR] docker: Update of service %s did not complete: %s", s.Name, err)
+		return err
+	}
+	return nil
+}
+
+// waitForUpdate waits until the latest update of a service has finished, and
+// returns an error if it didn't complete.
+func waitForUpdate(ctx context.Context, name string) error {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	for {
+		service, _, err := cli.ServiceInspectWithRaw(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		status := service.UpdateStatus
+		switch status.State {
+		case "", swarm.UpdateStateCompleted:
+			return nil
+		case swarm.UpdateStateUpdating, "rollback_started":
+		default:
+			return fmt.Errorf("update is %s: %s", status.State, status.Message)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// imageEnv returns the environment variables that an image sets.
+func imageEnv(image string) (map[string]string, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	inspect, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return nil, err
+	}
+
+	env := map[string]string{}
+	if inspect.Config != nil {
+		for _, v := range inspect.Config.Env {
+			if parts := strings.SplitN(v, "=", 2); len(parts) == 2 {
+				env[parts[0]] = parts[1]
+			}
+		}
+	}
+	return env, nil
+}
+
+// serviceContainerSpec returns the container specification of a service.
+func serviceContainerSpec(name string) (swarm.ContainerSpec, error) {
+	ctx := context.Background()
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return swarm.ContainerSpec{}, err
+	}
+	service, _, err := cli.ServiceInspectWithRaw(ctx, name)
+	if err != nil {
+		return swarm.ContainerSpec{}, err
+	}
+	return service.Spec.TaskTemplate.ContainerSpec, nil
+}
+
 // ForceUpdateService will use the docker CLI directly to forcefully update a
 // service with the given ID.
 func ForceUpdateService(id string) error {
@@ -438,3 +863,55 @@ func forceUpdateService(id string) error {
 	}
 	return nil
 }
+
+// Secrets will return a list of the names of the docker secrets that start with
+// the prefix.
+func Secrets(prefix string) []string {
+	cmd := exec.Command("docker", "secret", "ls", "--format", "{{.Name}}")
+	output, err := cmd.Output()
+	if err != nil {
+		return []string{}
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && strings.HasPrefix(line, prefix) {
+			secrets = append(secrets, line)
+		}
+	}
+	return secrets
+}
+
+// EnsureSecret will create a docker secret with the name and value if it
+// doesn't exist already. Docker secrets can't be changed once created, so a
+// changed value needs a secret with a new name.
+func EnsureSecret(name string, value []byte) error {
+	for _, s := range Secrets(name) {
+		if s == name {
+			return nil
+		}
+	}
+
+	// The value is passed on stdin so that it never shows up in the process
+	// list.
+	cmd := exec.Command("docker", "secret", "create", name, "-")
+	cmd.Stdin = bytes.NewReader(value)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("[ERR] docker: Could not create secret %s: %s", name, err)
+		return err
+	}
+	log.Printf("[INFO] docker: Created secret %s", name)
+	return nil
+}
+
+// RemoveSecret will remove a docker secret. This fails if the secret is still
+// used by a service.
+func RemoveSecret(name string) error {
+	cmd := exec.Command("docker", "secret", "rm", name)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] docker: Removed secret %s", name)
+	return nil
+}
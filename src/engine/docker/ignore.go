@@ -0,0 +1,200 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/scanner"
+
+	"github.com/docker/docker/builder/dockerignore"
+)
+
+// The files that list what is left out of the build context. The Orbit one is
+// used instead of the docker one if there are both, so that an app can leave
+// out files only when it is built by Orbit.
+const (
+	orbitIgnoreFile  = ".orbitignore"
+	dockerIgnoreFile = ".dockerignore"
+)
+
+// PrepareContext removes the files that the ignore file of the source code
+// leaves out of the build, so that every kind of builder sees the same source.
+// The patterns are matched in the same way as docker matches a .dockerignore
+// file, including exceptions that start with "!". The Dockerfile, the
+// directories that it is in and the ignore files are always kept, as docker
+// needs them to build.
+//
+// This removes files from the directory, so it must only be used on a copy of
+// the source code.
+func PrepareContext(path, dockerfile string) error {
+	patterns, err := ignorePatterns(path)
+	if err != nil || len(patterns) == 0 {
+		return err
+	}
+	exceptions := false
+	for _, p := range patterns {
+		if p == "!" {
+			return fmt.Errorf("%s is not a valid ignore pattern", p)
+		}
+		if strings.HasPrefix(p, "!") {
+			exceptions = true
+		}
+	}
+
+	keep := map[string]bool{
+		orbitIgnoreFile:  true,
+		dockerIgnoreFile: true,
+	}
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	for dir := filepath.Clean(dockerfile); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		keep[filepath.ToSlash(dir)] = true
+	}
+
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		skip, err := ignored(rel, patterns)
+		if err != nil || !skip {
+			return err
+		}
+		if info.IsDir() {
+			// A directory that is left out can't be removed as a whole if an
+			// exception could bring back something inside of it.
+			if exceptions {
+				return nil
+			}
+			if err := os.RemoveAll(file); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return os.Remove(file)
+	})
+}
+
+// ignorePatterns reads the patterns of the ignore file of the source code, if
+// it has one. Patterns are relative to the root of the source code, whether or
+// not they start with "/".
+func ignorePatterns(path string) ([]string, error) {
+	for _, name := range []string{orbitIgnoreFile, dockerIgnoreFile} {
+		f, err := os.Open(filepath.Join(path, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		patterns, err := dockerignore.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range patterns {
+			if strings.HasPrefix(p, "!") {
+				patterns[i] = "!" + strings.TrimPrefix(p[1:], "/")
+			} else {
+				patterns[i] = strings.TrimPrefix(p, "/")
+			}
+		}
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// ignored returns whether or not a file is left out by the patterns. The last
+// pattern that matches the file wins, and a pattern matches a file if it
+// matches the file or the directories that it is in.
+//
+// This and ignoreMatch are the matching of pkg/fileutils in docker, which can't
+// be imported as it uses an import path of logrus that no longer resolves.
+func ignored(file string, patterns []string) (bool, error) {
+	matched := false
+	parentDirs := strings.Split(filepath.Dir(file), "/")
+
+	for _, pattern := range patterns {
+		exception := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		match, err := ignoreMatch(pattern, file)
+		if err != nil {
+			return false, fmt.Errorf("%s is not a valid ignore pattern: %s", pattern, err)
+		}
+
+		// A pattern with as many parts as a directory that the file is in also
+		// matches the file if it matches the directory.
+		patternDirs := strings.Split(pattern, "/")
+		if !match && filepath.Dir(file) != "." && len(patternDirs) <= len(parentDirs) {
+			match, _ = ignoreMatch(pattern, strings.Join(parentDirs[:len(patternDirs)], "/"))
+		}
+
+		if match {
+			matched = !exception
+		}
+	}
+	return matched, nil
+}
+
+// ignoreMatch returns whether or not a pattern matches a path. A "*" or "?"
+// matches within a single directory, and "**" matches any number of
+// directories.
+func ignoreMatch(pattern, path string) (bool, error) {
+	// The syntax of the pattern is checked by filepath.Match, which errors on
+	// the patterns that can't be converted.
+	if _, err := filepath.Match(pattern, path); err != nil {
+		return false, err
+	}
+
+	re := "^"
+	var scan scanner.Scanner
+	scan.Init(strings.NewReader(pattern))
+	for scan.Peek() != scanner.EOF {
+		ch := scan.Next()
+		switch {
+		case ch == '*' && scan.Peek() == '*':
+			scan.Next()
+			if scan.Peek() == scanner.EOF {
+				re += ".*"
+			} else {
+				re += "((.*/)|([^/]*))"
+			}
+			// "**/" is treated as "**".
+			if scan.Peek() == '/' {
+				scan.Next()
+			}
+		case ch == '*':
+			re += "[^/]*"
+		case ch == '?':
+			re += "[^/]"
+		case ch == '.' || ch == '$':
+			re += `\` + string(ch)
+		case ch == '\\':
+			if scan.Peek() != scanner.EOF {
+				re += `\` + string(scan.Next())
+			} else {
+				re += `\\`
+			}
+		default:
+			re += string(ch)
+		}
+	}
+
+	match, err := regexp.MatchString(re+"$", path)
+	if err != nil {
+		return false, filepath.ErrBadPattern
+	}
+	return match, nil
+}
@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ProcessWeb is the process type that serves the HTTP requests of an app. It is
+// the only process type that routers send requests to.
+const ProcessWeb = "web"
+
+// ProcessNameFormat is the format that the names of process types have to be
+// in. They are kept short so that the name of the service that runs them is
+// still a valid service name.
+var ProcessNameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+// ReadProcfile reads the process types of the source code in a directory from
+// its Procfile, as a map of their names to the commands that start them. Source
+// code without a Procfile has no process types, and nil is returned.
+func ReadProcfile(path string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(path, "Procfile"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	processes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d of the Procfile is not a process type", n)
+		}
+		name := strings.TrimSpace(parts[0])
+		command := strings.TrimSpace(parts[1])
+		if !ProcessNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("%s is not a valid process type name", name)
+		}
+		if command == "" {
+			return nil, fmt.Errorf("process type %s does not have a command", name)
+		}
+		if _, ok := processes[name]; ok {
+			return nil, fmt.Errorf("process type %s is in the Procfile more than once", name)
+		}
+		processes[name] = command
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return processes, nil
+}
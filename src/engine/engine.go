@@ -21,6 +21,8 @@ type Engine struct {
 	Status     Status
 	DataPath   string
 	ConfigFile string
+
+	builds *buildRunner // The builds running on this node
 }
 
 // New creates a new instance of the engine.
@@ -29,6 +31,7 @@ func New() *Engine {
 		Status:     StatusInit,
 		DataPath:   "/var/orbit",
 		ConfigFile: "config.json",
+		builds:     &buildRunner{},
 	}
 
 	e.Store = NewStore(e)
@@ -13,6 +13,9 @@ var (
 	ErrEmailTaken = errors.New("email is already in use")
 	// ErrMissingFields means that required fields are missing.
 	ErrMissingFields = errors.New("required fields are missing")
+	// ErrNotFirstUser means that a user was to become the owner of the cluster,
+	// but it already has users.
+	ErrNotFirstUser = errors.New("the cluster already has users")
 	// ErrNotFound means that the item in question could not be found.
 	ErrNotFound = errors.New("could not be found")
 )
@@ -0,0 +1,405 @@
+package engine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512 for RS384 and RS512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// oidcClient is used for every request to an identity provider. The issuer
+// can be any URL (including a local mock provider), so this has a timeout to
+// ensure a slow provider can't hold up a request forever.
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscovery is the provider metadata retrieved from the well-known
+// discovery document of the issuer.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcDiscoveryTTL is how long a discovery document is cached for. Providers
+// rarely change their endpoints, and caching them means that starting a login
+// doesn't have to wait for the provider.
+const oidcDiscoveryTTL = time.Hour
+
+// oidcDiscoveries caches the discovery documents of the issuers.
+var oidcDiscoveries = struct {
+	sync.Mutex
+	docs map[string]cachedDiscovery
+}{docs: map[string]cachedDiscovery{}}
+
+// cachedDiscovery is a discovery document and when it was retrieved.
+type cachedDiscovery struct {
+	discovery *oidcDiscovery
+	fetchedAt time.Time
+}
+
+// discoverOIDC returns the discovery document of the issuer, retrieving it if
+// it hasn't been cached or the cached one is too old. Only documents that are
+// valid are cached.
+func discoverOIDC(issuer string) (*oidcDiscovery, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	oidcDiscoveries.Lock()
+	cached, ok := oidcDiscoveries.docs[issuer]
+	oidcDiscoveries.Unlock()
+	if ok && time.Since(cached.fetchedAt) < oidcDiscoveryTTL {
+		return cached.discovery, nil
+	}
+
+	d, err := fetchOIDCDiscovery(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcDiscoveries.Lock()
+	oidcDiscoveries.docs[issuer] = cachedDiscovery{discovery: d, fetchedAt: time.Now()}
+	oidcDiscoveries.Unlock()
+
+	return d, nil
+}
+
+// fetchOIDCDiscovery retrieves the discovery document of the issuer.
+func fetchOIDCDiscovery(issuer string) (*oidcDiscovery, error) {
+	var d oidcDiscovery
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve discovery document")
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document issuer %s does not match %s", d.Issuer, issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing required endpoints")
+	}
+
+	return &d, nil
+}
+
+// AuthURL returns the URL that the user is sent to in order to log in with the
+// identity provider.
+func (d *oidcDiscovery) AuthURL(p OIDCProvider, login OIDCLogin) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	v.Set("state", login.State)
+	v.Set("nonce", login.Nonce)
+	v.Set("code_challenge", pkceChallenge(login.Verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// Exchange trades the authorization code for the ID token of the user.
+func (d *oidcDiscovery) Exchange(p OIDCProvider, code, verifier string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("client_id", p.ClientID)
+	v.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "could not reach token endpoint")
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "could not decode token response")
+	}
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response did not contain an ID token")
+	}
+
+	return body.IDToken, nil
+}
+
+// oidcClaims are the claims in an ID token that Orbit makes use of. The raw
+// claims are kept so that the groups can be read from any claim.
+type oidcClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"` // Either a string or a list
+	Expiry            int64       `json:"exp"`
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"` // Some providers send a string
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+
+	raw map[string]interface{}
+}
+
+// Verified returns whether or not the provider has verified the email address.
+func (c oidcClaims) Verified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Groups returns the groups in the given claim. The claim can either be a list
+// of strings or a single string.
+func (c oidcClaims) Groups(claim string) []string {
+	if claim == "" {
+		claim = "groups"
+	}
+
+	var groups []string
+	switch v := c.raw[claim].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
+
+// hasAudience returns whether or not the token was issued for the client.
+func (c oidcClaims) hasAudience(clientID string) bool {
+	switch v := c.Audience.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verify checks the signature and the claims of the ID token, and returns the
+// claims if it is valid.
+func (d *oidcDiscovery) Verify(p OIDCProvider, idToken, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "could not decode ID token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode ID token signature")
+	}
+
+	// Find the key that the token was signed with and check the signature.
+	var keys struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := oidcGetJSON(d.JWKSURI, &keys); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve signing keys")
+	}
+
+	verified := false
+	for _, key := range keys.Keys {
+		if header.Kid != "" && key.Kid != header.Kid {
+			continue
+		}
+		if key.verify(header.Alg, []byte(parts[0]+"."+parts[1]), signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("ID token signature is invalid")
+	}
+
+	// The signature is valid, so the claims can now be checked.
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "could not decode ID token claims")
+	}
+	if err := decodeJWTPart(parts[1], &claims.raw); err != nil {
+		return nil, errors.Wrap(err, "could not decode ID token claims")
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(d.Issuer, "/"):
+		return nil, fmt.Errorf("ID token issuer %s is incorrect", claims.Issuer)
+	case !claims.hasAudience(p.ClientID):
+		return nil, fmt.Errorf("ID token was not issued for this client")
+	case time.Now().Unix() > claims.Expiry:
+		return nil, fmt.Errorf("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("ID token nonce is incorrect")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+
+	return &claims, nil
+}
+
+// jwk is a single public key from the JSON web key set of the provider. Only
+// RSA and P-256 elliptic curve keys are supported, as those are what providers
+// use to sign ID tokens.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify checks the signature of the data with the key.
+func (k jwk) verify(alg string, data, signature []byte) error {
+	switch {
+	case k.Kty == "RSA" && strings.HasPrefix(alg, "RS"):
+		hash := map[string]crypto.Hash{"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512}[alg]
+		if hash == 0 {
+			return fmt.Errorf("unsupported algorithm %s", alg)
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return err
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature)
+
+	case k.Kty == "EC" && k.Crv == "P-256" && alg == "ES256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return err
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("malformed signature")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		sum := sha256.Sum256(data)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, sum[:], r, s) {
+			return fmt.Errorf("signature is invalid")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported key type %s for algorithm %s", k.Kty, alg)
+}
+
+// decodeJWTPart decodes a base64 encoded JSON part of a JWT.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// oidcGetJSON retrieves and decodes a JSON document from the provider.
+func oidcGetJSON(url string, v interface{}) error {
+	res, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// pkceChallenge returns the S256 code challenge for the PKCE verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GenerateOIDCLogin creates the state, nonce and PKCE verifier for a new login
+// with the identity provider.
+func GenerateOIDCLogin(providerID string) OIDCLogin {
+	random := func() string {
+		b := make([]byte, 32)
+		rand.Read(b)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return OIDCLogin{
+		State:      random(),
+		ProviderID: providerID,
+		Verifier:   random(),
+		Nonce:      random(),
+		ExpiresAt:  time.Now().Add(oidcLoginTimeout),
+	}
+}
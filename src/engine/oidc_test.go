@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is an identity provider that serves the discovery document, the
+// signing keys and the token endpoint, and issues ID tokens with whatever
+// claims the test sets.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu          sync.Mutex
+	discoveries int
+	challenge   string                 // The PKCE challenge the login was started with
+	claims      map[string]interface{} // The claims of the next ID token
+	signer      *rsa.PrivateKey        // Signs the ID token if it isn't the key
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.discoveries++
+		m.mu.Unlock()
+
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jwk{{
+				Kty: "RSA",
+				Kid: "test",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		r.ParseForm()
+		if r.PostForm.Get("code") != "code" || pkceChallenge(r.PostForm.Get("code_verifier")) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t)})
+	})
+	m.Server = httptest.NewServer(mux)
+
+	return m
+}
+
+// sign returns an ID token with the claims, signed with RS256.
+func (m *mockIdP) sign(t *testing.T) string {
+	signer := m.signer
+	if signer == nil {
+		signer = m.key
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	claims, _ := json.Marshal(m.claims)
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(data))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login sends the login to the provider and returns the ID token with the
+// claims that the token endpoint gives for it.
+func (m *mockIdP) login(t *testing.T, p OIDCProvider, login OIDCLogin, claims map[string]interface{}) (*oidcDiscovery, string) {
+	d, err := discoverOIDC(m.URL)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+
+	u, err := url.Parse(d.AuthURL(p, login))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.mu.Lock()
+	m.challenge = u.Query().Get("code_challenge")
+	m.claims = claims
+	m.mu.Unlock()
+
+	idToken, err := d.Exchange(p, "code", login.Verifier)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	return d, idToken
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	m := newMockIdP(t)
+	defer m.Close()
+
+	d, err := discoverOIDC(m.URL + "/")
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	if d.TokenEndpoint != m.URL+"/token" {
+		t.Errorf("token endpoint is %s", d.TokenEndpoint)
+	}
+
+	// The document is cached, so it is only retrieved once.
+	if _, err := discoverOIDC(m.URL); err != nil {
+		t.Fatalf("cached discovery failed: %s", err)
+	}
+	m.mu.Lock()
+	if m.discoveries != 1 {
+		t.Errorf("discovery document was retrieved %d times", m.discoveries)
+	}
+	m.mu.Unlock()
+
+	// An issuer has to match the one in its discovery document.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	other := httptest.NewServer(mux)
+	defer other.Close()
+	if _, err := discoverOIDC(other.URL); err == nil {
+		t.Error("discovery with a mismatched issuer succeeded")
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	m := newMockIdP(t)
+	defer m.Close()
+
+	p := OIDCProvider{ID: "p", ClientID: "orbit", RedirectURL: "https://orbit.example/oidc/callback"}
+	d, err := discoverOIDC(m.URL)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+
+	login := GenerateOIDCLogin(p.ID)
+	u, err := url.Parse(d.AuthURL(p, login))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") != pkceChallenge(login.Verifier) {
+		t.Fatalf("auth URL has the wrong PKCE challenge: %s", u)
+	}
+	if q.Get("state") != login.State || q.Get("nonce") != login.Nonce {
+		t.Fatalf("auth URL has the wrong state or nonce: %s", u)
+	}
+
+	// The token endpoint only gives a token for the verifier of the challenge.
+	m.mu.Lock()
+	m.challenge = q.Get("code_challenge")
+	m.claims = map[string]interface{}{}
+	m.mu.Unlock()
+	if _, err := d.Exchange(p, "code", GenerateOIDCLogin(p.ID).Verifier); err == nil {
+		t.Error("exchange with the wrong verifier succeeded")
+	}
+	if _, err := d.Exchange(p, "code", login.Verifier); err != nil {
+		t.Errorf("exchange with the right verifier failed: %s", err)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	m := newMockIdP(t)
+	defer m.Close()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := OIDCProvider{ID: "p", ClientID: "orbit", RedirectURL: "https://orbit.example/oidc/callback"}
+	valid := func(login OIDCLogin) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   m.URL,
+			"sub":   "alice",
+			"aud":   []string{"other", "orbit"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": login.Nonce,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		signer *rsa.PrivateKey
+		valid  bool
+	}{
+		{name: "valid", valid: true},
+		{name: "signature", signer: other},
+		{name: "audience", change: func(c map[string]interface{}) { c["aud"] = "other" }},
+		{name: "issuer", change: func(c map[string]interface{}) { c["iss"] = "https://attacker.example" }},
+		{name: "expiry", change: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "nonce", change: func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+		{name: "subject", change: func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			login := GenerateOIDCLogin(p.ID)
+			claims := valid(login)
+			if test.change != nil {
+				test.change(claims)
+			}
+			m.mu.Lock()
+			m.signer = test.signer
+			m.mu.Unlock()
+
+			d, idToken := m.login(t, p, login, claims)
+			_, err := d.Verify(p, idToken, login.Nonce)
+			if test.valid && err != nil {
+				t.Errorf("valid ID token was rejected: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("invalid ID token was accepted")
+			}
+		})
+	}
+}
+
+func TestOIDCGroupMapping(t *testing.T) {
+	m := newMockIdP(t)
+	defer m.Close()
+
+	p := OIDCProvider{
+		ID:          "p",
+		ClientID:    "orbit",
+		RedirectURL: "https://orbit.example/oidc/callback",
+		GroupsClaim: "roles",
+		GroupMappings: []OIDCGroupMapping{
+			{Group: "devs", NamespaceID: "web", Role: RoleDeveloper},
+			{Group: "leads", NamespaceID: "web", Role: RoleAdmin},
+			{Group: "devs", NamespaceID: "db", Role: RoleViewer},
+			{Group: "ops", NamespaceID: "system", Role: RoleOwner},
+		},
+	}
+
+	login := GenerateOIDCLogin(p.ID)
+	d, idToken := m.login(t, p, login, map[string]interface{}{
+		"iss":   m.URL,
+		"sub":   "alice",
+		"aud":   "orbit",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": login.Nonce,
+		"roles": []string{"devs", "leads", "unmapped"},
+	})
+	claims, err := d.Verify(p, idToken, login.Nonce)
+	if err != nil {
+		t.Fatalf("valid ID token was rejected: %s", err)
+	}
+
+	groups := claims.Groups(p.GroupsClaim)
+	if strings.Join(groups, ",") != "devs,leads,unmapped" {
+		t.Fatalf("groups are %v", groups)
+	}
+
+	// The highest role is granted in each namespace, and namespaces that none
+	// of the groups match are included so that their roles can be revoked.
+	roles := p.Roles(groups)
+	expected := map[string]Role{"web": RoleAdmin, "db": RoleViewer, "system": ""}
+	if len(roles) != len(expected) {
+		t.Fatalf("roles are %v", roles)
+	}
+	for namespace, role := range expected {
+		if r, ok := roles[namespace]; !ok || r != role {
+			t.Errorf("role in %s is %q, expected %q", namespace, r, role)
+		}
+	}
+}
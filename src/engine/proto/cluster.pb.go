@@ -94,6 +94,7 @@ func (m *StatusResponse) GetStatus() Status {
 
 type JoinRequest struct {
 	JoinToken            string   `protobuf:"bytes,1,opt,name=join_token,json=joinToken,proto3" json:"join_token,omitempty"`
+	Csr                  []byte   `protobuf:"bytes,2,opt,name=csr,proto3" json:"csr,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -131,6 +132,13 @@ func (m *JoinRequest) GetJoinToken() string {
 	return ""
 }
 
+func (m *JoinRequest) GetCsr() []byte {
+	if m != nil {
+		return m.Csr
+	}
+	return nil
+}
+
 type JoinResponse struct {
 	AdvertiseAddr        string   `protobuf:"bytes,1,opt,name=advertise_addr,json=advertiseAddr,proto3" json:"advertise_addr,omitempty"`
 	Id                   string   `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
@@ -138,6 +146,9 @@ type JoinResponse struct {
 	SerfPort             uint32   `protobuf:"varint,4,opt,name=serf_port,json=serfPort,proto3" json:"serf_port,omitempty"`
 	WanSerfPort          uint32   `protobuf:"varint,5,opt,name=wan_serf_port,json=wanSerfPort,proto3" json:"wan_serf_port,omitempty"`
 	Status               Status   `protobuf:"varint,6,opt,name=status,proto3,enum=proto.Status" json:"status,omitempty"`
+	Certificate          []byte   `protobuf:"bytes,7,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	CaCertificate        []byte   `protobuf:"bytes,8,opt,name=ca_certificate,json=caCertificate,proto3" json:"ca_certificate,omitempty"`
+	Keyring              []byte   `protobuf:"bytes,9,opt,name=keyring,proto3" json:"keyring,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -210,6 +221,27 @@ func (m *JoinResponse) GetStatus() Status {
 	return Status_OK
 }
 
+func (m *JoinResponse) GetCertificate() []byte {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+func (m *JoinResponse) GetCaCertificate() []byte {
+	if m != nil {
+		return m.CaCertificate
+	}
+	return nil
+}
+
+func (m *JoinResponse) GetKeyring() []byte {
+	if m != nil {
+		return m.Keyring
+	}
+	return nil
+}
+
 type ConfirmJoinRequest struct {
 	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	RaftAddr             string   `protobuf:"bytes,2,opt,name=raft_addr,json=raftAddr,proto3" json:"raft_addr,omitempty"`
@@ -351,6 +383,233 @@ func (m *ForwardJoinRequest) GetAddress() string {
 	return ""
 }
 
+type KeyringRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyringRequest) Reset()         { *m = KeyringRequest{} }
+func (m *KeyringRequest) String() string { return proto.CompactTextString(m) }
+func (*KeyringRequest) ProtoMessage()    {}
+func (*KeyringRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{6}
+}
+
+func (m *KeyringRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyringRequest.Unmarshal(m, b)
+}
+func (m *KeyringRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyringRequest.Marshal(b, m, deterministic)
+}
+func (m *KeyringRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyringRequest.Merge(m, src)
+}
+func (m *KeyringRequest) XXX_Size() int {
+	return xxx_messageInfo_KeyringRequest.Size(m)
+}
+func (m *KeyringRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyringRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyringRequest proto.InternalMessageInfo
+
+type KeyringResponse struct {
+	Keyring              []byte   `protobuf:"bytes,1,opt,name=keyring,proto3" json:"keyring,omitempty"`
+	Status               Status   `protobuf:"varint,2,opt,name=status,proto3,enum=proto.Status" json:"status,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyringResponse) Reset()         { *m = KeyringResponse{} }
+func (m *KeyringResponse) String() string { return proto.CompactTextString(m) }
+func (*KeyringResponse) ProtoMessage()    {}
+func (*KeyringResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{7}
+}
+
+func (m *KeyringResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyringResponse.Unmarshal(m, b)
+}
+func (m *KeyringResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyringResponse.Marshal(b, m, deterministic)
+}
+func (m *KeyringResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyringResponse.Merge(m, src)
+}
+func (m *KeyringResponse) XXX_Size() int {
+	return xxx_messageInfo_KeyringResponse.Size(m)
+}
+func (m *KeyringResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyringResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyringResponse proto.InternalMessageInfo
+
+func (m *KeyringResponse) GetKeyring() []byte {
+	if m != nil {
+		return m.Keyring
+	}
+	return nil
+}
+
+func (m *KeyringResponse) GetStatus() Status {
+	if m != nil {
+		return m.Status
+	}
+	return Status_OK
+}
+
+type SetKeyringRequest struct {
+	Keyring              []byte   `protobuf:"bytes,1,opt,name=keyring,proto3" json:"keyring,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetKeyringRequest) Reset()         { *m = SetKeyringRequest{} }
+func (m *SetKeyringRequest) String() string { return proto.CompactTextString(m) }
+func (*SetKeyringRequest) ProtoMessage()    {}
+func (*SetKeyringRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{8}
+}
+
+func (m *SetKeyringRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetKeyringRequest.Unmarshal(m, b)
+}
+func (m *SetKeyringRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetKeyringRequest.Marshal(b, m, deterministic)
+}
+func (m *SetKeyringRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetKeyringRequest.Merge(m, src)
+}
+func (m *SetKeyringRequest) XXX_Size() int {
+	return xxx_messageInfo_SetKeyringRequest.Size(m)
+}
+func (m *SetKeyringRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetKeyringRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetKeyringRequest proto.InternalMessageInfo
+
+func (m *SetKeyringRequest) GetKeyring() []byte {
+	if m != nil {
+		return m.Keyring
+	}
+	return nil
+}
+
+type SignRequest struct {
+	Csr                  []byte   `protobuf:"bytes,1,opt,name=csr,proto3" json:"csr,omitempty"`
+	NodeId               string   `protobuf:"bytes,2,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	Ip                   string   `protobuf:"bytes,3,opt,name=ip,proto3" json:"ip,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SignRequest) Reset()         { *m = SignRequest{} }
+func (m *SignRequest) String() string { return proto.CompactTextString(m) }
+func (*SignRequest) ProtoMessage()    {}
+func (*SignRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{9}
+}
+
+func (m *SignRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SignRequest.Unmarshal(m, b)
+}
+func (m *SignRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SignRequest.Marshal(b, m, deterministic)
+}
+func (m *SignRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SignRequest.Merge(m, src)
+}
+func (m *SignRequest) XXX_Size() int {
+	return xxx_messageInfo_SignRequest.Size(m)
+}
+func (m *SignRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SignRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SignRequest proto.InternalMessageInfo
+
+func (m *SignRequest) GetCsr() []byte {
+	if m != nil {
+		return m.Csr
+	}
+	return nil
+}
+
+func (m *SignRequest) GetNodeId() string {
+	if m != nil {
+		return m.NodeId
+	}
+	return ""
+}
+
+func (m *SignRequest) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
+type SignResponse struct {
+	Certificate          []byte   `protobuf:"bytes,1,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	CaCertificate        []byte   `protobuf:"bytes,2,opt,name=ca_certificate,json=caCertificate,proto3" json:"ca_certificate,omitempty"`
+	Status               Status   `protobuf:"varint,3,opt,name=status,proto3,enum=proto.Status" json:"status,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SignResponse) Reset()         { *m = SignResponse{} }
+func (m *SignResponse) String() string { return proto.CompactTextString(m) }
+func (*SignResponse) ProtoMessage()    {}
+func (*SignResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{10}
+}
+
+func (m *SignResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SignResponse.Unmarshal(m, b)
+}
+func (m *SignResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SignResponse.Marshal(b, m, deterministic)
+}
+func (m *SignResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SignResponse.Merge(m, src)
+}
+func (m *SignResponse) XXX_Size() int {
+	return xxx_messageInfo_SignResponse.Size(m)
+}
+func (m *SignResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SignResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SignResponse proto.InternalMessageInfo
+
+func (m *SignResponse) GetCertificate() []byte {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+func (m *SignResponse) GetCaCertificate() []byte {
+	if m != nil {
+		return m.CaCertificate
+	}
+	return nil
+}
+
+func (m *SignResponse) GetStatus() Status {
+	if m != nil {
+		return m.Status
+	}
+	return Status_OK
+}
+
 func init() {
 	proto.RegisterEnum("proto.Status", Status_name, Status_value)
 	proto.RegisterType((*StatusResponse)(nil), "proto.StatusResponse")
@@ -359,39 +618,56 @@ func init() {
 	proto.RegisterType((*ConfirmJoinRequest)(nil), "proto.ConfirmJoinRequest")
 	proto.RegisterType((*ApplyRequest)(nil), "proto.ApplyRequest")
 	proto.RegisterType((*ForwardJoinRequest)(nil), "proto.ForwardJoinRequest")
+	proto.RegisterType((*KeyringRequest)(nil), "proto.KeyringRequest")
+	proto.RegisterType((*KeyringResponse)(nil), "proto.KeyringResponse")
+	proto.RegisterType((*SetKeyringRequest)(nil), "proto.SetKeyringRequest")
+	proto.RegisterType((*SignRequest)(nil), "proto.SignRequest")
+	proto.RegisterType((*SignResponse)(nil), "proto.SignResponse")
 }
 
 func init() { proto.RegisterFile("cluster.proto", fileDescriptor_3cfb3b8ec240c376) }
 
 var fileDescriptor_3cfb3b8ec240c376 = []byte{
-	// 425 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x51, 0x5d, 0x6b, 0xd4, 0x40,
-	0x14, 0x6d, 0xb2, 0xbb, 0xa9, 0xb9, 0xf9, 0x20, 0x5c, 0x11, 0x63, 0x45, 0x28, 0x01, 0xa1, 0x88,
-	0x16, 0xac, 0x88, 0xcf, 0xa1, 0x56, 0xad, 0x82, 0x5b, 0xa6, 0xed, 0x8b, 0x2f, 0x31, 0x75, 0x66,
-	0x21, 0x5a, 0x67, 0xe2, 0xcc, 0xac, 0x4b, 0xff, 0xa2, 0xff, 0xc7, 0x77, 0x99, 0x99, 0x24, 0x9b,
-	0x75, 0x69, 0x9f, 0x76, 0xe7, 0x9c, 0x73, 0xef, 0x3d, 0xe7, 0x04, 0x92, 0x6f, 0xd7, 0x4b, 0xa5,
-	0x99, 0x3c, 0x6c, 0xa5, 0xd0, 0x02, 0x67, 0xf6, 0xa7, 0x78, 0x03, 0xe9, 0xb9, 0xae, 0xf5, 0x52,
-	0x11, 0xa6, 0x5a, 0xc1, 0x15, 0xc3, 0xa7, 0x10, 0x28, 0x8b, 0xe4, 0xde, 0xbe, 0x77, 0x90, 0x1e,
-	0x25, 0x6e, 0xe0, 0xb0, 0x93, 0x75, 0x64, 0xf1, 0x1c, 0xa2, 0x8f, 0xa2, 0xe1, 0x84, 0xfd, 0x5a,
-	0x32, 0xa5, 0xf1, 0x09, 0xc0, 0x77, 0xd1, 0xf0, 0x4a, 0x8b, 0x1f, 0x8c, 0xdb, 0xc9, 0x90, 0x84,
-	0x06, 0xb9, 0x30, 0x40, 0xf1, 0xc7, 0x83, 0xd8, 0xc9, 0x87, 0x2b, 0x69, 0x4d, 0x7f, 0x33, 0xa9,
-	0x1b, 0xc5, 0xaa, 0x9a, 0x52, 0xd9, 0xcd, 0x24, 0x03, 0x5a, 0x52, 0x2a, 0x31, 0x05, 0xbf, 0xa1,
-	0xb9, 0x6f, 0x29, 0xbf, 0xa1, 0xf8, 0x18, 0x42, 0x59, 0x2f, 0x74, 0xd5, 0x0a, 0xa9, 0xf3, 0xc9,
-	0xbe, 0x77, 0x90, 0x90, 0x7b, 0x06, 0x38, 0x13, 0x52, 0x1b, 0x52, 0x31, 0xb9, 0x70, 0xe4, 0xd4,
-	0x91, 0x06, 0xb0, 0x64, 0x01, 0xc9, 0xaa, 0xe6, 0xd5, 0x5a, 0x30, 0xb3, 0x82, 0x68, 0x55, 0xf3,
-	0xf3, 0x5e, 0xb3, 0x8e, 0x1e, 0xdc, 0x15, 0xfd, 0x2b, 0xe0, 0xb1, 0xe0, 0x8b, 0x46, 0xfe, 0x1c,
-	0x37, 0xe0, 0xac, 0x7a, 0x5b, 0x56, 0x6d, 0x38, 0x97, 0xc0, 0x5a, 0xb5, 0xb9, 0x36, 0xeb, 0x9a,
-	0xfc, 0x5f, 0x57, 0x01, 0x71, 0xd9, 0xb6, 0xd7, 0x37, 0xfd, 0x6e, 0x84, 0xe9, 0x95, 0xa0, 0x37,
-	0x76, 0x7b, 0x4c, 0xec, 0xff, 0xe2, 0x3d, 0xe0, 0x3b, 0x21, 0x57, 0xb5, 0xa4, 0x63, 0x17, 0x0f,
-	0x61, 0x97, 0x0b, 0xca, 0xaa, 0xc1, 0x4a, 0x60, 0x9e, 0xa7, 0x14, 0x73, 0xd8, 0x35, 0x4e, 0x98,
-	0x52, 0x9d, 0x99, 0xfe, 0xf9, 0xec, 0x05, 0x04, 0x2e, 0x20, 0x06, 0xe0, 0xcf, 0x3f, 0x65, 0x3b,
-	0x98, 0x41, 0x7c, 0xf9, 0xb9, 0xbc, 0xbc, 0xf8, 0x30, 0x27, 0xa7, 0x5f, 0x4e, 0xde, 0x66, 0x1e,
-	0x86, 0x30, 0x3b, 0x21, 0x64, 0x4e, 0x32, 0xff, 0xe8, 0xaf, 0x07, 0x13, 0x72, 0x76, 0x8c, 0x2f,
-	0x61, 0x6a, 0x0e, 0x23, 0x76, 0x25, 0x8d, 0x5c, 0xec, 0xdd, 0xdf, 0xc0, 0xdc, 0x27, 0x2f, 0x76,
-	0xb0, 0x84, 0x68, 0x54, 0x1c, 0x3e, 0xea, 0x54, 0xdb, 0x65, 0xee, 0x3d, 0xd8, 0x6c, 0x7e, 0xbd,
-	0xe2, 0x35, 0xcc, 0x6c, 0x33, 0xd8, 0x9f, 0x18, 0xf7, 0x74, 0xfb, 0x58, 0x09, 0xd1, 0xa8, 0xac,
-	0xe1, 0xf2, 0x76, 0x81, 0xb7, 0xae, 0xb8, 0x0a, 0x2c, 0xfe, 0xea, 0x5f, 0x00, 0x00, 0x00, 0xff,
-	0xff, 0x86, 0x3f, 0xfa, 0x3c, 0x48, 0x03, 0x00, 0x00,
+	// 611 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x52, 0x4f, 0x6f, 0xd3, 0x4e,
+	0x10, 0xad, 0xed, 0xc6, 0xad, 0xc7, 0x76, 0xea, 0xdf, 0x56, 0x3f, 0x30, 0x41, 0x48, 0xd1, 0x4a,
+	0x48, 0x15, 0x52, 0x2b, 0x51, 0x84, 0xb8, 0xf0, 0x47, 0x51, 0x29, 0x6d, 0xa9, 0x44, 0xab, 0x4d,
+	0x7b, 0xe1, 0x62, 0x5c, 0x7b, 0x53, 0x99, 0x16, 0xaf, 0x59, 0x6f, 0xa9, 0x72, 0xe1, 0x1b, 0x71,
+	0xe2, 0x0b, 0xa2, 0x5d, 0xff, 0xc9, 0x3a, 0x21, 0x11, 0xa7, 0xc4, 0x6f, 0x66, 0xdf, 0xcc, 0x7b,
+	0xf3, 0xc0, 0x4f, 0x6e, 0xef, 0x4a, 0x41, 0xf9, 0x5e, 0xc1, 0x99, 0x60, 0xa8, 0xa7, 0x7e, 0xf0,
+	0x2b, 0xe8, 0x8f, 0x45, 0x2c, 0xee, 0x4a, 0x42, 0xcb, 0x82, 0xe5, 0x25, 0x45, 0x4f, 0xc1, 0x2e,
+	0x15, 0x12, 0x1a, 0x43, 0x63, 0xa7, 0xbf, 0xef, 0x57, 0x0f, 0xf6, 0xea, 0xb6, 0xba, 0x88, 0xdf,
+	0x82, 0xfb, 0x91, 0x65, 0x39, 0xa1, 0xdf, 0xef, 0x68, 0x29, 0xd0, 0x13, 0x80, 0xaf, 0x2c, 0xcb,
+	0x23, 0xc1, 0x6e, 0x68, 0xae, 0x5e, 0x3a, 0xc4, 0x91, 0xc8, 0x85, 0x04, 0x50, 0x00, 0x56, 0x52,
+	0xf2, 0xd0, 0x1c, 0x1a, 0x3b, 0x1e, 0x91, 0x7f, 0xf1, 0x2f, 0x13, 0xbc, 0x8a, 0xa0, 0x9d, 0xdb,
+	0x8f, 0xd3, 0x1f, 0x94, 0x8b, 0xac, 0xa4, 0x51, 0x9c, 0xa6, 0xbc, 0x66, 0xf1, 0x5b, 0x74, 0x94,
+	0xa6, 0x1c, 0xf5, 0xc1, 0xcc, 0x52, 0x45, 0xe4, 0x10, 0x33, 0x4b, 0xd1, 0x63, 0x70, 0x78, 0x3c,
+	0x11, 0x51, 0xc1, 0xb8, 0x08, 0xad, 0xa1, 0xb1, 0xe3, 0x93, 0x4d, 0x09, 0x9c, 0x33, 0x2e, 0x64,
+	0xb1, 0xa4, 0x7c, 0x52, 0x15, 0xd7, 0xab, 0xa2, 0x04, 0x54, 0x11, 0x83, 0x7f, 0x1f, 0xe7, 0xd1,
+	0xac, 0xa1, 0xa7, 0x1a, 0xdc, 0xfb, 0x38, 0x1f, 0x37, 0x3d, 0x33, 0x33, 0xec, 0x15, 0x66, 0xa0,
+	0x21, 0xb8, 0x89, 0xdc, 0x71, 0x92, 0x25, 0xb1, 0xa0, 0xe1, 0x86, 0x92, 0xa9, 0x43, 0x52, 0x5d,
+	0x12, 0x47, 0x7a, 0xd3, 0xa6, 0x6a, 0xf2, 0x93, 0xf8, 0x40, 0x6b, 0x0b, 0x61, 0xe3, 0x86, 0x4e,
+	0x79, 0x96, 0x5f, 0x87, 0x8e, 0xaa, 0x37, 0x9f, 0xf8, 0x0b, 0xa0, 0x03, 0x96, 0x4f, 0x32, 0xfe,
+	0x4d, 0xb7, 0xbd, 0x72, 0xc3, 0x58, 0x70, 0x43, 0xf9, 0x57, 0x99, 0xa4, 0xdc, 0x50, 0xd6, 0x75,
+	0x6f, 0x64, 0xcd, 0xdd, 0x08, 0x63, 0xf0, 0x46, 0x45, 0x71, 0x3b, 0x6d, 0xb8, 0x11, 0xac, 0x5f,
+	0xb1, 0x74, 0xaa, 0xd8, 0x3d, 0xa2, 0xfe, 0xe3, 0x23, 0x40, 0x1f, 0x18, 0xbf, 0x8f, 0x79, 0xaa,
+	0x6f, 0xf1, 0x10, 0x36, 0x72, 0x96, 0xd2, 0xa8, 0x5d, 0xc5, 0x96, 0x9f, 0x27, 0xa9, 0x94, 0x23,
+	0x37, 0xa1, 0x65, 0x59, 0x2f, 0xd3, 0x7c, 0xe2, 0x00, 0xfa, 0xa7, 0x95, 0xb2, 0x9a, 0x04, 0x13,
+	0xd8, 0x6a, 0x91, 0x3a, 0x12, 0x9a, 0x1b, 0x46, 0xc7, 0x0d, 0xed, 0x2e, 0xe6, 0xaa, 0x90, 0xee,
+	0xc2, 0x7f, 0x63, 0x2a, 0xba, 0x83, 0x96, 0xb3, 0xe2, 0x63, 0x70, 0xc7, 0xd9, 0x75, 0x2b, 0xab,
+	0x0e, 0xad, 0xd1, 0x86, 0x56, 0x17, 0x6a, 0x76, 0x84, 0xca, 0x3b, 0x14, 0xb5, 0xa5, 0x66, 0x56,
+	0xe0, 0x9f, 0xe0, 0x55, 0x4c, 0xb5, 0x92, 0xb9, 0x80, 0x18, 0xff, 0x12, 0x10, 0xf3, 0x6f, 0x01,
+	0x99, 0x09, 0xb7, 0x56, 0x08, 0x7f, 0xb6, 0x0b, 0x76, 0x85, 0x20, 0x1b, 0xcc, 0xb3, 0xd3, 0x60,
+	0x0d, 0x05, 0xe0, 0x5d, 0x7e, 0x1a, 0x5d, 0x5e, 0x1c, 0x9f, 0x91, 0x93, 0xcf, 0x87, 0xef, 0x03,
+	0x03, 0x39, 0xd0, 0x3b, 0x24, 0xe4, 0x8c, 0x04, 0xe6, 0xfe, 0x6f, 0x0b, 0x2c, 0x72, 0x7e, 0x80,
+	0x9e, 0xc3, 0xba, 0xbc, 0x2b, 0x42, 0x35, 0xab, 0x76, 0xe4, 0xc1, 0x76, 0x07, 0xab, 0x74, 0xe1,
+	0x35, 0x34, 0x02, 0x57, 0xcb, 0x25, 0x7a, 0x54, 0x77, 0x2d, 0x66, 0x75, 0xf0, 0x7f, 0x77, 0xd5,
+	0x19, 0xc5, 0x4b, 0xe8, 0xa9, 0xe0, 0xa1, 0x66, 0x84, 0x1e, 0xc3, 0xe5, 0xcf, 0x46, 0xe0, 0x6a,
+	0x59, 0x6c, 0x27, 0x2f, 0xe6, 0x73, 0x39, 0xc5, 0x1b, 0x80, 0xa3, 0x36, 0x1f, 0xa8, 0x69, 0xeb,
+	0xe6, 0x65, 0xf0, 0x60, 0x1e, 0x6e, 0x9f, 0xbf, 0x03, 0x98, 0xc5, 0x0b, 0x85, 0xcd, 0x94, 0xf9,
+	0xc4, 0x2d, 0x9f, 0xff, 0x1a, 0xb6, 0x64, 0x4c, 0xf4, 0x03, 0x37, 0xd6, 0x6b, 0x41, 0x1c, 0x6c,
+	0x77, 0xb0, 0xe6, 0xf5, 0x95, 0xad, 0xd0, 0x17, 0x7f, 0x06, 0x00, 0xc7, 0xa7, 0x52, 0xc2, 0xda,
+	0x05, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -414,6 +690,12 @@ type RPCClient interface {
 	Apply(ctx context.Context, in *ApplyRequest, opts ...grpc.CallOption) (*StatusResponse, error)
 	// When a node wishes to join us.
 	ForwardJoin(ctx context.Context, in *ForwardJoinRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// Retrieve the keyring that sensitive fields in the store are sealed with.
+	GetKeyring(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error)
+	// Add the first key of a new keyring to the node.
+	SetKeyring(ctx context.Context, in *SetKeyringRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// Sign the certificate of a node with the cluster CA.
+	SignCertificate(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error)
 }
 
 type rPCClient struct {
@@ -460,6 +742,33 @@ func (c *rPCClient) ForwardJoin(ctx context.Context, in *ForwardJoinRequest, opt
 	return out, nil
 }
 
+func (c *rPCClient) GetKeyring(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/proto.RPC/GetKeyring", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rPCClient) SetKeyring(ctx context.Context, in *SetKeyringRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/proto.RPC/SetKeyring", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rPCClient) SignCertificate(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, "/proto.RPC/SignCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // RPCServer is the server API for RPC service.
 type RPCServer interface {
 	// Join is for when a node wishes to join another node.
@@ -470,6 +779,12 @@ type RPCServer interface {
 	Apply(context.Context, *ApplyRequest) (*StatusResponse, error)
 	// When a node wishes to join us.
 	ForwardJoin(context.Context, *ForwardJoinRequest) (*StatusResponse, error)
+	// Retrieve the keyring that sensitive fields in the store are sealed with.
+	GetKeyring(context.Context, *KeyringRequest) (*KeyringResponse, error)
+	// Add the first key of a new keyring to the node.
+	SetKeyring(context.Context, *SetKeyringRequest) (*StatusResponse, error)
+	// Sign the certificate of a node with the cluster CA.
+	SignCertificate(context.Context, *SignRequest) (*SignResponse, error)
 }
 
 func RegisterRPCServer(s *grpc.Server, srv RPCServer) {
@@ -548,6 +863,60 @@ func _RPC_ForwardJoin_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RPC_GetKeyring_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RPCServer).GetKeyring(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.RPC/GetKeyring",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RPCServer).GetKeyring(ctx, req.(*KeyringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RPC_SetKeyring_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetKeyringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RPCServer).SetKeyring(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.RPC/SetKeyring",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RPCServer).SetKeyring(ctx, req.(*SetKeyringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RPC_SignCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RPCServer).SignCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.RPC/SignCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RPCServer).SignCertificate(ctx, req.(*SignRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _RPC_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "proto.RPC",
 	HandlerType: (*RPCServer)(nil),
@@ -568,6 +937,18 @@ var _RPC_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ForwardJoin",
 			Handler:    _RPC_ForwardJoin_Handler,
 		},
+		{
+			MethodName: "GetKeyring",
+			Handler:    _RPC_GetKeyring_Handler,
+		},
+		{
+			MethodName: "SetKeyring",
+			Handler:    _RPC_SetKeyring_Handler,
+		},
+		{
+			MethodName: "SignCertificate",
+			Handler:    _RPC_SignCertificate_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "cluster.proto",
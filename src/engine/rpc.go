@@ -2,14 +2,18 @@ package engine
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"orbit.sh/engine/gluster"
 	"orbit.sh/engine/proto"
@@ -21,14 +25,32 @@ type RPCServer struct {
 	server  *grpc.Server // The primary gRPC server instance
 	Port    int
 	started sync.WaitGroup
+
+	tlsMu sync.RWMutex
+	cert  *tls.Certificate // The certificate of this node
+	pool  *x509.CertPool   // Contains the cluster CA
 }
 
 // NewRPCServer returns a new instance of the RPC Server.
 func NewRPCServer(e *Engine) *RPCServer {
 	s := &RPCServer{
 		engine: e,
-		server: grpc.NewServer(),
 	}
+
+	// All RPC traffic uses mutual TLS with certificates issued by the cluster CA.
+	// The configuration is resolved per connection, as the node won't have a
+	// certificate until it has been bootstrapped or joined.
+	//
+	// A client certificate is only verified if one is given, as a node that is
+	// joining the cluster doesn't have one yet. Every method other than Join
+	// requires one.
+	creds := credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.serverConfig(tls.VerifyClientCertIfGiven, "h2")
+		},
+	})
+	s.server = grpc.NewServer(grpc.Creds(creds))
+
 	s.started.Add(1)
 	return s
 }
@@ -48,6 +70,11 @@ func (s *RPCServer) Started() <-chan struct{} {
 // Start will start the RPC server. It will only return if there is an error,
 // otherwise it will hang forever.
 func (s *RPCServer) Start() error {
+	// Load the certificate of this node if it has one.
+	if err := s.loadCertificate(); err != nil {
+		return errors.Wrap(err, "could not load node certificate")
+	}
+
 	// Register the RPC server. This uses a GRPC package that is auto generated.
 	proto.RegisterRPCServer(s.server, s)
 
@@ -67,7 +94,9 @@ func (s *RPCServer) Start() error {
 	return <-errCh
 }
 
-// Join handle receiving an RPC to join the server.
+// Join handle receiving an RPC to join the server. The node is issued a
+// certificate by the cluster CA for the signing request that it sends, which it
+// uses for every request after this one.
 func (s *RPCServer) Join(ctx context.Context, in *proto.JoinRequest) (*proto.JoinResponse, error) {
 	engine := s.engine
 	store := engine.Store
@@ -107,6 +136,26 @@ func (s *RPCServer) Join(ctx context.Context, in *proto.JoinRequest) (*proto.Joi
 	id := store.state.Nodes.GenerateNodeID()
 	res.Id = id
 
+	// Issue the node a certificate so that it can take part in the cluster. The
+	// leader signs it, even if the node is joining through this one.
+	cert, caCert, err := s.signCertificate(id, in.Csr, addr.IP)
+	if err != nil {
+		log.Printf("[ERR] rpc: Could not issue node certificate: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+	res.Certificate = cert
+	res.CaCertificate = caCert
+
+	// The node needs the keyring to open the sealed fields in the store.
+	keyring, err := store.keyring.Marshal()
+	if err != nil {
+		log.Printf("[ERR] rpc: Could not encode keyring: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+	res.Keyring = keyring
+
 	return res, nil
 }
 
@@ -128,6 +177,13 @@ func (s *RPCServer) ConfirmJoin(ctx context.Context, in *proto.ConfirmJoinReques
 		return res, nil
 	}
 
+	// The node must be using the certificate it was issued when it joined.
+	if id := peerNodeID(ctx); id == "" || id != in.Id {
+		log.Printf("[WARN] rpc: Rejected join confirmation for %s without its certificate", in.Id)
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+
 	// Perform the join operation.
 	addr, _ := net.ResolveTCPAddr("tcp", in.RaftAddr)
 	if err := store.Join(in.Id, *addr); err != nil {
@@ -155,8 +211,14 @@ func (s *RPCServer) Apply(ctx context.Context, in *proto.ApplyRequest) (*proto.S
 		Status: proto.Status_OK,
 	}
 
+	if !s.isMember(ctx) {
+		log.Printf("[WARN] rpc: Rejected apply from a node that is not a member of the cluster")
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+
 	f := s.engine.Store.raft.Apply(in.Body, s.engine.Store.RaftTimeout)
-	if err := f.Error(); err != nil {
+	if err := applyError(f); err != nil {
 		log.Printf("[ERR] store: %s", err)
 		res.Status = proto.Status_ERROR
 	}
@@ -165,8 +227,9 @@ func (s *RPCServer) Apply(ctx context.Context, in *proto.ApplyRequest) (*proto.S
 }
 
 // ForwardJoin is the method that handles us receiving a join request forwarded
-// to us from another node. This request is already authenticated, and it means
-// that we are the leader o the cluster, so this simply has to be applied.
+// to us from another node. The node that forwarded it must be a member of the
+// cluster, and it means that we are the leader of the cluster, so this simply
+// has to be applied.
 func (s *RPCServer) ForwardJoin(ctx context.Context, in *proto.ForwardJoinRequest) (*proto.StatusResponse, error) {
 	log.Printf("[INFO] rpc: Received forwarded join request")
 
@@ -174,6 +237,12 @@ func (s *RPCServer) ForwardJoin(ctx context.Context, in *proto.ForwardJoinReques
 		Status: proto.Status_OK,
 	}
 
+	if !s.isMember(ctx) {
+		log.Printf("[WARN] rpc: Rejected forwarded join from a node that is not a member of the cluster")
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp", in.Address)
 	if err != nil {
 		log.Printf("[ERR] rpc: Received forwarded request but can't parse TCP address: %v", err)
@@ -191,6 +260,112 @@ func (s *RPCServer) ForwardJoin(ctx context.Context, in *proto.ForwardJoinReques
 	return res, nil
 }
 
+// GetKeyring returns the keyring to a node that is missing some of its keys.
+func (s *RPCServer) GetKeyring(ctx context.Context, in *proto.KeyringRequest) (*proto.KeyringResponse, error) {
+	res := &proto.KeyringResponse{
+		Status: proto.Status_OK,
+	}
+
+	if !s.isMember(ctx) {
+		log.Printf("[WARN] rpc: Rejected keyring request from a node that is not a member of the cluster")
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+
+	keyring, err := s.engine.Store.keyring.Marshal()
+	if err != nil {
+		log.Printf("[ERR] rpc: Could not encode keyring: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+	res.Keyring = keyring
+
+	return res, nil
+}
+
+// SetKeyring receives the first key of the keyring from the leader, when it
+// creates one for a cluster from before there was a keyring.
+func (s *RPCServer) SetKeyring(ctx context.Context, in *proto.SetKeyringRequest) (*proto.StatusResponse, error) {
+	store := s.engine.Store
+
+	res := &proto.StatusResponse{
+		Status: proto.Status_OK,
+	}
+
+	if !s.isMember(ctx) {
+		log.Printf("[WARN] rpc: Rejected keyring from a node that is not a member of the cluster")
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+
+	if err := store.keyring.Merge(in.Keyring); err != nil {
+		log.Printf("[ERR] rpc: Could not merge keyring: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+	if err := store.keyring.Save(store.keyringPath()); err != nil {
+		log.Printf("[ERR] rpc: Could not save keyring: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+
+	return res, nil
+}
+
+// SignCertificate is called when another node wants the leader to sign the
+// certificate of a node. A node can only have a certificate signed for itself,
+// unless it is passing on the request of a new node that is joining through it,
+// in which case it has already checked the join token.
+func (s *RPCServer) SignCertificate(ctx context.Context, in *proto.SignRequest) (*proto.SignResponse, error) {
+	store := s.engine.Store
+
+	res := &proto.SignResponse{
+		Status: proto.Status_OK,
+	}
+
+	if !s.isMember(ctx) {
+		log.Printf("[WARN] rpc: Rejected sign request from a node that is not a member of the cluster")
+		res.Status = proto.Status_UNAUTHORIZED
+		return res, nil
+	}
+	if store.raft.State() != raft.Leader {
+		log.Printf("[ERR] rpc: Received sign request, but this node is not the leader")
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+
+	// A joining node always has a new ID, so a node can't be issued a
+	// certificate that lets it pretend to be another one.
+	nodeID := peerNodeID(ctx)
+	if in.NodeId != "" {
+		exists := false
+		store.mu.RLock()
+		for _, n := range store.state.Nodes {
+			if n.ID == in.NodeId {
+				exists = true
+			}
+		}
+		store.mu.RUnlock()
+		if exists || in.NodeId == peerNodeID(ctx) {
+			log.Printf("[WARN] rpc: Rejected sign request from %s for existing node %s", nodeID, in.NodeId)
+			res.Status = proto.Status_UNAUTHORIZED
+			return res, nil
+		}
+		nodeID = in.NodeId
+	}
+
+	cert, caCert, err := s.signCertificate(nodeID, in.Csr, net.ParseIP(in.Ip))
+	if err != nil {
+		log.Printf("[ERR] rpc: Could not sign node certificate: %s", err)
+		res.Status = proto.Status_ERROR
+		return res, nil
+	}
+	res.Certificate = cert
+	res.CaCertificate = caCert
+
+	return res, nil
+}
+
 // Leader gets the RPC address of the leader of the cluster.
 func (s *RPCServer) Leader() string {
 	opTimeout := time.Second * 20             // Length of time for operation timeouts.
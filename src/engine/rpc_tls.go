@@ -0,0 +1,370 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"orbit.sh/engine/proto"
+)
+
+// The files that the node certificate material is kept in, relative to the
+// "tls" directory in the data path.
+const (
+	nodeCertificateFile = "node.crt"
+	nodeKeyFile         = "node.key"
+	clusterCAFile       = "ca.crt"
+)
+
+// tlsPath returns the path of a file in the directory the node certificate
+// material is kept in.
+func (s *RPCServer) tlsPath(name string) string {
+	return filepath.Join(s.engine.DataPath, "tls", name)
+}
+
+// loadCertificate reads the certificate of this node and the cluster CA from
+// the data path. It is not an error for them not to exist yet, as that is the
+// case until the node has been bootstrapped or joined.
+func (s *RPCServer) loadCertificate() error {
+	certPEM, err := ioutil.ReadFile(s.tlsPath(nodeCertificateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(s.tlsPath(nodeKeyFile))
+	if err != nil {
+		return err
+	}
+	caPEM, err := ioutil.ReadFile(s.tlsPath(clusterCAFile))
+	if err != nil {
+		return err
+	}
+
+	return s.setCertificate(certPEM, keyPEM, caPEM)
+}
+
+// SetCertificate will use the certificate and key for all RPC traffic of this
+// node from now on, and save them to the data path so that they are used again
+// when the engine restarts. The peers of the node are verified against the CA.
+func (s *RPCServer) SetCertificate(certPEM, keyPEM, caPEM []byte) error {
+	if err := s.setCertificate(certPEM, keyPEM, caPEM); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.tlsPath(""), 0700); err != nil {
+		return errors.Wrap(err, "could not create tls directory")
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{nodeCertificateFile, certPEM, 0644},
+		{nodeKeyFile, keyPEM, 0600},
+		{clusterCAFile, caPEM, 0644},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(s.tlsPath(f.name), f.data, f.perm); err != nil {
+			return errors.Wrapf(err, "could not write %s", f.name)
+		}
+	}
+
+	log.Printf("[INFO] rpc: Updated node certificate")
+	return nil
+}
+
+// setCertificate parses and sets the certificate material without saving it.
+func (s *RPCServer) setCertificate(certPEM, keyPEM, caPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "could not parse node certificate")
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "could not parse node certificate")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("could not parse cluster CA certificate")
+	}
+
+	s.tlsMu.Lock()
+	defer s.tlsMu.Unlock()
+	s.cert = &cert
+	s.pool = pool
+
+	return nil
+}
+
+// certificate returns the current certificate of the node and the pool that
+// peers are verified against. Both are nil if the node has no certificate.
+func (s *RPCServer) certificate() (*tls.Certificate, *x509.CertPool) {
+	s.tlsMu.RLock()
+	defer s.tlsMu.RUnlock()
+	return s.cert, s.pool
+}
+
+// HasCertificate returns whether or not the node has a certificate.
+func (s *RPCServer) HasCertificate() bool {
+	cert, _ := s.certificate()
+	return cert != nil
+}
+
+// NeedsCertificate returns whether or not the node needs to be issued a new
+// certificate by the cluster CA. That's the case if it doesn't have one, if
+// it's about to expire, or if it wasn't issued by the CA.
+func (s *RPCServer) NeedsCertificate(ca ClusterCA) bool {
+	cert, _ := s.certificate()
+	if cert == nil || cert.Leaf.Subject.CommonName != s.engine.Store.ID {
+		return true
+	}
+	if time.Until(cert.Leaf.NotAfter) < nodeCertificateRenewal {
+		return true
+	}
+
+	pool, err := ca.Pool()
+	if err != nil {
+		return false // Nothing can be issued with a broken CA anyway
+	}
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err != nil
+}
+
+// IssueCertificate will issue this node a new certificate from the cluster CA.
+// The leader signs it, unless this node doesn't have a certificate to prove
+// who it is to the leader with. That is only the case for the nodes of a
+// cluster from before there was a CA, which sign their first one themselves.
+func (s *RPCServer) IssueCertificate(ca ClusterCA) error {
+	store := s.engine.Store
+
+	keyPEM, csrPEM, err := GenerateNodeKey()
+	if err != nil {
+		return err
+	}
+
+	var certPEM, caPEM []byte
+	if s.HasCertificate() || store.raft.State() == raft.Leader {
+		certPEM, caPEM, err = s.signCertificate(store.ID, csrPEM, store.AdvertiseAddr)
+	} else {
+		certPEM, err = ca.IssueNodeCertificate(store.ID, csrPEM, store.AdvertiseAddr)
+		caPEM = ca.Certificate
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.SetCertificate(certPEM, keyPEM, caPEM)
+}
+
+// signCertificate has the cluster CA sign the certificate signing request of a
+// node, returning the certificate and the certificate of the CA. Only the
+// leader signs certificates, so any other node sends the request to it.
+func (s *RPCServer) signCertificate(nodeID string, csrPEM []byte, ip net.IP) ([]byte, []byte, error) {
+	store := s.engine.Store
+
+	if store.raft.State() == raft.Leader {
+		store.mu.RLock()
+		ca := store.state.ClusterCA
+		store.mu.RUnlock()
+		if ca == nil {
+			return nil, nil, fmt.Errorf("cluster does not have a CA")
+		}
+
+		certPEM, err := ca.IssueNodeCertificate(nodeID, csrPEM, ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certPEM, ca.Certificate, nil
+	}
+
+	leaderAddr := s.Leader()
+	if leaderAddr == "" {
+		return nil, nil, fmt.Errorf("could not retrieve leader address")
+	}
+	conn, err := s.Dial(leaderAddr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, fmt.Sprintf("could not dial %s", leaderAddr))
+	}
+	defer conn.Close()
+
+	// The leader takes the ID of this node from its certificate, so the ID is
+	// only sent for a node that is joining through this one.
+	req := &proto.SignRequest{Csr: csrPEM}
+	if ip != nil {
+		req.Ip = ip.String()
+	}
+	if nodeID != store.ID {
+		req.NodeId = nodeID
+	}
+
+	res, err := proto.NewRPCClient(conn).SignCertificate(context.Background(), req)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not perform the remote sign request")
+	}
+	if res.Status != proto.Status_OK {
+		return nil, nil, fmt.Errorf("leader did not sign the certificate")
+	}
+	return res.Certificate, res.CaCertificate, nil
+}
+
+// serverConfig returns the TLS configuration for a connection to this node.
+// This is resolved for every connection so that a new certificate is picked up
+// without restarting the server.
+func (s *RPCServer) serverConfig(clientAuth tls.ClientAuthType, nextProtos ...string) (*tls.Config, error) {
+	cert, pool := s.certificate()
+	if cert == nil {
+		return nil, fmt.Errorf("node does not have a certificate")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    pool,
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   nextProtos,
+	}, nil
+}
+
+// clientConfig returns the TLS configuration for connecting to another node.
+// The certificate of the other node has to be issued by the cluster CA, but as
+// nodes are often reached through an address other than the one they advertise,
+// the host name isn't checked.
+func (s *RPCServer) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := s.certificate(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		InsecureSkipVerify: true, // The chain is verified below instead
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := s.certificate()
+			if pool == nil {
+				return fmt.Errorf("node does not have a cluster CA to verify peers with")
+			}
+			return verifyPeerCertificate(pool, rawCerts)
+		},
+	}
+}
+
+// Dial creates a mutual TLS connection to the RPC server of another node.
+func (s *RPCServer) Dial(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(s.clientConfig())))
+}
+
+// DialJoin creates a connection to the RPC server of a node in the cluster that
+// this node wishes to join. At this point there is no cluster CA to verify the
+// node with, so the caller has to check the certificate of the node against
+// the CA it receives with verifyJoinPeer.
+func DialJoin(addr string) (*grpc.ClientConn, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // Verified by verifyJoinPeer
+	}
+	return grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+}
+
+// verifyJoinPeer checks that the node that responded to a join request has a
+// certificate issued by the cluster CA that it returned.
+func verifyJoinPeer(p *peer.Peer, caPEM []byte) error {
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return fmt.Errorf("connection is not using tls")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("could not parse cluster CA certificate")
+	}
+
+	var rawCerts [][]byte
+	for _, cert := range info.State.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+	return verifyPeerCertificate(pool, rawCerts)
+}
+
+// verifyPeerCertificate checks that the certificate chain presented by a node
+// was issued by the cluster CA.
+func verifyPeerCertificate(pool *x509.CertPool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer did not present a certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Wrap(err, "could not parse peer certificate")
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// peerNodeID returns the ID of the node that made the request, from the
+// certificate that it presented. It returns an empty string if it didn't
+// present a certificate issued by the cluster CA.
+func peerNodeID(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// isMember returns whether or not the request was made by a node that is a
+// member of the cluster. That means it has a certificate issued by the cluster
+// CA and is part of the raft configuration, so a node that has been removed
+// can't keep using its certificate.
+func (s *RPCServer) isMember(ctx context.Context) bool {
+	id := peerNodeID(ctx)
+	if id == "" {
+		return false
+	}
+
+	f := s.engine.Store.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		log.Printf("[ERR] rpc: Could not get raft configuration: %s", err)
+		return false
+	}
+	for _, server := range f.Configuration().Servers {
+		if string(server.ID) == id {
+			return true
+		}
+	}
+	return false
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/pkg/errors"
-	"google.golang.org/grpc"
 	"orbit.sh/engine/proto"
 )
 
@@ -32,9 +31,11 @@ type Store struct {
 	RaftTimeout         time.Duration
 	RaftMaxPool         int
 
-	mu    sync.RWMutex
-	state *StoreState
-	raft  *raft.Raft // Primary consensus mechanism
+	mu      sync.RWMutex
+	state   *StoreState
+	raft    *raft.Raft // Primary consensus mechanism
+	keyring *Keyring   // Seals the sensitive fields of the state on disk
+	audit   *auditStore
 
 	started sync.WaitGroup
 }
@@ -52,7 +53,9 @@ func NewStore(e *Engine) *Store {
 		RaftTimeout:         10 * time.Second,
 		RaftMaxPool:         7,
 
-		state: &StoreState{},
+		state:   &StoreState{},
+		keyring: &Keyring{},
+		audit:   &auditStore{last: map[string]uint64{}},
 	}
 
 	s.started.Add(1)
@@ -89,6 +92,12 @@ func (s *Store) Open() error {
 		s.engine.writeConfig() // Ensure we keep the ID
 	}
 
+	// Load the keyring, which is needed to open the sealed fields in the raft
+	// log and snapshots.
+	if err := s.keyring.Load(s.keyringPath()); err != nil {
+		return errors.Wrap(err, "could not load keyring")
+	}
+
 	// Set up raft configuration.
 	raftConfig := raft.DefaultConfig()
 	raftConfig.LocalID = raft.ServerID(s.ID)
@@ -98,10 +107,11 @@ func (s *Store) Open() error {
 	if err != nil {
 		return errors.Wrap(err, "could not resolve tcp address")
 	}
-	transport, err := raft.NewTCPTransport(fmt.Sprintf("%s", addr), addr, s.RaftMaxPool, s.RaftTimeout, os.Stderr)
+	layer, err := newRaftLayer(s, addr)
 	if err != nil {
 		return errors.Wrap(err, "could not create tcp transport")
 	}
+	transport := raft.NewNetworkTransport(layer, s.RaftMaxPool, s.RaftTimeout, os.Stderr)
 
 	// Create the store instances.
 	var (
@@ -184,6 +194,8 @@ func (s *Store) GenerateNodeDetails() *Node {
 		RaftPort:    s.RaftPort,
 		SerfPort:    s.SerfPort,
 		WANSerfPort: s.WANSerfPort,
+
+		TLS: s.engine.RPCServer.HasCertificate(),
 	}
 }
 
@@ -203,7 +215,7 @@ func (s *Store) Join(nodeID string, addr net.TCPAddr) error {
 		}
 
 		// Connect to the leader.
-		conn, err := grpc.Dial(leader, grpc.WithInsecure())
+		conn, err := s.engine.RPCServer.Dial(leader)
 		if err != nil {
 			log.Printf("[ERR] store: Could not dial the leader of the cluster: %v", err)
 			return err
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// accountLockoutThreshold is the number of failed attempts against a single
+	// account before it is locked.
+	accountLockoutThreshold = 5
+	// ipLockoutThreshold is the number of failed attempts from a single IP
+	// address before it is locked. This is higher than for accounts as a whole
+	// office can share an address.
+	ipLockoutThreshold = 20
+
+	// loginBackoff is how long a client has to wait after their first failed
+	// attempt. It doubles with every failed attempt after that, up to the
+	// maximum.
+	loginBackoff    = time.Second
+	loginBackoffMax = time.Minute
+	// loginLockout is how long an account or IP address is locked for once it
+	// reaches its threshold.
+	loginLockout = 15 * time.Minute
+	// loginAttemptWindow is how long failed attempts are remembered for when
+	// there hasn't been another one.
+	loginAttemptWindow = 15 * time.Minute
+	// loginAttemptLimit is the most accounts and IP addresses that failed
+	// attempts are kept for. Once it is reached, the ones that failed longest
+	// ago are forgotten first.
+	loginAttemptLimit = 10000
+)
+
+// LoginAttempts keeps track of failed attempts to log in (through either the
+// API or the git server). These are in the store so that the limits hold no
+// matter which node receives the request.
+type LoginAttempts []LoginAttempt
+
+// LoginAttempt is the record of failed attempts for a single account or IP
+// address, identified by keys such as "user:alice" or "ip:10.0.0.1".
+type LoginAttempt struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// accountAttemptKey returns the key used to record attempts against an
+// account. Accounts that don't exist get a key too, so that they behave exactly
+// the same as ones that do, but their attempts are never kept in the store.
+func accountAttemptKey(users *Users, identifier string) string {
+	if user := users.Find(identifier); user != nil {
+		return "user:" + user.ID
+	}
+	return "user:" + strings.ToLower(identifier)
+}
+
+// ipAttemptKey returns the key used to record attempts from an IP address.
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// attemptKeyStored returns whether or not attempts against the key are kept in
+// the store. Attempts against accounts that don't exist aren't, as anybody can
+// make up as many of them as they like.
+func (s *StoreState) attemptKeyStored(key string) bool {
+	if !strings.HasPrefix(key, "user:") {
+		return true
+	}
+	i, _ := s.Users.FindByID(strings.TrimPrefix(key, "user:"))
+	return i != -1
+}
+
+// threshold returns the number of failures before the key is locked.
+func (a LoginAttempt) threshold() int {
+	if strings.HasPrefix(a.Key, "ip:") {
+		return ipLockoutThreshold
+	}
+	return accountLockoutThreshold
+}
+
+// RetryAt returns the time after which another attempt can be made. The wait
+// doubles with every failure until the threshold is reached, at which point it
+// is locked out for a while.
+func (a LoginAttempt) RetryAt() time.Time {
+	if a.Failures == 0 {
+		return time.Time{}
+	}
+	if a.Failures >= a.threshold() {
+		return a.LastFailure.Add(loginLockout)
+	}
+
+	wait := loginBackoffMax
+	if a.Failures <= 16 {
+		if d := loginBackoff << uint(a.Failures-1); d < wait {
+			wait = d
+		}
+	}
+	return a.LastFailure.Add(wait)
+}
+
+// Expired returns whether or not the attempts can be forgotten at the given
+// time.
+func (a LoginAttempt) Expired(now time.Time) bool {
+	forget := a.LastFailure.Add(loginAttemptWindow)
+	if retry := a.RetryAt(); retry.After(forget) {
+		forget = retry
+	}
+	return now.After(forget)
+}
+
+// Find returns the attempts recorded for the key, or nil if there aren't any.
+func (l *LoginAttempts) Find(key string) *LoginAttempt {
+	for _, a := range *l {
+		if a.Key == key {
+			return &a
+		}
+	}
+	return nil
+}
+
+// RetryAfter returns how long the client has to wait before another attempt
+// can be made against any of the keys. It returns zero if they can try now.
+func (l *LoginAttempts) RetryAfter(now time.Time, keys ...string) time.Duration {
+	var wait time.Duration
+	for _, key := range keys {
+		a := l.Find(key)
+		if a == nil || a.Expired(now) {
+			continue
+		}
+		if d := a.RetryAt().Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt against the key at the given time.
+func (l *LoginAttempts) Fail(key string, now time.Time) {
+	for i, a := range *l {
+		if a.Key == key {
+			if a.Expired(now) {
+				a.Failures = 0
+			}
+			(*l)[i].Failures = a.Failures + 1
+			(*l)[i].LastFailure = now
+			return
+		}
+	}
+
+	// Make room for the key by forgetting the attempts that failed longest ago,
+	// so that the attempts can't grow without limit.
+	if len(*l) >= loginAttemptLimit {
+		oldest := 0
+		for i, a := range *l {
+			if a.LastFailure.Before((*l)[oldest].LastFailure) {
+				oldest = i
+			}
+		}
+		*l = append((*l)[:oldest], (*l)[oldest+1:]...)
+	}
+
+	*l = append(*l, LoginAttempt{Key: key, Failures: 1, LastFailure: now})
+}
+
+// Clear forgets the failed attempts against the key.
+func (l *LoginAttempts) Clear(key string) {
+	for i, a := range *l {
+		if a.Key == key {
+			*l = append((*l)[:i], (*l)[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditChunkSize is the size that a chunk of the audit log can grow to
+	// before entries are written to a new one.
+	auditChunkSize = 4 * 1024 * 1024
+
+	// auditAnonymousChunks is the number of chunks of anonymous entries that
+	// are kept. Anybody can cause these, so only the newest are kept, while
+	// the entries of everything else are kept forever.
+	auditAnonymousChunks = 8
+)
+
+// opNames are the names of the operations as they appear in the audit log.
+var opNames = map[op]string{
+	opEmpty:                  "empty",
+	opNewUser:                "new_user",
+	opRemoveUser:             "remove_user",
+	opNewSession:             "new_session",
+	opRevokeSession:          "revoke_session",
+	opRevokeAllSessions:      "revoke_all_sessions",
+	opSetJoinTokens:          "set_join_tokens",
+	opNewNode:                "new_node",
+	opUpdateNode:             "update_node",
+	opNewNamespace:           "new_namespace",
+	opNewRepository:          "new_repository",
+	opNewDeployment:          "new_deployment",
+	opAppendBuildLog:         "append_build_log",
+	opClearBuildLog:          "clear_build_log",
+	opNewRouter:              "new_router",
+	opUpdateRouter:           "update_router",
+	opRemoveRouter:           "remove_router",
+	opNewCertificate:         "new_certificate",
+	opUpdateCertificate:      "update_certificate",
+	opRemoveCertificate:      "remove_certificate",
+	opNewVolume:              "new_volume",
+	opUpdateVolumeBrick:      "update_volume_brick",
+	opRemoveVolume:           "remove_volume",
+	opGrantRole:              "grant_role",
+	opRevokeRole:             "revoke_role",
+	opNewAPIToken:            "new_api_token",
+	opRevokeAPIToken:         "revoke_api_token",
+	opTouchAPIToken:          "touch_api_token",
+	opTouchSession:           "touch_session",
+	opExpireSessions:         "expire_sessions",
+	opSetTOTP:                "set_totp",
+	opNewLoginChallenge:      "new_login_challenge",
+	opCompleteLoginChallenge: "complete_login_challenge",
+	opNewOIDCProvider:        "new_oidc_provider",
+	opUpdateOIDCProvider:     "update_oidc_provider",
+	opRemoveOIDCProvider:     "remove_oidc_provider",
+	opNewOIDCLogin:           "new_oidc_login",
+	opRemoveOIDCLogin:        "remove_oidc_login",
+	opLinkIdentity:           "link_identity",
+	opUpdateUser:             "update_user",
+	opRevokeOtherSessions:    "revoke_other_sessions",
+	opLoginFailure:           "login_failure",
+	opLoginSuccess:           "login_success",
+	opSetClusterCA:           "set_cluster_ca",
+	opSetNodeTLS:             "set_node_tls",
+	opNewSecret:              "new_secret",
+	opUpdateSecret:           "update_secret",
+	opRemoveSecret:           "remove_secret",
+	opSetDeploymentSecrets:   "set_deployment_secrets",
+	opSetDeploymentEnv:       "set_deployment_env",
+	opSetDeploymentImage:     "set_deployment_image",
+	opNewRelease:             "new_release",
+	opSetDeploymentWebhook:   "set_deployment_webhook",
+	opSetRepositoryUpstream:  "set_repository_upstream",
+	opNewBuild:               "new_build",
+	opUpdateBuild:            "update_build",
+	opCancelBuild:            "cancel_build",
+	opSetLogRetention:        "set_deployment_log_retention",
+	opSetDeploymentBuilder:   "set_deployment_builder",
+	opSetBuildConfig:         "set_deployment_build_config",
+	opSetFormation:           "set_deployment_formation",
+	opMigrateRoles:           "migrate_roles",
+	opSetPassword:            "set_password",
+	opSetPasswordReset:       "set_password_reset",
+	opRemoveProfile:          "remove_profile",
+	opRotateKeyring:          "rotate_keyring",
+	opTouchBuild:             "touch_build",
+	opNewOwner:               "new_owner",
+}
+
+// String returns the name of the operation.
+func (o op) String() string {
+	if name, ok := opNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("op_%d", o)
+}
+
+// unaudited are the operations that are left out of the audit log. These are
+// the bookkeeping that happens as a side effect of other requests, and
+// recording them would drown out everything else.
+var unaudited = map[op]bool{
+	opTouchSession:   true,
+	opTouchAPIToken:  true,
+	opAppendBuildLog: true,
+	opTouchBuild:     true,
+}
+
+// anonymous are the operations that can be caused by anybody, without logging
+// in. These are written to their own part of the audit log, so that they can't
+// drown out or push out the record of everything else.
+var anonymous = map[op]bool{
+	opLoginFailure:    true,
+	opLoginSuccess:    true,
+	opNewOIDCLogin:    true,
+	opRemoveOIDCLogin: true,
+}
+
+// Actor is whoever caused a command to be applied. Commands applied by Orbit
+// itself (such as by the watcher) don't have a user.
+type Actor struct {
+	UserID   string `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	TokenID  string `json:"token_id,omitempty"` // If the request used an API token
+	IP       string `json:"ip,omitempty"`
+}
+
+// AuditEntry records a single command that has been applied to the store.
+type AuditEntry struct {
+	Index   uint64    `json:"index"` // Index of the command in the raft log
+	Time    time.Time `json:"time"`
+	Actor   Actor     `json:"actor"`
+	Op      string    `json:"op"`
+	Target  string    `json:"target"`  // The ID of the resource that was changed
+	Outcome string    `json:"outcome"` // Either "ok" or the error
+}
+
+// AuditLog is a list of entries in the audit log, oldest first.
+type AuditLog []AuditEntry
+
+// AuditFilter narrows down the entries in the audit log. Empty fields match
+// every entry.
+type AuditFilter struct {
+	User    string // User ID or username
+	Op      string
+	Target  string
+	Outcome string // "ok" or "error"
+	Since   time.Time
+	Until   time.Time
+}
+
+// Match returns whether or not the entry matches the filter.
+func (f AuditFilter) Match(e AuditEntry) bool {
+	switch {
+	case f.User != "" && e.Actor.UserID != f.User && e.Actor.Username != f.User:
+		return false
+	case f.Op != "" && e.Op != f.Op:
+		return false
+	case f.Target != "" && e.Target != f.Target:
+		return false
+	case f.Outcome == "ok" && e.Outcome != "ok":
+		return false
+	case f.Outcome == "error" && e.Outcome == "ok":
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// Filter returns the entries that match the filter, oldest first.
+func (a *AuditLog) Filter(f AuditFilter) AuditLog {
+	entries := AuditLog{}
+	for _, e := range *a {
+		if f.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// auditTarget returns the ID of the resource that the command changes. This has
+// to be worked out before the command is applied, as some commands (such as
+// revoking a session) remove the only thing that identifies them.
+func (s *StoreState) auditTarget(c command) string {
+	switch c.Op {
+	case opRevokeSession, opTouchSession:
+		// Never record the session token itself.
+		if user, session := s.Users.FindBySession(c.Session.Token); user != nil {
+			return user.ID + "/" + session.ID
+		}
+		return ""
+	case opNewSession:
+		return c.User.ID + "/" + c.Session.ID
+	case opGrantRole, opRevokeRole:
+		return c.RoleBinding.UserID + "@" + c.RoleBinding.NamespaceID
+	case opNewAPIToken, opRevokeAPIToken, opTouchAPIToken:
+		return c.User.ID + "/" + c.APIToken.ID
+	case opNewOIDCLogin, opRemoveOIDCLogin:
+		return c.OIDCLogin.ProviderID
+	case opLoginFailure, opLoginSuccess:
+		return strings.Join(c.AttemptKeys, ",")
+	}
+
+	// Otherwise, it's the first resource in the command that has an ID.
+	for _, id := range []string{
+		c.User.ID,
+		c.Node.ID,
+		c.Router.ID,
+		c.Certificate.ID,
+		c.Namespace.ID,
+		c.Repository.ID,
+		c.Volume.ID,
+		c.Deployment.ID,
+		c.OIDCProvider.ID,
+		c.Secret.ID,
+		c.Release.DeploymentID,
+		c.Build.ID,
+	} {
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// auditOutcome describes the result of applying a command.
+func auditOutcome(res interface{}) string {
+	if err, ok := res.(error); ok && err != nil {
+		return "error: " + err.Error()
+	}
+	return "ok"
+}
+
+// auditStore writes the audit log to append-only files in the data directory
+// of the node, rather than keeping it in the store state, so that it doesn't
+// grow the snapshots and nothing ever has to be dropped from it. Every node
+// writes the entries of the commands that it applies.
+type auditStore struct {
+	mu   sync.Mutex
+	last map[string]uint64 // The index of the last entry in each part of the log
+}
+
+// auditParts are the parts that the audit log is split into, which are the
+// names of their directories.
+var auditParts = []string{"mutations", "anonymous"}
+
+// auditDir returns the directory that the part of the audit log is written to.
+func (s *Store) auditDir(part string) string {
+	return filepath.Join(s.engine.DataPath, "audit", part)
+}
+
+// appendAudit writes the entry to the end of the audit log. Raft replays the
+// commands after the last snapshot when a node restarts, so entries that have
+// been written already are skipped.
+func (s *Store) appendAudit(entry AuditEntry, anonymous bool) error {
+	part := auditParts[0]
+	if anonymous {
+		part = auditParts[1]
+	}
+	dir := s.auditDir(part)
+
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	chunks, err := auditChunks(dir)
+	if err != nil {
+		return err
+	}
+
+	last, ok := s.audit.last[part]
+	if !ok {
+		if last, err = lastAuditIndex(chunks); err != nil {
+			return err
+		}
+		s.audit.last[part] = last
+	}
+	if entry.Index <= last {
+		return nil
+	}
+
+	// Find the chunk to write to, starting a new one if the last one is full.
+	path := filepath.Join(dir, fmt.Sprintf("%06d.jsonl", 0))
+	if len(chunks) > 0 {
+		path = chunks[len(chunks)-1]
+		if info, err := os.Stat(path); err == nil && info.Size() >= auditChunkSize {
+			var n int
+			fmt.Sscanf(filepath.Base(path), "%06d.jsonl", &n)
+			path = filepath.Join(dir, fmt.Sprintf("%06d.jsonl", n+1))
+			chunks = append(chunks, path)
+		}
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.audit.last[part] = entry.Index
+
+	// Only the newest anonymous entries are kept.
+	if anonymous {
+		for len(chunks) > auditAnonymousChunks {
+			os.Remove(chunks[0])
+			chunks = chunks[1:]
+		}
+	}
+
+	return nil
+}
+
+// ReadAudit returns the entries of the audit log that match the filter, oldest
+// first.
+func (s *Store) ReadAudit(f AuditFilter) (AuditLog, error) {
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+
+	entries := AuditLog{}
+	for _, part := range auditParts {
+		chunks, err := auditChunks(s.auditDir(part))
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if err := readAuditChunk(chunk, func(e AuditEntry) {
+				if f.Match(e) {
+					entries = append(entries, e)
+				}
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+	return entries, nil
+}
+
+// auditChunks returns the paths of the chunks of a part of the audit log, in
+// order.
+func auditChunks(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".jsonl") {
+			chunks = append(chunks, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(chunks) // The names are zero padded, so this is numerical order
+	return chunks, nil
+}
+
+// readAuditChunk calls the function with every entry in the chunk. A line that
+// was only partly written (such as when the node crashed) is skipped.
+func readAuditChunk(path string, fn func(AuditEntry)) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, auditChunkSize)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+// lastAuditIndex returns the index of the last entry in the chunks.
+func lastAuditIndex(chunks []string) (uint64, error) {
+	var last uint64
+	for i := len(chunks) - 1; i >= 0 && last == 0; i-- {
+		if err := readAuditChunk(chunks[i], func(e AuditEntry) {
+			if e.Index > last {
+				last = e.Index
+			}
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,480 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// buildConcurrency is the number of builds that can run across the whole
+	// cluster at once. Builds after that wait in the queue.
+	buildConcurrency = 2
+
+	// buildLimit is the number of finished builds kept for each deployment.
+	buildLimit = 50
+
+	// buildHeartbeatInterval is how often the node running a build reports that
+	// it is still running it.
+	buildHeartbeatInterval = 30 * time.Second
+	// buildStaleAfter is how long a running build can go without being reported
+	// before it is failed, as the node running it must have stopped.
+	buildStaleAfter = 5 * time.Minute
+)
+
+// BuildState is the stage of its life that a build is at.
+type BuildState string
+
+const (
+	// BuildQueued means that the build is waiting to be assigned to a node.
+	BuildQueued BuildState = "queued"
+	// BuildRunning means that the build has been assigned to a node, which is
+	// building and deploying it.
+	BuildRunning BuildState = "running"
+	// BuildSucceeded means that the build was deployed as a new release.
+	BuildSucceeded BuildState = "succeeded"
+	// BuildFailed means that the build or the deploy after it failed.
+	BuildFailed BuildState = "failed"
+	// BuildCancelled means that the build was cancelled before it finished.
+	BuildCancelled BuildState = "cancelled"
+)
+
+// Finished returns whether or not a build in the state can still change.
+func (s BuildState) Finished() bool {
+	return s == BuildSucceeded || s == BuildFailed || s == BuildCancelled
+}
+
+// Build is a request to build a deployment and deploy it as a new release. The
+// builds are kept in the store, so that they are scheduled across the cluster
+// and carry on even if the client that asked for them goes away.
+//
+// Rolling back to an earlier release is a build as well, which deploys the
+// release instead of building anything. That way it waits for the builds of
+// the deployment before it, and the releases happen in order.
+type Build struct {
+	ID           string     `json:"id"`
+	DeploymentID string     `json:"deployment_id"`
+	NamespaceID  string     `json:"namespace_id"`
+	State        BuildState `json:"state"`
+	NodeID       string     `json:"node_id,omitempty"`     // The node that the build runs on
+	RollbackOf   string     `json:"rollback_of,omitempty"` // The release to roll back to
+	LastSeen     time.Time  `json:"last_seen,omitempty"`   // When the node last reported that it is running the build
+
+	Commit    string `json:"commit,omitempty"`     // The hash of the commit, once it has been checked out
+	LogKey    string `json:"log_key,omitempty"`    // The key of the build log, once it has started
+	LogSize   int64  `json:"log_size,omitempty"`   // The number of bytes in the build log, once it has finished
+	ReleaseID string `json:"release_id,omitempty"` // The release that the build was deployed as
+	Error     string `json:"error,omitempty"`      // Why the build failed
+
+	Metrics *BuildMetrics `json:"metrics,omitempty"` // Recorded once the image has been built
+
+	TriggeredBy Actor     `json:"triggered_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	FinishedAt  time.Time `json:"finished_at,omitempty"`
+}
+
+// BuildMetrics describes how long the image of a build took to build, and how
+// much of it was reused from the cache. A step is an instruction of a
+// Dockerfile, or a layer of a buildpack build.
+type BuildMetrics struct {
+	Duration      float64 `json:"duration"` // The seconds spent building the image
+	Steps         int     `json:"steps"`
+	CachedSteps   int     `json:"cached_steps"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"` // From 0 to 1
+}
+
+// Builds is a list of builds.
+type Builds []Build
+
+// GenerateID will generate a unique ID for a build.
+func (b *Builds) GenerateID() string {
+search:
+	for {
+		bytes := make([]byte, 8)
+		rand.Read(bytes)
+		id := hex.EncodeToString(bytes)
+
+		for _, build := range *b {
+			if build.ID == id {
+				continue search
+			}
+		}
+
+		return id
+	}
+}
+
+// Find will find a build by its ID. Will return nil if it could not be found.
+func (b Builds) Find(id string) *Build {
+	for _, build := range b {
+		if build.ID == id {
+			return &build
+		}
+	}
+	return nil
+}
+
+// ForDeployment returns the builds of a deployment, newest first.
+func (b Builds) ForDeployment(deploymentID string) Builds {
+	builds := Builds{}
+	for _, build := range b {
+		if build.DeploymentID == deploymentID {
+			builds = append(builds, build)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].CreatedAt.After(builds[j].CreatedAt)
+	})
+	return builds
+}
+
+// Append adds a build, dropping the oldest finished builds of the deployment if
+// it has more than the limit. Builds that haven't finished are never dropped.
+func (b *Builds) Append(build Build) {
+	*b = append(*b, build)
+
+	count := 0
+	for _, existing := range *b {
+		if existing.DeploymentID == build.DeploymentID && existing.State.Finished() {
+			count++
+		}
+	}
+	for i := 0; count > buildLimit && i < len(*b); {
+		if (*b)[i].DeploymentID == build.DeploymentID && (*b)[i].State.Finished() {
+			*b = append((*b)[:i], (*b)[i+1:]...)
+			count--
+			continue
+		}
+		i++
+	}
+}
+
+// QueueBuild adds a build of the deployment to the queue. It is built once the
+// scheduler assigns it to a node.
+func (e *Engine) QueueBuild(d Deployment, actor Actor) (*Build, error) {
+	return e.queueBuild(d, "", actor)
+}
+
+// QueueRollback adds a rollback of the deployment to the release to the queue.
+// It is deployed once the builds of the deployment before it have finished.
+func (e *Engine) QueueRollback(d Deployment, releaseID string, actor Actor) (*Build, error) {
+	return e.queueBuild(d, releaseID, actor)
+}
+
+// queueBuild adds a build of the deployment to the queue, which rolls back to
+// the release if one is given.
+func (e *Engine) queueBuild(d Deployment, rollbackOf string, actor Actor) (*Build, error) {
+	e.Store.mu.RLock()
+	id := e.Store.state.Builds.GenerateID()
+	e.Store.mu.RUnlock()
+
+	build := Build{
+		ID:           id,
+		DeploymentID: d.ID,
+		NamespaceID:  d.NamespaceID,
+		State:        BuildQueued,
+		RollbackOf:   rollbackOf,
+		TriggeredBy:  actor,
+		CreatedAt:    time.Now(),
+	}
+
+	cmd := command{
+		Op:    opNewBuild,
+		Actor: actor,
+		Build: build,
+	}
+	if err := cmd.Apply(e.Store); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// UpdateBuild applies a change to a build. The store refuses to change a build
+// that has finished, so a build that was cancelled stays cancelled.
+func (e *Engine) UpdateBuild(b Build) error {
+	cmd := command{
+		Op:    opUpdateBuild,
+		Build: b,
+	}
+	return cmd.Apply(e.Store)
+}
+
+// touchBuild records that the build is still running on this node.
+func (e *Engine) touchBuild(id string) error {
+	cmd := command{
+		Op:    opTouchBuild,
+		Build: Build{ID: id, NodeID: e.Store.ID, LastSeen: time.Now()},
+	}
+	return cmd.Apply(e.Store)
+}
+
+// FollowBuild writes the build log of a build to out as it is written, until
+// the build has finished. The log is read from the log store on the orbit
+// system volume, so the build can be running on any node.
+func (e *Engine) FollowBuild(ctx context.Context, id string, out io.Writer) (*Build, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		build := e.Store.state.Builds.Find(id)
+		if build == nil {
+			return nil, fmt.Errorf("build %s does not exist", id)
+		}
+
+		// The build is checked before the log is read, so that the lines written
+		// just before it finished are still read.
+		if build.LogKey != "" {
+			data, next, err := e.Store.ReadBuildLog(build.DeploymentID, build.LogKey, offset)
+			if err != nil {
+				return build, err
+			}
+			if _, err := out.Write(data); err != nil {
+				return build, err
+			}
+			offset = next
+		}
+
+		if build.State.Finished() {
+			return build, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return build, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildRunner keeps track of the builds that have run on this node, so that
+// they can be cancelled, and so that they aren't run again before the store
+// has caught up with them finishing.
+type buildRunner struct {
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// start marks the build as running on this node, and returns the context that
+// it runs with. It returns nil if the build has already been run.
+func (r *buildRunner) start(id string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running == nil {
+		r.running = map[string]context.CancelFunc{}
+	}
+	if _, ok := r.running[id]; ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.running[id] = cancel
+	return ctx
+}
+
+// finish marks the build as no longer running on this node.
+func (r *buildRunner) finish(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel := r.running[id]; cancel != nil {
+		cancel()
+		r.running[id] = nil
+	}
+}
+
+// cancel stops the build if it is running on this node.
+func (r *buildRunner) cancel(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel := r.running[id]; cancel != nil {
+		cancel()
+	}
+}
+
+// ids returns the builds that are running on this node.
+func (r *buildRunner) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := []string{}
+	for id, cancel := range r.running {
+		if cancel != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// RunBuild builds and deploys a build that has been assigned to this node, and
+// records how it finished. The context is the one that the build was started
+// with on this node.
+func (e *Engine) RunBuild(ctx context.Context, b Build) {
+	defer e.builds.finish(b.ID)
+
+	// Report that the build is still running until it has finished, so that the
+	// leader can tell it apart from a build on a node that has stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(buildHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := e.touchBuild(b.ID); err != nil {
+					log.Printf("[WARN] build: Could not report build %s as running: %s", b.ID, err)
+				}
+			}
+		}
+	}()
+
+	var release *Release
+	var err error
+	if b.RollbackOf != "" {
+		log.Printf("[INFO] build: Rolling deployment %s back to release %s", b.DeploymentID, b.RollbackOf)
+		release, err = e.RollbackDeployment(ctx, b)
+	} else {
+		log.Printf("[INFO] build: Running build %s of deployment %s", b.ID, b.DeploymentID)
+		release, err = e.ReleaseDeployment(ctx, b, nil)
+	}
+
+	// Get the latest version of the build, which has the log key and commit.
+	if latest := e.Store.state.Builds.Find(b.ID); latest != nil {
+		b = *latest
+	}
+	b.FinishedAt = time.Now()
+	if b.LogKey != "" {
+		b.LogSize = e.Store.BuildLogSize(b.DeploymentID, b.LogKey)
+	}
+	switch {
+	case err == nil:
+		b.State = BuildSucceeded
+		b.ReleaseID = release.ID
+	case ctx.Err() != nil:
+		b.State = BuildCancelled
+	default:
+		log.Printf("[ERR] build: Build %s of deployment %s failed: %s", b.ID, b.DeploymentID, err)
+		b.State = BuildFailed
+		b.Error = err.Error()
+	}
+
+	if err := e.UpdateBuild(b); err != nil && b.State != BuildCancelled {
+		log.Printf("[ERR] build: Could not record the result of build %s: %s", b.ID, err)
+	}
+}
+
+// ScheduleBuilds assigns the builds in the queue to nodes, oldest first. A
+// deployment only has one build running at a time, so that its releases happen
+// in order, and no more than the concurrency limit run across the cluster.
+//
+// Builds are assigned to the builder nodes with the fewest builds running. A
+// cluster without any builder nodes builds on the leader, so that it can still
+// be deployed to.
+//
+// Running builds that their node hasn't reported on for a while are failed, as
+// the node has stopped or lost the build. They aren't queued again, as the node
+// could still be running them.
+func (e *Engine) ScheduleBuilds() {
+	store := e.Store
+
+	nodes := map[string]int{} // The node ID to the number of builds running on it
+	for _, n := range store.state.Nodes {
+		if n.HasRole(RoleBuilder) {
+			nodes[n.ID] = 0
+		}
+	}
+	if len(nodes) == 0 {
+		nodes[store.ID] = 0
+	}
+
+	builds := make(Builds, len(store.state.Builds))
+	copy(builds, store.state.Builds)
+	sort.SliceStable(builds, func(i, j int) bool {
+		return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+	})
+
+	running := 0
+	busy := map[string]bool{} // The deployments with a build running
+	for _, b := range builds {
+		if b.State != BuildRunning {
+			continue
+		}
+
+		// A build on a node that has left the cluster will never finish.
+		exists := false
+		for _, n := range store.state.Nodes {
+			if n.ID == b.NodeID {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			b.State = BuildFailed
+			b.Error = "the node running the build left the cluster"
+			b.FinishedAt = time.Now()
+			if err := e.UpdateBuild(b); err != nil {
+				log.Printf("[ERR] build: Could not fail build %s: %s", b.ID, err)
+			}
+			continue
+		}
+
+		// A build that hasn't been reported on since it was assigned, or since
+		// the last heartbeat, has stopped without finishing.
+		lastSeen := b.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = b.StartedAt
+		}
+		if time.Since(lastSeen) > buildStaleAfter {
+			b.State = BuildFailed
+			b.Error = "the node running the build stopped reporting on it"
+			b.FinishedAt = time.Now()
+			if err := e.UpdateBuild(b); err != nil {
+				log.Printf("[ERR] build: Could not fail build %s: %s", b.ID, err)
+			}
+			continue
+		}
+
+		running++
+		busy[b.DeploymentID] = true
+		if _, ok := nodes[b.NodeID]; ok {
+			nodes[b.NodeID]++
+		}
+	}
+
+	for _, b := range builds {
+		if running >= buildConcurrency {
+			return
+		}
+		if b.State != BuildQueued || busy[b.DeploymentID] {
+			continue
+		}
+
+		var node string
+		for id, count := range nodes {
+			if node == "" || count < nodes[node] || (count == nodes[node] && id < node) {
+				node = id
+			}
+		}
+
+		b.State = BuildRunning
+		b.NodeID = node
+		b.StartedAt = time.Now()
+		if err := e.UpdateBuild(b); err != nil {
+			log.Printf("[ERR] build: Could not assign build %s to node %s: %s", b.ID, node, err)
+			continue
+		}
+		log.Printf("[INFO] build: Assigned build %s of deployment %s to node %s", b.ID, b.DeploymentID, node)
+
+		running++
+		busy[b.DeploymentID] = true
+		nodes[node]++
+	}
+}
@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// clusterCALifetime is how long the cluster certificate authority is valid
+	// for. There is no way to rotate it without re-issuing every node
+	// certificate, so this is deliberately long.
+	clusterCALifetime = 10 * 365 * 24 * time.Hour
+
+	// nodeCertificateLifetime is how long a node certificate is valid for.
+	nodeCertificateLifetime = 365 * 24 * time.Hour
+	// nodeCertificateRenewal is how long before it expires that a node asks for
+	// a new certificate.
+	nodeCertificateRenewal = 30 * 24 * time.Hour
+)
+
+// ClusterCA is the certificate authority that every node certificate in the
+// cluster is issued by. Nodes use these certificates to authenticate each
+// other over mutual TLS. Both fields are PEM encoded.
+//
+// The private key is sealed with the keyring in the raft log and snapshots,
+// and every manager has a copy so that any of them can become the leader. As
+// joining with the manager token hands a node the keyring, that token grants
+// the CA as well and has to be treated as the root credential of the cluster.
+// Only the leader signs certificates, and the other nodes ask it to over
+// mutual TLS, so a node can only be issued a certificate for itself.
+type ClusterCA struct {
+	Certificate []byte `json:"certificate"`
+	PrivateKey  []byte `json:"private_key"`
+}
+
+// GenerateClusterCA creates a new self-signed certificate authority for the
+// cluster.
+func GenerateClusterCA() (*ClusterCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate key")
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Orbit Cluster CA"},
+		NotBefore:             now.Add(-time.Hour), // Allow for clock skew between nodes
+		NotAfter:              now.Add(clusterCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal key")
+	}
+
+	return &ClusterCA{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// Pool returns a certificate pool containing only the cluster CA, for
+// verifying the certificates of other nodes.
+func (ca ClusterCA) Pool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca.Certificate) {
+		return nil, fmt.Errorf("could not parse cluster CA certificate")
+	}
+	return pool, nil
+}
+
+// IssueNodeCertificate signs the certificate signing request of a node. The
+// common name of the certificate is always the ID of the node, no matter what
+// the request asked for, as that is how the node is identified by its peers.
+func (ca ClusterCA) IssueNodeCertificate(nodeID string, csrPEM []byte, ips ...net.IP) ([]byte, error) {
+	caCert, caKey, err := ca.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("could not decode certificate signing request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse certificate signing request")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "invalid certificate signing request signature")
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(nodeCertificateLifetime)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	var addrs []net.IP
+	for _, ip := range ips {
+		if ip != nil {
+			addrs = append(addrs, ip)
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		DNSNames:     []string{nodeID},
+		IPAddresses:  addrs,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create certificate")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// parse decodes the certificate and private key of the CA.
+func (ca ClusterCA) parse() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(ca.Certificate)
+	keyBlock, _ := pem.Decode(ca.PrivateKey)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("could not decode cluster CA")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse cluster CA certificate")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse cluster CA key")
+	}
+
+	return cert, key, nil
+}
+
+// GenerateNodeKey creates a private key for a node along with a certificate
+// signing request for it. The key never has to leave the node, only the request
+// is sent to be signed.
+func GenerateNodeKey() (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate key")
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create certificate signing request")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not marshal key")
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	return keyPEM, csrPEM, nil
+}
+
+// serialNumber generates a random certificate serial number.
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate serial number")
+	}
+	return serial, nil
+}
+
+// InitClusterCA will generate the certificate authority for the cluster and
+// apply it to the store. This must only be called on the leader, as it is only
+// ever created once.
+func (s *Store) InitClusterCA() error {
+	ca, err := GenerateClusterCA()
+	if err != nil {
+		return err
+	}
+
+	cmd := command{
+		Op:        opSetClusterCA,
+		ClusterCA: ca,
+	}
+	return cmd.Apply(s)
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// buildCacheRoot returns the directory that the build caches of deployments are
+// kept in. It is on the orbit system volume, so that a deployment has the same
+// cache no matter which builder node builds it.
+func (s *Store) buildCacheRoot() (string, error) {
+	volume := s.OrbitSystemVolume()
+	if volume == nil {
+		return "", fmt.Errorf("could not find the orbit system volume")
+	}
+	return filepath.Join(volume.Paths().Data, "cache"), nil
+}
+
+// BuildCacheDir returns the directory that the builder of the kind given keeps
+// the dependencies of a deployment in between builds, creating it if it
+// doesn't exist yet. Each kind of builder lays its cache out differently, so
+// they each have their own.
+func (s *Store) BuildCacheDir(deploymentID, builder string) (string, error) {
+	root, err := s.buildCacheRoot()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, deploymentID, builder)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// PruneBuildCaches removes the build caches of the deployments that no longer
+// exist.
+func (s *Store) PruneBuildCaches() error {
+	root, err := s.buildCacheRoot()
+	if err != nil {
+		return err
+	}
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deployments := map[string]bool{}
+	for _, d := range s.state.Deployments {
+		deployments[d.ID] = true
+	}
+	for _, dir := range dirs {
+		if !deployments[dir.Name()] {
+			if err := os.RemoveAll(filepath.Join(root, dir.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,13 +1,18 @@
 package engine
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -29,9 +34,42 @@ type Deployment struct {
 	// The logs from the build processes. This is a map that contains a string
 	// (the key) which is used to store the git commit hash of the repository that
 	// this particular deployment path was taken from. The value is a string list
-	// of the individual lines outputted from the build process. These all need to
-	// be kept in raft consensus so that they can be referenced later on.
-	BuildLogs map[string][]string `json:"build_logs"`
+	// of the individual lines outputted from the build process.
+	//
+	// Build logs are now written to the log store on the orbit system volume,
+	// and the logs that were kept in raft are moved there by the leader. The API
+	// still fills this in from the log store for the clients that read it.
+	BuildLogs    map[string][]string `json:"build_logs"`
+	LogRetention LogRetention        `json:"log_retention"`
+
+	// The image that the service of the deployment runs. Every build is tagged
+	// with the commit that it was built from, so that it never overwrites the
+	// image that is running.
+	Image     string            `json:"image"`
+	BuiltWith string            `json:"built_with,omitempty"` // The kind of builder that built the image
+	Processes map[string]string `json:"processes,omitempty"`  // The process types of the image, from its Procfile
+	ReleaseID string            `json:"release_id"`           // The release that is deployed
+
+	// The builder that the deployment is built with, which is one of the kinds
+	// of builder in the docker package. If it isn't set, it is picked from the
+	// source code of each build. The image that the builder runs in can be
+	// replaced by an admin.
+	Builder      string      `json:"builder"`
+	BuilderImage string      `json:"builder_image,omitempty"`
+	BuildConfig  BuildConfig `json:"build_config"`
+
+	// The configuration of the service of the deployment. Changing it updates
+	// the service without having to build the deployment again.
+	Env     map[string]string `json:"env"`
+	Secrets []SecretRef       `json:"secrets"`
+
+	// The number of replicas that each process type runs with. Each process type
+	// runs as its own service, so that they can be scaled on their own.
+	Formation map[string]int `json:"formation,omitempty"`
+
+	// The secret that GitHub and GitLab webhooks are verified with. Webhooks are
+	// not accepted if it isn't set.
+	WebhookSecret string `json:"webhook_secret,omitempty"`
 
 	NamespaceID string `json:"namespace_id"`
 }
@@ -39,67 +77,124 @@ type Deployment struct {
 // Deployments is a slice of the deployments in the store.
 type Deployments []Deployment
 
-// AppendBuildLog appends a log item entry to a given build process with a given
-// ID. This takes place in a deployment, and is a short-hand for the longer
-// process of performing a store apply.
-func (s *Store) AppendBuildLog(deploymentID, key string, lines ...string) error {
-	// Don't perform an operation if this command contained no additional lines.
-	if len(lines) == 0 {
-		return nil
-	}
-
-	// Create the log map so that the apply command knows what data we need to
-	// provide it. Set the lines that we provide to it as the log items to use.
-	logs := map[string][]string{}
-	logs[key] = lines
+// buildTargetFormat is the format that the names of the stages of a Dockerfile
+// have to be in.
+var buildTargetFormat = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// BuildConfig is how the source code of a deployment is built. The Dockerfile
+// and target are only used by the Dockerfile builder, and buildpacks are given
+// the build args as environment variables while they build.
+//
+// Secrets are looked up when each build starts. The buildpack builders leave
+// the build args out of the image, but docker keeps the build args that a
+// Dockerfile uses in the history of the image, so a secret given as a build arg
+// to a Dockerfile can be read by anyone who can pull the image.
+type BuildConfig struct {
+	Dockerfile string            `json:"dockerfile,omitempty"` // Relative to the path, "Dockerfile" if empty
+	Target     string            `json:"target,omitempty"`     // The stage to build, the last one if empty
+	Args       map[string]string `json:"args,omitempty"`
+	Secrets    []SecretRef       `json:"secrets,omitempty"` // Passed as the build arg named by their env
+}
 
-	// Construct the apply command.
-	cmd := command{
-		Op: opAppendBuildLog,
-		Deployment: Deployment{
-			ID:        deploymentID,
-			BuildLogs: logs,
-		},
+// Validate checks that the source code can be built with the config.
+func (c BuildConfig) Validate() error {
+	if c.Dockerfile != "" {
+		clean := filepath.Clean(c.Dockerfile)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("%s is not a path inside of the deployment", c.Dockerfile)
+		}
 	}
-
-	// Apply it to the store.
-	if err := cmd.Apply(s); err != nil {
-		return err
+	if c.Target != "" && !buildTargetFormat.MatchString(c.Target) {
+		return fmt.Errorf("%s is not a valid build target", c.Target)
 	}
 
+	// The builders hand the build args to the docker client in its environment,
+	// so they can't have the names of the variables that the client reads.
+	used := map[string]bool{}
+	for k := range c.Args {
+		if !envNameFormat.MatchString(k) {
+			return fmt.Errorf("%s is not a valid build arg name", k)
+		}
+		if docker.IsClientEnv(k) {
+			return fmt.Errorf("%s can't be used as a build arg name", k)
+		}
+		used[k] = true
+	}
+	for _, ref := range c.Secrets {
+		if ref.Path != "" || !envNameFormat.MatchString(ref.Env) {
+			return fmt.Errorf("secret %s needs a build arg name to be passed as", ref.SecretID)
+		}
+		if docker.IsClientEnv(ref.Env) {
+			return fmt.Errorf("%s can't be used as a build arg name", ref.Env)
+		}
+		if used[ref.Env] {
+			return fmt.Errorf("build arg %s is set more than once", ref.Env)
+		}
+		used[ref.Env] = true
+	}
 	return nil
 }
 
-// ClearBuildLog will clear the build log for a map with a given key. This will
-// essentially remove the key in the map.
-func (s *Store) ClearBuildLog(deploymentID, key string) error {
-	// Create the empty log map to correctly inform the process to take place.
-	logs := map[string][]string{}
-	logs[key] = []string{}
+// ProcessTypes returns the process types of the image of the deployment, and
+// the commands that they are started with. Images built from source code
+// without a Procfile, or before the Procfile was read, only have a web process
+// that is started in the way that the builder starts it.
+func (d Deployment) ProcessTypes() map[string]string {
+	if len(d.Processes) == 0 {
+		return map[string]string{docker.ProcessWeb: ""}
+	}
+	return d.Processes
+}
 
-	// Construct the command.
-	cmd := command{
-		Op: opClearBuildLog,
-		Deployment: Deployment{
-			ID:        deploymentID,
-			BuildLogs: logs,
-		},
+// ProcessNames returns the names of the process types of the deployment, in
+// order.
+func (d Deployment) ProcessNames() []string {
+	names := []string{}
+	for process := range d.ProcessTypes() {
+		names = append(names, process)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	// Apply the command.
-	if err := cmd.Apply(s); err != nil {
-		return err
+// Replicas returns the number of replicas that a process type of the deployment
+// runs with. Process types that haven't been scaled run a single replica.
+func (d Deployment) Replicas(process string) int {
+	if n, ok := d.Formation[process]; ok {
+		return n
 	}
+	return 1
+}
 
-	return nil
+// ServiceName returns the name of the docker service that runs a process type
+// of the deployment.
+func (d Deployment) ServiceName(process string) string {
+	return fmt.Sprintf("%s-%s", d.ID, process)
+}
+
+// ImageTag returns the tag of the image of the deployment built from the
+// commit.
+func (d Deployment) ImageTag(hash string) string {
+	return fmt.Sprintf("%s:%s", d.ID, hash)
 }
 
 // BuildDeployment will take in the given deployment object and then run through
-// and actually perform the operations to build that deployment.
-func (e *Engine) BuildDeployment(d Deployment) (string, error) {
+// and actually perform the operations to build that deployment. It returns the
+// key of the build log and the hash of the commit that was built, which the
+// image is tagged with, and records both on the build as soon as they are
+// known. The kind of builder that built the image and the process types in the
+// Procfile of the source code are returned as well, as they decide how the
+// image is started. The output of the build is also written to out, if it isn't
+// nil.
+//
+// The checkout is removed once the build has finished. Builds reuse the layers
+// of the image that the deployment runs, and the dependencies that buildpacks
+// keep in the build cache of the deployment, so that only what has changed is
+// built again.
+func (e *Engine) BuildDeployment(ctx context.Context, d Deployment, b Build, out io.Writer) (key, commit, builder string, processes map[string]string, err error) {
 	// Checkout the repo to a temporary directory, navigate to the specified path,
-	// and if there is a Dockerfile, use that for building, and if there isn't,
-	// create a default one that uses the herokuish image.
+	// and build it with the builder of the deployment. If the deployment doesn't
+	// have one, a Dockerfile is used if there is one, and herokuish if not.
 
 	// Find the repo.
 	var repo *Repository
@@ -110,26 +205,27 @@ func (e *Engine) BuildDeployment(d Deployment) (string, error) {
 		}
 	}
 	if repo == nil {
-		return "", fmt.Errorf("that repository does not exist")
+		return "", "", "", nil, fmt.Errorf("that repository does not exist")
 	}
 
 	// Derive the repo path.
 	volume := e.Store.OrbitSystemVolume()
 	if volume == nil {
-		return "", fmt.Errorf("could not find the orbit system volume")
+		return "", "", "", nil, fmt.Errorf("could not find the orbit system volume")
 	}
 	path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
 
 	// Check it out to a temporary directory.
 	tmp, err := ioutil.TempDir("", "")
 	if err != nil {
-		return "", fmt.Errorf("could not create temporary directory: %s", err)
+		return "", "", "", nil, fmt.Errorf("could not create temporary directory: %s", err)
 	}
+	defer os.RemoveAll(tmp)
 	cmd := exec.Command("git", "clone", path, tmp)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("could not run git clone command: %s", err)
+		return "", "", "", nil, fmt.Errorf("could not run git clone command: %s", err)
 	}
 
 	// Ensure that we're in the correct branch (if it's set).
@@ -138,7 +234,7 @@ func (e *Engine) BuildDeployment(d Deployment) (string, error) {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
-			return "", err
+			return "", "", "", nil, err
 		}
 	}
 
@@ -146,22 +242,51 @@ func (e *Engine) BuildDeployment(d Deployment) (string, error) {
 	cmd = exec.Command("git", "-C", tmp, "rev-parse", "HEAD")
 	output, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return "", "", "", nil, err
 	}
 	hash := strings.TrimSpace(string(output))
+	commit = hash
 
-	// Check for a Dockerfile and create one if there isn't one.
-	src := filepath.Join(tmp, d.Path) // The actual directory to check
-	if err := docker.EnsureDockerfile(src); err != nil {
-		return "", fmt.Errorf("could not ensure dockerfile: %s", err)
+	// Work out which builder to use.
+	src := filepath.Join(tmp, d.Path) // The actual directory to build
+	builder = d.Builder
+	if builder == "" {
+		builder = docker.DetectBuilder(src, d.BuildConfig.Dockerfile)
+	}
+	imageBuilder, err := docker.NewBuilder(builder, d.BuilderImage)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	args, err := e.BuildArgs(d)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	// The Procfile is read before the ignore file is applied, as the app may
+	// leave it out of its image.
+	processes, err = docker.ReadProcfile(src)
+	if err != nil {
+		return "", "", "", nil, fmt.Errorf("could not read the Procfile: %s", err)
+	}
+
+	// Leave out the files that the app doesn't want in its image.
+	if err := docker.PrepareContext(src, d.BuildConfig.Dockerfile); err != nil {
+		return "", "", "", nil, fmt.Errorf("could not apply the ignore file: %s", err)
 	}
 
 	// Generate the map key for the build log.
 	now := fmt.Sprintf("%d", time.Now().UnixNano())
-	key := filepath.Join(hash, now, d.Path)
+	key = filepath.Join(hash, now, d.Path)
+
+	// Let anyone following the build know where its log is.
+	b.Commit = commit
+	b.LogKey = key
+	if err := e.UpdateBuild(b); err != nil {
+		return "", "", "", nil, err
+	}
 
 	// flushBuffer takes in the buffer that is provided in the enclosing function
-	// and updates the store deployment build log with the data in the buffer. If
+	// and appends the data in the buffer to the build log in the log store. If
 	// there is no data in the buffer then this will not execute anything.
 	var lineBuf []string
 	flushBuffer := func() error {
@@ -175,11 +300,51 @@ func (e *Engine) BuildDeployment(d Deployment) (string, error) {
 	// Begin the build process. All of the operations for this take place
 	// asynchronously and so this is a non-blocking operation. Handle all of the
 	// following output with the channels it creates.
-	tag := fmt.Sprintf("127.0.0.1:6510/%s", d.ID)
-	outputCh, errorCh := docker.Build(src, tag) // STARTS THE ASYNC OP
+	tag := fmt.Sprintf("127.0.0.1:6510/%s", d.ImageTag(hash))
+	lineBuf = append(lineBuf, fmt.Sprintf("-----> Building with the %s builder", builder))
+
+	// The image that is running is in the registry, so its layers can be reused
+	// no matter which node built it.
+	var cacheFrom string
+	if d.Image != "" {
+		cacheFrom = fmt.Sprintf("127.0.0.1:6510/%s", d.Image)
+	}
+	cache, err := e.Store.BuildCacheDir(d.ID, builder)
+	if err != nil {
+		log.Printf("[WARN] build: Building deployment %s without a cache: %s", d.ID, err)
+	}
+
+	started := time.Now()
+	stats := docker.BuildStats{}
+	outputCh, errorCh := imageBuilder.Build(ctx, docker.BuildOptions{
+		Path:       src,
+		Tag:        tag,
+		Cache:      cache,
+		CacheFrom:  cacheFrom,
+		Dockerfile: d.BuildConfig.Dockerfile,
+		Target:     d.BuildConfig.Target,
+		Args:       args,
+	}) // STARTS THE ASYNC OP
 	ticker := time.NewTicker(time.Second * 2)
 	defer ticker.Stop()
 
+	// recordMetrics records how long the image took to build and how much of it
+	// was reused from the cache, whether or not it built.
+	recordMetrics := func() {
+		duration := time.Since(started)
+		b.Metrics = &BuildMetrics{
+			Duration:      duration.Seconds(),
+			Steps:         stats.Steps,
+			CachedSteps:   stats.Cached,
+			CacheHitRatio: stats.HitRatio(),
+		}
+		if err := e.UpdateBuild(b); err != nil && ctx.Err() == nil {
+			log.Printf("[WARN] build: Could not record the metrics of build %s: %s", b.ID, err)
+		}
+		lineBuf = append(lineBuf, fmt.Sprintf("-----> Built in %s, with %d of %d steps from the cache",
+			duration.Round(100*time.Millisecond), stats.Cached, stats.Steps))
+	}
+
 loop:
 	for {
 		select {
@@ -189,26 +354,174 @@ loop:
 				break loop
 			}
 			lineBuf = append(lineBuf, line)
+			stats.Read(line)
 			fmt.Println(line)
+			if out != nil {
+				fmt.Fprintln(out, line)
+			}
 
-		// If an error occurs at any point, return it and fail.
-		case err := <-errorCh:
-			return key, err
+		// If an error occurs at any point, keep the output so far and fail. The
+		// channel is closed without one once the build has worked, and the rest
+		// of the output is still read.
+		case err, ok := <-errorCh:
+			if !ok {
+				errorCh = nil
+				continue
+			}
+			recordMetrics()
+			flushBuffer()
+			return key, commit, builder, processes, err
 
-		// Every two seconds, actually save the buffer data to the store.
+		// Every two seconds, actually save the buffer data to the log store.
 		case <-ticker.C:
 			if err := flushBuffer(); err != nil {
-				return key, err
+				return key, commit, builder, processes, err
 			}
 		}
 	}
 
 	// Perform a final flush of the buffer.
+	recordMetrics()
 	if err := flushBuffer(); err != nil {
-		return key, err
+		return key, commit, builder, processes, err
 	}
 
-	return key, nil
+	return key, commit, builder, processes, nil
+}
+
+// Services returns the docker services that run the process types of the
+// deployment, leaving out the ones that have been scaled down to no replicas.
+// The secrets attached to the deployment override any environment variable of
+// the same name.
+func (e *Engine) Services(d Deployment) ([]docker.Service, error) {
+	env, secrets, err := e.ServiceSecrets(d)
+	if err != nil {
+		return nil, err
+	}
+
+	envVars := map[string]string{}
+	for k, v := range d.Env {
+		envVars[k] = v
+	}
+	for k, v := range env {
+		envVars[k] = v
+	}
+
+	// Deployments built before images were tagged by commit only have the one
+	// image.
+	image := d.Image
+	if image == "" {
+		image = d.ID
+	}
+
+	// Images built before there was a choice of builder were all started by
+	// herokuish.
+	kind := d.BuiltWith
+	if kind == "" {
+		kind = docker.BuilderHerokuish
+	}
+	builder, err := docker.NewBuilder(kind, "")
+	if err != nil {
+		return nil, err
+	}
+
+	processes := d.ProcessTypes()
+	services := []docker.Service{}
+	for _, process := range d.ProcessNames() {
+		replicas := d.Replicas(process)
+		if replicas < 1 {
+			continue
+		}
+
+		entrypoint, command := builder.Start(process, processes[process])
+		service := docker.Service{
+			Name:       d.ServiceName(process),
+			Tag:        image,
+			Replicas:   replicas,
+			Update:     docker.DefaultUpdateConfig,
+			EnvVars:    envVars,
+			Secrets:    secrets,
+			Entrypoint: entrypoint,
+		}
+		if len(command) > 0 {
+			service.Command = command[0]
+			service.Args = command[1:]
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// deploymentServices returns the names of the docker services of the
+// deployment that exist. Deployments deployed before each process type had its
+// own service have a single service named after the deployment.
+func deploymentServices(d Deployment) []string {
+	services := []string{}
+	for _, name := range docker.Services() {
+		if name == d.ID || strings.HasPrefix(name, d.ID+"-") {
+			services = append(services, name)
+		}
+	}
+	return services
+}
+
+// Deploy will create the docker service of each process type of the
+// deployment, or perform a rolling update of it if it exists already. The
+// services of process types that are no longer in the image, or that have been
+// scaled down to no replicas, are removed once the others have been deployed.
+func (e *Engine) Deploy(d Deployment) error {
+	services, err := e.Services(d)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, name := range deploymentServices(d) {
+		existing[name] = true
+	}
+
+	for _, service := range services {
+		if existing[service.Name] {
+			err = docker.UpdateService(service)
+		} else {
+			err = docker.CreateService(service)
+		}
+		if err != nil {
+			return err
+		}
+		delete(existing, service.Name)
+	}
+
+	for name := range existing {
+		log.Printf("[INFO] deployment: Removing service %s of deployment %s", name, d.ID)
+		if !docker.RemoveService(name) {
+			log.Printf("[WARN] deployment: Could not remove service %s", name)
+		}
+	}
+
+	e.RemoveStaleSecrets(d)
+	return nil
+}
+
+// Redeploy will update the docker services of the deployment after its
+// configuration has changed. Deployments that haven't been built yet don't
+// have any services, and pick up the configuration when they are.
+func (e *Engine) Redeploy(d Deployment) error {
+	if d.Image == "" && len(deploymentServices(d)) == 0 {
+		return nil
+	}
+	return e.Deploy(d)
+}
+
+// Find will find a deployment by its ID. Will return nil if it could not be
+// found.
+func (d Deployments) Find(id string) *Deployment {
+	for _, deployment := range d {
+		if deployment.ID == id {
+			return &deployment
+		}
+	}
+	return nil
 }
 
 // GenerateID will create a unique identifier for the deployment.
@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/jinzhu/copier"
 	"github.com/pkg/errors"
-	"google.golang.org/grpc"
 	"orbit.sh/engine/proto"
 )
 
@@ -37,7 +37,7 @@ const (
 	opNewRepository
 
 	opNewDeployment
-	opAppendBuildLog
+	opAppendBuildLog // Replaced by the log store, kept for existing logs
 	opClearBuildLog
 
 	opNewRouter
@@ -51,30 +51,125 @@ const (
 	opNewVolume
 	opUpdateVolumeBrick
 	opRemoveVolume
+
+	opGrantRole
+	opRevokeRole
+
+	opNewAPIToken
+	opRevokeAPIToken
+	opTouchAPIToken
+
+	opTouchSession
+	opExpireSessions
+
+	opSetTOTP
+	opNewLoginChallenge
+	opCompleteLoginChallenge
+
+	opNewOIDCProvider
+	opUpdateOIDCProvider
+	opRemoveOIDCProvider
+	opNewOIDCLogin
+	opRemoveOIDCLogin
+	opLinkIdentity
+
+	opUpdateUser
+	opRevokeOtherSessions
+
+	opLoginFailure
+	opLoginSuccess
+
+	opSetClusterCA
+	opSetNodeTLS
+
+	opNewSecret
+	opUpdateSecret
+	opRemoveSecret
+	opSetDeploymentSecrets
+
+	opSetDeploymentEnv
+	opSetDeploymentImage // Replaced by opNewRelease, kept for existing logs
+
+	opNewRelease
+
+	opSetDeploymentWebhook
+
+	opSetRepositoryUpstream
+
+	opNewBuild
+	opUpdateBuild
+	opCancelBuild
+
+	opSetLogRetention
+
+	opSetDeploymentBuilder
+	opSetBuildConfig
+	opSetFormation
+
+	opMigrateRoles
+
+	opSetPassword
+	opSetPasswordReset
+	opRemoveProfile
+
+	opRotateKeyring
+
+	opTouchBuild
+
+	opNewOwner
 )
 
 type command struct {
-	Op op `json:"op"`
-
-	User             User        `json:"user,omitempty"`
-	Session          Session     `json:"session,omitempty"`
-	Brick            Brick       `json:"brick,omitempty"`
-	Node             Node        `json:"node,omitempty"`
-	Router           Router      `json:"router,omitempty"`
-	Certificate      Certificate `json:"certificate,omitempty"`
-	Namespace        Namespace   `json:"namespace,omitempty"`
-	Repository       Repository  `json:"repository,omitempty"`
-	Volume           Volume      `json:"volume,omitempty"`
-	Deployment       Deployment  `json:"deployment,omitempty"`
-	ManagerJoinToken string      `json:"manager_join_token,omitempty"`
-	WorkerJoinToken  string      `json:"worker_join_token,omitempty"`
+	Op    op    `json:"op"`
+	Actor Actor `json:"actor,omitempty"` // Who caused the command, for the audit log
+
+	User             User           `json:"user,omitempty"`
+	Session          Session        `json:"session,omitempty"`
+	Brick            Brick          `json:"brick,omitempty"`
+	Node             Node           `json:"node,omitempty"`
+	Router           Router         `json:"router,omitempty"`
+	Certificate      Certificate    `json:"certificate,omitempty"`
+	Namespace        Namespace      `json:"namespace,omitempty"`
+	Repository       Repository     `json:"repository,omitempty"`
+	Volume           Volume         `json:"volume,omitempty"`
+	Deployment       Deployment     `json:"deployment,omitempty"`
+	RoleBinding      RoleBinding    `json:"role_binding,omitempty"`
+	APIToken         APIToken       `json:"api_token,omitempty"`
+	TOTP             TOTP           `json:"totp,omitempty"`
+	LoginChallenge   LoginChallenge `json:"login_challenge,omitempty"`
+	RecoveryCode     string         `json:"recovery_code,omitempty"` // Hash of a used recovery code
+	Secret           Secret         `json:"secret,omitempty"`
+	Release          Release        `json:"release,omitempty"`
+	Build            Build          `json:"build,omitempty"`
+	OIDCProvider     OIDCProvider   `json:"oidc_provider,omitempty"`
+	OIDCLogin        OIDCLogin      `json:"oidc_login,omitempty"`
+	Identity         Identity       `json:"identity,omitempty"`
+	AttemptKeys      []string       `json:"attempt_keys,omitempty"` // Accounts and IPs attempting to log in
+	KeyringKey       string         `json:"keyring_key,omitempty"`  // A rotated key, sealed with the key before it
+	ClusterCA        *ClusterCA     `json:"cluster_ca,omitempty"`
+	ManagerJoinToken string         `json:"manager_join_token,omitempty"`
+	WorkerJoinToken  string         `json:"worker_join_token,omitempty"`
+	Time             time.Time      `json:"time,omitempty"`
 }
 
 // Apply is a helper proxy method that will apply the command to a raft instance
 // in the store using it's "Apply" method. This is also the part of the process
 // that is responsible for leader forwarding.
 func (c *command) Apply(s *Store) error {
-	b, err := json.Marshal(c)
+	// Every command records the time that it was issued. This is done here so
+	// that every node agrees on it.
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+
+	// Seal the sensitive fields of a copy of the command, so that they are never
+	// written to the raft log in plaintext.
+	sealed := *c
+	if err := sealed.transformSecrets(s.keyring.Seal); err != nil {
+		return errors.Wrap(err, "could not seal command")
+	}
+
+	b, err := json.Marshal(&sealed)
 	if err != nil {
 		return err
 	}
@@ -86,8 +181,19 @@ func (c *command) Apply(s *Store) error {
 		return forwardApply(s, b)
 	}
 
-	f := s.raft.Apply(b, s.RaftTimeout)
-	return f.Error()
+	return applyError(s.raft.Apply(b, s.RaftTimeout))
+}
+
+// applyError returns why a command couldn't be applied, whether it couldn't be
+// committed or the store refused it once it was.
+func applyError(f raft.ApplyFuture) error {
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
 }
 
 // forwardApply will apply a command by forwarding it to the current leader. This
@@ -101,7 +207,7 @@ func forwardApply(s *Store, b []byte) error {
 	log.Printf("[INFO] store: Forwarding to %s", leaderAddr)
 
 	// Prepare the GRPC connection.
-	conn, err := grpc.Dial(leaderAddr, grpc.WithInsecure())
+	conn, err := s.engine.RPCServer.Dial(leaderAddr)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("could not dial %s", leaderAddr))
 	}
@@ -120,25 +226,133 @@ func forwardApply(s *Store, b []byte) error {
 	return nil
 }
 
-// Apply will apply an entry to the store.
+// Apply will apply an entry to the store, and then record it in the audit log.
 func (f *fsm) Apply(l *raft.Log) interface{} {
-	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic("failed to unmarshal command")
+	c := f.open(l)
+
+	if unaudited[c.Op] {
+		return f.apply(c)
+	}
+
+	f.mu.RLock()
+	target := f.state.auditTarget(c)
+	f.mu.RUnlock()
+
+	res := f.apply(c)
+
+	// The audit log is only written to the disk of this node, so a failure to
+	// write it can't be allowed to stop the command from being applied.
+	entry := AuditEntry{
+		Index:   l.Index,
+		Time:    c.Time,
+		Actor:   c.Actor,
+		Op:      c.Op.String(),
+		Target:  target,
+		Outcome: auditOutcome(res),
+	}
+	if err := (*Store)(f).appendAudit(entry, anonymous[c.Op]); err != nil {
+		log.Printf("[ERR] store: Could not write audit log entry %d: %s", l.Index, err)
+	}
+
+	return res
+}
+
+// openAttempts is how many times the store tries to open a sealed entry,
+// fetching the keyring from the leader in between, before it gives up.
+const openAttempts = 5
+
+// open decodes the command of the log entry and opens its sealed fields. An
+// entry can't be skipped, as every node has to apply the same entries to end up
+// with the same state, so if the key it was sealed with never turns up, the
+// node stops rather than carrying on without it.
+func (f *fsm) open(l *raft.Log) command {
+	for attempt := 1; ; attempt++ {
+		var c command
+		if err := json.Unmarshal(l.Data, &c); err != nil {
+			panic("failed to unmarshal command")
+		}
+		err := c.transformSecrets(f.keyring.Open)
+		if err == nil {
+			return c
+		}
+		if attempt == openAttempts {
+			panic(fmt.Sprintf("failed to open sealed entry %d: %s", l.Index, err))
+		}
+
+		log.Printf("[WARN] store: Could not open sealed entry %d, fetching the keyring: %s", l.Index, err)
+		if err := (*Store)(f).fetchKeyring(); err != nil {
+			log.Printf("[ERR] store: Could not fetch the keyring: %s", err)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
 	}
+}
 
+// apply will perform the operation of the command on the store.
+func (f *fsm) apply(c command) interface{} {
 	switch c.Op {
 	// User operations.
 	case opNewUser:
 		return f.applyNewUser(c.User)
 	case opRemoveUser:
 		return f.applyRemoveUser(c.User.ID)
+	case opUpdateUser:
+		return f.applyUpdateUser(c.User)
+	case opSetPassword:
+		return f.applySetPassword(c.User.ID, c.User.Password)
+	case opSetPasswordReset:
+		return f.applySetPasswordReset(c.User.ID, c.User.Reset)
+	case opRemoveProfile:
+		return f.applyRemoveProfile(c.User.ID)
 	case opNewSession:
 		return f.applyNewSession(c.User.ID, c.Session)
 	case opRevokeSession:
 		return f.applyRevokeSession(c.Session.Token)
 	case opRevokeAllSessions:
 		return f.applyRevokeAllSessions(c.User.ID)
+	case opRevokeOtherSessions:
+		return f.applyRevokeOtherSessions(c.User.ID, c.Session.Token)
+	case opTouchSession:
+		return f.applyTouchSession(c.Session)
+	case opExpireSessions:
+		return f.applyExpireSessions(c.Time)
+
+	// Second factor operations.
+	case opSetTOTP:
+		return f.applySetTOTP(c.User.ID, c.TOTP)
+	case opNewLoginChallenge:
+		return f.applyNewLoginChallenge(c.User.ID, c.LoginChallenge)
+	case opCompleteLoginChallenge:
+		return f.applyCompleteLoginChallenge(c.User.ID, c.LoginChallenge, c.Session, c.TOTP.LastStep, c.RecoveryCode)
+
+	// Login attempt operations.
+	case opLoginFailure:
+		return f.applyLoginFailure(c.AttemptKeys, c.Time)
+	case opLoginSuccess:
+		return f.applyLoginSuccess(c.AttemptKeys)
+
+	// Cluster certificate authority operations.
+	case opSetClusterCA:
+		return f.applySetClusterCA(c.ClusterCA)
+	case opSetNodeTLS:
+		return f.applySetNodeTLS(c.Node.ID)
+
+	// Keyring operations.
+	case opRotateKeyring:
+		return f.applyRotateKeyring(c.KeyringKey)
+
+	// Single sign-on operations.
+	case opNewOIDCProvider:
+		return f.applyNewOIDCProvider(c.OIDCProvider)
+	case opUpdateOIDCProvider:
+		return f.applyUpdateOIDCProvider(c.OIDCProvider)
+	case opRemoveOIDCProvider:
+		return f.applyRemoveOIDCProvider(c.OIDCProvider.ID)
+	case opNewOIDCLogin:
+		return f.applyNewOIDCLogin(c.OIDCLogin)
+	case opRemoveOIDCLogin:
+		return f.applyRemoveOIDCLogin(c.OIDCLogin.State)
+	case opLinkIdentity:
+		return f.applyLinkIdentity(c.User.ID, c.Identity)
 
 	// Token operations.
 	case opSetJoinTokens:
@@ -161,10 +375,53 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 		return f.applyAppendBuildLog(c.Deployment)
 	case opClearBuildLog:
 		return f.applyClearBuildLog(c.Deployment)
+	case opSetDeploymentSecrets:
+		return f.applySetDeploymentSecrets(c.Deployment)
+	case opSetDeploymentEnv:
+		return f.applySetDeploymentEnv(c.Deployment)
+	case opSetDeploymentImage:
+		return f.applySetDeploymentImage(c.Deployment)
+	case opNewRelease:
+		return f.applyNewRelease(c.Release)
+
+	// Build operations.
+	case opNewBuild:
+		return f.applyNewBuild(c.Build)
+	case opUpdateBuild:
+		return f.applyUpdateBuild(c.Build)
+	case opCancelBuild:
+		return f.applyCancelBuild(c.Build.ID, c.Time)
+	case opTouchBuild:
+		return f.applyTouchBuild(c.Build)
+	case opNewOwner:
+		return f.applyNewOwner(c.User)
+	case opSetDeploymentWebhook:
+		return f.applySetDeploymentWebhook(c.Deployment)
+	case opSetLogRetention:
+		return f.applySetDeploymentLogRetention(c.Deployment)
+	case opSetDeploymentBuilder:
+		return f.applySetDeploymentBuilder(c.Deployment)
+	case opSetBuildConfig:
+		return f.applySetBuildConfig(c.Deployment)
+	case opSetFormation:
+		return f.applySetFormation(c.Deployment)
+
+	case opMigrateRoles:
+		return f.applyMigrateRoles()
+
+	// Secret operations.
+	case opNewSecret:
+		return f.applyNewSecret(c.Secret)
+	case opUpdateSecret:
+		return f.applyUpdateSecret(c.Secret)
+	case opRemoveSecret:
+		return f.applyRemoveSecret(c.Secret.ID)
 
 	// Repository operations.
 	case opNewRepository:
 		return f.applyNewRepository(c.Repository)
+	case opSetRepositoryUpstream:
+		return f.applySetRepositoryUpstream(c.Repository)
 
 	// Router and certificate operations.
 	case opNewRouter:
@@ -189,6 +446,19 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 	case opRemoveVolume:
 		return f.applyRemoveVolume(c.Volume.ID)
 
+	// Role operations.
+	case opGrantRole:
+		return f.applyGrantRole(c.RoleBinding)
+	case opRevokeRole:
+		return f.applyRevokeRole(c.RoleBinding)
+
+	// API token operations.
+	case opNewAPIToken:
+		return f.applyNewAPIToken(c.User.ID, c.APIToken)
+	case opRevokeAPIToken:
+		return f.applyRevokeAPIToken(c.User.ID, c.APIToken.ID)
+	case opTouchAPIToken:
+		return f.applyTouchAPIToken(c.User.ID, c.APIToken)
 	}
 
 	return nil
@@ -201,10 +471,108 @@ func (f *fsm) applyNewUser(u User) interface{} {
 	return nil
 }
 
+func (f *fsm) applyNewOwner(u User) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Only the very first user becomes the owner of the cluster, which is
+	// decided here so that two users signing up at once can't both become it.
+	if len(f.state.Users) != 0 {
+		return ErrNotFirstUser
+	}
+	system := f.state.Namespaces.Find("orbit-system")
+	if system == nil {
+		return fmt.Errorf("the orbit-system namespace does not exist")
+	}
+
+	f.state.Users = append(f.state.Users, u)
+	f.state.RoleBindings.Set(RoleBinding{
+		UserID:      u.ID,
+		NamespaceID: system.ID,
+		Role:        RoleOwner,
+	})
+	return nil
+}
+
 func (f *fsm) applyRemoveUser(id string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.state.Users.Remove(id)
+	f.state.RoleBindings.RemoveUser(id)
+	return nil
+}
+
+func (f *fsm) applyUpdateUser(u User) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Only the details of the user itself can be updated this way, and only the
+	// ones that were provided, so that updates made at the same time don't undo
+	// each other. Everything else (such as their password and sessions) has its
+	// own operations.
+	for i, user := range f.state.Users {
+		if user.ID == u.ID {
+			if u.Name != "" {
+				f.state.Users[i].Name = u.Name
+			}
+			if u.Username != "" {
+				f.state.Users[i].Username = u.Username
+			}
+			if u.Email != "" {
+				f.state.Users[i].Email = u.Email
+			}
+			if u.Profile != nil {
+				f.state.Users[i].Profile = u.Profile
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applySetPassword(userID string, password [60]byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A new password always clears the password reset, so that it can't be
+	// used again.
+	for i, user := range f.state.Users {
+		if user.ID == userID {
+			f.state.Users[i].Password = password
+			f.state.Users[i].Reset = PasswordReset{}
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applySetPasswordReset(userID string, reset PasswordReset) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, user := range f.state.Users {
+		if user.ID == userID {
+			f.state.Users[i].Reset = reset
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyRemoveProfile(userID string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, user := range f.state.Users {
+		if user.ID == userID {
+			f.state.Users[i].Profile = nil
+			break
+		}
+	}
+
 	return nil
 }
 
@@ -238,6 +606,20 @@ func (f *fsm) applyNewRepository(repo Repository) interface{} {
 	return nil
 }
 
+func (f *fsm) applySetRepositoryUpstream(repo Repository) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, r := range f.state.Repositories {
+		if r.ID == repo.ID {
+			f.state.Repositories[i].Upstream = repo.Upstream
+			return nil
+		}
+	}
+
+	return fmt.Errorf("repository does not exist")
+}
+
 func (f *fsm) applyAppendBuildLog(deployment Deployment) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -334,118 +716,101 @@ func (f *fsm) applyRevokeAllSessions(userID string) interface{} {
 	return nil
 }
 
-func (f *fsm) applyNewNode(n Node) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.state.Nodes = append(f.state.Nodes, n)
-	return nil
-}
-
-func (f *fsm) applyUpdateNode(n Node) interface{} {
+func (f *fsm) applyRevokeOtherSessions(userID, token string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Find the existing node so we can keep the details from it, and then remove
-	// it from the store so that we can add it again.
-	var currentNode Node
-	var foundNode bool
-	for i, node := range f.state.Nodes {
-		if node.ID == n.ID {
-			f.state.Nodes = append(f.state.Nodes[:i], f.state.Nodes[i+1:]...)
-			currentNode = node
-			foundNode = true
+	// Remove every session of the user except for the one with the token.
+	for i, u := range f.state.Users {
+		if u.ID == userID {
+			sessions := []Session{}
+			for _, s := range u.Sessions {
+				if s.Token == token {
+					sessions = append(sessions, s)
+				}
+			}
+			f.state.Users[i].Sessions = sessions
 			break
 		}
 	}
-	if !foundNode {
-		return nil
-	}
-
-	// Handle all of the properties that could get updated.
-	currentNode.Roles = n.Roles
-
-	if n.SwapSize != -1 {
-		currentNode.SwapSize = n.SwapSize
-	}
-	if n.Swappiness != -1 {
-		currentNode.Swappiness = n.Swappiness
-	}
 
-	// Re-create the node in the store.
-	f.state.Nodes = append(f.state.Nodes, currentNode)
 	return nil
 }
 
-func (f *fsm) applyNewNamespace(n Namespace) interface{} {
+func (f *fsm) applyTouchSession(session Session) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.state.Namespaces = append(f.state.Namespaces, n)
-	return nil
-}
 
-func (f *fsm) applyNewRouter(r Router) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.state.Routers = append(f.state.Routers, r)
-	return nil
-}
+	// Only the last seen and expiry times are updated.
+search:
+	for i, u := range f.state.Users {
+		for j, s := range u.Sessions {
+			if s.Token == session.Token {
+				f.state.Users[i].Sessions[j].LastSeen = session.LastSeen
+				f.state.Users[i].Sessions[j].ExpiresAt = session.ExpiresAt
+				break search
+			}
+		}
+	}
 
-func (f *fsm) applyNewCertificate(c Certificate) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.state.Certificates = append(f.state.Certificates, c)
 	return nil
 }
 
-func (f *fsm) applyUpdateCertificate(c Certificate) interface{} {
+func (f *fsm) applyExpireSessions(now time.Time) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Find the existing certificate so we can keep the details from it, and then
-	// remove it from the store so that we can add it again.
-	var currentCertificate Certificate
-	var foundCertificate bool
-	for i, cert := range f.state.Certificates {
-		if cert.ID == c.ID {
-			f.state.Certificates = append(f.state.Certificates[:i], f.state.Certificates[i+1:]...)
-			currentCertificate = cert
-			foundCertificate = true
-			break
+	// Remove every session and login challenge that has expired by the time
+	// provided. The time comes from the command so that every node removes
+	// exactly the same ones. Sessions from before sessions could expire are
+	// given an expiry time instead, so that nobody is logged out by an upgrade.
+	for i, u := range f.state.Users {
+		sessions := []Session{}
+		for _, s := range u.Sessions {
+			if s.Legacy() {
+				s.Migrate(now)
+			}
+			if !s.Expired(now) {
+				sessions = append(sessions, s)
+			}
 		}
-	}
-	if !foundCertificate {
-		return nil
-	}
+		f.state.Users[i].Sessions = sessions
 
-	// We need to completely overwrite all of the challenges on a certificate no
-	// matter what happens when we update a certificate. This ensures that we can
-	// always clear out the pending challenges and add new ones when we perform
-	// the update.
-	currentCertificate.Challenges = c.Challenges
+		challenges := []LoginChallenge{}
+		for _, l := range u.Challenges {
+			if !l.Expired(now) {
+				challenges = append(challenges, l)
+			}
+		}
+		f.state.Users[i].Challenges = challenges
+	}
 
-	// Update other details normally (if they are not equal to their null
-	// counterparts).
-	if len(c.FullChain) > 0 {
-		currentCertificate.FullChain = c.FullChain
+	logins := OIDCLogins{}
+	for _, l := range f.state.OIDCLogins {
+		if !l.Expired(now) {
+			logins = append(logins, l)
+		}
 	}
-	if len(c.PrivateKey) > 0 {
-		currentCertificate.PrivateKey = c.PrivateKey
+	f.state.OIDCLogins = logins
+
+	attempts := LoginAttempts{}
+	for _, a := range f.state.LoginAttempts {
+		if !a.Expired(now) {
+			attempts = append(attempts, a)
+		}
 	}
+	f.state.LoginAttempts = attempts
 
-	// Apply the new certificate.
-	f.state.Certificates = append(f.state.Certificates, currentCertificate)
 	return nil
 }
 
-func (f *fsm) applyRemoveCertificate(id string) interface{} {
+func (f *fsm) applySetTOTP(userID string, totp TOTP) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Find the index of the certificate to remove.
-	for i, cert := range f.state.Certificates {
-		if cert.ID == id {
-			// Remove the certificate.
-			f.state.Certificates = append(f.state.Certificates[:i], f.state.Certificates[i+1:]...)
+	for i, u := range f.state.Users {
+		if u.ID == userID {
+			f.state.Users[i].TOTP = totp
 			break
 		}
 	}
@@ -453,15 +818,13 @@ func (f *fsm) applyRemoveCertificate(id string) interface{} {
 	return nil
 }
 
-func (f *fsm) applyRemoveRouter(id string) interface{} {
+func (f *fsm) applyNewLoginChallenge(userID string, challenge LoginChallenge) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Find the index of the router to remove.
-	for i, r := range f.state.Routers {
-		if r.ID == id {
-			// Remove the router.
-			f.state.Routers = append(f.state.Routers[:i], f.state.Routers[i+1:]...)
+	for i, u := range f.state.Users {
+		if u.ID == userID {
+			f.state.Users[i].Challenges = append(u.Challenges, challenge)
 			break
 		}
 	}
@@ -469,49 +832,653 @@ func (f *fsm) applyRemoveRouter(id string) interface{} {
 	return nil
 }
 
-func (f *fsm) applyUpdateRouter(r Router) interface{} {
+func (f *fsm) applyCompleteLoginChallenge(userID string, challenge LoginChallenge, session Session, step int64, recoveryCode string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Find the existing router so we can keep the details from it, and then
-	// remove it from the store so that we can add it again.
-	currentRouter := func() *Router {
-		for i, router := range f.state.Routers {
-			if router.ID == r.ID {
-				f.state.Routers = append(f.state.Routers[:i], f.state.Routers[i+1:]...)
-				return &router
-			}
-		}
-		return nil
-	}()
-
-	// Update the router object if the properties have been specified.
-	if r.CertificateID != "" {
-		currentRouter.CertificateID = r.CertificateID
+	i, user := f.state.Users.FindByID(userID)
+	if user == nil {
+		return ErrNotFound
 	}
-	if r.Domain != "" {
-		currentRouter.Domain = r.Domain
+
+	// The challenge is removed whether or not the session gets created, so that
+	// it can only ever be used once.
+	found := false
+	for j, l := range user.Challenges {
+		if l.ID == challenge.ID {
+			user.Challenges = append(user.Challenges[:j], user.Challenges[j+1:]...)
+			found = true
+			break
+		}
 	}
-	if r.NamespaceID != "" {
-		currentRouter.NamespaceID = r.NamespaceID
+	f.state.Users[i].Challenges = user.Challenges
+	if !found {
+		return fmt.Errorf("login challenge has already been used")
 	}
-	if r.AppID != "" {
-		currentRouter.AppID = r.AppID
+
+	// Consume the second factor that was used. If another login got there first
+	// with the same code, then this one doesn't get a session.
+	if recoveryCode != "" {
+		codes := []string{}
+		used := false
+		for _, c := range user.TOTP.RecoveryCodes {
+			if c == recoveryCode && !used {
+				used = true
+				continue
+			}
+			codes = append(codes, c)
+		}
+		if !used {
+			return fmt.Errorf("recovery code has already been used")
+		}
+		f.state.Users[i].TOTP.RecoveryCodes = codes
+	} else {
+		if step <= user.TOTP.LastStep {
+			return fmt.Errorf("code has already been used")
+		}
+		f.state.Users[i].TOTP.LastStep = step
 	}
 
-	// Re-create the router object.
-	f.state.Routers = append(f.state.Routers, *currentRouter)
+	f.state.Users[i].Sessions = append(user.Sessions, session)
 	return nil
 }
 
-func (f *fsm) applyNewVolume(v Volume) interface{} {
+func (f *fsm) applyLoginFailure(keys []string, now time.Time) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.state.Volumes = append(f.state.Volumes, v)
+
+	// The time comes from the command so that every node records exactly the
+	// same attempts.
+	for _, key := range keys {
+		f.state.LoginAttempts.Fail(key, now)
+	}
+
 	return nil
 }
 
-func (f *fsm) applyRemoveVolume(id string) interface{} {
+func (f *fsm) applyLoginSuccess(keys []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range keys {
+		f.state.LoginAttempts.Clear(key)
+	}
+
+	return nil
+}
+
+func (f *fsm) applySetClusterCA(ca *ClusterCA) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The CA can't be replaced, as every node certificate was issued by it.
+	if f.state.ClusterCA != nil {
+		return fmt.Errorf("cluster CA already exists")
+	}
+	f.state.ClusterCA = ca
+
+	return nil
+}
+
+func (f *fsm) applySetNodeTLS(nodeID string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, n := range f.state.Nodes {
+		if n.ID == nodeID {
+			f.state.Nodes[i].TLS = true
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyRotateKeyring(sealed string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The key is kept in the state even if this node can't open it, so that the
+	// state is the same on every node.
+	f.state.KeyringKeys = append(f.state.KeyringKeys, sealed)
+	return (*Store)(f).addKeyringKey(sealed)
+}
+
+func (f *fsm) applySetDeploymentSecrets(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].Secrets = deployment.Secrets
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetDeploymentEnv(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].Env = deployment.Env
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetDeploymentImage(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].Image = deployment.Image
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetDeploymentWebhook(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].WebhookSecret = deployment.WebhookSecret
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetDeploymentLogRetention(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].LogRetention = deployment.LogRetention
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetDeploymentBuilder(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].Builder = deployment.Builder
+			f.state.Deployments[i].BuilderImage = deployment.BuilderImage
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetBuildConfig(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].BuildConfig = deployment.BuildConfig
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applySetFormation(deployment Deployment) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == deployment.ID {
+			f.state.Deployments[i].Formation = deployment.Formation
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applyNewRelease(r Release) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, d := range f.state.Deployments {
+		if d.ID == r.DeploymentID {
+			// The version is decided here so that two releases at the same time
+			// can't end up with the same one.
+			r.Version = f.state.Releases.NextVersion(d.ID)
+			f.state.Releases.Append(r)
+
+			// The deployment now runs the release. Only a rollback brings back the
+			// configuration of the release, as the configuration of a build may
+			// have changed since it was deployed.
+			f.state.Deployments[i].Image = r.ImageRef()
+			f.state.Deployments[i].BuiltWith = r.Builder
+			f.state.Deployments[i].Processes = r.Processes
+			f.state.Deployments[i].ReleaseID = r.ID
+			if r.RollbackOf != "" {
+				f.state.Deployments[i].Env = r.Env
+				f.state.Deployments[i].Secrets = r.Secrets
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("deployment does not exist")
+}
+
+func (f *fsm) applyNewBuild(b Build) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Builds.Append(b)
+	return nil
+}
+
+func (f *fsm) applyUpdateBuild(b Build) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, existing := range f.state.Builds {
+		if existing.ID == b.ID {
+			// A finished build can't be started again, which stops a node that
+			// didn't notice a cancellation from overwriting it.
+			if existing.State.Finished() {
+				return fmt.Errorf("build has already %s", existing.State)
+			}
+
+			// The build can't be moved to another deployment or namespace.
+			b.DeploymentID = existing.DeploymentID
+			b.NamespaceID = existing.NamespaceID
+
+			// The metrics are kept if the node updating the build hasn't seen
+			// them yet.
+			if b.Metrics == nil {
+				b.Metrics = existing.Metrics
+			}
+			f.state.Builds[i] = b
+			return nil
+		}
+	}
+
+	return fmt.Errorf("build does not exist")
+}
+
+func (f *fsm) applyCancelBuild(id string, now time.Time) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, b := range f.state.Builds {
+		if b.ID == id {
+			if b.State.Finished() {
+				return fmt.Errorf("build has already %s", b.State)
+			}
+			f.state.Builds[i].State = BuildCancelled
+			f.state.Builds[i].FinishedAt = now
+			return nil
+		}
+	}
+
+	return fmt.Errorf("build does not exist")
+}
+
+func (f *fsm) applyTouchBuild(b Build) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Only the last seen time is updated, and only while the build is running
+	// on the node that reported it.
+	for i, existing := range f.state.Builds {
+		if existing.ID == b.ID {
+			if existing.State != BuildRunning || existing.NodeID != b.NodeID {
+				return fmt.Errorf("build is not running on node %s", b.NodeID)
+			}
+			f.state.Builds[i].LastSeen = b.LastSeen
+			return nil
+		}
+	}
+
+	return fmt.Errorf("build does not exist")
+}
+
+func (f *fsm) applyNewSecret(s Secret) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Secrets = append(f.state.Secrets, s)
+	return nil
+}
+
+func (f *fsm) applyUpdateSecret(s Secret) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, secret := range f.state.Secrets {
+		if secret.ID == s.ID {
+			f.state.Secrets[i] = s
+			return nil
+		}
+	}
+
+	return fmt.Errorf("secret does not exist")
+}
+
+func (f *fsm) applyRemoveSecret(id string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, secret := range f.state.Secrets {
+		if secret.ID == id {
+			f.state.Secrets = append(f.state.Secrets[:i], f.state.Secrets[i+1:]...)
+			break
+		}
+	}
+
+	// Detach it from any deployment that still has it, so that a build doesn't
+	// fail on a secret that is gone.
+	for i, d := range f.state.Deployments {
+		refs := []SecretRef{}
+		for _, ref := range d.Secrets {
+			if ref.SecretID != id {
+				refs = append(refs, ref)
+			}
+		}
+		f.state.Deployments[i].Secrets = refs
+
+		buildRefs := []SecretRef{}
+		for _, ref := range d.BuildConfig.Secrets {
+			if ref.SecretID != id {
+				buildRefs = append(buildRefs, ref)
+			}
+		}
+		f.state.Deployments[i].BuildConfig.Secrets = buildRefs
+	}
+
+	return nil
+}
+
+func (f *fsm) applyNewOIDCProvider(p OIDCProvider) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.OIDCProviders = append(f.state.OIDCProviders, p)
+	return nil
+}
+
+func (f *fsm) applyUpdateOIDCProvider(p OIDCProvider) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, provider := range f.state.OIDCProviders {
+		if provider.ID == p.ID {
+			f.state.OIDCProviders[i] = p
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyRemoveOIDCProvider(id string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, provider := range f.state.OIDCProviders {
+		if provider.ID == id {
+			f.state.OIDCProviders = append(f.state.OIDCProviders[:i], f.state.OIDCProviders[i+1:]...)
+			break
+		}
+	}
+
+	// Unlink the accounts from the provider, so that a new provider that happens
+	// to reuse the ID can't log in as them.
+	for i, u := range f.state.Users {
+		identities := []Identity{}
+		for _, identity := range u.Identities {
+			if identity.ProviderID != id {
+				identities = append(identities, identity)
+			}
+		}
+		f.state.Users[i].Identities = identities
+	}
+
+	return nil
+}
+
+func (f *fsm) applyNewOIDCLogin(l OIDCLogin) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.OIDCLogins = append(f.state.OIDCLogins, l)
+	return nil
+}
+
+func (f *fsm) applyRemoveOIDCLogin(state string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, l := range f.state.OIDCLogins {
+		if l.State == state {
+			f.state.OIDCLogins = append(f.state.OIDCLogins[:i], f.state.OIDCLogins[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyLinkIdentity(userID string, identity Identity) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// An identity can only ever be linked to a single user.
+	if f.state.Users.FindByIdentity(identity.ProviderID, identity.Subject) != nil {
+		return fmt.Errorf("identity is already linked to a user")
+	}
+
+	for i, u := range f.state.Users {
+		if u.ID == userID {
+			f.state.Users[i].Identities = append(u.Identities, identity)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyNewNode(n Node) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Nodes = append(f.state.Nodes, n)
+	return nil
+}
+
+func (f *fsm) applyUpdateNode(n Node) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Find the existing node so we can keep the details from it, and then remove
+	// it from the store so that we can add it again.
+	var currentNode Node
+	var foundNode bool
+	for i, node := range f.state.Nodes {
+		if node.ID == n.ID {
+			f.state.Nodes = append(f.state.Nodes[:i], f.state.Nodes[i+1:]...)
+			currentNode = node
+			foundNode = true
+			break
+		}
+	}
+	if !foundNode {
+		return nil
+	}
+
+	// Handle all of the properties that could get updated.
+	currentNode.Roles = n.Roles
+
+	if n.SwapSize != -1 {
+		currentNode.SwapSize = n.SwapSize
+	}
+	if n.Swappiness != -1 {
+		currentNode.Swappiness = n.Swappiness
+	}
+
+	// Re-create the node in the store.
+	f.state.Nodes = append(f.state.Nodes, currentNode)
+	return nil
+}
+
+func (f *fsm) applyNewNamespace(n Namespace) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Namespaces = append(f.state.Namespaces, n)
+	return nil
+}
+
+func (f *fsm) applyNewRouter(r Router) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Routers = append(f.state.Routers, r)
+	return nil
+}
+
+func (f *fsm) applyNewCertificate(c Certificate) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Certificates = append(f.state.Certificates, c)
+	return nil
+}
+
+func (f *fsm) applyUpdateCertificate(c Certificate) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Find the existing certificate so we can keep the details from it, and then
+	// remove it from the store so that we can add it again.
+	var currentCertificate Certificate
+	var foundCertificate bool
+	for i, cert := range f.state.Certificates {
+		if cert.ID == c.ID {
+			f.state.Certificates = append(f.state.Certificates[:i], f.state.Certificates[i+1:]...)
+			currentCertificate = cert
+			foundCertificate = true
+			break
+		}
+	}
+	if !foundCertificate {
+		return nil
+	}
+
+	// We need to completely overwrite all of the challenges on a certificate no
+	// matter what happens when we update a certificate. This ensures that we can
+	// always clear out the pending challenges and add new ones when we perform
+	// the update.
+	currentCertificate.Challenges = c.Challenges
+
+	// Update other details normally (if they are not equal to their null
+	// counterparts).
+	if len(c.FullChain) > 0 {
+		currentCertificate.FullChain = c.FullChain
+	}
+	if len(c.PrivateKey) > 0 {
+		currentCertificate.PrivateKey = c.PrivateKey
+	}
+
+	// Apply the new certificate.
+	f.state.Certificates = append(f.state.Certificates, currentCertificate)
+	return nil
+}
+
+func (f *fsm) applyRemoveCertificate(id string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Find the index of the certificate to remove.
+	for i, cert := range f.state.Certificates {
+		if cert.ID == id {
+			// Remove the certificate.
+			f.state.Certificates = append(f.state.Certificates[:i], f.state.Certificates[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyRemoveRouter(id string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Find the index of the router to remove.
+	for i, r := range f.state.Routers {
+		if r.ID == id {
+			// Remove the router.
+			f.state.Routers = append(f.state.Routers[:i], f.state.Routers[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyUpdateRouter(r Router) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Find the existing router so we can keep the details from it, and then
+	// remove it from the store so that we can add it again.
+	currentRouter := func() *Router {
+		for i, router := range f.state.Routers {
+			if router.ID == r.ID {
+				f.state.Routers = append(f.state.Routers[:i], f.state.Routers[i+1:]...)
+				return &router
+			}
+		}
+		return nil
+	}()
+
+	// Update the router object if the properties have been specified.
+	if r.CertificateID != "" {
+		currentRouter.CertificateID = r.CertificateID
+	}
+	if r.Domain != "" {
+		currentRouter.Domain = r.Domain
+	}
+	if r.NamespaceID != "" {
+		currentRouter.NamespaceID = r.NamespaceID
+	}
+	if r.AppID != "" {
+		currentRouter.AppID = r.AppID
+	}
+
+	// Re-create the router object.
+	f.state.Routers = append(f.state.Routers, *currentRouter)
+	return nil
+}
+
+func (f *fsm) applyNewVolume(v Volume) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Volumes = append(f.state.Volumes, v)
+	return nil
+}
+
+func (f *fsm) applyRemoveVolume(id string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -545,6 +1512,81 @@ outer:
 	return nil
 }
 
+func (f *fsm) applyGrantRole(b RoleBinding) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.RoleBindings.Set(b)
+	return nil
+}
+
+func (f *fsm) applyMigrateRoles() interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state.MigrateRoles()
+}
+
+func (f *fsm) applyRevokeRole(b RoleBinding) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.RoleBindings.Remove(b.UserID, b.NamespaceID)
+	return nil
+}
+
+func (f *fsm) applyNewAPIToken(userID string, t APIToken) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, u := range f.state.Users {
+		if u.ID == userID {
+			f.state.Users[i].Tokens = append(u.Tokens, t)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyRevokeAPIToken(userID, tokenID string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+search:
+	for i, u := range f.state.Users {
+		if u.ID != userID {
+			continue
+		}
+		for j, t := range u.Tokens {
+			if t.ID == tokenID {
+				f.state.Users[i].Tokens = append(u.Tokens[:j], u.Tokens[j+1:]...)
+				break search
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *fsm) applyTouchAPIToken(userID string, t APIToken) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Only the last used time is updated.
+search:
+	for i, u := range f.state.Users {
+		if u.ID != userID {
+			continue
+		}
+		for j, token := range u.Tokens {
+			if token.ID == t.ID {
+				f.state.Users[i].Tokens[j].LastUsed = t.LastUsed
+				break search
+			}
+		}
+	}
+
+	return nil
+}
+
 // Snapshot is a method that a raft finite state machine requires to operate. It
 // simply copies the data into an FSM snapshot.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
@@ -557,6 +1599,12 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 		return nil, err
 	}
 
+	// Seal the sensitive fields before they are persisted.
+	if err := (*StoreState)(snapshot).transformSecrets(f.keyring.Seal); err != nil {
+		log.Println("[ERR] fsm: Could not seal snapshot")
+		return nil, err
+	}
+
 	return snapshot, nil
 }
 
@@ -569,6 +1617,18 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 		return err
 	}
 
+	// Add the rotated keys in order, as each one is sealed with the one before.
+	for _, sealed := range state.KeyringKeys {
+		if err := (*Store)(f).addKeyringKey(sealed); err != nil {
+			log.Println("[ERR] fsm: Could not add rotated key from snapshot")
+			return err
+		}
+	}
+	if err := state.transformSecrets(f.keyring.Open); err != nil {
+		log.Println("[ERR] fsm: Could not open sealed snapshot")
+		return err
+	}
+
 	// Set the state from the snapshot. This does not require a mutex lock.
 	f.state = state
 	return nil
@@ -0,0 +1,606 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"orbit.sh/engine/proto"
+)
+
+// sealedPrefix marks a value that has been sealed with the keyring. Values
+// without it are from before the keyring existed, and are used as they are.
+const sealedPrefix = "orbit:sealed:v1:"
+
+// Keyring holds the keys that the sensitive fields of the store are sealed with
+// before they are written to the raft log or a snapshot. It is kept outside of
+// the raft directory on every node and is handed to a node when it joins, so a
+// copy of the raft directory on its own reveals nothing.
+//
+// Every value is sealed with its own data key, which is in turn sealed with the
+// primary key of the keyring (envelope encryption). Rotating the keyring adds a
+// new primary key, and the old ones are kept so that the entries and snapshots
+// that were sealed with them can still be opened.
+//
+// A rotated key is sealed with the key before it and sent through the raft log,
+// so every node receives it before the first entry that is sealed with it. The
+// sealed keys are kept in the state as well, so that a node restored from a
+// snapshot has them too.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    []KeyringKey
+	primary string
+}
+
+// KeyringKey is a single key in the keyring.
+type KeyringKey struct {
+	ID        string    `json:"id"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// keyringFile is how the keyring is encoded on disk and over RPC.
+type keyringFile struct {
+	Keys    []KeyringKey `json:"keys"`
+	Primary string       `json:"primary"`
+}
+
+// Empty returns whether or not the keyring has a key to seal values with.
+func (k *Keyring) Empty() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary == ""
+}
+
+// Keys returns the keys in the keyring and the ID of the primary key.
+func (k *Keyring) Keys() ([]KeyringKey, string) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]KeyringKey{}, k.keys...), k.primary
+}
+
+// Load adds the keys from the keyring file at the path. It is not an error for
+// the file not to exist, as a node only has a keyring once it has been
+// bootstrapped or joined.
+func (k *Keyring) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return k.Merge(b)
+}
+
+// Save writes the keyring to the file at the path.
+func (k *Keyring) Save(path string) error {
+	b, err := k.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Marshal encodes the keyring so that it can be saved or sent to another node.
+func (k *Keyring) Marshal() ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return json.Marshal(keyringFile{Keys: k.keys, Primary: k.primary})
+}
+
+// Merge adds the keys from an encoded keyring that this one doesn't have. The
+// primary key of the other keyring is used if it is newer than this one's.
+func (k *Keyring) Merge(b []byte) error {
+	var other keyringFile
+	if err := json.Unmarshal(b, &other); err != nil {
+		return errors.Wrap(err, "could not decode keyring")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+search:
+	for _, key := range other.Keys {
+		for _, existing := range k.keys {
+			if existing.ID == key.ID {
+				continue search
+			}
+		}
+		if len(key.Key) != 32 {
+			return fmt.Errorf("key %s is not a 256-bit key", key.ID)
+		}
+		k.keys = append(k.keys, key)
+	}
+
+	if other.Primary != "" && other.Primary != k.primary {
+		current, next := k.find(k.primary), k.find(other.Primary)
+		if next != nil && (current == nil || next.CreatedAt.After(current.CreatedAt)) {
+			k.primary = next.ID
+		}
+	}
+
+	return nil
+}
+
+// Rotated returns an encoded keyring that only has a new primary key, without
+// changing this one. Merging it makes the new key the primary.
+func (k *Keyring) Rotated() ([]byte, *KeyringKey, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	key := KeyringKey{
+		ID:        hex.EncodeToString(b),
+		Key:       make([]byte, 32),
+		CreatedAt: time.Now(),
+	}
+	if _, err := rand.Read(key.Key); err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate key")
+	}
+
+	enc, err := json.Marshal(keyringFile{Keys: []KeyringKey{key}, Primary: key.ID})
+	return enc, &key, err
+}
+
+// find returns the key with the ID, or nil if it isn't in the keyring. The
+// caller must hold the lock.
+func (k *Keyring) find(id string) *KeyringKey {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return &key
+		}
+	}
+	return nil
+}
+
+// Seal encrypts the value with a new data key, and seals the data key with the
+// primary key. If the keyring is empty the value is returned as it is, which is
+// only the case for a cluster that was created before there was a keyring.
+func (k *Keyring) Seal(value []byte) ([]byte, error) {
+	k.mu.RLock()
+	key := k.find(k.primary)
+	k.mu.RUnlock()
+	if key == nil || len(value) == 0 {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap(err, "could not generate data key")
+	}
+	sealedKey, err := gcmSeal(key.Key, dataKey, []byte(key.ID))
+	if err != nil {
+		return nil, err
+	}
+	sealedValue, err := gcmSeal(dataKey, value, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := base64.RawStdEncoding
+	return []byte(sealedPrefix + key.ID + ":" + enc.EncodeToString(sealedKey) + ":" + enc.EncodeToString(sealedValue)), nil
+}
+
+// Open decrypts a value that was sealed with the keyring. Values that weren't
+// sealed are returned as they are.
+func (k *Keyring) Open(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(sealedPrefix)) {
+		return value, nil
+	}
+
+	parts := bytes.Split(bytes.TrimPrefix(value, []byte(sealedPrefix)), []byte(":"))
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed sealed value")
+	}
+	id := string(parts[0])
+
+	k.mu.RLock()
+	key := k.find(id)
+	k.mu.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("key %s is not in the keyring", id)
+	}
+
+	enc := base64.RawStdEncoding
+	sealedKey, err := enc.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed sealed value")
+	}
+	sealedValue, err := enc.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed sealed value")
+	}
+
+	dataKey, err := gcmOpen(key.Key, sealedKey, []byte(key.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open data key")
+	}
+	return gcmOpen(dataKey, sealedValue, nil)
+}
+
+// gcmSeal encrypts the plaintext with AES-256-GCM, and prepends the nonce.
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// gcmOpen decrypts a ciphertext created with gcmSeal.
+func gcmOpen(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// secretFunc transforms the value of a sensitive field, either sealing or
+// opening it.
+type secretFunc func([]byte) ([]byte, error)
+
+// transformString applies the function to a sensitive string field.
+func transformString(v *string, fn secretFunc) error {
+	if *v == "" {
+		return nil
+	}
+	b, err := fn([]byte(*v))
+	if err != nil {
+		return err
+	}
+	*v = string(b)
+	return nil
+}
+
+// transformBytes applies the function to a sensitive byte slice field.
+func transformBytes(v *[]byte, fn secretFunc) error {
+	if len(*v) == 0 {
+		return nil
+	}
+	b, err := fn(*v)
+	if err != nil {
+		return err
+	}
+	*v = b
+	return nil
+}
+
+// transformSecrets applies the function to the sensitive fields of the user.
+// The sessions are copied first, so that the original user isn't changed.
+func (u *User) transformSecrets(fn secretFunc) error {
+	if len(u.Sessions) > 0 {
+		sessions := make([]Session, len(u.Sessions))
+		copy(sessions, u.Sessions)
+		for i := range sessions {
+			if err := transformString(&sessions[i].Token, fn); err != nil {
+				return err
+			}
+		}
+		u.Sessions = sessions
+	}
+	return transformString(&u.TOTP.Secret, fn)
+}
+
+// transformSecrets applies the function to the credentials of the upstream of
+// the repository. The upstream is copied first, so that the original
+// repository isn't changed.
+func (r *Repository) transformSecrets(fn secretFunc) error {
+	if r.Upstream == nil {
+		return nil
+	}
+	upstream := *r.Upstream
+	if err := transformString(&upstream.Token, fn); err != nil {
+		return err
+	}
+	if err := transformString(&upstream.DeployKey, fn); err != nil {
+		return err
+	}
+	r.Upstream = &upstream
+	return nil
+}
+
+// transformSecrets applies the function to every sensitive field in the state.
+// Every list that contains one is copied first, so that this can be used on a
+// shallow copy of the state without changing the original.
+func (s *StoreState) transformSecrets(fn secretFunc) error {
+	if len(s.Users) > 0 {
+		users := make(Users, len(s.Users))
+		copy(users, s.Users)
+		for i := range users {
+			if err := users[i].transformSecrets(fn); err != nil {
+				return err
+			}
+		}
+		s.Users = users
+	}
+
+	if len(s.Certificates) > 0 {
+		certificates := make(Certificates, len(s.Certificates))
+		copy(certificates, s.Certificates)
+		for i := range certificates {
+			if err := transformBytes(&certificates[i].PrivateKey, fn); err != nil {
+				return err
+			}
+		}
+		s.Certificates = certificates
+	}
+
+	if len(s.OIDCProviders) > 0 {
+		providers := make(OIDCProviders, len(s.OIDCProviders))
+		copy(providers, s.OIDCProviders)
+		for i := range providers {
+			if err := transformString(&providers[i].ClientSecret, fn); err != nil {
+				return err
+			}
+		}
+		s.OIDCProviders = providers
+	}
+
+	if len(s.Secrets) > 0 {
+		secrets := make(Secrets, len(s.Secrets))
+		copy(secrets, s.Secrets)
+		for i := range secrets {
+			if err := transformString(&secrets[i].Value, fn); err != nil {
+				return err
+			}
+		}
+		s.Secrets = secrets
+	}
+
+	if len(s.Repositories) > 0 {
+		repos := make(Repositories, len(s.Repositories))
+		copy(repos, s.Repositories)
+		for i := range repos {
+			if err := repos[i].transformSecrets(fn); err != nil {
+				return err
+			}
+		}
+		s.Repositories = repos
+	}
+
+	if len(s.Deployments) > 0 {
+		deployments := make(Deployments, len(s.Deployments))
+		copy(deployments, s.Deployments)
+		for i := range deployments {
+			if err := transformString(&deployments[i].WebhookSecret, fn); err != nil {
+				return err
+			}
+		}
+		s.Deployments = deployments
+	}
+
+	if s.ClusterCA != nil {
+		ca := *s.ClusterCA
+		if err := transformBytes(&ca.PrivateKey, fn); err != nil {
+			return err
+		}
+		s.ClusterCA = &ca
+	}
+
+	if err := transformString(&s.ManagerJoinToken, fn); err != nil {
+		return err
+	}
+	return transformString(&s.WorkerJoinToken, fn)
+}
+
+// transformSecrets applies the function to every sensitive field in the
+// command, in the same way as it is for the state.
+func (c *command) transformSecrets(fn secretFunc) error {
+	if err := c.User.transformSecrets(fn); err != nil {
+		return err
+	}
+	if err := transformString(&c.Session.Token, fn); err != nil {
+		return err
+	}
+	if err := transformString(&c.TOTP.Secret, fn); err != nil {
+		return err
+	}
+	if err := transformBytes(&c.Certificate.PrivateKey, fn); err != nil {
+		return err
+	}
+	if err := transformString(&c.OIDCProvider.ClientSecret, fn); err != nil {
+		return err
+	}
+	if err := transformString(&c.Secret.Value, fn); err != nil {
+		return err
+	}
+	if err := transformString(&c.Deployment.WebhookSecret, fn); err != nil {
+		return err
+	}
+	if err := c.Repository.transformSecrets(fn); err != nil {
+		return err
+	}
+
+	if c.ClusterCA != nil {
+		ca := *c.ClusterCA
+		if err := transformBytes(&ca.PrivateKey, fn); err != nil {
+			return err
+		}
+		c.ClusterCA = &ca
+	}
+
+	if err := transformString(&c.ManagerJoinToken, fn); err != nil {
+		return err
+	}
+	return transformString(&c.WorkerJoinToken, fn)
+}
+
+// keyringPath returns the path of the keyring file of the node. This is
+// deliberately outside of the raft directory.
+func (s *Store) keyringPath() string {
+	return filepath.Join(s.engine.DataPath, "keyring.json")
+}
+
+// InitKeyring will create the first key of the keyring if there isn't one. This
+// is done when the cluster is bootstrapped, or by the leader of a cluster from
+// before there was a keyring. The key is sent to every other node before it is
+// used, so that none of them receive an entry that they can't open.
+func (s *Store) InitKeyring() error {
+	if !s.keyring.Empty() {
+		return nil
+	}
+
+	b, _, err := s.keyring.Rotated()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	nodes := append(Nodes{}, s.state.Nodes...)
+	s.mu.RUnlock()
+	for _, node := range nodes {
+		if node.ID == s.ID {
+			continue
+		}
+		addr := fmt.Sprintf("%s:%d", node.Address, node.RPCPort)
+		if err := s.sendKeyring(addr, b); err != nil {
+			return errors.Wrapf(err, "could not send keyring to node %s", node.ID)
+		}
+	}
+
+	if err := s.keyring.Merge(b); err != nil {
+		return err
+	}
+	return s.keyring.Save(s.keyringPath())
+}
+
+// RotateKeyring adds a new primary key to the keyring. The key is sealed with
+// the current primary key and applied through the raft log, so that every node
+// adds it before any entry is sealed with it.
+func (s *Store) RotateKeyring(actor Actor) (*KeyringKey, error) {
+	if s.keyring.Empty() {
+		return nil, fmt.Errorf("keyring has not been created")
+	}
+
+	b, key, err := s.keyring.Rotated()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.keyring.Seal(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not seal key")
+	}
+
+	cmd := command{
+		Op:         opRotateKeyring,
+		Actor:      actor,
+		KeyringKey: string(sealed),
+	}
+	if err := cmd.Apply(s); err != nil {
+		return nil, err
+	}
+
+	// Take a snapshot, so that the state on disk is sealed with the new key.
+	if err := s.raft.Snapshot().Error(); err != nil {
+		log.Printf("[WARN] store: Could not snapshot after rotating keyring: %s", err)
+	}
+
+	log.Printf("[INFO] store: Rotated keyring to key %s", key.ID)
+	return key, nil
+}
+
+// addKeyringKey opens a rotated key that was sealed with the key before it, and
+// adds it to the keyring. The keyring is saved so that the key is there when
+// the node restarts, but it isn't needed to be, as the sealed key is kept in
+// the state.
+func (s *Store) addKeyringKey(sealed string) error {
+	b, err := s.keyring.Open([]byte(sealed))
+	if err != nil {
+		return errors.Wrap(err, "could not open key")
+	}
+	if err := s.keyring.Merge(b); err != nil {
+		return err
+	}
+	if err := s.keyring.Save(s.keyringPath()); err != nil {
+		log.Printf("[WARN] store: Could not save keyring: %s", err)
+	}
+	return nil
+}
+
+// sendKeyring sends the encoded keyring to the node at the RPC address.
+func (s *Store) sendKeyring(addr string, b []byte) error {
+	conn, err := s.engine.RPCServer.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RaftTimeout)
+	defer cancel()
+	res, err := proto.NewRPCClient(conn).SetKeyring(ctx, &proto.SetKeyringRequest{Keyring: b})
+	if err != nil {
+		return err
+	}
+	if res.Status != proto.Status_OK {
+		return fmt.Errorf("node responded with %s", res.Status)
+	}
+	return nil
+}
+
+// fetchKeyring retrieves the keyring from the leader and adds the keys that
+// this node is missing. This is only needed by a node that missed the first key
+// of a cluster from before there was a keyring.
+func (s *Store) fetchKeyring() error {
+	leader := s.engine.RPCServer.Leader()
+	if leader == "" {
+		return fmt.Errorf("could not determine the leader")
+	}
+	if s.raft.State() == raft.Leader {
+		return fmt.Errorf("this node is the leader")
+	}
+
+	conn, err := s.engine.RPCServer.Dial(leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RaftTimeout)
+	defer cancel()
+	res, err := proto.NewRPCClient(conn).GetKeyring(ctx, &proto.KeyringRequest{})
+	if err != nil {
+		return err
+	}
+	if res.Status != proto.Status_OK {
+		return fmt.Errorf("leader responded with %s", res.Status)
+	}
+
+	if err := s.keyring.Merge(res.Keyring); err != nil {
+		return err
+	}
+	return s.keyring.Save(s.keyringPath())
+}
@@ -0,0 +1,362 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logChunkSize is the size that a chunk of a build log can grow to before
+	// the next lines are written to a new one.
+	logChunkSize = 1024 * 1024
+
+	// logRetentionBuilds is the number of build logs kept for a deployment that
+	// doesn't have a retention policy of its own.
+	logRetentionBuilds = 20
+)
+
+// LogRetention is how long the build logs of a deployment are kept for. The
+// newest logs are kept up to the number of builds, and logs older than the
+// maximum age are removed even if that leaves fewer.
+type LogRetention struct {
+	Builds int `json:"builds,omitempty"`  // The number of logs kept, the default is used if 0
+	MaxAge int `json:"max_age,omitempty"` // The number of days that logs are kept, forever if 0
+}
+
+// logMu stops two writers from appending to the same chunk at once.
+var logMu sync.Mutex
+
+// buildLogDir returns the directory that the chunks of a build log are written
+// to. The logs are kept on the orbit system volume, so that every node can read
+// the logs of a build no matter which node built it.
+func (s *Store) buildLogDir(deploymentID, key string) (string, error) {
+	volume := s.OrbitSystemVolume()
+	if volume == nil {
+		return "", fmt.Errorf("could not find the orbit system volume")
+	}
+	if key == "." || key == ".." {
+		return "", fmt.Errorf("%s is not a valid build log key", key)
+	}
+	return filepath.Join(volume.Paths().Data, "logs", deploymentID, url.PathEscape(key)), nil
+}
+
+// buildLogChunks returns the paths of the chunks of a build log, in order.
+func buildLogChunks(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".log") {
+			chunks = append(chunks, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(chunks) // The names are zero padded, so this is numerical order
+	return chunks, nil
+}
+
+// AppendBuildLog appends lines to the build log with the given key. The lines
+// are written to the last chunk of the log, or a new chunk once the last one
+// is full. Logs are only ever appended to, so that they can be followed by
+// reading from where the last read ended.
+func (s *Store) AppendBuildLog(deploymentID, key string, lines ...string) error {
+	// Don't write anything if there are no additional lines.
+	if len(lines) == 0 {
+		return nil
+	}
+
+	dir, err := s.buildLogDir(deploymentID, key)
+	if err != nil {
+		return err
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	chunks, err := buildLogChunks(dir)
+	if err != nil {
+		return err
+	}
+
+	// Find the chunk to write to, starting a new one if the last one is full.
+	path := filepath.Join(dir, fmt.Sprintf("%06d.log", len(chunks)))
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		if info, err := os.Stat(last); err == nil && info.Size() < logChunkSize {
+			path = last
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// ReadBuildLog reads the build log with the given key from a byte offset in
+// the log, and returns the offset that the next read should start from. Only
+// whole lines are returned, so that a line being written isn't split between
+// two reads.
+func (s *Store) ReadBuildLog(deploymentID, key string, offset int64) ([]byte, int64, error) {
+	dir, err := s.buildLogDir(deploymentID, key)
+	if err != nil {
+		return nil, offset, err
+	}
+	chunks, err := buildLogChunks(dir)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	// Skip past the chunks that have been read already.
+	readers := []io.Reader{}
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	skip := offset
+	for _, chunk := range chunks {
+		f, err := os.Open(chunk)
+		if err != nil {
+			return nil, offset, err
+		}
+		files = append(files, f)
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, offset, err
+		}
+		if skip >= info.Size() {
+			skip -= info.Size()
+			continue
+		}
+		if _, err := f.Seek(skip, io.SeekStart); err != nil {
+			return nil, offset, err
+		}
+		skip = 0
+		readers = append(readers, f)
+	}
+
+	data, err := ioutil.ReadAll(io.MultiReader(readers...))
+	if err != nil {
+		return nil, offset, err
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i != -1 {
+		data = data[:i+1]
+	} else {
+		data = nil
+	}
+	return data, offset + int64(len(data)), nil
+}
+
+// BuildLogLines returns every line of the build log with the given key.
+func (s *Store) BuildLogLines(deploymentID, key string) ([]string, error) {
+	data, _, err := s.ReadBuildLog(deploymentID, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	return lines[:len(lines)-1], nil // The last line is always empty
+}
+
+// BuildLogSize returns the number of bytes in the build log with the given key.
+func (s *Store) BuildLogSize(deploymentID, key string) int64 {
+	dir, err := s.buildLogDir(deploymentID, key)
+	if err != nil {
+		return 0
+	}
+	chunks, _ := buildLogChunks(dir)
+
+	var size int64
+	for _, chunk := range chunks {
+		if info, err := os.Stat(chunk); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// BuildLogKeys returns the keys of the build logs that a deployment has, along
+// with when each was last written to.
+func (s *Store) BuildLogKeys(deploymentID string) (map[string]time.Time, error) {
+	dir, err := s.buildLogDir(deploymentID, "")
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]time.Time{}
+	for _, f := range files {
+		key, err := url.PathUnescape(f.Name())
+		if err != nil || !f.IsDir() {
+			continue
+		}
+
+		// The last chunk is the one that was written to last.
+		modified := f.ModTime()
+		chunks, _ := buildLogChunks(filepath.Join(dir, f.Name()))
+		if len(chunks) > 0 {
+			if info, err := os.Stat(chunks[len(chunks)-1]); err == nil {
+				modified = info.ModTime()
+			}
+		}
+		keys[key] = modified
+	}
+	return keys, nil
+}
+
+// ClearBuildLog will remove the build log with the given key, including any
+// copy of it that is still in the store from before logs were kept on disk.
+func (s *Store) ClearBuildLog(deploymentID, key string) error {
+	dir, err := s.buildLogDir(deploymentID, key)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	for _, d := range s.state.Deployments {
+		if _, ok := d.BuildLogs[key]; ok && d.ID == deploymentID {
+			return s.clearStoredBuildLog(deploymentID, key)
+		}
+	}
+	return nil
+}
+
+// clearStoredBuildLog removes a build log that was kept in the store.
+func (s *Store) clearStoredBuildLog(deploymentID, key string) error {
+	cmd := command{
+		Op: opClearBuildLog,
+		Deployment: Deployment{
+			ID:        deploymentID,
+			BuildLogs: map[string][]string{key: {}},
+		},
+	}
+	return cmd.Apply(s)
+}
+
+// MigrateBuildLogs moves the build logs that are kept in the store onto disk,
+// one at a time, so that they no longer take up room in every snapshot.
+func (s *Store) MigrateBuildLogs() error {
+	for _, d := range s.state.Deployments {
+		for key, lines := range d.BuildLogs {
+			// The log may have been written already, if removing it from the store
+			// failed last time.
+			if s.BuildLogSize(d.ID, key) == 0 {
+				if err := s.AppendBuildLog(d.ID, key, lines...); err != nil {
+					return err
+				}
+			}
+			if err := s.clearStoredBuildLog(d.ID, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PruneBuildLogs removes the build logs that are outside of the retention
+// policy of their deployment, as well as the logs of deployments that no
+// longer exist. The logs of builds that haven't finished are always kept.
+func (s *Store) PruneBuildLogs() error {
+	volume := s.OrbitSystemVolume()
+	if volume == nil {
+		return fmt.Errorf("could not find the orbit system volume")
+	}
+	root := filepath.Join(volume.Paths().Data, "logs")
+
+	deployments := map[string]Deployment{}
+	for _, d := range s.state.Deployments {
+		deployments[d.ID] = d
+	}
+	active := map[string]bool{} // The keys of the builds that haven't finished
+	for _, b := range s.state.Builds {
+		if !b.State.Finished() && b.LogKey != "" {
+			active[b.LogKey] = true
+		}
+	}
+
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		d, ok := deployments[dir.Name()]
+		if !ok {
+			os.RemoveAll(filepath.Join(root, dir.Name()))
+			continue
+		}
+
+		keys, err := s.BuildLogKeys(d.ID)
+		if err != nil {
+			return err
+		}
+		for _, key := range d.LogRetention.expired(keys, active) {
+			if err := s.ClearBuildLog(d.ID, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expired returns the keys of the logs that are outside of the policy, given
+// when each log was last written to.
+func (r LogRetention) expired(logs map[string]time.Time, active map[string]bool) []string {
+	limit := r.Builds
+	if limit == 0 {
+		limit = logRetentionBuilds
+	}
+
+	keys := []string{}
+	for key := range logs {
+		if !active[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return logs[keys[i]].After(logs[keys[j]])
+	})
+
+	expired := []string{}
+	for i, key := range keys {
+		tooOld := r.MaxAge > 0 && time.Since(logs[key]) > time.Duration(r.MaxAge)*24*time.Hour
+		if i >= limit || tooOld {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// mirrorDefaultInterval is how often a mirrored repository is fetched from
+	// its upstream if it doesn't have an interval of its own.
+	mirrorDefaultInterval = time.Minute
+
+	// mirrorMinInterval is the shortest interval that an upstream can be fetched
+	// at, so that Orbit doesn't hammer the git host.
+	mirrorMinInterval = 10 * time.Second
+)
+
+// Upstream is a remote git repository that a repository mirrors, rather than
+// having code pushed to it directly. Private repositories are fetched with
+// either a token over HTTP, or a deploy key over SSH. Both are sealed by the
+// keyring whenever they are written to disk, and are never sent back by the
+// API.
+type Upstream struct {
+	URL       string `json:"url"`
+	Username  string `json:"username,omitempty"`   // The user that the token belongs to, if the host needs it
+	Token     string `json:"token,omitempty"`      // Used as the password for HTTP URLs
+	DeployKey string `json:"deploy_key,omitempty"` // A private key for SSH URLs
+	Interval  int    `json:"interval,omitempty"`   // Seconds between fetches, the default is used if 0
+}
+
+// scheme returns the transport that the URL of the upstream uses. URLs in the
+// scp style of "git@host:path" use SSH.
+func (u Upstream) scheme() string {
+	if parsed, err := url.Parse(u.URL); err == nil && strings.Contains(u.URL, "://") {
+		return parsed.Scheme
+	}
+	if strings.Contains(u.URL, "@") && strings.Contains(u.URL, ":") {
+		return "ssh"
+	}
+	return ""
+}
+
+// Local returns whether or not the upstream is on the disk of the node, which
+// only admins are allowed to mirror.
+func (u Upstream) Local() bool {
+	return u.scheme() == "file"
+}
+
+// Validate checks that the upstream can be fetched from.
+func (u Upstream) Validate() error {
+	if strings.HasPrefix(u.URL, "-") {
+		return fmt.Errorf("%s is not a valid git URL", u.URL)
+	}
+
+	switch u.scheme() {
+	case "http", "https":
+		if u.DeployKey != "" {
+			return fmt.Errorf("deploy keys can only be used with SSH URLs")
+		}
+	case "ssh":
+		if u.Token != "" {
+			return fmt.Errorf("tokens can only be used with HTTP URLs")
+		}
+	case "git", "file":
+		if u.Token != "" || u.DeployKey != "" {
+			return fmt.Errorf("credentials can't be used with %s URLs", u.scheme())
+		}
+	default:
+		return fmt.Errorf("%s is not an HTTP, SSH, git or file URL", u.URL)
+	}
+
+	if u.Interval != 0 && time.Duration(u.Interval)*time.Second < mirrorMinInterval {
+		return fmt.Errorf("the interval can't be shorter than %s", mirrorMinInterval)
+	}
+	return nil
+}
+
+// FetchInterval returns how often the upstream is fetched from.
+func (u Upstream) FetchInterval() time.Duration {
+	if u.Interval == 0 {
+		return mirrorDefaultInterval
+	}
+	return time.Duration(u.Interval) * time.Second
+}
+
+// gitCommand returns a git command that has access to the upstream. The clean
+// up function has to be called once the command has finished, as the deploy
+// key is written to a temporary file for SSH to read.
+func (u Upstream) gitCommand(args ...string) (*exec.Cmd, func(), error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_ALLOW_PROTOCOL="+u.scheme(),
+	)
+	cleanup := func() {}
+
+	// The token is given to git through the environment rather than the command
+	// line, so that it can't be seen in the process list.
+	if u.Token != "" {
+		username := u.Username
+		if username == "" {
+			username = "orbit"
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + u.Token))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	if u.DeployKey != "" {
+		f, err := ioutil.TempFile("", "orbit-deploy-key-")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.Remove(f.Name()) }
+
+		key := strings.TrimSpace(u.DeployKey) + "\n"
+		if _, err := f.WriteString(key); err != nil {
+			f.Close()
+			cleanup()
+			return nil, nil, err
+		}
+		f.Close()
+
+		cmd.Env = append(cmd.Env, fmt.Sprintf(
+			"GIT_SSH_COMMAND=ssh -i '%s' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			f.Name(),
+		))
+	}
+
+	return cmd, cleanup, nil
+}
+
+// gitRefs returns the commit that each branch in a repository points to.
+func gitRefs(path string) (map[string]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads/")
+	cmd.Dir = path
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// MirrorRepository fetches every branch of the upstream of a repository into
+// the repository, replacing the branches that it has. The branches that were
+// changed are returned in the same form as a push to the repository. Fetches of
+// the same repository wait for each other, even from different nodes.
+func (s *Store) MirrorRepository(repo Repository) ([]gitRefUpdate, error) {
+	if repo.Upstream == nil {
+		return nil, fmt.Errorf("repository %s does not have an upstream", repo.ID)
+	}
+	upstream := *repo.Upstream
+
+	volume := s.OrbitSystemVolume()
+	if volume == nil {
+		return nil, fmt.Errorf("could not find the orbit system volume")
+	}
+	path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
+	if err := gitInitBare(path); err != nil {
+		return nil, err
+	}
+	unlock, err := lockRepository(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock repository: %s", err)
+	}
+	defer unlock()
+
+	before, err := gitRefs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, cleanup, err := upstream.gitCommand("-C", path, "fetch", "--prune", "--no-tags", upstream.URL, "+refs/heads/*:refs/heads/*")
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.CombinedOutput()
+	cleanup()
+	if err != nil {
+		return nil, fmt.Errorf("git fetch failed: %s", strings.TrimSpace(string(output)))
+	}
+
+	// Follow the default branch of the upstream, so that deployments without a
+	// branch build the same one that a clone of the upstream would.
+	if branch := upstreamDefaultBranch(upstream); branch != "" {
+		exec.Command("git", "-C", path, "symbolic-ref", "HEAD", "refs/heads/"+branch).Run()
+	}
+
+	after, err := gitRefs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := []gitRefUpdate{}
+	for ref, rev := range after {
+		if old, ok := before[ref]; !ok || old != rev {
+			if !ok {
+				old = gitZeroRev
+			}
+			updates = append(updates, gitRefUpdate{Old: old, New: rev, Ref: ref})
+		}
+	}
+	for ref, rev := range before {
+		if _, ok := after[ref]; !ok {
+			updates = append(updates, gitRefUpdate{Old: rev, New: gitZeroRev, Ref: ref})
+		}
+	}
+	return updates, nil
+}
+
+// upstreamDefaultBranch returns the branch that HEAD points to in the upstream,
+// or an empty string if it couldn't be found.
+func upstreamDefaultBranch(u Upstream) string {
+	cmd, cleanup, err := u.gitCommand("ls-remote", "--symref", u.URL, "HEAD")
+	if err != nil {
+		return ""
+	}
+	defer cleanup()
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	// The symbolic ref is listed as "ref: refs/heads/main\tHEAD".
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/")
+		}
+	}
+	return ""
+}
+
+// ForPush returns the deployments of a repository that use the branches that
+// were updated. A deployment without a branch uses the default branch of the
+// repository. Deleted branches and tags aren't deployed.
+func (d Deployments) ForPush(repoID, defaultBranch string, refs []gitRefUpdate) Deployments {
+	deployments := Deployments{}
+	for _, ref := range refs {
+		if ref.New == gitZeroRev || !strings.HasPrefix(ref.Ref, "refs/heads/") {
+			continue
+		}
+		branch := strings.TrimPrefix(ref.Ref, "refs/heads/")
+
+		for _, deployment := range d {
+			deploymentBranch := deployment.Branch
+			if deploymentBranch == "" {
+				deploymentBranch = defaultBranch
+			}
+			if deployment.Repository == repoID && deploymentBranch == branch {
+				deployments = append(deployments, deployment)
+			}
+		}
+	}
+	return deployments
+}
+
+// SyncMirror fetches a mirrored repository from its upstream, and queues a build
+// of the deployments that use the branches that moved. Fetches of the same
+// repository wait for each other.
+func (e *Engine) SyncMirror(repo Repository, actor Actor) ([]gitRefUpdate, Deployments, error) {
+	updates, err := e.Store.MirrorRepository(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	volume := e.Store.OrbitSystemVolume()
+	if volume == nil {
+		return nil, nil, fmt.Errorf("could not find the orbit system volume")
+	}
+	path := filepath.Join(volume.Paths().Data, "repositories", repo.ID)
+	defaultBranch := gitDefaultBranch(path)
+	e.Store.mu.RLock()
+	deployments := e.Store.state.Deployments.ForPush(repo.ID, defaultBranch, updates)
+	e.Store.mu.RUnlock()
+
+	for _, d := range deployments {
+		log.Printf("[INFO] mirror: Building deployment %s from repository %s", d.ID, repo.ID)
+		if _, err := e.QueueBuild(d, actor); err != nil {
+			log.Printf("[ERR] mirror: Could not queue build of deployment %s: %s", d.ID, err)
+		}
+	}
+
+	return updates, deployments, nil
+}
+
+// lockRepository waits until no other fetch holds the lock of the repository,
+// and returns the function that releases it. The lock is a file lock in the
+// repository, which is on the orbit system volume that every node shares, so a
+// webhook received by one node and the fetches of the leader don't both write
+// to the repository at once.
+func lockRepository(path string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(path, "orbit-fetch.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
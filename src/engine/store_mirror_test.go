@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestEngine returns an engine with a single node raft cluster that keeps
+// everything in memory, and an orbit system volume in a temporary directory.
+func newTestEngine(t *testing.T) *Engine {
+	dir, err := ioutil.TempDir("", "orbit-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	root := RootVolumeDir
+	RootVolumeDir = filepath.Join(dir, "volumes")
+	t.Cleanup(func() { RootVolumeDir = root })
+
+	e := New()
+	e.DataPath = dir
+	e.Store.ID = "test"
+	e.Store.state.Namespaces = Namespaces{{ID: "orbit-system", Name: "orbit-system"}}
+	e.Store.state.Volumes = Volumes{{ID: "system", NamespaceID: "orbit-system"}}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(e.Store.ID)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = ioutil.Discard
+
+	logs := raft.NewInmemStore()
+	addr, transport := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(config, (*fsm)(e.Store), logs, logs, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Shutdown() })
+	r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: addr}}})
+	e.Store.raft = r
+
+	for deadline := time.Now().Add(5 * time.Second); r.State() != raft.Leader; {
+		if time.Now().After(deadline) {
+			t.Fatal("raft did not elect a leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return e
+}
+
+// git runs a git command in the directory, and returns its output.
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Orbit", "GIT_AUTHOR_EMAIL=orbit@example.com",
+		"GIT_COMMITTER_NAME=Orbit", "GIT_COMMITTER_EMAIL=orbit@example.com",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// commit adds a commit to the branch that is checked out, and returns its hash.
+func commit(t *testing.T, dir, message string) string {
+	git(t, dir, "commit", "--allow-empty", "-m", message)
+	return git(t, dir, "rev-parse", "HEAD")
+}
+
+// refUpdates returns the updates keyed by their ref.
+func refUpdates(updates []gitRefUpdate) map[string]gitRefUpdate {
+	refs := map[string]gitRefUpdate{}
+	for _, u := range updates {
+		refs[u.Ref] = u
+	}
+	return refs
+}
+
+func TestMirrorRepository(t *testing.T) {
+	e := newTestEngine(t)
+
+	upstream, err := ioutil.TempDir("", "orbit-upstream-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(upstream)
+	git(t, upstream, "init", "--initial-branch", "main")
+	first := commit(t, upstream, "first")
+
+	repo := Repository{ID: "repo", Upstream: &Upstream{URL: "file://" + upstream}}
+
+	// Every branch of a new mirror is created.
+	updates, err := e.Store.MirrorRepository(repo)
+	if err != nil {
+		t.Fatalf("mirror failed: %s", err)
+	}
+	refs := refUpdates(updates)
+	if len(refs) != 1 || refs["refs/heads/main"] != (gitRefUpdate{Old: gitZeroRev, New: first, Ref: "refs/heads/main"}) {
+		t.Fatalf("first fetch updated %+v", updates)
+	}
+
+	// Nothing is updated if the upstream hasn't changed.
+	updates, err = e.Store.MirrorRepository(repo)
+	if err != nil {
+		t.Fatalf("mirror failed: %s", err)
+	}
+	if len(updates) != 0 {
+		t.Fatalf("fetch without changes updated %+v", updates)
+	}
+
+	// Branches that move, are created and are deleted are all updates.
+	git(t, upstream, "branch", "old")
+	if _, err := e.Store.MirrorRepository(repo); err != nil {
+		t.Fatalf("mirror failed: %s", err)
+	}
+	second := commit(t, upstream, "second")
+	git(t, upstream, "branch", "feature")
+	git(t, upstream, "branch", "-D", "old")
+
+	updates, err = e.Store.MirrorRepository(repo)
+	if err != nil {
+		t.Fatalf("mirror failed: %s", err)
+	}
+	refs = refUpdates(updates)
+	expected := map[string]gitRefUpdate{
+		"refs/heads/main":    {Old: first, New: second, Ref: "refs/heads/main"},
+		"refs/heads/feature": {Old: gitZeroRev, New: second, Ref: "refs/heads/feature"},
+		"refs/heads/old":     {Old: first, New: gitZeroRev, Ref: "refs/heads/old"},
+	}
+	if len(refs) != len(expected) {
+		t.Fatalf("fetch updated %+v", updates)
+	}
+	for ref, u := range expected {
+		if refs[ref] != u {
+			t.Errorf("update of %s is %+v, expected %+v", ref, refs[ref], u)
+		}
+	}
+}
+
+func TestSyncMirror(t *testing.T) {
+	e := newTestEngine(t)
+
+	upstream, err := ioutil.TempDir("", "orbit-upstream-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(upstream)
+	git(t, upstream, "init", "--initial-branch", "main")
+	commit(t, upstream, "first")
+	git(t, upstream, "branch", "feature")
+
+	repo := Repository{ID: "repo", Upstream: &Upstream{URL: "file://" + upstream}}
+	e.Store.mu.Lock()
+	e.Store.state.Deployments = Deployments{
+		{ID: "default", Repository: repo.ID},
+		{ID: "feature", Repository: repo.ID, Branch: "feature"},
+		{ID: "other", Repository: "other"},
+	}
+	e.Store.mu.Unlock()
+
+	// The mirror follows the default branch of the upstream, which deployments
+	// without a branch build.
+	_, deployments, err := e.SyncMirror(repo, Actor{})
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if len(deployments) != 2 {
+		t.Fatalf("first sync built %d deployments", len(deployments))
+	}
+
+	// Only the deployments of the branch that moved are built.
+	git(t, upstream, "checkout", "feature")
+	commit(t, upstream, "second")
+	git(t, upstream, "checkout", "main")
+	updates, deployments, err := e.SyncMirror(repo, Actor{})
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if len(updates) != 1 || updates[0].Ref != "refs/heads/feature" {
+		t.Fatalf("sync updated %+v", updates)
+	}
+	if len(deployments) != 1 || deployments[0].ID != "feature" {
+		t.Fatalf("sync built %+v", deployments)
+	}
+
+	e.Store.mu.RLock()
+	builds := e.Store.state.Builds.ForDeployment("feature")
+	e.Store.mu.RUnlock()
+	if len(builds) != 2 || builds[0].State != BuildQueued {
+		t.Fatalf("builds of the feature deployment are %+v", builds)
+	}
+}
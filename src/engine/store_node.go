@@ -40,6 +40,8 @@ type Node struct {
 	Roles      []NodeRole `json:"node_roles"` // What roles this node serves
 	SwapSize   int        `json:"swap_size"`  // The size of the swap in MB
 	Swappiness int        `json:"swappiness"` // Likelihood of swapping (0 - 100)
+
+	TLS bool `json:"tls"` // Whether the node has a certificate for raft traffic
 }
 
 // HasRole returns whether or not a node has a given role.
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// oidcLoginTimeout is how long a user has to log in with the identity provider
+// before they have to start again.
+const oidcLoginTimeout = 10 * time.Minute
+
+// OIDCProvider is an OpenID Connect identity provider that users can log in
+// with instead of using an Orbit password.
+type OIDCProvider struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`          // Shown on the login button
+	Issuer       string   `json:"issuer"`        // Used to discover the endpoints
+	ClientID     string   `json:"client_id"`     // Registered with the provider
+	ClientSecret string   `json:"client_secret"` // Empty for public clients
+	RedirectURL  string   `json:"redirect_url"`  // The URL of the callback route
+	Scopes       []string `json:"scopes"`        // Requested as well as "openid"
+	GroupsClaim  string   `json:"groups_claim"`  // The claim holding the groups
+
+	// GroupMappings decide the roles that users of the provider have. They are
+	// applied every time a user logs in, so changes in the provider are kept in
+	// sync with Orbit.
+	GroupMappings []OIDCGroupMapping `json:"group_mappings"`
+}
+
+// OIDCGroupMapping grants members of a group in the identity provider a role
+// in a namespace.
+type OIDCGroupMapping struct {
+	Group       string `json:"group"`
+	NamespaceID string `json:"namespace_id"`
+	Role        Role   `json:"role"`
+}
+
+// OIDCProviders is a list of identity providers.
+type OIDCProviders []OIDCProvider
+
+// GenerateID will generate a unique ID for an identity provider.
+func (p *OIDCProviders) GenerateID() string {
+search:
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+
+		for _, provider := range *p {
+			if provider.ID == id {
+				continue search
+			}
+		}
+
+		return id
+	}
+}
+
+// Find will find an identity provider by its name or ID. Will return nil if it
+// could not be found.
+func (p *OIDCProviders) Find(id string) *OIDCProvider {
+	for _, provider := range *p {
+		if provider.ID == id || provider.Name == id {
+			return &provider
+		}
+	}
+	return nil
+}
+
+// Roles works out the role that a user with the given groups should have in
+// each of the namespaces that the provider manages. Namespaces where none of
+// the groups match are included with an empty role, so that any role granted
+// previously can be revoked.
+func (p OIDCProvider) Roles(groups []string) map[string]Role {
+	member := map[string]bool{}
+	for _, g := range groups {
+		member[g] = true
+	}
+
+	roles := map[string]Role{}
+	for _, m := range p.GroupMappings {
+		if _, ok := roles[m.NamespaceID]; !ok {
+			roles[m.NamespaceID] = ""
+		}
+		if member[m.Group] && m.Role.level() > roles[m.NamespaceID].level() {
+			roles[m.NamespaceID] = m.Role
+		}
+	}
+
+	return roles
+}
+
+// Identity links a user to their account with an identity provider.
+type Identity struct {
+	ProviderID string `json:"provider_id"`
+	Subject    string `json:"subject"` // The "sub" claim, unique within the provider
+}
+
+// FindByIdentity will search for the user that is linked to the account with
+// the identity provider. Will return nil if it could not be found.
+func (u *Users) FindByIdentity(providerID, subject string) *User {
+	for _, user := range *u {
+		for _, i := range user.Identities {
+			if i.ProviderID == providerID && i.Subject == subject {
+				return &user
+			}
+		}
+	}
+	return nil
+}
+
+// OIDCLogin keeps track of a login that has been sent to an identity provider,
+// so that the callback can be matched to it and the PKCE verifier and nonce can
+// be checked.
+type OIDCLogin struct {
+	State      string    `json:"state"`
+	ProviderID string    `json:"provider_id"`
+	Verifier   string    `json:"verifier"`
+	Nonce      string    `json:"nonce"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired returns whether or not the login has expired at the given time.
+func (l OIDCLogin) Expired(now time.Time) bool {
+	return now.After(l.ExpiresAt)
+}
+
+// OIDCLogins is a list of logins in progress.
+type OIDCLogins []OIDCLogin
+
+// Find will find the login with the given state. Will return nil if it could not
+// be found or if it has expired.
+func (l *OIDCLogins) Find(state string) *OIDCLogin {
+	for _, login := range *l {
+		if login.State == state {
+			if login.Expired(time.Now()) {
+				return nil
+			}
+			return &login
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"orbit.sh/engine/docker"
+)
+
+// releaseLimit is the number of releases kept for each deployment. Once the
+// limit is reached, the oldest releases are dropped to make room for new ones.
+const releaseLimit = 50
+
+// Release is a version of a deployment that has been deployed, either by a
+// build or by rolling back to an earlier release. It has everything needed to
+// deploy that version again without building it.
+//
+// The secrets are kept as references, so a release uses the current value of
+// a secret rather than the value it had at the time.
+type Release struct {
+	ID           string `json:"id"`
+	DeploymentID string `json:"deployment_id"`
+	Version      int    `json:"version"` // Counts up from 1 for each deployment
+
+	Commit   string `json:"commit"`    // The hash of the commit that was built
+	Image    string `json:"image"`     // The tag of the image in the local registry
+	Digest   string `json:"digest"`    // The digest of the image, if it is known
+	BuildKey string `json:"build_key"` // The key of the build log
+	Builder  string `json:"builder"`   // The kind of builder that built the image
+
+	// The process types of the image, from the Procfile of the commit.
+	Processes map[string]string `json:"processes,omitempty"`
+
+	// The configuration of the deployment at the time of the release.
+	Env     map[string]string `json:"env"`
+	Secrets []SecretRef       `json:"secrets"`
+
+	RollbackOf  string    `json:"rollback_of,omitempty"` // The release that was rolled back to
+	TriggeredBy Actor     `json:"triggered_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ImageRef returns the reference to the image that the service of the release
+// runs. This is the digest if it is known, so that the release always runs the
+// exact image that was built.
+func (r Release) ImageRef() string {
+	if r.Digest != "" {
+		name := r.Image
+		if i := strings.LastIndex(name, ":"); i != -1 {
+			name = name[:i]
+		}
+		return fmt.Sprintf("%s@%s", name, r.Digest)
+	}
+	return r.Image
+}
+
+// Releases is a list of releases.
+type Releases []Release
+
+// GenerateID will generate a unique ID for a release.
+func (r *Releases) GenerateID() string {
+search:
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+
+		for _, release := range *r {
+			if release.ID == id {
+				continue search
+			}
+		}
+
+		return id
+	}
+}
+
+// ForDeployment returns the releases of a deployment, newest first.
+func (r Releases) ForDeployment(deploymentID string) Releases {
+	releases := Releases{}
+	for _, release := range r {
+		if release.DeploymentID == deploymentID {
+			releases = append(releases, release)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Version > releases[j].Version
+	})
+	return releases
+}
+
+// NextVersion returns the version number of the next release of a deployment.
+func (r Releases) NextVersion(deploymentID string) int {
+	version := 0
+	for _, release := range r {
+		if release.DeploymentID == deploymentID && release.Version > version {
+			version = release.Version
+		}
+	}
+	return version + 1
+}
+
+// Find will find a release of a deployment by its ID or its version, which can
+// be written as either "3" or "v3". Will return nil if it could not be found.
+func (r Releases) Find(deploymentID, id string) *Release {
+	version, err := strconv.Atoi(strings.TrimPrefix(id, "v"))
+	if err != nil {
+		version = -1
+	}
+	for _, release := range r {
+		if release.DeploymentID != deploymentID {
+			continue
+		}
+		if release.ID == id || release.Version == version {
+			return &release
+		}
+	}
+	return nil
+}
+
+// Append adds a release, dropping the oldest releases of the deployment if it
+// has more than the limit.
+func (r *Releases) Append(release Release) {
+	*r = append(*r, release)
+
+	count := 0
+	for _, existing := range *r {
+		if existing.DeploymentID == release.DeploymentID {
+			count++
+		}
+	}
+	for i := 0; count > releaseLimit && i < len(*r); {
+		if (*r)[i].DeploymentID == release.DeploymentID {
+			*r = append((*r)[:i], (*r)[i+1:]...)
+			count--
+			continue
+		}
+		i++
+	}
+}
+
+// NewRelease returns a release of the deployment as it is configured now, for
+// the image given.
+func (d Deployment) NewRelease(commit, image, digest string) Release {
+	env := map[string]string{}
+	for k, v := range d.Env {
+		env[k] = v
+	}
+	secrets := make([]SecretRef, len(d.Secrets))
+	copy(secrets, d.Secrets)
+
+	return Release{
+		DeploymentID: d.ID,
+		Commit:       commit,
+		Image:        image,
+		Digest:       digest,
+		Env:          env,
+		Secrets:      secrets,
+	}
+}
+
+// ReleaseDeployment builds the deployment of a build, pushes the image to the
+// registry and deploys it as a new release. The build can be cancelled through
+// the context up until it is deployed. The progress is written to the build
+// log, as well as to out if it isn't nil.
+func (e *Engine) ReleaseDeployment(ctx context.Context, b Build, out io.Writer) (*Release, error) {
+	e.Store.mu.RLock()
+	deployment := e.Store.state.Deployments.Find(b.DeploymentID)
+	e.Store.mu.RUnlock()
+	if deployment == nil {
+		return nil, fmt.Errorf("deployment %s does not exist", b.DeploymentID)
+	}
+
+	key, commit, builder, processes, err := e.BuildDeployment(ctx, *deployment, b, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build deployment")
+	}
+
+	// The configuration of the deployment may have changed while it was being
+	// built, so the release is made from how it is configured now.
+	e.Store.mu.RLock()
+	deployment = e.Store.state.Deployments.Find(b.DeploymentID)
+	e.Store.mu.RUnlock()
+	if deployment == nil {
+		return nil, fmt.Errorf("deployment %s was removed during the build", b.DeploymentID)
+	}
+
+	// Create a shorthand function log to the build log entries for this
+	// deployment.
+	buildLog := func(format string, values ...interface{}) {
+		str := fmt.Sprintf(format, values...)
+		e.Store.AppendBuildLog(deployment.ID, key, str)
+		if out != nil {
+			fmt.Fprintln(out, str)
+		}
+	}
+
+	// Push the image to the docker image registry, unless the build has been
+	// cancelled in the mean time.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	image := deployment.ImageTag(commit)
+	buildLog("Pushing image %s to the local docker registry", image)
+	if err := docker.Push(image); err != nil {
+		return nil, errors.Wrap(err, "could not push to docker image registry")
+	}
+	buildLog("Image %s pushed successfully", image)
+
+	// The digest is what the release runs, so that it can be rolled back to even
+	// if the tag is pushed again.
+	digest, err := docker.ImageDigest(image)
+	if err != nil {
+		log.Printf("[WARN] deployment: Could not get the digest of image %s: %s", image, err)
+	}
+	release := deployment.NewRelease(commit, image, digest)
+	e.Store.mu.RLock()
+	release.ID = e.Store.state.Releases.GenerateID()
+	e.Store.mu.RUnlock()
+	release.BuildKey = key
+	release.Builder = builder
+	release.Processes = processes
+	release.TriggeredBy = b.TriggeredBy
+	release.CreatedAt = time.Now()
+
+	// Create the service, or roll the existing one over to the new image. The old
+	// tasks are only stopped once the new ones have started, and this waits for
+	// the update to converge, so that an update that was rolled back is never
+	// recorded as the release.
+	deployment.Image = release.ImageRef()
+	deployment.BuiltWith = release.Builder
+	deployment.Processes = release.Processes
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, process := range deployment.ProcessNames() {
+		buildLog("Deploying the docker service for the %s process with %d replicas", process, deployment.Replicas(process))
+	}
+	if len(deployment.Secrets) > 0 {
+		buildLog("Attaching %d secrets to the services", len(deployment.Secrets))
+	}
+	if err := e.Deploy(*deployment); err != nil {
+		return nil, errors.Wrap(err, "could not deploy docker service")
+	}
+	buildLog("Docker services for %s deployed", deployment.ID)
+
+	// Record the release that is now running, so that changes to the config of
+	// the deployment keep using its image, and so that it can be rolled back to
+	// later.
+	cmd := command{
+		Op:      opNewRelease,
+		Actor:   b.TriggeredBy,
+		Release: release,
+	}
+	if err := cmd.Apply(e.Store); err != nil {
+		return nil, errors.Wrap(err, "could not record the release of the deployment")
+	}
+
+	// The deployment process has finished.
+	buildLog("-----> Deployment succeeded!")
+	return &release, nil
+}
+
+// RollbackDeployment deploys the release that the build rolls back to as a new
+// release, with the image and configuration of that release. It runs as a build
+// so that it happens in order with the builds of the deployment.
+func (e *Engine) RollbackDeployment(ctx context.Context, b Build) (*Release, error) {
+	e.Store.mu.RLock()
+	deployment := e.Store.state.Deployments.Find(b.DeploymentID)
+	target := e.Store.state.Releases.Find(b.DeploymentID, b.RollbackOf)
+	id := e.Store.state.Releases.GenerateID()
+	e.Store.mu.RUnlock()
+	if deployment == nil {
+		return nil, fmt.Errorf("deployment %s does not exist", b.DeploymentID)
+	}
+	if target == nil {
+		return nil, fmt.Errorf("release %s of deployment %s does not exist", b.RollbackOf, b.DeploymentID)
+	}
+
+	// Rolling back is a new release with the image and config of the old one.
+	release := *target
+	release.ID = id
+	release.RollbackOf = target.ID
+	release.TriggeredBy = b.TriggeredBy
+	release.CreatedAt = time.Now()
+
+	deployment.Image = release.ImageRef()
+	deployment.BuiltWith = release.Builder
+	deployment.Processes = release.Processes
+	deployment.Env = release.Env
+	deployment.Secrets = release.Secrets
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := e.Deploy(*deployment); err != nil {
+		return nil, errors.Wrap(err, "could not deploy docker service")
+	}
+
+	cmd := command{
+		Op:      opNewRelease,
+		Actor:   b.TriggeredBy,
+		Release: release,
+	}
+	if err := cmd.Apply(e.Store); err != nil {
+		return nil, errors.Wrap(err, "could not record the release of the deployment")
+	}
+	return &release, nil
+}
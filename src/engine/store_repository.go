@@ -16,6 +16,10 @@ type Repository struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
 
+	// The remote repository that this one mirrors. Repositories with an upstream
+	// can't be pushed to, as every fetch replaces their branches.
+	Upstream *Upstream `json:"upstream,omitempty"`
+
 	NamespaceID string `json:"namespace_id"`
 }
 
@@ -39,6 +43,18 @@ func gitBranches(path string) (branches []string) {
 	return branches
 }
 
+// gitDefaultBranch returns the branch that HEAD points to in a given path,
+// which is the branch that is checked out when the repository is cloned.
+func gitDefaultBranch(path string) string {
+	cmd := exec.Command("git", "symbolic-ref", "--short", "HEAD")
+	cmd.Dir = path
+	output, err := cmd.Output()
+	if err != nil {
+		return "master"
+	}
+	return strings.TrimSpace(string(output))
+}
+
 // gitCheckout will checkout a specified branch in a given path.
 func gitCheckout(path, branch string) error {
 	cmd := exec.Command("git", "checkout", branch)
@@ -0,0 +1,198 @@
+package engine
+
+import "fmt"
+
+// Role is the level of access that a user has been granted in a namespace. A
+// role includes all of the access that the roles below it have, so an admin can
+// do everything that a developer can do (and so on).
+type Role string
+
+const (
+	// RoleViewer can only view the resources in a namespace.
+	RoleViewer Role = "VIEWER"
+	// RoleDeveloper can push code to repositories and create and build
+	// deployments in a namespace.
+	RoleDeveloper Role = "DEVELOPER"
+	// RoleAdmin can manage all of the resources in a namespace, such as routers,
+	// certificates and volumes.
+	RoleAdmin Role = "ADMIN"
+	// RoleOwner can do everything an admin can, and can also grant and revoke
+	// roles for other users in the namespace.
+	RoleOwner Role = "OWNER"
+)
+
+// level returns the rank of the role so that roles can be compared. An unknown
+// role has a level of zero.
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleDeveloper:
+		return 2
+	case RoleAdmin:
+		return 3
+	case RoleOwner:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Includes returns whether or not this role grants at least the access of the
+// other role.
+func (r Role) Includes(other Role) bool {
+	return r.level() > 0 && r.level() >= other.level()
+}
+
+// RoleBinding grants a user a role within a single namespace.
+type RoleBinding struct {
+	UserID      string `json:"user_id"`
+	NamespaceID string `json:"namespace_id"`
+	Role        Role   `json:"role"`
+}
+
+// RoleBindings is a list of the role bindings in the store.
+type RoleBindings []RoleBinding
+
+// Find returns the role that the user has been granted in the namespace, or an
+// empty role if they have not been granted one.
+func (r *RoleBindings) Find(userID, namespaceID string) Role {
+	for _, b := range *r {
+		if b.UserID == userID && b.NamespaceID == namespaceID {
+			return b.Role
+		}
+	}
+	return ""
+}
+
+// Set will grant the role to the user in the namespace, replacing the role
+// that they had there before.
+func (r *RoleBindings) Set(binding RoleBinding) {
+	r.Remove(binding.UserID, binding.NamespaceID)
+	*r = append(*r, binding)
+}
+
+// Remove will remove the role that the user has in the namespace.
+func (r *RoleBindings) Remove(userID, namespaceID string) {
+	for i, b := range *r {
+		if b.UserID == userID && b.NamespaceID == namespaceID {
+			*r = append((*r)[:i], (*r)[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemoveUser will remove every role that the user has been granted.
+func (r *RoleBindings) RemoveUser(userID string) {
+	bindings := RoleBindings{}
+	for _, b := range *r {
+		if b.UserID != userID {
+			bindings = append(bindings, b)
+		}
+	}
+	*r = bindings
+}
+
+// UserRole returns the effective role of a user in a namespace. The role that a
+// user has in the orbit-system namespace applies to every namespace, as that is
+// the namespace that controls the cluster itself. Resources that don't belong
+// to a namespace are treated as though they belong to orbit-system.
+func (s *StoreState) UserRole(userID, namespaceID string) Role {
+	systemID := s.systemNamespaceID()
+	if namespaceID == "" {
+		namespaceID = systemID
+	}
+
+	role := s.RoleBindings.Find(userID, namespaceID)
+	if systemRole := s.RoleBindings.Find(userID, systemID); systemRole.level() > role.level() {
+		role = systemRole
+	}
+
+	return role
+}
+
+// Allowed returns whether or not a user has been granted at least the role in
+// the namespace. If the request is being made with an API token, the token also
+// has to be scoped to that namespace and have the matching permission.
+func (s *StoreState) Allowed(userID string, token *APIToken, namespaceID string, role Role) bool {
+	if token != nil {
+		if !token.Permissions.Allows(role) {
+			return false
+		}
+
+		scope := namespaceID
+		if scope == "" {
+			scope = s.systemNamespaceID()
+		}
+		if token.NamespaceID != "" && token.NamespaceID != scope {
+			return false
+		}
+	}
+
+	return s.UserRole(userID, namespaceID).Includes(role)
+}
+
+// HighestRole returns the highest role that the user has been granted in any
+// namespace, or an empty role if they haven't been granted one.
+func (s *StoreState) HighestRole(userID string) Role {
+	var role Role
+	for _, b := range s.RoleBindings {
+		if b.UserID == userID && b.Role.level() > role.level() {
+			role = b.Role
+		}
+	}
+	return role
+}
+
+// LastOwner returns whether or not the user is the only owner of the cluster.
+// The cluster must always have an owner, otherwise nobody would be able to
+// manage it anymore.
+func (s *StoreState) LastOwner(userID string) bool {
+	systemID := s.systemNamespaceID()
+	if s.RoleBindings.Find(userID, systemID) != RoleOwner {
+		return false
+	}
+
+	owners := 0
+	for _, b := range s.RoleBindings {
+		if b.NamespaceID == systemID && b.Role == RoleOwner {
+			owners++
+		}
+	}
+	return owners <= 1
+}
+
+// MigrateRoles makes every user an owner of the cluster if it was created
+// before roles existed, so that they keep the access that they had before. It
+// only ever happens once, and a user without a role has no access after that.
+func (s *StoreState) MigrateRoles() error {
+	if s.RolesMigrated {
+		return nil
+	}
+
+	if len(s.RoleBindings) == 0 {
+		systemID := s.systemNamespaceID()
+		if systemID == "" && len(s.Users) > 0 {
+			return fmt.Errorf("the orbit-system namespace does not exist")
+		}
+		for _, u := range s.Users {
+			s.RoleBindings.Set(RoleBinding{
+				UserID:      u.ID,
+				NamespaceID: systemID,
+				Role:        RoleOwner,
+			})
+		}
+	}
+
+	s.RolesMigrated = true
+	return nil
+}
+
+// systemNamespaceID returns the ID of the orbit-system namespace, or an empty
+// string if it doesn't exist yet.
+func (s *StoreState) systemNamespaceID() string {
+	if system := s.Namespaces.Find("orbit-system"); system != nil {
+		return system.ID
+	}
+	return ""
+}
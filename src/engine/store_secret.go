@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"orbit.sh/engine/docker"
+)
+
+var (
+	// secretNameFormat is the format that the names of secrets have to be in.
+	secretNameFormat = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	// envNameFormat is the format that the names of environment variables have
+	// to be in.
+	envNameFormat = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Secret is a sensitive value, such as a database password, that deployments
+// in the same namespace can use. The value is sealed by the keyring whenever
+// it is written to disk, and it is never sent back by the API.
+type Secret struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"` // Unique within the namespace
+	Value     string    `json:"value,omitempty"`
+	Version   int       `json:"version"` // Incremented every time the value changes
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	NamespaceID string `json:"namespace_id"`
+}
+
+// Secrets is a list of secrets.
+type Secrets []Secret
+
+// GenerateID will generate a unique ID for a secret.
+func (s *Secrets) GenerateID() string {
+search:
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+
+		for _, secret := range *s {
+			if secret.ID == id {
+				continue search
+			}
+		}
+
+		return id
+	}
+}
+
+// Find will find a secret by its ID, or by its name within the namespace. Will
+// return nil if it could not be found.
+func (s *Secrets) Find(namespaceID, id string) *Secret {
+	for _, secret := range *s {
+		if secret.ID == id || (secret.NamespaceID == namespaceID && secret.Name == id) {
+			return &secret
+		}
+	}
+	return nil
+}
+
+// DockerName returns the name of the docker secret that holds this version of
+// the secret. Docker secrets can't be changed, so every version has its own.
+func (s Secret) DockerName() string {
+	return fmt.Sprintf("orbit-secret-%s-%d", s.ID, s.Version)
+}
+
+// SecretRef attaches a secret to a deployment. The secret is given to the
+// service of the deployment as an environment variable, as a file, or both.
+type SecretRef struct {
+	SecretID string `json:"secret_id"`
+	Env      string `json:"env,omitempty"`  // The name of the environment variable
+	Path     string `json:"path,omitempty"` // The absolute path of the file in the container
+}
+
+// Validate checks that the reference can be used.
+func (r SecretRef) Validate() error {
+	if r.Env == "" && r.Path == "" {
+		return fmt.Errorf("secret %s needs an env or path to be attached with", r.SecretID)
+	}
+	if r.Env != "" && !envNameFormat.MatchString(r.Env) {
+		return fmt.Errorf("%s is not a valid environment variable name", r.Env)
+	}
+	if r.Path != "" && (!path.IsAbs(r.Path) || path.Clean(r.Path) != r.Path || r.Path == "/") {
+		return fmt.Errorf("%s is not a valid absolute file path", r.Path)
+	}
+	return nil
+}
+
+// UsedBy returns the deployments that have the secret attached to them, or
+// passed to their builds.
+func (d Deployments) UsedBy(secretID string) Deployments {
+	deployments := Deployments{}
+	for _, deployment := range d {
+		refs := append([]SecretRef{}, deployment.Secrets...)
+		refs = append(refs, deployment.BuildConfig.Secrets...)
+		for _, ref := range refs {
+			if ref.SecretID == secretID {
+				deployments = append(deployments, deployment)
+				break
+			}
+		}
+	}
+	return deployments
+}
+
+// ServiceSecrets works out the environment variables and docker secrets that
+// give the service of the deployment its secrets. The docker secret for the
+// current version of each file secret is created if it doesn't exist yet.
+func (e *Engine) ServiceSecrets(d Deployment) (map[string]string, []docker.ServiceSecret, error) {
+	secrets, err := e.attachedSecrets(d.NamespaceID, d.Secrets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s attached to deployment %s", err, d.ID)
+	}
+
+	env := map[string]string{}
+	files := []docker.ServiceSecret{}
+	for i, ref := range d.Secrets {
+		secret := secrets[i]
+
+		if ref.Env != "" {
+			env[ref.Env] = secret.Value
+		}
+
+		if ref.Path != "" {
+			name := secret.DockerName()
+			if err := docker.EnsureSecret(name, []byte(secret.Value)); err != nil {
+				return nil, nil, err
+			}
+			files = append(files, docker.ServiceSecret{Name: name, Target: ref.Path})
+		}
+	}
+
+	return env, files, nil
+}
+
+// attachedSecrets looks up the secret of each of the references, which all have
+// to be in the namespace.
+func (e *Engine) attachedSecrets(namespaceID string, refs []SecretRef) ([]Secret, error) {
+	e.Store.mu.RLock()
+	defer e.Store.mu.RUnlock()
+
+	secrets := []Secret{}
+	for _, ref := range refs {
+		secret := e.Store.state.Secrets.Find(namespaceID, ref.SecretID)
+		if secret == nil || secret.NamespaceID != namespaceID {
+			return nil, fmt.Errorf("secret %s does not exist", ref.SecretID)
+		}
+		secrets = append(secrets, *secret)
+	}
+	return secrets, nil
+}
+
+// BuildArgs returns the build args of the deployment, with the secrets that are
+// passed as build args.
+func (e *Engine) BuildArgs(d Deployment) (map[string]string, error) {
+	// Build configs saved before a name was disallowed are still in the store.
+	if err := d.BuildConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("the build config of deployment %s is invalid: %s", d.ID, err)
+	}
+
+	args := map[string]string{}
+	for k, v := range d.BuildConfig.Args {
+		args[k] = v
+	}
+
+	secrets, err := e.attachedSecrets(d.NamespaceID, d.BuildConfig.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("%s passed to the build of deployment %s", err, d.ID)
+	}
+	for i, ref := range d.BuildConfig.Secrets {
+		args[ref.Env] = secrets[i].Value
+	}
+
+	return args, nil
+}
+
+// RemoveStaleSecrets removes the docker secrets of the old versions of the
+// secrets attached to the deployment as files. This is done once its service
+// has been updated, as they can't be removed while they are in use.
+func (e *Engine) RemoveStaleSecrets(d Deployment) {
+	keep := map[string]string{}
+	e.Store.mu.RLock()
+	for _, ref := range d.Secrets {
+		secret := e.Store.state.Secrets.Find(d.NamespaceID, ref.SecretID)
+		if ref.Path != "" && secret != nil {
+			keep[secret.ID] = secret.DockerName()
+		}
+	}
+	e.Store.mu.RUnlock()
+
+	for id, name := range keep {
+		removeSecretVersions(id, name)
+	}
+}
+
+// removeSecretVersions removes the docker secrets of every version of the
+// secret other than the one to keep, which can be empty to remove them all.
+// Versions still used by a service fail to be removed, and are left until
+// the service no longer uses them.
+func removeSecretVersions(secretID, keep string) {
+	prefix := fmt.Sprintf("orbit-secret-%s-", secretID)
+	for _, name := range docker.Secrets(prefix) {
+		if name != keep {
+			docker.RemoveSecret(name)
+		}
+	}
+}
@@ -20,9 +20,23 @@ type StoreState struct {
 	Volumes      Volumes      `json:"volumes"`
 	Repositories Repositories `json:"repositories"`
 	Deployments  Deployments  `json:"deployments"`
+	RoleBindings RoleBindings `json:"role_bindings"`
+	Secrets      Secrets      `json:"secrets"`
+	Releases     Releases     `json:"releases"`
+	Builds       Builds       `json:"builds"`
 
-	ManagerJoinToken string `json:"manager_join_token"`
-	WorkerJoinToken  string `json:"worker_join_token"`
+	OIDCProviders OIDCProviders `json:"oidc_providers"`
+	OIDCLogins    OIDCLogins    `json:"oidc_logins"` // Logins waiting on a provider
+
+	LoginAttempts LoginAttempts `json:"login_attempts"` // Failed attempts to log in
+
+	RolesMigrated bool `json:"roles_migrated"` // Whether the users from before roles were made owners
+
+	KeyringKeys []string `json:"keyring_keys"` // Rotated keys, each sealed with the key before it
+
+	ClusterCA        *ClusterCA `json:"cluster_ca"` // Issues the node certificates for mutual TLS
+	ManagerJoinToken string     `json:"manager_join_token"`
+	WorkerJoinToken  string     `json:"worker_join_token"`
 }
 
 // Namespace is a location where certain elements exist in. The elements in
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix is prepended to every API token secret. This makes them easy
+// to tell apart from session tokens (and easy to search for if they leak).
+const apiTokenPrefix = "orbit_"
+
+// Permission is an action that an API token is allowed to perform. Each
+// permission corresponds to the role that is needed for the same action.
+type Permission string
+
+const (
+	// PermissionRead allows the token to view resources and fetch code.
+	PermissionRead Permission = "read"
+	// PermissionWrite allows the token to push code and build deployments.
+	PermissionWrite Permission = "write"
+	// PermissionAdmin allows the token to manage every resource.
+	PermissionAdmin Permission = "admin"
+)
+
+// Permissions is a set of permissions granted to an API token.
+type Permissions []Permission
+
+// Allows returns whether or not the permissions allow an action that requires
+// the given role. The token still needs to belong to a user with that role.
+func (p Permissions) Allows(role Role) bool {
+	var required Permission
+	switch role {
+	case RoleViewer:
+		required = PermissionRead
+	case RoleDeveloper:
+		required = PermissionWrite
+	default:
+		required = PermissionAdmin
+	}
+
+	for _, permission := range p {
+		if permission == required {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid returns whether or not every permission in the set is known.
+func (p Permissions) Valid() bool {
+	for _, permission := range p {
+		switch permission {
+		case PermissionRead, PermissionWrite, PermissionAdmin:
+		default:
+			return false
+		}
+	}
+	return len(p) > 0
+}
+
+// APIToken is a long-lived token that a user can create for automation, such
+// as for a CI server. Only the hash of the token is kept in the store; the
+// token itself is only ever shown once when it is created.
+type APIToken struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Hash        string      `json:"hash"`         // SHA-256 hash of the token
+	NamespaceID string      `json:"namespace_id"` // Empty for every namespace
+	Permissions Permissions `json:"permissions"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"` // Zero if the token never expires
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Expired returns whether or not the token has expired.
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// hashToken returns the hash of a secret token (such as an API token) that is
+// kept in the store in place of the token itself.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIToken will create a new API token for the user. It returns the
+// token to keep in the store and the secret to give to the user.
+func (u User) GenerateAPIToken(name, namespaceID string, permissions Permissions, expiresAt time.Time) (APIToken, string) {
+	// Generate the ID, making sure it's unique for this user.
+	var id string
+search:
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+
+		for _, t := range u.Tokens {
+			if t.ID == id {
+				continue search
+			}
+		}
+		break
+	}
+
+	// Generate the secret itself.
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := apiTokenPrefix + hex.EncodeToString(b)
+
+	token := APIToken{
+		ID:          id,
+		Name:        name,
+		Hash:        hashToken(secret),
+		NamespaceID: namespaceID,
+		Permissions: permissions,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	}
+
+	return token, secret
+}
+
+// FindAPIToken will find the token of the user that matches the secret. It
+// returns nil if there is no match or if the token has expired.
+func (u User) FindAPIToken(secret string) *APIToken {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil
+	}
+
+	hash := []byte(hashToken(secret))
+	for _, t := range u.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			if t.Expired() {
+				return nil
+			}
+			return &t
+		}
+	}
+	return nil
+}
+
+// FindByAPIToken will search for the user that owns the API token secret. It
+// returns the user and the token, or nil for both if there is no match.
+func (u *Users) FindByAPIToken(secret string) (*User, *APIToken) {
+	for _, user := range *u {
+		if token := user.FindAPIToken(secret); token != nil {
+			return &user, token
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// totpIssuer is the name shown next to the account in authenticator apps.
+	totpIssuer = "Orbit"
+	// totpPeriod is how long each code is valid for (RFC 6238 step size).
+	totpPeriod = 30
+	// totpDigits is the number of digits in each code.
+	totpDigits = 6
+	// totpSkew is the number of steps either side of the current one that are
+	// also accepted, to allow for clocks that have drifted slightly.
+	totpSkew = 1
+
+	// recoveryCodeCount is the number of recovery codes a user receives when they
+	// enrol, each of which can be used once in place of a code.
+	recoveryCodeCount = 10
+
+	// loginChallengeTimeout is how long a user has to enter their code after
+	// their password has been accepted.
+	loginChallengeTimeout = 5 * time.Minute
+)
+
+// TOTP is the time-based one-time password (RFC 6238) second factor of a user.
+// It is only enforced once the user has verified a code from their
+// authenticator, so that an abandoned enrolment can't lock them out.
+type TOTP struct {
+	Secret        string   `json:"secret"`         // Base32 encoded shared secret
+	Enabled       bool     `json:"enabled"`        // Whether enrolment has been verified
+	LastStep      int64    `json:"last_step"`      // The last time step used to log in
+	RecoveryCodes []string `json:"recovery_codes"` // SHA-256 hashes of the unused recovery codes
+}
+
+// LoginChallenge is issued once the password of a user with a second factor
+// has been accepted. It must be completed with a code from their authenticator
+// (or a recovery code) before a session is created.
+type LoginChallenge struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired returns whether or not the challenge has expired at the given time.
+func (l LoginChallenge) Expired(now time.Time) bool {
+	return now.After(l.ExpiresAt)
+}
+
+// GenerateTOTP creates a new secret and a set of recovery codes. The recovery
+// codes are returned separately as only their hashes are kept.
+func GenerateTOTP() (TOTP, []string) {
+	b := make([]byte, 20)
+	rand.Read(b)
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	totp := TOTP{Secret: secret}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hashRecoveryCode(codes[i]))
+	}
+
+	return totp, codes
+}
+
+// URI returns the otpauth URI for the secret, which authenticator apps can
+// import (usually by scanning it as a QR code).
+func (t TOTP) URI(account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+
+	v := url.Values{}
+	v.Set("secret", t.Secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// Validate checks the code against the secret at the given time. It returns
+// the time step that the code belongs to, which must be recorded so that the
+// same code can't be used twice.
+func (t TOTP) Validate(code string, now time.Time) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(t.Secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// FindRecoveryCode returns the hash of the recovery code if it is one of the
+// unused recovery codes, or an empty string if it isn't.
+func (t TOTP) FindRecoveryCode(code string) string {
+	hash := []byte(hashRecoveryCode(code))
+	for _, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			return h
+		}
+	}
+	return ""
+}
+
+// totpCode generates the code for a single time step (RFC 4226 section 5.3).
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// hashRecoveryCode returns the hash of a recovery code that is kept in the
+// store. Codes are compared without case or the dash that separates them.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.Replace(code, "-", "", -1)
+	return hashToken(code)
+}
+
+// GenerateLoginChallenge will create a new login challenge for the user.
+func (u User) GenerateLoginChallenge() LoginChallenge {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return LoginChallenge{
+		ID:        hex.EncodeToString(b),
+		ExpiresAt: time.Now().Add(loginChallengeTimeout),
+	}
+}
+
+// FindByLoginChallenge will search for the user that the login challenge was
+// issued to. It returns nil for both if there is no match or if the challenge
+// has expired.
+func (u *Users) FindByLoginChallenge(id string) (*User, *LoginChallenge) {
+	for _, user := range *u {
+		for _, challenge := range user.Challenges {
+			if subtle.ConstantTimeCompare([]byte(challenge.ID), []byte(id)) == 1 {
+				if challenge.Expired(time.Now()) {
+					return nil, nil
+				}
+				return &user, &challenge
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// tlsRecordHandshake is the first byte of a TLS connection. The raft protocol
+// never starts with it, which is how the two can be told apart.
+const tlsRecordHandshake = 0x16
+
+// raftLayer is the stream layer of the raft transport. Once a node has a
+// certificate issued by the cluster CA, all of its raft traffic is over mutual
+// TLS, both to and from it.
+//
+// Nodes from before the cluster had a CA talk in plaintext until they have a
+// certificate. Connections to a node are only made in plaintext if it hasn't
+// told the cluster that it has one yet, and a node only accepts plaintext
+// connections if it doesn't.
+type raftLayer struct {
+	store     *Store
+	listener  net.Listener
+	advertise net.Addr
+}
+
+// newRaftLayer creates a raft stream layer listening on the address.
+func newRaftLayer(s *Store, addr *net.TCPAddr) (*raftLayer, error) {
+	listener, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &raftLayer{
+		store:     s,
+		listener:  listener,
+		advertise: addr,
+	}, nil
+}
+
+// Accept waits for the next connection. The protocol of the connection is only
+// known once the first byte has arrived, which happens on the first read so
+// that a slow client can't hold up the others.
+func (l *raftLayer) Accept() (net.Conn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &raftConn{Conn: conn, layer: l}, nil
+}
+
+// Close stops listening for connections.
+func (l *raftLayer) Close() error {
+	return l.listener.Close()
+}
+
+// Addr returns the address that other nodes reach this one at.
+func (l *raftLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// Dial creates a connection to the raft server of another node.
+func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rpc := l.store.engine.RPCServer
+	if !rpc.HasCertificate() || !l.peerUsesTLS(address) {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, rpc.clientConfig())
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// peerUsesTLS returns whether or not the node at the raft address has a
+// certificate. Nodes that aren't in the store yet are new, and so they always
+// do.
+func (l *raftLayer) peerUsesTLS(address raft.ServerAddress) bool {
+	addr, err := net.ResolveTCPAddr("tcp", string(address))
+	if err != nil {
+		return true
+	}
+
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	for _, node := range l.store.state.Nodes {
+		if node.Address.Equal(addr.IP) && node.RaftPort == addr.Port {
+			return node.TLS
+		}
+	}
+	return true
+}
+
+// raftConn is a connection accepted by the raft stream layer, which is either
+// TLS or plaintext depending on the first byte that the client sends.
+type raftConn struct {
+	net.Conn
+	layer *raftLayer
+
+	once sync.Once
+	conn net.Conn // The connection once the protocol is known
+	err  error
+}
+
+// init works out the protocol of the connection.
+func (c *raftConn) init() {
+	c.once.Do(func() {
+		r := bufio.NewReader(c.Conn)
+		b, err := r.Peek(1)
+		if err != nil {
+			c.err = err
+			return
+		}
+		conn := &bufferedConn{Conn: c.Conn, r: r}
+
+		rpc := c.layer.store.engine.RPCServer
+		if b[0] == tlsRecordHandshake {
+			c.conn = tls.Server(conn, &tls.Config{
+				GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+					return rpc.serverConfig(tls.RequireAndVerifyClientCert)
+				},
+			})
+			return
+		}
+
+		if rpc.HasCertificate() {
+			c.err = fmt.Errorf("plaintext raft connection from %s rejected", c.RemoteAddr())
+			c.Conn.Close()
+			return
+		}
+		c.conn = conn
+	})
+}
+
+func (c *raftConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(b)
+}
+
+func (c *raftConn) Write(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Write(b)
+}
+
+// bufferedConn is a connection that has had some of it read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
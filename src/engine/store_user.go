@@ -2,27 +2,107 @@ package engine
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // User is any user who has access to a system.
 type User struct {
-	ID       string    `json:"id"` // Auto generated
-	Name     string    `json:"name"`
-	Username string    `json:"username"`
-	Password [60]byte  `json:"password"` // Bcrypt hashed field
-	Email    string    `json:"email"`
-	Profile  []byte    `json:"profile"`  // Image data in a byte slice
-	Sessions []Session `json:"sessions"` // The session array
+	ID       string     `json:"id"` // Auto generated
+	Name     string     `json:"name"`
+	Username string     `json:"username"`
+	Password [60]byte   `json:"password"` // Bcrypt hashed field
+	Email    string     `json:"email"`
+	Profile  []byte     `json:"profile"`  // Image data in a byte slice
+	Sessions []Session  `json:"sessions"` // The session array
+	Tokens   []APIToken `json:"tokens"`   // API tokens for automation
+
+	TOTP       TOTP             `json:"totp"`       // Second factor for logging in
+	Challenges []LoginChallenge `json:"challenges"` // Logins awaiting a second factor
+	Identities []Identity       `json:"identities"` // Linked identity provider accounts
+
+	Reset PasswordReset `json:"reset"` // Issued by an admin to set a new password
+}
+
+// passwordResetTimeout is how long a password reset token can be used for.
+const passwordResetTimeout = 24 * time.Hour
+
+// PasswordReset is a one-time token that lets a user set a new password without
+// knowing their current one. Only the hash of the token is kept in the store.
+type PasswordReset struct {
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // Session is a user session that has a unique token that identifies it for the
 // purpose of authenticating a user.
 type Session struct {
+	ID    string `json:"id"` // Identifies the session without revealing the token
 	Token string `json:"token"`
+
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+}
+
+// legacySessionLifetime is how long sessions that were created before sessions
+// could expire last from when they are first given an expiry time.
+const legacySessionLifetime = 7 * 24 * time.Hour
+
+// Expired returns whether or not the session has expired at the given time.
+// Sessions that were created before sessions could expire don't have an expiry
+// time yet, so they don't expire until they are given one with Migrate.
+func (s Session) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt)
+}
+
+// Legacy returns whether or not the session was created before sessions could
+// expire, and so needs to be migrated.
+func (s Session) Legacy() bool {
+	return s.ExpiresAt.IsZero()
+}
+
+// Migrate gives a session that was created before sessions could expire the
+// details that it is missing, as if it had been created at the given time. The
+// ID comes from the token, so that every node gives it the same one.
+func (s *Session) Migrate(now time.Time) {
+	if s.ID == "" {
+		sum := sha256.Sum256([]byte(s.Token))
+		s.ID = hex.EncodeToString(sum[:8])
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	if s.LastSeen.IsZero() {
+		s.LastSeen = now
+	}
+	s.ExpiresAt = now.Add(legacySessionLifetime)
+}
+
+// Touch marks the session as being seen at the given time. The session will
+// expire after it has been idle for the idle timeout, but never later than the
+// lifetime after it was created.
+func (s *Session) Touch(now time.Time, lifetime, idle time.Duration) {
+	s.LastSeen = now
+
+	// Sessions that haven't been migrated yet don't know when they were
+	// created, so their expiry is left to the migration.
+	if s.CreatedAt.IsZero() {
+		return
+	}
+
+	s.ExpiresAt = now.Add(idle)
+	if limit := s.CreatedAt.Add(lifetime); s.ExpiresAt.After(limit) {
+		s.ExpiresAt = limit
+	}
 }
 
 // Users is a list of users.
@@ -48,22 +128,15 @@ func (u *Users) Generate(config UserConfig) (*User, error) {
 	}
 
 	// Check for duplicates.
-	for _, user := range *u {
-		if user.Username == config.Username {
-			return nil, ErrUsernameTaken
-		}
-		if user.Email == config.Email {
-			return nil, ErrEmailTaken
-		}
+	if err := u.CheckUnique("", config.Username, config.Email); err != nil {
+		return nil, err
 	}
 
 	// Hash the password.
-	rawHashed, err := bcrypt.GenerateFromPassword([]byte(config.Password), bcrypt.DefaultCost)
+	hashed, err := hashPassword(config.Password)
 	if err != nil {
-		return nil, errors.New("could not hash password")
+		return nil, err
 	}
-	var hashed [60]byte
-	copy(hashed[:], rawHashed)
 
 	// Create the user, append and return it.
 	newUser := User{
@@ -78,6 +151,85 @@ func (u *Users) Generate(config UserConfig) (*User, error) {
 	return &newUser, nil
 }
 
+// CheckUnique ensures that the username and email address aren't being used by
+// any user other than the one with the given ID.
+func (u *Users) CheckUnique(id, username, email string) error {
+	for _, user := range *u {
+		if user.ID == id {
+			continue
+		}
+		if user.Username == username {
+			return ErrUsernameTaken
+		}
+		if user.Email == email {
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of the password.
+func hashPassword(password string) ([60]byte, error) {
+	var hashed [60]byte
+
+	rawHashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return hashed, errors.New("could not hash password")
+	}
+	copy(hashed[:], rawHashed)
+
+	return hashed, nil
+}
+
+// SetPassword will replace the password of the user. Any password reset that
+// was outstanding is cancelled.
+func (u *User) SetPassword(password string) error {
+	if password == "" {
+		return ErrMissingFields
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.Password = hashed
+	u.Reset = PasswordReset{}
+	return nil
+}
+
+// GeneratePasswordReset will create a new password reset for the user. It
+// returns the reset to keep in the store and the token to give to the user.
+func (u User) GeneratePasswordReset() (PasswordReset, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	return PasswordReset{
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTimeout),
+	}, token
+}
+
+// FindByPasswordReset will search for the user that the password reset token
+// was issued to. It returns nil if there is no match or if it has expired.
+func (u *Users) FindByPasswordReset(token string) *User {
+	if token == "" {
+		return nil
+	}
+
+	hash := []byte(hashToken(token))
+	for _, user := range *u {
+		if user.Reset.Hash == "" || time.Now().After(user.Reset.ExpiresAt) {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(user.Reset.Hash)) == 1 {
+			return &user
+		}
+	}
+	return nil
+}
+
 // GenerateID returns an available ID from the user. It will keep autogenerating
 // until one is found, so this can take unlimited time (but in practice, pretty
 // much never will).
@@ -106,12 +258,33 @@ func (u User) GenerateSession() Session {
 	rand.Read(b)
 	token := hex.EncodeToString(b)
 
+	// Generate a separate random ID.
+	b = make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
 	// Create and return the session object.
+	now := time.Now()
 	return Session{
-		Token: token,
+		ID:        id,
+		Token:     token,
+		CreatedAt: now,
+		LastSeen:  now,
 	}
 }
 
+// dummyPasswordHash is checked against when somebody tries to log in as a user
+// that doesn't exist. This makes it take as long as it would for a user that
+// does exist, so the time taken doesn't reveal which users exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("orbit"), bcrypt.DefaultCost)
+
+// ValidateDummyPassword takes the same amount of time as ValidatePassword, but
+// always fails.
+func ValidateDummyPassword(password string) bool {
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+	return false
+}
+
 // ValidatePassword will take in a plaintext password and return whether or not
 // it is valid.
 func (u User) ValidatePassword(password string) bool {
@@ -140,6 +313,20 @@ func (u *Users) Find(id string) *User {
 	return nil
 }
 
+// FindBySession will search for the user that owns the session with the given
+// token. It returns the user and the session, or nil for both if the token does
+// not belong to any session.
+func (u *Users) FindBySession(token string) (*User, *Session) {
+	for _, user := range *u {
+		for _, session := range user.Sessions {
+			if session.Token == token {
+				return &user, &session
+			}
+		}
+	}
+	return nil, nil
+}
+
 // Remove removes the user with the specified ID from the slice.
 func (u *Users) Remove(id string) error {
 	i, _ := u.FindByID(id)
@@ -36,7 +36,7 @@ type Volumes []Volume
 
 // RootVolumeDir is the root filesystem where the volumes are stored. This
 // will be the same for each volume.
-const RootVolumeDir = "/var/orbit/volumes"
+var RootVolumeDir = "/var/orbit/volumes"
 
 // VolumePaths returns the data about where the absolute (read: not relative)
 // paths for a given volume should be. This makes the handling of volume paths
@@ -6,20 +6,51 @@ import (
 	"os"
 	"time"
 
+	"github.com/hashicorp/raft"
+	"orbit.sh/engine/docker"
 	"orbit.sh/engine/gluster"
 )
 
+// sessionExpiryInterval is how often the leader checks for expired sessions to
+// remove from the store.
+const sessionExpiryInterval = time.Minute
+
+// keyringCheckInterval is how often a node without a keyring attempts to get
+// one.
+const keyringCheckInterval = 10 * time.Second
+
+// mirrorCheckInterval is how often the leader checks for mirrored repositories
+// that are due to be fetched from their upstream.
+const mirrorCheckInterval = 5 * time.Second
+
+// buildLogInterval is how often the leader removes the build logs that are
+// outside of their retention policy.
+const buildLogInterval = 10 * time.Minute
+
+// serviceMigrationInterval is how often the leader tries again to move the
+// deployments that it couldn't to a service for each process type.
+const serviceMigrationInterval = time.Minute
+
 // Watcher is a process responsible for watching the processes taking place in
 // the engine. it also keeps track of the engine so it can perform operations on
 // it.
 type Watcher struct {
 	engine *Engine
+
+	lastSessionExpiry time.Time
+	lastKeyringCheck  time.Time
+	lastMirrorCheck   time.Time
+	lastBuildLogCheck time.Time
+	lastMigration     time.Time
+	servicesMigrated  bool
+	lastMirrorSync    map[string]time.Time // The repository ID to when it was last fetched
 }
 
 // NewWatcher will return a new instance of a watcher.
 func NewWatcher(e *Engine) *Watcher {
 	return &Watcher{
-		engine: e,
+		engine:         e,
+		lastMirrorSync: map[string]time.Time{},
 	}
 }
 
@@ -41,6 +72,14 @@ func (w *Watcher) Start() {
 		w.CreateBricks()
 		w.MountRaw()
 		w.MountVolumes()
+		w.ExpireSessions()
+		w.EnsureCertificates()
+		w.EnsureKeyring()
+		w.SyncMirrors()
+		w.RunBuilds()
+		w.MaintainBuildLogs()
+		w.MigrateServices()
+		w.MigrateRoles()
 
 		// If this is the first run, then restart gluster after performing all of
 		// these operations so that the mount points work properly.
@@ -211,3 +250,285 @@ func (w *Watcher) CreateBricks() {
 		}
 	}
 }
+
+// ExpireSessions will remove the sessions, logins in progress and failed login
+// attempts that have expired from the store, and give sessions from before
+// sessions could expire an expiry time.
+// Only the leader does this, and only if there is actually a session to remove
+// or migrate, so that the raft log isn't filled with empty operations.
+func (w *Watcher) ExpireSessions() {
+	if time.Since(w.lastSessionExpiry) < sessionExpiryInterval {
+		return
+	}
+	w.lastSessionExpiry = time.Now()
+
+	store := w.engine.Store
+	if w.engine.Status < StatusReady || store.raft == nil || store.raft.State() != raft.Leader {
+		return
+	}
+
+	now := time.Now()
+	expired := false
+
+	store.mu.RLock()
+search:
+	for _, u := range store.state.Users {
+		for _, s := range u.Sessions {
+			if s.Expired(now) || s.Legacy() {
+				expired = true
+				break search
+			}
+		}
+		for _, l := range u.Challenges {
+			if l.Expired(now) {
+				expired = true
+				break search
+			}
+		}
+	}
+	for _, l := range store.state.OIDCLogins {
+		if l.Expired(now) {
+			expired = true
+			break
+		}
+	}
+	for _, a := range store.state.LoginAttempts {
+		if a.Expired(now) {
+			expired = true
+			break
+		}
+	}
+	store.mu.RUnlock()
+
+	if !expired {
+		return
+	}
+
+	cmd := command{
+		Op:   opExpireSessions,
+		Time: now,
+	}
+	if err := cmd.Apply(store); err != nil {
+		log.Printf("[ERR] watcher: Could not remove expired sessions: %s", err)
+	}
+}
+
+// EnsureCertificates will make sure that the cluster has a CA and that this
+// node has a valid certificate issued by it. The CA is created when the cluster
+// is bootstrapped, so this only has to create it for clusters that were
+// bootstrapped before there was one. Node certificates are renewed here before
+// they expire.
+func (w *Watcher) EnsureCertificates() {
+	store := w.engine.Store
+	if w.engine.Status < StatusReady || store.raft == nil {
+		return
+	}
+
+	ca := store.state.ClusterCA
+	if ca == nil {
+		// Only the leader creates the CA, and only once the cluster is running so
+		// that it doesn't race with the bootstrap process.
+		if w.engine.Status < StatusRunning || store.raft.State() != raft.Leader {
+			return
+		}
+		log.Printf("[INFO] watcher: Creating cluster CA")
+		if err := store.InitClusterCA(); err != nil {
+			log.Printf("[ERR] watcher: Could not create cluster CA: %s", err)
+		}
+		return
+	}
+
+	if w.engine.RPCServer.NeedsCertificate(*ca) {
+		log.Printf("[INFO] watcher: Issuing node certificate")
+		if err := w.engine.RPCServer.IssueCertificate(*ca); err != nil {
+			log.Printf("[ERR] watcher: Could not issue node certificate: %s", err)
+			return
+		}
+	}
+
+	// Let the other nodes know that they can use TLS for raft traffic to us.
+	for _, node := range store.state.Nodes {
+		if node.ID == store.ID && !node.TLS {
+			cmd := command{
+				Op:   opSetNodeTLS,
+				Node: Node{ID: node.ID},
+			}
+			if err := cmd.Apply(store); err != nil {
+				log.Printf("[ERR] watcher: Could not set node TLS: %s", err)
+			}
+		}
+	}
+}
+
+// EnsureKeyring will make sure that this node has a keyring to seal the
+// sensitive fields of the store with. Every cluster has one from when it was
+// bootstrapped, so this is only needed for clusters from before there was one.
+// The leader creates it, and every other node fetches it from the leader.
+func (w *Watcher) EnsureKeyring() {
+	store := w.engine.Store
+	if w.engine.Status < StatusRunning || store.raft == nil || !store.keyring.Empty() {
+		return
+	}
+	if time.Since(w.lastKeyringCheck) < keyringCheckInterval {
+		return
+	}
+	w.lastKeyringCheck = time.Now()
+
+	if store.raft.State() == raft.Leader {
+		log.Printf("[INFO] watcher: Creating keyring")
+		if err := store.InitKeyring(); err != nil {
+			log.Printf("[ERR] watcher: Could not create keyring: %s", err)
+		}
+		return
+	}
+
+	if err := store.fetchKeyring(); err != nil {
+		log.Printf("[ERR] watcher: Could not fetch keyring: %s", err)
+	}
+}
+
+// SyncMirrors fetches the mirrored repositories whose interval has passed from
+// their upstream, which builds the deployments that use a branch that moved.
+// Only the leader does this, so that each upstream is only fetched once. The
+// fetches happen in the background, as they can take a while.
+func (w *Watcher) SyncMirrors() {
+	if time.Since(w.lastMirrorCheck) < mirrorCheckInterval {
+		return
+	}
+	w.lastMirrorCheck = time.Now()
+
+	store := w.engine.Store
+	if w.engine.Status < StatusRunning || store.raft == nil || store.raft.State() != raft.Leader {
+		return
+	}
+
+	for _, repo := range store.state.Repositories {
+		if repo.Upstream == nil {
+			continue
+		}
+		if time.Since(w.lastMirrorSync[repo.ID]) < repo.Upstream.FetchInterval() {
+			continue
+		}
+		w.lastMirrorSync[repo.ID] = time.Now()
+
+		go func(repo Repository) {
+			if _, _, err := w.engine.SyncMirror(repo, Actor{}); err != nil {
+				log.Printf("[ERR] watcher: Could not sync mirror %s: %s", repo.ID, err)
+			}
+		}(repo)
+	}
+}
+
+// RunBuilds starts the builds that have been assigned to this node, and stops
+// the ones running here that have been cancelled, or failed by the leader for
+// going stale. The leader schedules the builds in the queue first, so that they
+// can start straight away.
+func (w *Watcher) RunBuilds() {
+	store := w.engine.Store
+	if w.engine.Status < StatusRunning || store.raft == nil {
+		return
+	}
+
+	if store.raft.State() == raft.Leader {
+		w.engine.ScheduleBuilds()
+	}
+
+	for _, b := range store.state.Builds {
+		if b.State != BuildRunning || b.NodeID != store.ID {
+			continue
+		}
+		if ctx := w.engine.builds.start(b.ID); ctx != nil {
+			go w.engine.RunBuild(ctx, b)
+		}
+	}
+
+	for _, id := range w.engine.builds.ids() {
+		if b := store.state.Builds.Find(id); b == nil || b.State.Finished() || b.NodeID != store.ID {
+			log.Printf("[INFO] watcher: Cancelling build %s", id)
+			w.engine.builds.cancel(id)
+		}
+	}
+}
+
+// MaintainBuildLogs moves the build logs that are still kept in the store into
+// the log store, and removes the logs that are outside of the retention policy
+// of their deployment. The build caches of deployments that no longer exist are
+// removed at the same time. Only the leader does this, as the logs and caches
+// are on the orbit system volume that every node shares.
+func (w *Watcher) MaintainBuildLogs() {
+	store := w.engine.Store
+	if w.engine.Status < StatusRunning || store.raft == nil || store.raft.State() != raft.Leader {
+		return
+	}
+	if time.Since(w.lastBuildLogCheck) < buildLogInterval {
+		return
+	}
+	w.lastBuildLogCheck = time.Now()
+
+	if err := store.MigrateBuildLogs(); err != nil {
+		log.Printf("[ERR] watcher: Could not move build logs into the log store: %s", err)
+	}
+	if err := store.PruneBuildLogs(); err != nil {
+		log.Printf("[ERR] watcher: Could not prune build logs: %s", err)
+	}
+	if err := store.PruneBuildCaches(); err != nil {
+		log.Printf("[ERR] watcher: Could not prune build caches: %s", err)
+	}
+}
+
+// MigrateServices deploys the deployments that were deployed before each of
+// their process types had its own service again, which replaces their single
+// service with one for each process type. The edge router only sends requests
+// to the service of the web process, so this is done as soon as the leader is
+// running. Only the leader does this, and only until it has succeeded.
+func (w *Watcher) MigrateServices() {
+	store := w.engine.Store
+	if w.servicesMigrated || w.engine.Status < StatusRunning || store.raft == nil || store.raft.State() != raft.Leader {
+		return
+	}
+	if time.Since(w.lastMigration) < serviceMigrationInterval {
+		return
+	}
+	w.lastMigration = time.Now()
+
+	services := map[string]bool{}
+	for _, name := range docker.Services() {
+		services[name] = true
+	}
+
+	migrated := true
+	for _, d := range store.state.Deployments {
+		if !services[d.ID] {
+			continue
+		}
+		log.Printf("[INFO] watcher: Moving deployment %s to a service for each process type", d.ID)
+		if err := w.engine.Deploy(d); err != nil {
+			log.Printf("[ERR] watcher: Could not move deployment %s to a service for each process type: %s", d.ID, err)
+			migrated = false
+		}
+	}
+	w.servicesMigrated = migrated
+}
+
+// MigrateRoles makes the users of a cluster from before roles existed owners
+// of it, once. Until then, users without a role can't do anything. Only the
+// leader does this.
+func (w *Watcher) MigrateRoles() {
+	store := w.engine.Store
+	if w.engine.Status < StatusRunning || store.raft == nil || store.raft.State() != raft.Leader {
+		return
+	}
+
+	store.mu.RLock()
+	migrated := store.state.RolesMigrated
+	store.mu.RUnlock()
+	if migrated {
+		return
+	}
+
+	log.Printf("[INFO] watcher: Migrating the roles of existing users")
+	cmd := command{Op: opMigrateRoles}
+	if err := cmd.Apply(store); err != nil {
+		log.Printf("[ERR] watcher: Could not migrate the roles of existing users: %s", err)
+	}
+}